@@ -26,6 +26,8 @@ import (
 	rzv "github.com/waku-org/go-libp2p-rendezvous"
 	rzvsqlite "github.com/waku-org/go-libp2p-rendezvous/db/sqlite"
 
+	"github.com/Metaphorme/wormhole/pkg/config"
+	"github.com/Metaphorme/wormhole/pkg/models"
 	"github.com/Metaphorme/wormhole/pkg/server"
 )
 
@@ -36,10 +38,22 @@ func main() {
 	var ctrlListen string
 	var rzvNamespace string
 	var ttlStr string
+	var gcGraceStr string
 	var digits int
+	var charset string
 	var bootstrapCSV string
+	var relaysCSV string
 	var publicAddrsCSV string
 	var identityPath string
+	var corsOriginCSV string
+	var topicPrefix string
+	var adminToken string
+	var configPath string
+	var motd string
+	var motdFile string
+	var auditLogPath string
+	var auditLogMax int64
+	var off disabledRoutes
 	// 频率控制相关参数
 	var rateReqWindowStr string
 	var rateMaxReqs int
@@ -51,16 +65,40 @@ func main() {
 	flag.StringVar(&ctrlListen, "control-listen", ":8080", "http control-plane listen addr")
 	flag.StringVar(&rzvNamespace, "rendezvous-namespace", "wormhole", "rendezvous namespace")
 	flag.StringVar(&ttlStr, "nameplate-ttl", "30m", "nameplate TTL, e.g. 10m/30m")
+	flag.StringVar(&gcGraceStr, "cleanup-grace", "2m", "keep expired or consumed nameplates this long before deleting them, so late claim/consume/fail calls see their real state")
 	flag.IntVar(&digits, "nameplate-digits", 3, "nameplate digits (3-4 recommended)")
+	flag.StringVar(&charset, "nameplate-charset", models.NameplateCharsetDigits, "nameplate character set: digits, or alnum (lowercase letters and digits without 0/o/1/l/i)")
 	flag.StringVar(&bootstrapCSV, "bootstrap", "", "comma-separated bootstrap dnsaddr/multiaddrs (optional)")
+	flag.StringVar(&relaysCSV, "relays", "", "comma-separated external relay multiaddrs (…/p2p/<relay id>) offered to clients after this server's own relay addrs")
 	flag.StringVar(&publicAddrsCSV, "public-addrs", "", "comma-separated public announce addrs (multiaddr/dnsaddr). If set, overrides automatic hostAddrs")
 	flag.StringVar(&identityPath, "identity", "./server.key", "path to persist libp2p private key")
+	flag.StringVar(&corsOriginCSV, "cors-origin", "", "comma-separated origins allowed by CORS, or '*' for any (empty disables CORS)")
+	flag.StringVar(&topicPrefix, "topic-prefix", server.DefaultTopicPrefix, "prefix of the per-nameplate topic returned to clients, e.g. /wormhole/prod")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("WORMHOLE_ADMIN_TOKEN"), "bearer token for /admin/* endpoints (default $WORMHOLE_ADMIN_TOKEN; empty disables them)")
 	flag.StringVar(&rateReqWindowStr, "rate-req-window", "1m", "per-IP request rate window")
 	flag.IntVar(&rateMaxReqs, "rate-max-reqs", 120, "max requests per IP within req-window")
 	flag.StringVar(&rateFailWindowStr, "rate-fail-window", "10m", "per-IP failures window")
 	flag.IntVar(&rateMaxFails, "rate-max-fails", 30, "max failures per IP within fail-window")
+	flag.StringVar(&motd, "motd", "", "short message shown to clients on allocate/claim (terms of use, maintenance notice)")
+	flag.StringVar(&motdFile, "motd-file", "", "read the client message from this file instead of -motd")
+	flag.StringVar(&auditLogPath, "audit-log", "", "append one JSON line per claim (time, IP, keyed hash of the nameplate, side, status) to this file (empty disables)")
+	flag.Int64Var(&auditLogMax, "audit-log-max-size", 10<<20, "rotate -audit-log to <file>.1 once it exceeds this many bytes")
+	flag.BoolVar(&off.allocate, "disable-allocate", false, "do not serve /v1/allocate (404); nameplates are allocated by another service sharing -db")
+	flag.BoolVar(&off.claim, "disable-claim", false, "do not serve /v1/claim (404); run as an allocate-only front end")
+	flag.StringVar(&configPath, "config", "", "TOML (or .yaml/.yml) file whose keys mirror these flags; flags given on the command line take precedence")
 	flag.Parse()
 
+	// 配置文件只填充命令行上未显式给出的标志，随后与命令行参数走同样的校验
+	if configPath != "" {
+		vals, err := config.Load(configPath)
+		if err == nil {
+			err = config.ApplyFlags(flag.CommandLine, vals, "config")
+		}
+		if err != nil {
+			log.Fatalf("config %s: %v", configPath, err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -69,9 +107,40 @@ func main() {
 	if err != nil || ttl <= 0 {
 		log.Fatalf("invalid -nameplate-ttl: %v", err)
 	}
+	gcGrace, err := time.ParseDuration(gcGraceStr)
+	if err != nil || gcGrace < 0 {
+		log.Fatalf("invalid -cleanup-grace")
+	}
 	if digits < 3 || digits > 4 {
 		log.Fatalf("invalid -nameplate-digits, want 3..4")
 	}
+	if _, ok := models.NameplateAlphabets[charset]; !ok {
+		log.Fatalf("invalid -nameplate-charset %q, want %s or %s", charset, models.NameplateCharsetDigits, models.NameplateCharsetAlnum)
+	}
+	if off.allocate && off.claim {
+		log.Fatalf("-disable-allocate and -disable-claim together leave nothing to serve")
+	}
+	extraRelays, err := server.ParseRelayAddrs(relaysCSV)
+	if err != nil {
+		log.Fatalf("invalid -relays: %v", err)
+	}
+	if rateMaxReqs <= 0 || rateMaxFails <= 0 {
+		log.Fatalf("invalid -rate-max-reqs / -rate-max-fails, want > 0")
+	}
+	if motdFile != "" {
+		if motd != "" {
+			log.Fatalf("-motd and -motd-file are mutually exclusive")
+		}
+		b, err := os.ReadFile(motdFile)
+		if err != nil {
+			log.Fatalf("read -motd-file: %v", err)
+		}
+		motd = string(b)
+	}
+	motd = strings.TrimSpace(motd)
+	if len(motd) > models.MaxMessageLen {
+		log.Fatalf("motd too long: %d bytes, max %d", len(motd), models.MaxMessageLen)
+	}
 	reqWin, err := time.ParseDuration(rateReqWindowStr)
 	if err != nil || reqWin <= 0 {
 		log.Fatalf("invalid -rate-req-window")
@@ -132,13 +201,16 @@ func main() {
 		log.Fatalf("open control db: %v", err)
 	}
 	defer ctrlDB.Close()
+	if v, err := ctrlDB.SchemaVersion(); err == nil {
+		log.Printf("control db schema v%d", v)
+	}
 
-	// 启动一个后台 goroutine，每分钟清理一次过期的密码牌
+	// 启动一个后台 goroutine，每分钟清理一次超出宽限期的过期或已消耗密码牌
 	go func() {
 		t := time.NewTicker(1 * time.Minute)
 		defer t.Stop()
 		for range t.C {
-			if n, err := ctrlDB.CleanupExpired(time.Now()); err == nil && n > 0 {
+			if n, err := ctrlDB.CleanupExpired(time.Now(), gcGrace); err == nil && n > 0 {
 				log.Printf("[gc] cleaned %d nameplates", n)
 			}
 		}
@@ -154,7 +226,13 @@ func main() {
 
 	// 确定并组合对外宣告的地址
 	advertised := server.AdvertisedAddrsWithP2P(h, publicAddrsCSV)
-	relayAddrs := server.RelayAddrsWithCircuit(advertised)
+	relayAddrs := server.MergeRelayAddrs(server.RelayAddrsWithCircuit(advertised), extraRelays)
+	if len(extraRelays) > 0 {
+		fmt.Println("External relays:")
+		for _, a := range extraRelays {
+			fmt.Printf("  %s\n", a)
+		}
+	}
 	bootstrap := server.SplitCSV(bootstrapCSV)
 
 	// --- HTTP 控制面服务器配置 ---
@@ -168,16 +246,32 @@ func main() {
 		ttl,
 		digits,
 	)
+	handlers.Charset = charset
+	handlers.TopicPrefix = topicPrefix
+	handlers.ListenAddrs = h.Network().ListenAddresses
+	handlers.AdminToken = adminToken
+	handlers.Message = motd
+	if auditLogPath != "" {
+		audit, err := server.OpenAuditLog(auditLogPath, auditLogMax)
+		if err != nil {
+			log.Fatalf("open -audit-log: %v", err)
+		}
+		defer audit.Close()
+		handlers.Audit = audit
+		log.Printf("auditing claims to %s", auditLogPath)
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/allocate", handlers.WithRateLimit(handlers.HandleAllocate))
-	mux.HandleFunc("/v1/claim", handlers.WithRateLimit(handlers.HandleClaim))
-	mux.HandleFunc("/v1/consume", handlers.WithRateLimit(handlers.HandleConsume))
-	mux.HandleFunc("/v1/fail", handlers.WithRateLimit(handlers.HandleFail))
+	mux := newControlMux(handlers, off)
+	if off.allocate {
+		log.Printf("/v1/allocate disabled")
+	}
+	if off.claim {
+		log.Printf("/v1/claim disabled")
+	}
 
 	srv := &http.Server{
 		Addr:              ctrlListen,
-		Handler:           server.LogRequests(mux),
+		Handler:           server.LogRequests(server.WithCORS(server.SplitCSV(corsOriginCSV), mux)),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 	go func() {
@@ -197,3 +291,30 @@ func main() {
 	_ = srv.Shutdown(ctxShutdown)
 	fmt.Println("bye")
 }
+
+// disabledRoutes 记录通过 -disable-allocate / -disable-claim 关闭的控制面端点
+type disabledRoutes struct {
+	allocate bool
+	claim    bool
+}
+
+// newControlMux 注册控制面路由；被关闭的端点不注册，请求将得到 404。
+// /v1/consume 和 /v1/fail 始终保留：它们只更新已认领的密码牌，无论由哪个实例分配。
+func newControlMux(h *server.HTTPHandlers, off disabledRoutes) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/info", h.WithRateLimit(h.HandleInfo))
+	if !off.allocate {
+		mux.HandleFunc("/v1/allocate", h.WithRateLimit(h.HandleAllocate))
+	}
+	if !off.claim {
+		mux.HandleFunc("/v1/claim", h.WithRateLimit(h.HandleClaim))
+	}
+	mux.HandleFunc("/v1/consume", h.WithRateLimit(h.HandleConsume))
+	mux.HandleFunc("/v1/fail", h.WithRateLimit(h.HandleFail))
+	mux.HandleFunc("/v1/report", h.WithRateLimit(h.HandleReport))
+	// 健康检查探针不做频率限制，避免编排系统的探测被限流
+	mux.HandleFunc("/healthz", server.HandleHealthz)
+	mux.HandleFunc("/readyz", h.HandleReadyz)
+	mux.HandleFunc("/admin/stats", h.WithRateLimit(h.RequireAdmin(h.HandleStats)))
+	return mux
+}
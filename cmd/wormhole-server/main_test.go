@@ -3,11 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,6 +27,7 @@ import (
 	rzv "github.com/waku-org/go-libp2p-rendezvous"
 	rzvsqlite "github.com/waku-org/go-libp2p-rendezvous/db/sqlite"
 
+	"github.com/Metaphorme/wormhole/pkg/config"
 	"github.com/Metaphorme/wormhole/pkg/models"
 	"github.com/Metaphorme/wormhole/pkg/server"
 )
@@ -153,6 +161,7 @@ func startWormholeServerForTest(t *testing.T, cfg serverConfig) *testServer {
 		}
 		resp := models.ClaimResponse{
 			Status:    string(st),
+			Reason:    server.ClaimFailReason(st, row, req.Side),
 			ExpiresAt: exp,
 			ConnectionInfo: models.ConnectionInfo{
 				Rendezvous: models.AddrBundle{Namespace: cfg.namespace, Addrs: advertised},
@@ -215,6 +224,18 @@ func startWormholeServerForTest(t *testing.T, cfg serverConfig) *testServer {
 	}
 }
 
+// newMemHandlers 使用给定的存储（通常是 MemoryStore）构造 HTTP 处理器，无需 libp2p 主机和磁盘 I/O
+func newMemHandlers(store server.Store, ttl time.Duration, digits int) *server.HTTPHandlers {
+	advertised := []string{"/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWJZQCkVyttfh9bouZsPpzu1m14wAoVawMCXbaq4QiWTZz"}
+	return server.NewHTTPHandlers(store, server.NewIPLimiter(time.Minute, 1000, time.Minute, 1000),
+		"wormhole-test", advertised, server.RelayAddrsWithCircuit(advertised), nil, ttl, digits)
+}
+
+// handlersMux 按 main.go 的方式注册所有控制面路由
+func handlersMux(h *server.HTTPHandlers) *http.ServeMux {
+	return newControlMux(h, disabledRoutes{})
+}
+
 func mustMA(t *testing.T, s string) ma.Multiaddr {
 	t.Helper()
 	a, err := ma.NewMultiaddr(s)
@@ -367,6 +388,960 @@ func TestRateLimitHits429(t *testing.T) {
 	}
 }
 
+func TestRateLimitHeaders_Decrement(t *testing.T) {
+	handlers := newMemHandlers(server.NewMemoryStore(), time.Minute, 3)
+	handlers.Limiter = server.NewIPLimiter(time.Minute, 3, time.Minute, 10)
+	ts := httptest.NewServer(handlersMux(handlers))
+	defer ts.Close()
+
+	hdr := map[string]string{"X-Forwarded-For": "203.0.113.7"}
+	for i, want := range []string{"2", "1", "0"} {
+		_, resp := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, hdr)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-RateLimit-Limit"); got != "3" {
+			t.Fatalf("request %d: X-RateLimit-Limit = %q", i, got)
+		}
+		if got := resp.Header.Get("X-RateLimit-Remaining"); got != want {
+			t.Fatalf("request %d: X-RateLimit-Remaining = %q, want %s", i, got, want)
+		}
+		if got := resp.Header.Get("X-RateLimit-Reset"); got != "60" {
+			t.Fatalf("request %d: X-RateLimit-Reset = %q, want 60", i, got)
+		}
+	}
+	_, resp := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, hdr)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("over limit: status %d, remaining %q", resp.StatusCode, resp.Header.Get("X-RateLimit-Remaining"))
+	}
+	// 其他 IP 的配额不受影响
+	_, resp = postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	if got := resp.Header.Get("X-RateLimit-Remaining"); got != "2" {
+		t.Fatalf("other IP: X-RateLimit-Remaining = %q, want 2", got)
+	}
+}
+
+func TestHandlersWithMemoryStore(t *testing.T) {
+	store := server.NewMemoryStore()
+	ts := httptest.NewServer(handlersMux(newMemHandlers(store, time.Minute, 3)))
+	defer ts.Close()
+
+	alloc, _ := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	if len(alloc.Nameplate) != 3 {
+		t.Fatalf("unexpected nameplate: %q", alloc.Nameplate)
+	}
+	cl1, _ := postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "host"}, nil)
+	if cl1.Status != string(server.StatusWaiting) {
+		t.Fatalf("expect waiting, got %s", cl1.Status)
+	}
+	// 其他 IP 重复认领同一侧 -> failed，并计入失败次数
+	dup, _ := postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "host"},
+		map[string]string{"X-Forwarded-For": "203.0.113.9"})
+	if dup.Status != string(server.StatusFailed) || dup.Reason != models.ClaimReasonSideTaken {
+		t.Fatalf("expect failed/%s on duplicate side, got %s/%q", models.ClaimReasonSideTaken, dup.Status, dup.Reason)
+	}
+	if row, err := store.Load(alloc.Nameplate); err != nil || row.FailCount != 1 {
+		t.Fatalf("expect fail_count=1, got row=%+v err=%v", row, err)
+	}
+	cl2, _ := postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "connect"}, nil)
+	if cl2.Status != string(server.StatusPaired) {
+		t.Fatalf("expect paired, got %s", cl2.Status)
+	}
+	// 双方都以 connect 模式运行：第二个 connect 得到 side_taken；不存在的密码牌不给出原因
+	dup, _ = postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "connect"},
+		map[string]string{"X-Forwarded-For": "203.0.113.10"})
+	if dup.Status != string(server.StatusFailed) || dup.Reason != models.ClaimReasonSideTaken {
+		t.Fatalf("second connect: %s/%q", dup.Status, dup.Reason)
+	}
+	missing, _ := postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: "nope", Side: "connect"}, nil)
+	if missing.Status != string(server.StatusFailed) || missing.Reason != "" {
+		t.Fatalf("unknown nameplate: %s/%q", missing.Status, missing.Reason)
+	}
+
+	// 注入存储错误：consume 应返回 500
+	store.SetError("Consume", errors.New("disk on fire"))
+	_, resp := postJSON[map[string]string](t, ts.URL, "/v1/consume", models.ConsumeRequest{Nameplate: alloc.Nameplate}, nil)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expect 500 when store fails, got %d", resp.StatusCode)
+	}
+	store.SetError("Consume", nil)
+	ok, _ := postJSON[map[string]string](t, ts.URL, "/v1/consume", models.ConsumeRequest{Nameplate: alloc.Nameplate}, nil)
+	if ok["ok"] != "true" {
+		t.Fatalf("consume not ok: %+v", ok)
+	}
+
+	// 注入存储错误：claim 应返回 500
+	store.SetError("Claim", errors.New("locked"))
+	_, resp = postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "host"}, nil)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expect 500 when claim fails, got %d", resp.StatusCode)
+	}
+
+	// 已消耗的密码牌会被清理
+	if n, err := store.CleanupExpired(time.Now(), 0); err != nil || n != 1 {
+		t.Fatalf("cleanup: n=%d err=%v", n, err)
+	}
+}
+
+func TestAuditLog_ClaimOutcomesAndRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := server.OpenAuditLog(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	handlers := newMemHandlers(server.NewMemoryStore(), time.Minute, 3)
+	handlers.Audit = audit
+	ts := httptest.NewServer(handlersMux(handlers))
+	defer ts.Close()
+
+	alloc, _ := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "host"}, nil)
+	postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "host"},
+		map[string]string{"X-Forwarded-For": "203.0.113.9"})
+	postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: "nope", Side: "connect"}, nil)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []server.AuditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var rec server.AuditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("bad audit line %q: %v", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("want 3 audit records, got %d: %s", len(recs), b)
+	}
+	// 同一密码牌的记录可以关联，但日志中没有明文密码牌
+	if recs[0].Nameplate != recs[1].Nameplate || recs[0].Nameplate == alloc.Nameplate || recs[0].Nameplate == recs[2].Nameplate {
+		t.Fatalf("nameplate hashes: %q %q %q", recs[0].Nameplate, recs[1].Nameplate, recs[2].Nameplate)
+	}
+	if r := recs[0]; r.Status != string(server.StatusWaiting) || r.Side != "host" || !r.Exists {
+		t.Fatalf("first claim: %+v", r)
+	}
+	if r := recs[1]; r.Status != string(server.StatusFailed) || r.Reason != models.ClaimReasonSideTaken || r.IP != "203.0.113.9" {
+		t.Fatalf("duplicate side: %+v", r)
+	}
+	if r := recs[2]; r.Status != string(server.StatusFailed) || r.Exists {
+		t.Fatalf("unknown nameplate: %+v", r)
+	}
+
+	// 超过大小上限时轮转为 <path>.1，当前文件重新从头写起
+	small := filepath.Join(t.TempDir(), "small.log")
+	a2, err := server.OpenAuditLog(small, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a2.Close()
+	for i := 0; i < 10; i++ {
+		a2.RecordClaim(time.Now(), "198.51.100.1", "123", "connect", "failed", "", false)
+	}
+	if _, err := os.Stat(small + ".1"); err != nil {
+		t.Fatalf("audit log not rotated: %v", err)
+	}
+	if st, err := os.Stat(small); err != nil || st.Size() > 512 {
+		t.Fatalf("current audit log exceeds limit: %v %v", st, err)
+	}
+}
+
+func TestCleanupExpired_GraceBoundary(t *testing.T) {
+	db, err := server.OpenControlDB(filepath.Join(t.TempDir(), "ctrl.db"))
+	if err != nil {
+		t.Fatalf("open control db: %v", err)
+	}
+	defer db.Close()
+	const grace = 2 * time.Minute
+
+	for name, store := range map[string]server.Store{"sqlite": db, "memory": server.NewMemoryStore()} {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			// "100" 在 now 时过期 (TTL 1 分钟)，"200" 在 now 时被消耗，"300" 仍有效
+			if err := store.InsertNew("100", time.Minute, now.Add(-time.Minute), "10.0.0.1"); err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+			for _, np := range []string{"200", "300"} {
+				if err := store.InsertNew(np, time.Hour, now, "10.0.0.1"); err != nil {
+					t.Fatalf("insert: %v", err)
+				}
+			}
+			if err := store.Consume("200"); err != nil {
+				t.Fatalf("consume: %v", err)
+			}
+			remaining := func() (out []string) {
+				for _, np := range []string{"100", "200", "300"} {
+					if _, err := store.Load(np); err == nil {
+						out = append(out, np)
+					}
+				}
+				return out
+			}
+
+			// 宽限期内两条记录都保留，迟到的 fail 不会重复计数
+			if n, err := store.CleanupExpired(now.Add(grace-2*time.Second), grace); err != nil || n != 0 {
+				t.Fatalf("inside grace: n=%d err=%v", n, err)
+			}
+			if err := store.FailAndConsume("200"); err != nil {
+				t.Fatalf("late fail: %v", err)
+			}
+			if r, err := store.Load("200"); err != nil || r.FailCount != 0 || !r.ConsumedAt.Valid {
+				t.Fatalf("late fail on consumed row: %+v %v", r, err)
+			}
+			// 超过宽限期后被清理，未过期的记录不受影响
+			if n, err := store.CleanupExpired(now.Add(grace+2*time.Second), grace); err != nil || n != 2 {
+				t.Fatalf("past grace: n=%d err=%v", n, err)
+			}
+			if got := remaining(); len(got) != 1 || got[0] != "300" {
+				t.Fatalf("remaining after cleanup: %v", got)
+			}
+		})
+	}
+}
+
+func TestControlDB_ConcurrentAllocateClaim(t *testing.T) {
+	db, err := server.OpenControlDB(filepath.Join(t.TempDir(), "ctrl.db"))
+	if err != nil {
+		t.Fatalf("open control db: %v", err)
+	}
+	defer db.Close()
+	ts := httptest.NewServer(handlersMux(newMemHandlers(db, time.Minute, 4)))
+	defer ts.Close()
+
+	const workers = 24
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var alloc models.AllocateResponse
+			if code, err := postStatus(ts.URL+"/v1/allocate", map[string]any{}, &alloc); err != nil || code != http.StatusOK {
+				errCh <- fmt.Errorf("allocate: code=%d err=%v", code, err)
+				return
+			}
+			for _, side := range []string{"host", "connect"} {
+				var cl models.ClaimResponse
+				code, err := postStatus(ts.URL+"/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: side}, &cl)
+				if err != nil || code != http.StatusOK || cl.Status == string(server.StatusFailed) {
+					errCh <- fmt.Errorf("claim %s/%s: code=%d status=%s err=%v", alloc.Nameplate, side, code, cl.Status, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+}
+
+func TestControlDB_ConcurrentClaimPairsOnce(t *testing.T) {
+	db, err := server.OpenControlDB(filepath.Join(t.TempDir(), "ctrl.db"))
+	if err != nil {
+		t.Fatalf("open control db: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		np := fmt.Sprintf("%03d", i)
+		if err := db.InsertNew(np, time.Minute, now, "127.0.0.1"); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		if st, _, err := db.Claim(np, "host", now, "127.0.0.1"); err != nil || st != server.StatusWaiting {
+			t.Fatalf("host claim: %s %v", st, err)
+		}
+
+		// 两个不同客户端的 connect 认领同时到达：只能有一个得到 paired
+		var wg sync.WaitGroup
+		results := make(chan server.PlateStatus, 2)
+		start := make(chan struct{})
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				st, _, err := db.Claim(np, "connect", now, fmt.Sprintf("10.0.0.%d", j+1))
+				if err != nil {
+					t.Errorf("claim: %v", err)
+				}
+				results <- st
+			}()
+		}
+		close(start)
+		wg.Wait()
+		close(results)
+		paired := 0
+		for st := range results {
+			if st == server.StatusPaired {
+				paired++
+			}
+		}
+		if paired != 1 {
+			t.Fatalf("nameplate %s: %d paired results, want exactly 1", np, paired)
+		}
+	}
+}
+
+func TestClaim_ResumeAfterCrash(t *testing.T) {
+	db, err := server.OpenControlDB(filepath.Join(t.TempDir(), "ctrl.db"))
+	if err != nil {
+		t.Fatalf("open control db: %v", err)
+	}
+	defer db.Close()
+
+	for name, store := range map[string]server.Store{"sqlite": db, "memory": server.NewMemoryStore()} {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			claim := func(np, side, ip string, at time.Time) server.PlateStatus {
+				t.Helper()
+				st, _, err := store.Claim(np, side, at, ip)
+				if err != nil {
+					t.Fatalf("claim %s/%s from %s: %v", np, side, ip, err)
+				}
+				return st
+			}
+			fails := func(np string) int64 {
+				t.Helper()
+				r, err := store.Load(np)
+				if err != nil {
+					t.Fatalf("load %s: %v", np, err)
+				}
+				return r.FailCount
+			}
+
+			// connect 一侧认领后崩溃，重新运行时得到相同的 waiting
+			if err := store.InsertNew("100", time.Hour, now, "10.0.0.1"); err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+			if st := claim("100", "connect", "10.0.0.2", now); st != server.StatusWaiting {
+				t.Fatalf("first claim: %s", st)
+			}
+			if st := claim("100", "connect", "10.0.0.2", now.Add(10*time.Second)); st != server.StatusWaiting {
+				t.Fatalf("resumed claim: %s, want waiting", st)
+			}
+
+			// 双方都已认领后，任一侧在宽限期内重连都得到 paired，且不计入失败
+			if st := claim("100", "host", "10.0.0.1", now); st != server.StatusPaired {
+				t.Fatalf("host claim: %s", st)
+			}
+			if st := claim("100", "connect", "10.0.0.2", now.Add(30*time.Second)); st != server.StatusPaired {
+				t.Fatalf("resumed connect: %s, want paired", st)
+			}
+			if st := claim("100", "host", "10.0.0.1", now.Add(server.ClaimResumeGrace)); st != server.StatusPaired {
+				t.Fatalf("resumed host at the end of the grace window: %s, want paired", st)
+			}
+			if n := fails("100"); n != 0 {
+				t.Fatalf("resumes counted as failures: %d", n)
+			}
+
+			// 其他 IP 不能借用重连，超过宽限期后原 IP 也不行
+			if st := claim("100", "connect", "10.0.0.3", now.Add(time.Second)); st != server.StatusFailed {
+				t.Fatalf("claim from another ip: %s, want failed", st)
+			}
+			if st := claim("100", "connect", "10.0.0.2", now.Add(server.ClaimResumeGrace+time.Second)); st != server.StatusFailed {
+				t.Fatalf("claim after grace: %s, want failed", st)
+			}
+			if n := fails("100"); n != 2 {
+				t.Fatalf("fail_count = %d, want 2", n)
+			}
+
+			// 已消耗的密码牌不能重连
+			if err := store.Consume("100"); err != nil {
+				t.Fatalf("consume: %v", err)
+			}
+			if st := claim("100", "connect", "10.0.0.2", now.Add(time.Second)); st != server.StatusFailed {
+				t.Fatalf("claim after consume: %s, want failed", st)
+			}
+		})
+	}
+
+	// 经过 HTTP 处理器：客户端崩溃后用同一代码重新运行，每次认领都得到当前状态
+	ts := httptest.NewServer(handlersMux(newMemHandlers(server.NewMemoryStore(), time.Minute, 3)))
+	defer ts.Close()
+	alloc, _ := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", nil, nil)
+	for i := 0; i < 3; i++ {
+		clm, resp := postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "connect"}, nil)
+		if resp.StatusCode != http.StatusOK || clm.Status != string(server.StatusWaiting) {
+			t.Fatalf("attempt %d: http %d status %q", i, resp.StatusCode, clm.Status)
+		}
+	}
+}
+
+// postStatus 发送 JSON POST 请求并解码响应；与 postJSON 不同，它不调用 t.Fatalf，可在子协程中使用
+func postStatus(url string, body, out any) (int, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, err
+}
+
+func TestTopicPrefix_AllocateAndClaimMatch(t *testing.T) {
+	handlers := newMemHandlers(server.NewMemoryStore(), time.Minute, 3)
+	handlers.TopicPrefix = "/wormhole/prod/"
+	ts := httptest.NewServer(handlersMux(handlers))
+	defer ts.Close()
+
+	alloc, _ := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	want := "/wormhole/prod/" + alloc.Nameplate
+	if alloc.Topic != want {
+		t.Fatalf("allocate topic = %q, want %q", alloc.Topic, want)
+	}
+	for _, side := range []string{"host", "connect"} {
+		cl, _ := postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: side}, nil)
+		if cl.Topic != alloc.Topic {
+			t.Fatalf("claim(%s) topic = %q, want %q", side, cl.Topic, alloc.Topic)
+		}
+	}
+
+	// 未配置前缀时保持原有的 /wormhole/<nameplate>
+	handlers.TopicPrefix = ""
+	if got := handlers.Topic("123"); got != "/wormhole/123" {
+		t.Fatalf("default topic = %q", got)
+	}
+}
+
+func TestServerMessage_InAllocateAndClaim(t *testing.T) {
+	handlers := newMemHandlers(server.NewMemoryStore(), time.Minute, 3)
+	ts := httptest.NewServer(handlersMux(handlers))
+	defer ts.Close()
+
+	// 未配置时不下发 message 字段
+	raw, _ := postJSON[map[string]any](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	if _, ok := raw["message"]; ok {
+		t.Fatalf("message should be omitted when unset: %v", raw)
+	}
+
+	handlers.Message = "maintenance on Sunday"
+	alloc, _ := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	if alloc.Message != handlers.Message {
+		t.Fatalf("allocate message = %q", alloc.Message)
+	}
+	cl, _ := postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "connect"}, nil)
+	if cl.Message != handlers.Message {
+		t.Fatalf("claim message = %q", cl.Message)
+	}
+}
+
+func TestDisabledRoutes_MirrorAndAllocateOnly(t *testing.T) {
+	// 两个实例共享同一存储：一个只负责分配，另一个作为只认领的镜像
+	store := server.NewMemoryStore()
+	front := httptest.NewServer(newControlMux(newMemHandlers(store, time.Minute, 3), disabledRoutes{claim: true}))
+	defer front.Close()
+	mirror := httptest.NewServer(newControlMux(newMemHandlers(store, time.Minute, 3), disabledRoutes{allocate: true}))
+	defer mirror.Close()
+
+	if _, resp := postJSON[map[string]any](t, mirror.URL, "/v1/allocate", map[string]any{}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("mirror allocate: expect 404, got %d", resp.StatusCode)
+	}
+	alloc, _ := postJSON[models.AllocateResponse](t, front.URL, "/v1/allocate", map[string]any{}, nil)
+	if alloc.Nameplate == "" {
+		t.Fatalf("front allocate returned no nameplate")
+	}
+	if _, resp := postJSON[map[string]any](t, front.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "host"}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("front claim: expect 404, got %d", resp.StatusCode)
+	}
+
+	// 镜像可以认领前端分配的密码牌，其余端点不受影响
+	cl1, _ := postJSON[models.ClaimResponse](t, mirror.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "host"}, nil)
+	cl2, _ := postJSON[models.ClaimResponse](t, mirror.URL, "/v1/claim", models.ClaimRequest{Nameplate: alloc.Nameplate, Side: "connect"}, nil)
+	if cl1.Status != string(server.StatusWaiting) || cl2.Status != string(server.StatusPaired) {
+		t.Fatalf("mirror claims: got %s then %s", cl1.Status, cl2.Status)
+	}
+	ok, _ := postJSON[map[string]string](t, mirror.URL, "/v1/consume", models.ConsumeRequest{Nameplate: alloc.Nameplate}, nil)
+	if ok["ok"] != "true" {
+		t.Fatalf("mirror consume not ok: %+v", ok)
+	}
+	for _, base := range []string{front.URL, mirror.URL} {
+		resp, err := http.Get(base + "/v1/info")
+		if err != nil {
+			t.Fatalf("GET /v1/info: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("info on %s: expect 200, got %d", base, resp.StatusCode)
+		}
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	store := server.NewMemoryStore()
+	handlers := newMemHandlers(store, time.Minute, 3)
+	ts := httptest.NewServer(handlersMux(handlers))
+	defer ts.Close()
+
+	get := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("healthz: expect 200, got %d", code)
+	}
+	// 没有监听地址时未就绪
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz without listen addrs: expect 503, got %d", code)
+	}
+	handlers.ListenAddrs = func() []ma.Multiaddr { return []ma.Multiaddr{mustMA(t, "/ip4/127.0.0.1/tcp/4001")} }
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz: expect 200, got %d", code)
+	}
+	// 数据库不可用时未就绪，但存活探针不受影响
+	store.SetError("Ping", errors.New("database is locked"))
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz with db error: expect 503, got %d", code)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("healthz with db error: expect 200, got %d", code)
+	}
+}
+
+func TestAdminStats_OldSchemaAndAuth(t *testing.T) {
+	// 使用初版表结构创建数据库，模拟升级前的部署
+	path := filepath.Join(t.TempDir(), "ctrl.db")
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open old db: %v", err)
+	}
+	now := time.Now()
+	if _, err := old.Exec(`CREATE TABLE nameplates(
+  nameplate TEXT PRIMARY KEY,
+  created_at INTEGER NOT NULL,
+  ttl_seconds INTEGER NOT NULL,
+  claimed_mask INTEGER NOT NULL DEFAULT 0,
+  consumed INTEGER NOT NULL DEFAULT 0,
+  fail_count INTEGER NOT NULL DEFAULT 0,
+  last_ip TEXT
+)`); err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+	if _, err := old.Exec(`INSERT INTO nameplates VALUES('777', ?, 600, 0, 0, 0, '10.0.0.1')`, now.Add(-10*time.Second).Unix()); err != nil {
+		t.Fatalf("insert old row: %v", err)
+	}
+	old.Close()
+
+	db, err := server.OpenControlDB(path)
+	if err != nil {
+		t.Fatalf("open control db on old schema: %v", err)
+	}
+	defer db.Close()
+	handlers := newMemHandlers(db, time.Minute, 3)
+	ts := httptest.NewServer(handlersMux(handlers))
+	defer ts.Close()
+
+	getStats := func(token string) (server.UsageStats, int) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin/stats", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /admin/stats: %v", err)
+		}
+		defer resp.Body.Close()
+		var st server.UsageStats
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+				t.Fatalf("decode stats: %v", err)
+			}
+		}
+		return st, resp.StatusCode
+	}
+
+	// 未配置令牌时管理接口不可用
+	if _, code := getStats("s3cret"); code != http.StatusNotFound {
+		t.Fatalf("without admin token: expect 404, got %d", code)
+	}
+	handlers.AdminToken = "s3cret"
+	if _, code := getStats(""); code != http.StatusUnauthorized {
+		t.Fatalf("missing token: expect 401, got %d", code)
+	}
+	if _, code := getStats("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: expect 401, got %d", code)
+	}
+
+	// 升级前的密码牌仍可认领，认领时间写入新增的列
+	if st, row, err := db.Claim("777", "connect", now, "10.0.0.2"); err != nil || st != server.StatusWaiting {
+		t.Fatalf("claim old row: %s %v", st, err)
+	} else if !row.ConnectClaimedAt.Valid || row.HostClaimedAt.Valid {
+		t.Fatalf("claim timestamps not recorded: %+v", row)
+	}
+	// 只有一侧认领的密码牌不计为配对
+	if st, _ := getStats("s3cret"); st.PairsToday != 0 || st.PairedNotConsumed != 0 {
+		t.Fatalf("one-sided claim counted as a pair: %+v", st)
+	}
+	if st, _, err := db.Claim("777", "host", now, "10.0.0.1"); err != nil || st != server.StatusPaired {
+		t.Fatalf("claim host side: %s %v", st, err)
+	}
+	alloc, _ := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	if err := db.Consume(alloc.Nameplate); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	st, code := getStats("s3cret")
+	if code != http.StatusOK {
+		t.Fatalf("stats: expect 200, got %d", code)
+	}
+	if st.AllocationsToday != 2 || st.PairsToday != 1 || st.ActiveNameplates != 2 || st.PairedNotConsumed != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if st.AvgTimeToPairSeconds < 9 || st.AvgTimeToPairSeconds > 11 {
+		t.Fatalf("avg time to pair = %v, want ~10s", st.AvgTimeToPairSeconds)
+	}
+}
+
+func TestReport_AggregatesIntoStats(t *testing.T) {
+	db, err := server.OpenControlDB(filepath.Join(t.TempDir(), "ctrl.db"))
+	if err != nil {
+		t.Fatalf("open control db: %v", err)
+	}
+	defer db.Close()
+	handlers := newMemHandlers(db, time.Minute, 3)
+	handlers.AdminToken = "s3cret"
+	ts := httptest.NewServer(handlersMux(handlers))
+	defer ts.Close()
+
+	// 报告令牌随分配 (host) 与认领成功 (connect) 下发
+	a1, _ := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	a2, _ := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	c1, _ := postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: a1.Nameplate, Side: "connect"}, nil)
+	if a1.ReportToken == "" || a2.ReportToken == "" || c1.ReportToken == "" || a1.ReportToken == c1.ReportToken {
+		t.Fatalf("report tokens not issued: %q %q %q", a1.ReportToken, a2.ReportToken, c1.ReportToken)
+	}
+	if cf, _ := postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: "000", Side: "connect"}, nil); cf.ReportToken != "" {
+		t.Fatalf("failed claim got a report token")
+	}
+
+	for _, r := range []models.TransferReport{
+		{Direction: models.ReportSend, Path: models.ReportPathRelay, Files: 3, Bytes: 3000, OK: true, Token: a1.ReportToken},
+		{Direction: models.ReportSend, Path: models.ReportPathRelay, Files: 1, FailedFiles: 2, Bytes: 100, Token: a2.ReportToken},
+		{Direction: models.ReportRecv, Path: models.ReportPathDirect, Files: 5, Bytes: 50, OK: true, Token: c1.ReportToken},
+	} {
+		if _, resp := postJSON[map[string]string](t, ts.URL, "/v1/report", r, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("report %+v: status %d", r, resp.StatusCode)
+		}
+	}
+	// 没有令牌或令牌被篡改的报告被拒绝，同一令牌的第二份报告不再计入
+	forged := a2.ReportToken[:len(a2.ReportToken)-1] + "0"
+	if forged == a2.ReportToken {
+		forged = a2.ReportToken[:len(a2.ReportToken)-1] + "1"
+	}
+	other := strings.Replace(a1.ReportToken, a1.Nameplate, a2.Nameplate, 1)
+	for _, c := range []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusForbidden},
+		{"host.123.1.abc", http.StatusForbidden},
+		{forged, http.StatusForbidden},
+		{other, http.StatusForbidden},
+		{a1.ReportToken, http.StatusConflict},
+	} {
+		r := models.TransferReport{Direction: models.ReportSend, Path: models.ReportPathDirect, Files: 100, Bytes: 1 << 30, OK: true, Token: c.token}
+		if _, resp := postJSON[map[string]string](t, ts.URL, "/v1/report", r, nil); resp.StatusCode != c.code {
+			t.Fatalf("report with token %q: expect %d, got %d", c.token, c.code, resp.StatusCode)
+		}
+	}
+	for _, bad := range []any{
+		models.TransferReport{Direction: "sideways", Path: models.ReportPathDirect},
+		models.TransferReport{Direction: models.ReportSend, Path: "carrier-pigeon"},
+		models.TransferReport{Direction: models.ReportSend, Path: models.ReportPathDirect, Bytes: -1},
+		"not an object",
+	} {
+		if _, resp := postJSON[map[string]string](t, ts.URL, "/v1/report", bad, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("report %+v: expect 400, got %d", bad, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /admin/stats: %v", err)
+	}
+	defer resp.Body.Close()
+	var st server.UsageStats
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	want := []server.TransferStats{
+		{Direction: "recv", Path: "direct", Reports: 1, Files: 5, Bytes: 50},
+		{Direction: "send", Path: "relay", Reports: 2, FailedReports: 1, Files: 4, FailedFiles: 2, Bytes: 3100},
+	}
+	if !reflect.DeepEqual(st.Transfers, want) {
+		t.Fatalf("transfers = %+v, want %+v", st.Transfers, want)
+	}
+
+	// MemoryStore 的汇总与 ControlDB 一致
+	mem := server.NewMemoryStore()
+	for _, r := range []models.TransferReport{
+		{Direction: models.ReportSend, Path: models.ReportPathRelay, Files: 3, Bytes: 3000, OK: true},
+		{Direction: models.ReportSend, Path: models.ReportPathRelay, Files: 1, FailedFiles: 2, Bytes: 100},
+		{Direction: models.ReportRecv, Path: models.ReportPathDirect, Files: 5, Bytes: 50, OK: true},
+	} {
+		if err := mem.RecordTransfer(r, time.Now()); err != nil {
+			t.Fatalf("mem record: %v", err)
+		}
+	}
+	if ms, err := mem.Stats(time.Now()); err != nil || !reflect.DeepEqual(ms.Transfers, want) {
+		t.Fatalf("memory transfers = %+v, %v", ms, err)
+	}
+}
+
+func TestParseRelayAddrs_ExternalRelaysInBundle(t *testing.T) {
+	const r1 = "12D3KooWJZQCkVyttfh9bouZsPpzu1m14wAoVawMCXbaq4QiWTZz"
+	const r2 = "QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N"
+	for _, bad := range []string{
+		"/ip4/198.51.100.1/tcp/4001", // 没有 PeerID
+		"/p2p/" + r1,                 // 没有传输地址
+		"/ip4/198.51.100.1/tcp/4001/p2p/" + r1 + "/p2p-circuit/p2p/" + r2, // 经中继到达的节点
+		"not-a-multiaddr",
+	} {
+		if _, err := server.ParseRelayAddrs(bad); err == nil {
+			t.Fatalf("ParseRelayAddrs(%q) accepted", bad)
+		}
+	}
+	extra, err := server.ParseRelayAddrs(" /ip4/198.51.100.1/tcp/4001/p2p/" + r1 + ", /dns4/relay.example.org/udp/4001/quic-v1/p2p/" + r2 + "/p2p-circuit,/ip4/198.51.100.1/tcp/4001/p2p/" + r1)
+	if err != nil {
+		t.Fatalf("ParseRelayAddrs: %v", err)
+	}
+	want := []string{
+		"/ip4/198.51.100.1/tcp/4001/p2p/" + r1 + "/p2p-circuit",
+		"/dns4/relay.example.org/udp/4001/quic-v1/p2p/" + r2 + "/p2p-circuit",
+	}
+	if !reflect.DeepEqual(extra, want) {
+		t.Fatalf("extra relays = %v, want %v", extra, want)
+	}
+
+	// 外部中继排在本服务器自身的中继地址之后，随 allocate 响应下发
+	own := server.RelayAddrsWithCircuit([]string{"/ip4/127.0.0.1/tcp/4001/p2p/" + r1})
+	h := server.NewHTTPHandlers(server.NewMemoryStore(), server.NewIPLimiter(time.Minute, 1000, time.Minute, 1000),
+		"wormhole-test", nil, server.MergeRelayAddrs(own, append(extra, own...)), nil, time.Minute, 3)
+	ts := httptest.NewServer(handlersMux(h))
+	defer ts.Close()
+	alloc, resp := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", map[string]any{}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("allocate: status %d", resp.StatusCode)
+	}
+	if got := alloc.Relay.Addrs; !reflect.DeepEqual(got, append(own, want...)) {
+		t.Fatalf("relay bundle = %v", got)
+	}
+	for _, a := range alloc.Relay.Addrs {
+		if !strings.HasSuffix(a, "/p2p-circuit") {
+			t.Fatalf("relay addr without /p2p-circuit: %s", a)
+		}
+	}
+}
+
+func TestControlDB_MigratesOldSchema(t *testing.T) {
+	// 引入版本表之前的数据库：只有初版 nameplates 表，没有 schema_version
+	path := filepath.Join(t.TempDir(), "ctrl.db")
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open old db: %v", err)
+	}
+	if _, err := old.Exec(`CREATE TABLE nameplates(
+  nameplate TEXT PRIMARY KEY,
+  created_at INTEGER NOT NULL,
+  ttl_seconds INTEGER NOT NULL,
+  claimed_mask INTEGER NOT NULL DEFAULT 0,
+  consumed INTEGER NOT NULL DEFAULT 0,
+  fail_count INTEGER NOT NULL DEFAULT 0,
+  last_ip TEXT
+)`); err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+	created := time.Now().Add(-time.Minute).Unix()
+	if _, err := old.Exec(`INSERT INTO nameplates VALUES('123', ?, 1800, 1, 0, 2, '10.0.0.1')`, created); err != nil {
+		t.Fatalf("insert old row: %v", err)
+	}
+	old.Close()
+
+	db, err := server.OpenControlDB(path)
+	if err != nil {
+		t.Fatalf("migrate old schema: %v", err)
+	}
+	if v, err := db.SchemaVersion(); err != nil || v != server.SchemaVersion {
+		t.Fatalf("schema version = %d, %v; want %d", v, err, server.SchemaVersion)
+	}
+	r, err := db.Load("123")
+	if err != nil {
+		t.Fatalf("load migrated row: %v", err)
+	}
+	if r.CreatedAt != created || r.TTLSeconds != 1800 || r.ClaimedMask != 1 || r.FailCount != 2 || r.LastIP.String != "10.0.0.1" {
+		t.Fatalf("row changed by migration: %+v", r)
+	}
+	if r.HostClaimedAt.Valid || r.ConnectClaimedAt.Valid {
+		t.Fatalf("new columns should default to NULL: %+v", r)
+	}
+	if st, _, err := db.Claim("123", "connect", time.Now(), "10.0.0.2"); err != nil || st != server.StatusPaired {
+		t.Fatalf("claim after migration: %s %v", st, err)
+	}
+	db.Close()
+
+	// 再次打开不会重复执行迁移
+	db, err = server.OpenControlDB(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	db.Close()
+	check, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open check db: %v", err)
+	}
+	defer check.Close()
+	var n int
+	if err := check.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&n); err != nil || n != server.SchemaVersion {
+		t.Fatalf("schema_version rows = %d, %v; want %d", n, err, server.SchemaVersion)
+	}
+
+	// 比当前程序更新的数据库拒绝打开，避免旧版本服务器误写
+	if _, err := check.Exec(`INSERT INTO schema_version(version, applied_at) VALUES(?, 0)`, server.SchemaVersion+1); err != nil {
+		t.Fatalf("bump version: %v", err)
+	}
+	if db, err := server.OpenControlDB(path); err == nil {
+		db.Close()
+		t.Fatalf("expected error opening a newer schema")
+	}
+}
+
+func TestInfoEndpointAndCORSPreflight(t *testing.T) {
+	handlers := newMemHandlers(server.NewMemoryStore(), 2*time.Minute, 4)
+	ts := httptest.NewServer(server.WithCORS([]string{"https://app.example"}, handlersMux(handlers)))
+	defer ts.Close()
+
+	// 1) GET /v1/info 返回静态配置
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/v1/info", nil)
+	req.Header.Set("Origin", "https://app.example")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /v1/info: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Fatalf("missing CORS origin header, got %q", got)
+	}
+	var info models.InfoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("decode info: %v", err)
+	}
+	if info.NameplateDigits != 4 || info.NameplateTTL != 120 || info.Rendezvous.Namespace != "wormhole-test" {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if len(info.Relay.Addrs) != 1 || !strings.HasSuffix(info.Relay.Addrs[0], "/p2p-circuit") {
+		t.Fatalf("unexpected relay addrs: %v", info.Relay.Addrs)
+	}
+
+	// 2) POST /v1/info 不被允许
+	_, resp2 := postJSON[models.InfoResponse](t, ts.URL, "/v1/info", map[string]any{}, nil)
+	if resp2.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expect 405 for POST /v1/info, got %d", resp2.StatusCode)
+	}
+
+	// 3) 预检请求直接返回 204
+	pre, _ := http.NewRequest(http.MethodOptions, ts.URL+"/v1/allocate", nil)
+	pre.Header.Set("Origin", "https://app.example")
+	pre.Header.Set("Access-Control-Request-Method", "POST")
+	presp, err := http.DefaultClient.Do(pre)
+	if err != nil {
+		t.Fatalf("OPTIONS /v1/allocate: %v", err)
+	}
+	presp.Body.Close()
+	if presp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expect 204 for preflight, got %d", presp.StatusCode)
+	}
+	if !strings.Contains(presp.Header.Get("Access-Control-Allow-Methods"), "POST") {
+		t.Fatalf("preflight missing allow-methods: %q", presp.Header.Get("Access-Control-Allow-Methods"))
+	}
+
+	// 4) 未允许的来源不会得到 CORS 头
+	req3, _ := http.NewRequest(http.MethodGet, ts.URL+"/v1/info", nil)
+	req3.Header.Set("Origin", "https://evil.example")
+	resp3, err := http.DefaultClient.Do(req3)
+	if err != nil {
+		t.Fatalf("GET /v1/info: %v", err)
+	}
+	resp3.Body.Close()
+	if got := resp3.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("unexpected CORS header for disallowed origin: %q", got)
+	}
+}
+
+func TestNameplateCharset_AlnumAllocateAndInfo(t *testing.T) {
+	handlers := newMemHandlers(server.NewMemoryStore(), time.Minute, 4)
+	handlers.Charset = models.NameplateCharsetAlnum
+	ts := httptest.NewServer(handlersMux(handlers))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/v1/info")
+	if err != nil {
+		t.Fatalf("GET /v1/info: %v", err)
+	}
+	var info models.InfoResponse
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil || info.NameplateCharset != models.NameplateCharsetAlnum || info.NameplateDigits != 4 {
+		t.Fatalf("unexpected info: %+v (%v)", info, err)
+	}
+
+	alphabet := models.NameplateAlphabets[models.NameplateCharsetAlnum]
+	for i := 0; i < 50; i++ {
+		alloc, r := postJSON[models.AllocateResponse](t, ts.URL, "/v1/allocate", nil, nil)
+		if r.StatusCode != http.StatusOK {
+			t.Fatalf("allocate: %d", r.StatusCode)
+		}
+		np := alloc.Nameplate
+		if len(np) != 4 || strings.Trim(np, alphabet) != "" {
+			t.Fatalf("nameplate %q not from alnum alphabet", np)
+		}
+		clm, _ := postJSON[models.ClaimResponse](t, ts.URL, "/v1/claim", models.ClaimRequest{Nameplate: np, Side: "host"}, nil)
+		if clm.Status != string(server.StatusWaiting) {
+			t.Fatalf("claim %q: %+v", np, clm)
+		}
+	}
+
+	// 未设置字符集时保持纯数字，/v1/info 明确报告 digits
+	ts2 := httptest.NewServer(handlersMux(newMemHandlers(server.NewMemoryStore(), time.Minute, 3)))
+	defer ts2.Close()
+	resp, err = http.Get(ts2.URL + "/v1/info")
+	if err != nil {
+		t.Fatalf("GET /v1/info: %v", err)
+	}
+	info = models.InfoResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil || info.NameplateCharset != models.NameplateCharsetDigits {
+		t.Fatalf("unexpected default info: %+v (%v)", info, err)
+	}
+	alloc, _ := postJSON[models.AllocateResponse](t, ts2.URL, "/v1/allocate", nil, nil)
+	if len(alloc.Nameplate) != 3 || strings.Trim(alloc.Nameplate, "0123456789") != "" {
+		t.Fatalf("default nameplate %q is not numeric", alloc.Nameplate)
+	}
+}
+
 func TestRendezvousRegisterAndDiscover(t *testing.T) {
 	// 我们使用的 Rendezvous 客户端 API：在服务器对等节点上进行 Register/Discover。
 	s := startWormholeServerForTest(t, serverConfig{
@@ -442,6 +1417,80 @@ func TestRendezvousRegisterAndDiscover(t *testing.T) {
 	}
 }
 
+func TestConfigFile_FlagsOverride(t *testing.T) {
+	dir := t.TempDir()
+	toml := filepath.Join(dir, "server.toml")
+	writeFile := func(p, body string) {
+		t.Helper()
+		if err := os.WriteFile(p, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(toml, `# comment
+db = "/var/lib/wormhole.db"   # trailing comment
+nameplate-digits = 4
+public-addrs = ["/ip4/203.0.113.1/tcp/4001", "/dns4/example.org/tcp/4001"]
+control-listen = ':9090'
+`)
+	newFS := func() (*flag.FlagSet, *string, *int, *string, *string) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		db := fs.String("db", "./wormhole.db", "")
+		digits := fs.Int("nameplate-digits", 3, "")
+		pub := fs.String("public-addrs", "", "")
+		ctrl := fs.String("control-listen", ":8080", "")
+		fs.String("config", "", "")
+		return fs, db, digits, pub, ctrl
+	}
+
+	fs, db, digits, pub, ctrl := newFS()
+	if err := fs.Parse([]string{"-nameplate-digits", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	vals, err := config.Load(toml)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := config.ApplyFlags(fs, vals, "config"); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if *db != "/var/lib/wormhole.db" || *ctrl != ":9090" || *pub != "/ip4/203.0.113.1/tcp/4001,/dns4/example.org/tcp/4001" {
+		t.Fatalf("file values not applied: db=%q ctrl=%q pub=%q", *db, *ctrl, *pub)
+	}
+	if *digits != 3 {
+		t.Fatalf("command line must win over the file, got digits=%d", *digits)
+	}
+
+	// YAML 子集
+	yml := filepath.Join(dir, "server.yaml")
+	writeFile(yml, "db: ./y.db\ncontrol-listen: \":7070\"\n")
+	fs, db, _, _, ctrl = newFS()
+	vals, err = config.Load(yml)
+	if err == nil {
+		err = config.ApplyFlags(fs, vals)
+	}
+	if err != nil || *db != "./y.db" || *ctrl != ":7070" {
+		t.Fatalf("yaml: db=%q ctrl=%q err=%v", *db, *ctrl, err)
+	}
+
+	// 未知键、非法值、语法错误与配置文件中的 config 键都应报错
+	for _, bad := range []string{
+		"nameplate-ttl = \"10m\"\n",
+		"nameplate-digits = four\n",
+		"db \"x\"\n",
+		"config = \"other.toml\"\n",
+	} {
+		writeFile(toml, bad)
+		fs, _, _, _, _ := newFS()
+		vals, err := config.Load(toml)
+		if err == nil {
+			err = config.ApplyFlags(fs, vals, "config")
+		}
+		if err == nil {
+			t.Fatalf("%q: expected error", bad)
+		}
+	}
+}
+
 // 辅助函数：将字符串地址转换为 []multiaddr.Multiaddr
 func mustMultiaddrs(t *testing.T, ss []string) (out []ma.Multiaddr) {
 	t.Helper()
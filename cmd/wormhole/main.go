@@ -2,47 +2,74 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
 	_ "embed"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	libp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
 	circuitv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
 	pingsvc "github.com/libp2p/go-libp2p/p2p/protocol/ping"
 
+	golog "github.com/ipfs/go-log/v2"
 	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 	rzv "github.com/waku-org/go-libp2p-rendezvous"
 
 	readline "github.com/chzyer/readline"
+	qrcode "github.com/skip2/go-qrcode"
 	mpb "github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
 
 	xxh3 "github.com/zeebo/xxh3"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/Metaphorme/wormhole/pkg/api"
 	"github.com/Metaphorme/wormhole/pkg/client"
+	"github.com/Metaphorme/wormhole/pkg/config"
 	"github.com/Metaphorme/wormhole/pkg/crypto"
 	"github.com/Metaphorme/wormhole/pkg/models"
 	"github.com/Metaphorme/wormhole/pkg/p2p"
+	"github.com/Metaphorme/wormhole/pkg/server"
 	"github.com/Metaphorme/wormhole/pkg/session"
+	"github.com/Metaphorme/wormhole/pkg/transfer"
 	uipkg "github.com/Metaphorme/wormhole/pkg/ui"
+	"github.com/Metaphorme/wormhole/pkg/version"
 )
 
 // 使用 pkg/models 中的聊天协议常量和协议 ID
@@ -57,7 +84,291 @@ var effShortWordlist []byte
 
 // ---------- 工具函数 ----------
 
-var verbose bool // 全局标志，用于控制是否输出详细日志
+// defaultMaxChatMsg 是 -max-chat-msg 的默认值。
+const defaultMaxChatMsg = 1 << 20
+
+// defaultWriteBuf 是 -write-buffer 的默认值。
+const defaultWriteBuf = 256 << 10
+
+// errChatTooLong 表示对端发送的单行聊天消息超过了 -max-chat-msg。
+var errChatTooLong = errors.New("chat message too long")
+
+// readChatLine 从聊天流读取一行，去掉结尾的 "\n" 或 "\r\n"。超过 max 字节的行会被完整读出并丢弃，
+// 返回 errChatTooLong (附带实际长度)，流仍可继续读取下一行。流在行中途结束时返回已读到的部分。
+func readChatLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	n, tooLong := 0, false
+	for {
+		frag, err := r.ReadSlice('\n')
+		n += len(frag)
+		if !tooLong && len(line)+len(frag) <= max+2 { // 为 "\r\n" 留出余量
+			line = append(line, frag...)
+		} else {
+			tooLong, line = true, nil
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || n == 0) {
+			return "", err
+		}
+		break
+	}
+	txt := strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r")
+	if !tooLong {
+		n = len(txt)
+	}
+	if tooLong || n > max {
+		return "", fmt.Errorf("%w: %d bytes, limit %d", errChatTooLong, n, max)
+	}
+	return txt, nil
+}
+
+// chatEndReason 把聊天接收循环结束时的读错误归类为给用户看的会话结束原因：
+// 对端正常半关闭 (EOF)、连接或流被重置、读超时，其余情况附带原始错误。
+func chatEndReason(err error) string {
+	var ne net.Error
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		return "peer closed the stream"
+	case errors.Is(err, network.ErrReset), errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return "read timeout"
+	}
+	return "read error: " + err.Error()
+}
+
+var rawChat bool  // 全局标志，为 true 时不过滤对端聊天消息中的控制字符
+var sasCheck bool // 全局标志，为 true 时要求对端在确认行中附带 SAS 交叉校验标签
+
+var strictSAS bool // 全局标志，为 true 时确认对端必须键入对端屏幕上的 SAS，而不是回答 y/N
+
+var maxChatMsg = defaultMaxChatMsg // 全局标志，单条聊天消息的最大字节数，超出的消息被丢弃而不是断开会话
+
+var jsonOut bool // 全局标志，为 true 时以 JSON 行在标准输出报告传输进度，取代进度条
+
+var discoverLimit = 64 // 全局标志，每次向汇合点查询的最多节点数
+
+var writeBufSize = defaultWriteBuf // 全局标志，接收方写盘缓冲区的字节数，0 表示每个数据块直接写入文件
+
+var excludes multiFlag // 全局标志，发送目录时跳过匹配这些模式的文件和子目录
+
+var idleTimeout time.Duration // 全局标志，会话无活动超过该时长后自动关闭，0 表示禁用
+
+var outTemplate string // 全局标志，接收目录时相对 outdir 的路径模板，如 "{date}/{name}"
+
+var dialTimeout = 12 * time.Second // 全局标志，单次直连拨号的超时时间
+
+var relayDialTimeout time.Duration // 全局标志，单次中继拨号的超时时间，0 表示按 dialTimeout 等比放大
+
+var progressFile string // 全局标志，非空时为每次传输维护 JSON 进度文件，列出已确认的文件
+
+// 全局标志，连接管理器的水位线：连接数超过 connHigh 时裁剪到 connLow，
+// 建立不足 connGrace 的连接以及受保护的中继与当前对端不会被裁剪
+var (
+	connLow   = 32
+	connHigh  = 64
+	connGrace = time.Minute
+)
+
+var forceDirect bool // 全局标志，为 true 时只允许直连，直连失败即报错而不回退到中继
+
+var transportsFlag string // 全局标志，逗号分隔的允许使用的传输 (见 transportNames)，空表示全部
+
+var onConnect string    // 全局标志，握手成功 (SAS 已确认) 后通过 shell 执行的命令
+var onDisconnect string // 全局标志，会话结束后通过 shell 执行的命令
+
+var announceAddrs []ma.Multiaddr // 由 -announce 给出并解析过的对外地址，总是向汇合点公布
+
+var ewmaAge float64 // 全局标志，进度条速度/ETA 的 EWMA 窗口，0 表示按传输大小自动选择
+
+var noIndex bool // 全局标志，为 true 时不在保存目录下记录下载索引
+
+var keepFailed bool // 全局标志，为 true 时校验失败的文件重命名为 <name>.corrupt 保留，而不是删除
+
+var tempDir string // 全局标志，非空时接收中的 .part 临时文件写在此目录，而不是目标文件旁
+
+var autoSend string // 全局标志，host 模式下握手成功后自动发送的文件或目录
+
+var outdirByCode bool // 全局标志，为 true 时接收的内容统一保存到 outdir/<密码牌>/ 下
+
+var archiveFormat string // 全局标志，非空时将接收的目录写入单个 tar/zip 归档，而不是散落的文件
+
+var asArchive bool // 全局标志，为 true 时发送目录会被实时打包为 tar，作为单个逻辑文件传输
+
+var ackWindow = 1 // 全局标志，发送目录时最多连续发送多少个未确认的文件；1 表示逐个等待 ACK
+
+var relaySelect = "first" // 全局标志，中继选择策略：first 按服务器给出的顺序，fastest 按 ping 延迟
+
+var quiet bool // 全局标志，为 true 时只输出代码、传输结果和错误，不显示提示信息与进度条
+
+var noReport bool // 全局标志，为 true 时不向控制服务器报告文件传输结果
+
+var showDigest bool // 全局标志，为 true 时传输结束后打印覆盖全部已送达文件的传输摘要
+
+var honorSuggestedPath bool // 全局标志，为 true 时接收的单个文件按发送方建议的相对路径保存
+
+var reportURL string // 传输结果报告的控制服务器地址，启动时由 -control 与 -no-report 决定；为空时不报告
+
+var reportToken string // 分配或认领时控制服务器下发的报告令牌，随每份报告发出；服务器只统计每次会话的第一份
+
+// logLevel 是应用日志级别 (-log-level)，默认 info；-verbose 等价于 debug，-quiet 在未指定级别时为 warn。
+var logLevel = new(slog.LevelVar)
+
+// logger 是会话之外的应用日志出口 (会话中的消息经 ui 输出，以免与输入行交错)。
+// 默认由 lineHandler 以纯文本逐行写到标准输出；结构化输出只需替换 handler。
+var logger = slog.New(&lineHandler{mu: new(sync.Mutex), w: os.Stdout, level: logLevel})
+
+// parseLogLevel 解析 -log-level 的取值
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "error":
+		return slog.LevelError, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	}
+	return 0, fmt.Errorf("want error, warn, info or debug")
+}
+
+// debugEnabled 报告是否输出调试信息 (原 -verbose 控制的内容)
+func debugEnabled() bool { return logLevel.Level() <= slog.LevelDebug }
+
+// setLibp2pLogLevel 让 libp2p 及其依赖的日志使用与应用相同的级别
+func setLibp2pLogLevel(l slog.Level) {
+	name := strings.ToLower(l.String())
+	if lvl, err := golog.Parse(name); err == nil {
+		golog.SetAllLoggers(lvl)
+	}
+}
+
+// lineHandler 是输出纯文本的 slog.Handler：每条记录一行，warn/error 带 "warn: "/"error: " 前缀，
+// 属性以 key=value 附在消息之后，与此前直接打印的格式保持一致。
+type lineHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	attrs []slog.Attr
+}
+
+func (h *lineHandler) Enabled(_ context.Context, l slog.Level) bool { return l >= h.level.Level() }
+
+func (h *lineHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString("error: ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("warn: ")
+	}
+	b.WriteString(r.Message)
+	write := func(a slog.Attr) bool {
+		if !a.Equal(slog.Attr{}) {
+			fmt.Fprintf(&b, " %s=%v", a.Key, a.Value.Resolve())
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	b.WriteByte('\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *lineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append(slices.Clip(h.attrs), attrs...)
+	return &nh
+}
+
+// WithGroup 不区分分组：纯文本输出中属性直接平铺
+func (h *lineHandler) WithGroup(string) slog.Handler { return h }
+
+// infoln 打印提示性信息 (info 级别)，安静模式下不输出。
+func infoln(a ...any) {
+	logger.Info(strings.TrimSuffix(fmt.Sprintln(a...), "\n"))
+}
+
+// serverMessageLines 将服务器公告整理为可安全显示的行：截断到 models.MaxMessageLen，
+// 逐行转义控制字符，丢弃空行。公告内容由服务器控制，不能直接写入终端。
+func serverMessageLines(msg string) []string {
+	if len(msg) > models.MaxMessageLen {
+		msg = strings.ToValidUTF8(msg[:models.MaxMessageLen], "") + "…"
+	}
+	var out []string
+	for _, ln := range strings.Split(msg, "\n") {
+		if ln = strings.TrimSpace(ln); ln != "" {
+			out = append(out, uipkg.Sanitize(ln))
+		}
+	}
+	return out
+}
+
+// printServerMessage 打印服务器公告 (如果有)。
+func printServerMessage(msg string) {
+	for _, ln := range serverMessageLines(msg) {
+		infoln(c("server: ", cDim) + ln)
+	}
+}
+
+// progressOutput 返回进度条的输出目标，安静模式与 -json 下丢弃。
+func progressOutput() io.Writer {
+	if quiet || jsonOut {
+		return io.Discard
+	}
+	return os.Stderr
+}
+
+// clientConfigPath 返回客户端配置文件路径：$XDG_CONFIG_HOME/wormhole/config.toml，
+// 未设置 XDG_CONFIG_HOME 时为 ~/.config/wormhole/config.toml。
+func clientConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "wormhole", "config.toml")
+}
+
+// loadClientConfig 用配置文件为命令行上未给出的标志设置默认值，返回实际加载的文件路径；
+// 文件不存在时返回空串。代码与模式只能来自命令行，不允许写入配置文件。
+func loadClientConfig(flags *flag.FlagSet, path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	vals, err := config.Load(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err == nil {
+		err = config.ApplyFlags(flags, vals, "code", "c", "code-from-stdin", "mode", "send")
+	}
+	if err != nil {
+		return "", fmt.Errorf("config %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// multiFlag 是可重复指定的字符串标志。
+type multiFlag []string
+
+func (m *multiFlag) String() string { return strings.Join(*m, ",") }
+
+func (m *multiFlag) Set(v string) error {
+	*m = append(*m, v)
+	return nil
+}
 
 // API 客户端辅助函数
 
@@ -110,18 +421,89 @@ func httpPostJSON[T any](ctx context.Context, base, path string, body any, out *
 	}
 }
 
+// reportTimeout 限制单次向控制服务器报告会话状态的时长，也是退出前等待报告完成的上限。
+const reportTimeout = 5 * time.Second
+
+// pendingReports 跟踪尚未完成的异步状态报告，进程退出前通过 waitReports 等待它们发出。
+var pendingReports sync.WaitGroup
+
 func postConsumeAsync(controlURL, nameplate string) {
+	pendingReports.Add(1)
 	go func() {
+		defer pendingReports.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+		defer cancel()
 		c := api.NewClient(controlURL)
-		_ = c.Consume(context.Background(), nameplate)
+		_ = c.Consume(ctx, nameplate)
 	}()
 }
 
 func postFailAsync(controlURL, nameplate string) {
+	pendingReports.Add(1)
 	go func() {
+		defer pendingReports.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+		defer cancel()
 		c := api.NewClient(controlURL)
-		_ = c.Fail(context.Background(), nameplate)
+		_ = c.Fail(ctx, nameplate)
+	}()
+}
+
+// xferStats 统计一次传输中确认送达的文件数与字节数，传输结束后随结果一起报告。
+type xferStats struct {
+	files int
+	bytes int64
+}
+
+func (st *xferStats) add(size int64) {
+	st.files++
+	st.bytes += size
+}
+
+// reportXferAsync 在后台向控制服务器报告一次传输的结果：方向、路径类型、文件数、字节数与失败数，
+// 不含文件名、密码牌或 PeerID。报告失败不影响用户，reportURL 为空 (-no-report) 时直接返回。
+func reportXferAsync(direction string, conn network.Conn, st xferStats, failed int, ok bool) {
+	if reportURL == "" {
+		return
+	}
+	path := models.ReportPathDirect
+	if p2p.ClassifyPath(conn).Kind == "RELAY" {
+		path = models.ReportPathRelay
+	}
+	r := models.TransferReport{Direction: direction, Path: path, Files: st.files, FailedFiles: failed, Bytes: st.bytes, OK: ok, Token: reportToken}
+	pendingReports.Add(1)
+	go func() {
+		defer pendingReports.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+		defer cancel()
+		_ = api.NewClient(reportURL).Report(ctx, r)
+	}()
+}
+
+// waitReports 等待所有异步状态报告完成，最多等待 timeout，
+// 避免收到 SIGINT/SIGTERM 后进程先于报告退出，使密码牌停留在未作废状态。
+func waitReports(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pendingReports.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// releaseRelay 断开与已预订中继的连接，使中继尽快回收预订槽位而不是等到过期。
+// Relay v2 协议没有取消预订的消息，中继在与我们的连接全部断开时删除预订。
+func releaseRelay(h host.Host, relay *peer.AddrInfo) {
+	if relay == nil {
+		return
+	}
+	h.ConnManager().Unprotect(relay.ID, "relay")
+	_ = h.Network().ClosePeer(relay.ID)
 }
 
 func min64(a, b int64) int64 {
@@ -155,6 +537,60 @@ func writeFrame(w io.Writer, typ byte, payload []byte) error {
 
 // readFrame 从 io.Reader 读取一个帧。
 func readFrame(r io.Reader) (byte, []byte, error) {
+	return readFrameInto(r, nil)
+}
+
+// chunkBufPool 复用 chunkSize 大小的数据块缓冲区。大文件传输时每个数据块都重新分配
+// 1 MiB 会给 GC 带来明显压力，发送与接收两侧都从这里借用缓冲区。
+var chunkBufPool = sync.Pool{New: func() any { b := make([]byte, chunkSize); return &b }}
+
+// partWriter 是接收方写入临时文件的句柄。bw 非空时数据块先进入缓冲区，攒满后一次写盘，
+// 避免数据块较小时每块一次系统调用；大于缓冲区的数据块由 bufio 直接写入，不多一次拷贝。
+type partWriter struct {
+	f  *os.File
+	bw *bufio.Writer
+}
+
+// newPartWriter 用 size 字节的缓冲区包装 f；size <= 0 时直接写入 f。
+func newPartWriter(f *os.File, size int) *partWriter {
+	w := &partWriter{f: f}
+	if size > 0 {
+		w.bw = bufio.NewWriterSize(f, size)
+	}
+	return w
+}
+
+func (w *partWriter) Write(p []byte) (int, error) {
+	if w.bw != nil {
+		return w.bw.Write(p)
+	}
+	return w.f.Write(p)
+}
+
+// Flush 把缓冲区中的数据写盘；没有缓冲区时什么也不做。
+func (w *partWriter) Flush() error {
+	if w.bw == nil {
+		return nil
+	}
+	return w.bw.Flush()
+}
+
+// Close 先把缓冲区写盘再关闭文件。校验失败、写入出错或传输中断时同样经由这里，
+// 因此保留下来的临时文件 (-keep-failed、断点续传) 总是包含全部已收到的数据。
+func (w *partWriter) Close() error {
+	var err error
+	if w.bw != nil {
+		err = w.bw.Flush()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readFrameInto 与 readFrame 相同，但在 buf 容量足够时把帧内容读入 buf 而不分配新内存。
+// 返回的 payload 可能与 buf 共享内存，只在下一次用同一 buf 读取之前有效。
+func readFrameInto(r io.Reader, buf []byte) (byte, []byte, error) {
 	var hdr [9]byte
 	if _, err := io.ReadFull(r, hdr[:]); err != nil {
 		return 0, nil, err
@@ -164,11 +600,10 @@ func readFrame(r io.Reader) (byte, []byte, error) {
 	if n > (1 << 31) {
 		return 0, nil, fmt.Errorf("frame too large: %d", n)
 	}
-	buf := make([]byte, int(n))
-	if n > 0 {
-		if _, err := io.ReadFull(r, buf); err != nil {
-			return 0, nil, err
-		}
+	// 帧内容按段读取并受 transfer.FrameIdleTimeout 约束，声明超大帧后缓慢发送的对端无法占住内存
+	buf, err := transfer.ReadBody(r, int(n), buf)
+	if err != nil {
+		return 0, nil, err
 	}
 	return typ, buf, nil
 }
@@ -190,426 +625,1772 @@ const (
 	chunkSize  = 1 << 20    // 1MiB, 文件分块大小
 )
 
-// xferOffer 定义了文件传输提议的内容。
-type xferOffer struct {
-	Kind  string `json:"kind"`            // 类型: "file" 或 "dir"
-	Name  string `json:"name,omitempty"`  // 文件或目录名
-	Size  int64  `json:"size,omitempty"`  // 总字节数
-	Files int    `json:"files,omitempty"` // 文件数量 (仅目录)
+// XFER 错误码，随 frameError 的 JSON 载荷发送，使对端可以区分临时性与永久性错误。
+const (
+	xferErrIO           = "io_error"          // 临时性 I/O 错误，可重试
+	xferErrHashMismatch = "hash_mismatch"     // 完整性校验失败，可重试
+	xferErrDiskFull     = "disk_full"         // 接收方磁盘已满，放弃剩余文件
+	xferErrPermission   = "permission_denied" // 接收方无权限写入，放弃该文件
+	xferErrProtocol     = "protocol_error"    // 帧序列不符合协议
+	xferErrUnknown      = "unknown"           // 旧版本对端发送的纯文本错误
+)
+
+// xferError 是 frameError 的载荷，同时实现了 error 接口。
+type xferError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Name    string `json:"name,omitempty"` // 出错的文件名，供流水线发送时核对回复顺序
 }
 
-// ---------- 进度条 ----------
+func (e *xferError) Error() string { return fmt.Sprintf("peer error [%s]: %s", e.Code, e.Message) }
 
-// newFileBar 为单个文件传输创建一个新的进度条。
-func newFileBar(p *mpb.Progress, name string, total int64) *mpb.Bar {
-	return p.New(total,
-		mpb.BarStyle(),
-		mpb.BarPriority(0),
-		mpb.BarRemoveOnComplete(),
-		mpb.PrependDecorators(
-			decor.Name(name+" ", decor.WC{C: decor.DindentRight}),
-			decor.CountersKibiByte("% .1f / % .1f"),
-		),
-		mpb.AppendDecorators(
-			decor.Percentage(),
-			decor.Name(" | "),
-			decor.EwmaSpeed(decor.SizeB1024(0), "% .1f", 30),
-			decor.Name(" | "),
-			decor.EwmaETA(decor.ET_STYLE_MMSS, 30),
-		),
-	)
+// payload 将错误编码为 frameError 的 JSON 载荷。
+func (e *xferError) payload() []byte {
+	b, _ := json.Marshal(e)
+	return b
 }
 
-// newTotalBar 为目录传输创建一个显示总进度的进度条。
-func newTotalBar(p *mpb.Progress, total int64) *mpb.Bar {
-	return p.New(total,
-		mpb.BarStyle(),
-		mpb.BarPriority(1),
-		mpb.PrependDecorators(
-			decor.Name("TOTAL ", decor.WC{C: decor.DindentRight}),
-			decor.CountersKibiByte("% .1f / % .1f"),
-		),
-		mpb.AppendDecorators(
-			decor.Percentage(),
-			decor.Name(" | "),
-			decor.EwmaSpeed(decor.SizeB1024(0), "% .1f", 30),
-			decor.Name(" | "),
-			decor.EwmaETA(decor.ET_STYLE_MMSS, 30),
-		),
-	)
+// retryable 报告发送方是否值得重试该错误。
+func (e *xferError) retryable() bool {
+	return e.Code == xferErrIO || e.Code == xferErrHashMismatch
 }
 
-// sendXfer 处理文件或目录的发送逻辑。
-func sendXfer(ctx context.Context, h host.Host, remote peer.ID, kind, arg string, ui *uiConsole, seed uint64) error {
-	xs, err := h.NewStream(ctx, remote, models.ProtoXfer)
-	if err != nil {
-		return err
+// decodeXferError 解析 frameError 的载荷；旧版本对端发送的纯文本被视为 unknown 错误。
+func decodeXferError(payload []byte) *xferError {
+	var e xferError
+	if err := json.Unmarshal(payload, &e); err != nil || e.Code == "" {
+		return &xferError{Code: xferErrUnknown, Message: string(payload)}
 	}
-	defer xs.Close()
+	return &e
+}
 
-	// 1. 根据类型 (file/dir) 创建传输提议。
-	var off xferOffer
-	switch kind {
-	case "file":
-		st, err := os.Stat(arg)
-		if err != nil {
-			return err
-		}
-		if !st.Mode().IsRegular() {
-			return fmt.Errorf("not a regular file")
-		}
-		off = xferOffer{Kind: "file", Name: filepath.Base(arg), Size: st.Size()}
-	case "dir":
-		cnt := 0
-		var total int64
-		filepath.WalkDir(arg, func(path string, d os.DirEntry, err error) error {
-			if err == nil && !d.IsDir() {
-				if st, er := os.Stat(path); er == nil && st.Mode().IsRegular() {
-					cnt++
-					total += st.Size()
-				}
-			}
-			return nil
-		})
-		off = xferOffer{Kind: "dir", Name: filepath.Base(arg), Files: cnt, Size: total}
-	default:
-		return fmt.Errorf("unknown kind %q", kind)
+// newXferIOError 根据本地文件系统错误生成相应错误码的 xferError。
+func newXferIOError(err error) *xferError {
+	code := xferErrIO
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		code = xferErrDiskFull
+	case errors.Is(err, fs.ErrPermission):
+		code = xferErrPermission
 	}
+	return &xferError{Code: code, Message: err.Error()}
+}
 
-	// 2. 发送提议并等待对方响应。
-	b, _ := json.Marshal(off)
-	if err := writeFrame(xs, frameOffer, b); err != nil {
-		return err
+// errHashMismatch 表示接收方回复了 NACK (哈希校验失败)。
+var errHashMismatch = errors.New("receiver reported hash mismatch")
+
+// fileReply 是 ACK/NACK 的载荷，回显接收方正在确认的文件名；旧版本对端发送空载荷。
+type fileReply struct {
+	Name string `json:"name"`
+}
+
+// xferReject 是 frameReject 的载荷，说明拒绝的原因；旧版本接收方发送空载荷。
+type xferReject struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// 接收方拒绝提议时告知发送方的原因
+const (
+	rejectDeclined = "declined by user"
+	rejectNoAnswer = "no answer from user"
+)
+
+// maxRejectReason 是显示给发送方的拒绝原因的最大字节数
+const maxRejectReason = 200
+
+// rejectError 将 frameReject 的载荷转换为发送方的错误；空载荷 (旧版本接收方) 或无法解析时只说明被拒绝。
+// 原因来自对端，显示前去掉控制字符并截断。
+func rejectError(payload []byte) error {
+	var rj xferReject
+	_ = json.Unmarshal(payload, &rj)
+	reason := uipkg.Sanitize(strings.TrimSpace(rj.Reason))
+	if len(reason) > maxRejectReason {
+		reason = reason[:maxRejectReason]
 	}
-	typ, _, err := readFrame(xs)
-	if err != nil {
-		return err
+	if reason == "" {
+		return errors.New("peer rejected")
 	}
-	if typ == frameReject {
-		return fmt.Errorf("peer rejected")
+	return fmt.Errorf("peer rejected: %s", reason)
+}
+
+// xferDone 是 frameXferDone 的载荷，携带发送方的传输摘要；旧版本发送方发送空载荷。
+type xferDone struct {
+	Digest string `json:"digest,omitempty"`
+}
+
+// transferDigest 按确认顺序对每个已送达文件的名称与哈希做滚动哈希，得到整个传输的摘要。
+// 接收方严格按收到的顺序逐个确认，两端因此以相同的顺序累加；单个文件都通过校验时，
+// 摘要不一致仍能发现缺失或顺序错乱的文件。
+type transferDigest struct {
+	h *xxh3.Hasher
+}
+
+func newTransferDigest(seed uint64) transferDigest {
+	return transferDigest{h: xxh3.NewSeed(seed)}
+}
+
+// add 累加一个已确认送达的文件
+func (d transferDigest) add(name, hash string) {
+	_, _ = d.h.WriteString(name)
+	_, _ = d.h.Write([]byte{0})
+	_, _ = d.h.WriteString(hash)
+	_, _ = d.h.Write([]byte{'\n'})
+}
+
+func (d transferDigest) hex() string {
+	sum := d.h.Sum128().Bytes()
+	return fmt.Sprintf("%x", sum[:])
+}
+
+// errAckOutOfOrder 表示接收方的回复与发送方等待确认的文件不对应，之后的回复都无法可靠归属。
+var errAckOutOfOrder = errors.New("receiver reply does not match the pending file")
+
+// fileResult 将接收方对文件 name 的回复 (ACK/NACK/ERROR) 转换为发送结果。
+// got 为发送时计算的哈希，expectHash 非空时用于发送方自检。
+// 回复中带有文件名且与 name 不符时返回 errAckOutOfOrder。
+func fileResult(typ byte, payload []byte, name, expectHash, got string) error {
+	switch typ {
+	case frameFileAck, frameFileNack:
+		var r fileReply
+		if len(payload) > 0 && json.Unmarshal(payload, &r) == nil && r.Name != "" && r.Name != name {
+			return fmt.Errorf("%w: got %q, want %q", errAckOutOfOrder, r.Name, name)
+		}
+		if typ == frameFileNack {
+			return errHashMismatch
+		}
+		if expectHash != "" && got != expectHash {
+			return fmt.Errorf("sender self-check mismatched (unexpected)")
+		}
+		return nil
+	case frameError:
+		xe := decodeXferError(payload)
+		if xe.Name != "" && xe.Name != name {
+			return fmt.Errorf("%w: got %q, want %q", errAckOutOfOrder, xe.Name, name)
+		}
+		return xe
+	default:
+		return fmt.Errorf("unexpected response after file: 0x%02x", typ)
 	}
-	if typ != frameAccept {
-		return fmt.Errorf("unexpected response")
+}
+
+// retryableXferErr 报告单个文件的发送错误是否可以重试。
+func retryableXferErr(err error) bool {
+	if errors.Is(err, errHashMismatch) {
+		return true
 	}
+	var xe *xferError
+	return errors.As(err, &xe) && xe.retryable()
+}
 
-	// 3. 初始化进度条。
-	var p *mpb.Progress
-	var fileBar, totalBar *mpb.Bar
-	if (off.Kind == "file" && off.Size > 0) || (off.Kind == "dir" && off.Size > 0) {
-		p = mpb.New(
-			mpb.WithWidth(64),
-			mpb.WithRefreshRate(120*time.Millisecond),
-			mpb.WithOutput(os.Stderr),
-		)
-		if off.Kind == "dir" {
-			totalBar = newTotalBar(p, off.Size)
-		}
-	} else if off.Kind == "file" && off.Size == 0 {
-		ui.Println("note: sending empty file")
-	}
-	createdBar := func() bool { return fileBar != nil || totalBar != nil }
-
-	// 4. 定义发送单个文件的辅助函数，包含完整性校验和重试逻辑。
-	sendOneAttempt := func(name string, r io.Reader, size int64, expectHash string) error {
-		// 为当前文件创建或更新进度条
-		if p != nil {
-			if totalBar != nil && fileBar != nil {
-				fileBar.Abort(true)
-				fileBar.Wait()
-			}
-			if size > 0 {
-				fileBar = newFileBar(p, name, size)
-			} else {
-				fileBar = nil // 零大小文件不显示进度条
-			}
-		}
-
-		if fileBar != nil {
-			fileBar.DecoratorAverageAdjust(time.Now())
-		}
-		if totalBar != nil {
-			totalBar.DecoratorAverageAdjust(time.Now())
-		}
-
-		// 发送文件头信息 (元数据)
-		hdr := map[string]any{
-			"name": name,
-			"size": size,
-			"algo": "xxh3-128-seed",
-			"hash": expectHash,
-		}
-		b, _ := json.Marshal(hdr)
-		if err := writeFrame(xs, frameFileHdr, b); err != nil {
-			return err
-		}
+// fatalXferErr 报告错误是否意味着剩余文件也无法送达 (例如对端磁盘已满)。
+func fatalXferErr(err error) bool {
+	var xe *xferError
+	return errors.As(err, &xe) && xe.Code == xferErrDiskFull
+}
 
-		// 分块发送文件数据
-		buf := make([]byte, chunkSize)
-		var sent int64
-		hw := xxh3.NewSeed(seed)
-		for {
-			if size >= 0 && sent >= size {
-				break
-			}
-			start := time.Now()
-			n, er := r.Read(buf)
-			if n > 0 {
-				sent += int64(n)
-				_, _ = hw.Write(buf[:n])
-				if err := writeFrame(xs, frameChunk, buf[:n]); err != nil {
-					return err
-				}
-				// 更新进度条
-				if fileBar != nil {
-					fileBar.EwmaIncrBy(n, time.Since(start))
-				}
-				if totalBar != nil {
-					totalBar.EwmaIncrBy(n, time.Since(start))
-				}
-			}
-			if er == io.EOF {
-				break
-			}
-			if er != nil {
-				return er
-			}
-		}
-		if err := writeFrame(xs, frameFileDone, nil); err != nil {
-			return err
-		}
-		if fileBar != nil {
-			fileBar.SetTotal(size, true)
+// excludeMatch 报告目录内的相对路径 rel 是否匹配任一排除模式。
+// 模式语法类似 .gitignore：不含 "/" 的模式匹配任意层级的名称，含 "/" 的模式
+// 匹配从目录根开始的完整相对路径，以 "/" 结尾的模式只匹配目录。
+func excludeMatch(patterns []string, rel string, isDir bool) bool {
+	rel = filepath.ToSlash(rel)
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		dirOnly := strings.HasSuffix(p, "/")
+		p = strings.TrimSuffix(p, "/")
+		if p == "" || (dirOnly && !isDir) {
+			continue
 		}
-
-		// 等待接收方的确认 (ACK/NACK)
-		typ, _, err := readFrame(xs)
-		if err != nil {
-			return err
+		target := path.Base(rel)
+		if strings.Contains(p, "/") {
+			p = strings.TrimPrefix(p, "/")
+			target = rel
 		}
-		switch typ {
-		case frameFileAck:
-			sumBytes := hw.Sum128().Bytes()
-			got := fmt.Sprintf("%x", sumBytes[:])
-			if expectHash != "" && got != expectHash {
-				return fmt.Errorf("sender self-check mismatched (unexpected)")
-			}
-			return nil
-		case frameFileNack:
-			return fmt.Errorf("receiver reported hash mismatch")
-		default:
-			return fmt.Errorf("unexpected response after file: 0x%02x", typ)
+		if ok, _ := path.Match(p, target); ok {
+			return true
 		}
 	}
+	return false
+}
 
-	// 5. 定义计算文件哈希的辅助函数。
-	hashFile := func(path string) (string, int64, error) {
-		f, err := os.Open(path)
-		if err != nil {
-			return "", 0, err
-		}
-		defer f.Close()
-		st, err := f.Stat()
-		if err != nil {
-			return "", 0, err
-		}
-		h := xxh3.NewSeed(seed)
-		if _, err := io.Copy(h, f); err != nil {
-			return "", 0, err
-		}
-		sum := h.Sum128().Bytes()
-		return fmt.Sprintf("%x", sum[:]), st.Size(), nil
+// skipExcluded 在遍历目录时应用排除模式：匹配的目录整体剪枝，匹配的文件跳过。
+func skipExcluded(root, p string, d fs.DirEntry) (skip bool, walkErr error) {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." || !excludeMatch(excludes, rel, d.IsDir()) {
+		return false, nil
 	}
+	if d.IsDir() {
+		return true, filepath.SkipDir
+	}
+	return true, nil
+}
 
-	// 6. 开始传输。
-	failedFiles := make([]string, 0)
-	const maxRetries = 3
+// planEntry 是目录发送计划中的一个文件。
+type planEntry struct {
+	Rel  string // 相对目录根的路径
+	Size int64
+}
 
-	switch off.Kind {
-	case "file":
-		hv, sz, err := hashFile(arg)
+// planDir 按发送目录时的规则 (-exclude 以及可选的 skip) 枚举将要发送的常规文件。
+func planDir(root string, skip func(root, p string) bool) (files []planEntry, total int64) {
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
-			return err
+			return nil
 		}
-		if off.Size <= 0 {
-			off.Size = sz
+		if skipped, se := skipExcluded(root, path, d); skipped {
+			return se
 		}
-		attempt := 0
-		for {
-			f, er := os.Open(arg)
-			if er != nil {
-				return er
-			}
-			err = sendOneAttempt(off.Name, f, off.Size, hv)
-			_ = f.Close()
-			if err == nil || attempt >= maxRetries {
-				if err != nil {
-					failedFiles = append(failedFiles, off.Name)
-				}
-				break
-			}
-			attempt++
-			ui.Println(fmt.Sprintf("hash mismatch, retrying %s (%d/%d)…", off.Name, attempt, maxRetries))
-			time.Sleep(time.Duration(attempt) * 300 * time.Millisecond)
+		if d.IsDir() || (skip != nil && skip(root, path)) {
+			return nil
 		}
-	case "dir":
-		root := arg
-		filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
-			if err != nil || d.IsDir() {
-				return nil
-			}
+		if st, er := os.Stat(path); er == nil && st.Mode().IsRegular() {
 			rel, _ := filepath.Rel(root, path)
-			st, er := os.Stat(path)
-			if er != nil || !st.Mode().IsRegular() {
-				return nil
-			}
-			hv, _, er := hashFile(path)
-			if er != nil {
-				return nil
-			}
-			attempt := 0
-			for {
-				f, er2 := os.Open(path)
-				if er2 != nil {
-					return nil
-				}
-				e := sendOneAttempt(rel, f, st.Size(), hv)
-				_ = f.Close()
-				if e == nil || attempt >= maxRetries {
-					if e != nil {
-						failedFiles = append(failedFiles, rel)
-					}
-					break
-				}
-				attempt++
-				ui.Println(fmt.Sprintf("hash mismatch, retrying %s (%d/%d)…", rel, attempt, maxRetries))
-				time.Sleep(time.Duration(attempt) * 300 * time.Millisecond)
-			}
-			return nil
-		})
-		if totalBar != nil {
-			totalBar.SetTotal(off.Size, true)
+			files = append(files, planEntry{Rel: rel, Size: st.Size()})
+			total += st.Size()
 		}
+		return nil
+	})
+	return files, total
+}
+
+// sendKind 根据本地路径判断发送类型："dir" 或 "file"。
+func sendKind(path string) (string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if st.IsDir() {
+		return "dir", nil
+	}
+	if !st.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file or directory", path)
+	}
+	return "file", nil
+}
+
+// fetchURL 以 GET 请求 rawURL 并返回 200 响应，供 /send -u 流式转发；重定向由 http.Client 跟随，
+// 其他状态码视为错误。name 取 URL 路径的最后一段，路径为空时为 "download"。调用方负责关闭响应体。
+func fetchURL(ctx context.Context, rawURL string) (resp *http.Response, name string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", fmt.Errorf("not an http(s) URL: %q", rawURL)
 	}
+	name = path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "download"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, "", fmt.Errorf("GET %s: %s", u.Redacted(), resp.Status)
+	}
+	return resp, name, nil
+}
 
-	// 7. 发送传输结束信号并清理。
-	if err := writeFrame(xs, frameXferDone, nil); err != nil {
+// printSendPlan 打印目录发送计划 (文件列表、大小与合计)，不打开任何流。
+func printSendPlan(emit func(string), root string) error {
+	st, err := os.Stat(root)
+	if err != nil {
 		return err
 	}
-	if p != nil && createdBar() {
-		p.Wait()
-		ui.Refresh()
+	if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
 	}
-	_ = xs.CloseWrite()
-	if len(failedFiles) > 0 {
-		ui.Println("some files failed integrity check and were not delivered:")
-		for _, f := range failedFiles {
-			ui.Println("  - " + f)
+	files, total := planDir(root, nil)
+	for _, f := range files {
+		emit(fmt.Sprintf("  %10s  %s", formatSize(f.Size), filepath.ToSlash(f.Rel)))
+	}
+	emit(fmt.Sprintf("dry run: %d file(s), %s would be sent from %s", len(files), formatSize(total), root))
+	return nil
+}
+
+// formatSize 以二进制单位 (KiB/MiB/GiB) 格式化字节数，与进度条的显示保持一致。
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
+// printDownloads 按时间顺序列出 outDir 中记录的已接收文件。
+func printDownloads(emit func(string), outDir string) error {
+	recs, err := transfer.ReadDownloadIndex(outDir)
+	if err != nil {
+		return err
+	}
+	for _, r := range recs {
+		peerID := r.Peer
+		if len(peerID) > 12 {
+			peerID = "…" + peerID[len(peerID)-12:]
+		}
+		emit(fmt.Sprintf("%s  %10s  %-13s  %s", r.Time.Local().Format("2006-01-02 15:04:05"), formatSize(r.Size), peerID, r.Path))
+		if debugEnabled() {
+			emit(fmt.Sprintf("    peer %s  %s %s", r.Peer, r.Algo, r.Hash))
 		}
 	}
+	emit(fmt.Sprintf("%d file(s) recorded in %s", len(recs), filepath.Join(outDir, transfer.DownloadIndexName)))
 	return nil
 }
 
-// promptReq 用于在主输入循环和需要用户输入的其他协程之间传递请求。
-type promptReq struct {
-	question string
-	resp     chan bool
+// progressEntry 是进度文件中一个已被对端确认的文件。
+type progressEntry struct {
+	Path string `json:"path"` // 目录传输中为相对路径 ("/" 分隔)
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
 }
 
-// tryDequeuePrompt 尝试从通道中非阻塞地取出一个提示请求。
-func tryDequeuePrompt(ch chan *promptReq) *promptReq {
-	select {
-	case p := <-ch:
-		return p
-	default:
+// xferProgress 是 -progress-file 写出的单次传输进度：每个文件确认送达后整体重写一次，
+// 传输中断时外部脚本可据此核对哪些文件已完成；传输成功结束后删除。nil 表示未启用。
+type xferProgress struct {
+	mu   sync.Mutex
+	path string
+
+	Role      string          `json:"role"` // "send" 或 "recv"
+	Kind      string          `json:"kind"`
+	Name      string          `json:"name"`
+	Peer      string          `json:"peer"`
+	Started   time.Time       `json:"started"`
+	Updated   time.Time       `json:"updated"`
+	Algo      string          `json:"algo"`
+	Completed []progressEntry `json:"completed"`
+}
+
+// progressPath 返回 role 方向的进度文件路径：base 的扩展名前插入 "-<role>"，
+// 使同一会话中同时进行的发送与接收互不覆盖，例如 progress.json -> progress-send.json。
+func progressPath(base, role string) string {
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "-" + role + ext
+}
+
+// newXferProgress 为一次传输创建进度文件；base 为空时返回 nil。
+func newXferProgress(base, role string, off xferOffer, remote peer.ID, ui *uiConsole) *xferProgress {
+	if base == "" {
 		return nil
 	}
+	now := time.Now().UTC()
+	p := &xferProgress{path: progressPath(base, role), Role: role, Kind: off.Kind, Name: off.Name, Peer: remote.String(),
+		Started: now, Updated: now, Algo: "xxh3-128-seed", Completed: []progressEntry{}}
+	if err := p.save(); err != nil {
+		ui.Logln("warn: progress file: " + err.Error())
+	}
+	return p
 }
 
-// handleIncomingXfer 处理接收文件或目录的逻辑。
-func handleIncomingXfer(_ context.Context, _ host.Host, xs network.Stream, outDir string, askYesNo func(q string, timeout time.Duration) bool, ui *uiConsole, seed uint64) {
-	defer xs.Close()
-	// 1. 读取传输提议。
-	typ, payload, err := readFrame(xs)
-	if err != nil || typ != frameOffer {
-		return
+// add 记录一个已确认的文件并重写进度文件。
+func (p *xferProgress) add(path string, size int64, hash string) error {
+	if p == nil {
+		return nil
 	}
-	var off xferOffer
-	_ = json.Unmarshal(payload, &off)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Completed = append(p.Completed, progressEntry{Path: filepath.ToSlash(path), Size: size, Hash: hash})
+	p.Updated = time.Now().UTC()
+	return p.saveLocked()
+}
 
-	// 2. 询问用户是否接受。
-	info := ""
-	switch off.Kind {
-	case "file":
-		info = fmt.Sprintf("Peer wants to send file %q (%d bytes).", off.Name, off.Size)
-	case "dir":
-		info = fmt.Sprintf("Peer wants to send directory %q (%d files, total %d bytes).", off.Name, off.Files, off.Size)
-	}
-	ui.Logln(info)
-	if !askYesNo("Accept? [y/N]: ", 30*time.Second) {
-		_ = writeFrame(xs, frameReject, nil)
-		return
-	}
-	if err := writeFrame(xs, frameAccept, nil); err != nil {
+// finish 在传输结束时调用：全部成功则删除进度文件，否则保留供核对。
+func (p *xferProgress) finish(ok bool) {
+	if p == nil || !ok {
 		return
 	}
+	_ = os.Remove(p.path)
+}
 
-	// 3. 初始化进度条。
-	var p *mpb.Progress
-	var fileBar, totalBar *mpb.Bar
-	if (off.Kind == "file" && off.Size > 0) || (off.Kind == "dir" && off.Size > 0) {
-		p = mpb.New(
-			mpb.WithWidth(64),
-			mpb.WithRefreshRate(120*time.Millisecond),
-			mpb.WithOutput(os.Stderr),
-		)
-		if off.Kind == "file" {
-			fileBar = newFileBar(p, off.Name, off.Size)
-		} else {
-			totalBar = newTotalBar(p, off.Size)
-		}
+func (p *xferProgress) save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.saveLocked()
+}
+
+// saveLocked 先写临时文件再重命名，读者不会看到写了一半的 JSON。
+func (p *xferProgress) saveLocked() error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
 	}
-	createdBar := func() bool { return p != nil && (fileBar != nil || totalBar != nil) }
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
 
-	// 4. 循环处理接收到的帧。
-	var fw *os.File
-	var dstPath string
-	var expectHash string
-	var algo string
-	failedFiles := make([]string, 0)
-	hasher := xxh3.NewSeed(seed)
-	lastTick := time.Now()
+// xferDest 描述接收的文件保存在哪里。
+type xferDest struct {
+	outDir       string // 保存目录
+	template     string // 目录传输相对 outDir 的路径模板，为空时等价于 "{name}"
+	nameplate    string // 用于模板中的 {code}
+	archive      string // "tar" 或 "zip" 时将目录传输写入 <baseDir>.<archive>
+	byCode       bool   // 为 true 时以 outDir/<nameplate> 作为根目录
+	index        bool   // 为 true 时将每个成功接收的文件记入 outDir 下的下载索引
+	keepFailed   bool   // 为 true 时校验失败的文件保留为 <name>.corrupt 而不是删除
+	progressFile string // 非空时在每个文件确认后更新进度文件 (见 xferProgress)
+	honorPath    bool   // 为 true 时单个文件按发送方建议的相对路径 (xferOffer.Path) 保存
+	tempDir      string // 非空时临时文件写在此目录，校验通过后再移动到目标位置
+}
 
-	// 对于目录传输，在 outDir 下创建一个与原目录同名的子目录
-	baseDir := outDir
-	if off.Kind == "dir" {
-		baseDir = filepath.Join(outDir, off.Name)
+// expandHome 将开头的 "~" 或 "~/" 展开为当前用户的主目录，其余路径原样返回。
+func expandHome(p string) (string, error) {
+	if p != "~" && !strings.HasPrefix(p, "~/") && !strings.HasPrefix(p, "~"+string(filepath.Separator)) {
+		return p, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
 	}
+	return filepath.Join(home, p[1:]), nil
+}
 
-	for {
-		typ, payload, err = readFrame(xs)
-		if err != nil {
-			return
-		}
-		switch typ {
-		case frameFileHdr: // 收到文件头，准备写入文件
-			var hdr struct {
-				Name string `json:"name"`
-				Size int64  `json:"size"`
-				Algo string `json:"algo"`
-				Hash string `json:"hash"`
+// resolveOutDir 解析会话中 /outdir 给出的保存目录：展开 "~"、转为绝对路径并检查可写 (不存在时创建)。
+func resolveOutDir(arg string) (string, error) {
+	dir, err := expandHome(arg)
+	if err == nil {
+		dir, err = filepath.Abs(dir)
+	}
+	if err == nil {
+		err = checkOutDir(dir)
+	}
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// checkOutDir 确保 dir 是一个可写的目录：不存在时创建，随后写入并删除一个探测文件。
+func checkOutDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	st, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".wormhole-probe-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	name := f.Name()
+	_ = f.Close()
+	return os.Remove(name)
+}
+
+// root 返回本次会话的保存根目录：默认为 outDir，byCode 时为 outDir/<nameplate>。
+func (d xferDest) root() (string, error) {
+	if !d.byCode {
+		return d.outDir, nil
+	}
+	if !nameplateRe.MatchString(d.nameplate) || !filepath.IsLocal(d.nameplate) {
+		return "", fmt.Errorf("unsafe nameplate %q for -outdir-by-code", d.nameplate)
+	}
+	return filepath.Join(d.outDir, d.nameplate), nil
+}
+
+// isPathElem 报告 name 是否为单个本地路径元素：非空，不含路径分隔符，也不是 "." 或 ".."。
+func isPathElem(name string) bool {
+	return name != "" && name != "." && !strings.ContainsAny(name, `/\`) && filepath.IsLocal(name)
+}
+
+// baseDir 返回本次传输的保存目录。文件直接保存在根目录 (见 root) 下；目录按模板展开，支持
+// {name} (对端提供的目录名)、{date} (本地日期)、{peer} (对端 PeerID) 与 {code} (密码牌)。
+// 展开结果必须是根目录内的相对路径，否则返回错误。
+func (d xferDest) baseDir(off xferOffer, remote peer.ID, now time.Time) (string, error) {
+	root, err := d.root()
+	if err != nil {
+		return "", err
+	}
+	if off.Kind != "dir" && off.Kind != "archive" {
+		return root, nil
+	}
+	// {name} 只能占据模板中的一段：否则 "{peer}/{name}" 配上 "../other/x" 这样的名字，
+	// 展开结果虽仍在根目录内，却会写进其他对端或其他日期的目录
+	if !isPathElem(off.Name) {
+		return "", fmt.Errorf("unsafe directory name %q", off.Name)
+	}
+	tmpl := d.template
+	if tmpl == "" {
+		tmpl = "{name}"
+	}
+	rel := strings.NewReplacer(
+		"{name}", off.Name,
+		"{date}", now.Format("2006-01-02"),
+		"{peer}", remote.String(),
+		"{code}", d.nameplate,
+	).Replace(tmpl)
+	rel = filepath.Clean(filepath.FromSlash(rel))
+	if rel == "." || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("unsafe destination %q for directory %q", rel, off.Name)
+	}
+	return filepath.Join(root, rel), nil
+}
+
+// partSuffix 是接收中文件的临时后缀，校验通过后才会重命名为最终文件名。
+const partSuffix = transfer.PartSuffix
+
+// corruptSuffix 是 -keep-failed 时校验失败文件的后缀。
+const corruptSuffix = ".corrupt"
+
+// discardPart 丢弃校验失败的临时文件 part。keep 为 true 时改为重命名为 dst + corruptSuffix
+// 以便排查，并返回保留的路径；重命名失败或 keep 为 false 时删除 part 并返回空串。
+func discardPart(part, dst string, keep bool) string {
+	if keep {
+		kept := dst + corruptSuffix
+		if err := os.MkdirAll(filepath.Dir(kept), 0o755); err == nil && movePart(part, kept) == nil {
+			return kept
+		}
+	}
+	_ = os.Remove(part)
+	return ""
+}
+
+// renameFile 即 os.Rename，测试中替换以模拟跨文件系统的重命名。
+var renameFile = os.Rename
+
+// movePart 将临时文件 part 移动为 dst。-temp-dir 与目标不在同一文件系统时重命名会以 EXDEV 失败，
+// 此时先复制到 dst 旁的 dst + partSuffix，再在目标文件系统内重命名，最后删除 part；
+// 因此 dst 同样不会出现写了一半的文件。
+func movePart(part, dst string) error {
+	err := renameFile(part, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	tmp := dst + partSuffix
+	if err := copyFile(part, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := renameFile(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(part)
+}
+
+// copyFile 将 src 的内容复制到新建 (或截断) 的 dst 并同步到磁盘。
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// finalizePart 在临时文件成功关闭 (closeErr 为 nil) 后将其重命名为最终文件名；
+// 归档模式下 (arc 非空) 则以相对路径 name 写入归档并删除临时文件。
+func finalizePart(closeErr error, arc *transfer.ArchiveWriter, part, dst, name string) error {
+	if closeErr != nil {
+		return closeErr
+	}
+	if arc == nil {
+		return movePart(part, dst)
+	}
+	defer os.Remove(part)
+	f, err := os.Open(part)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return arc.Add(name, st.Size(), f)
+}
+
+// verifyBlockSize 是分块校验的块大小。大于一个块的文件会在文件头中附带每个块的哈希，
+// 接收方每收完一块就校验一次，数据损坏时立即放弃该文件，而不是把整个文件写完才发现。
+var verifyBlockSize int64 = 8 * chunkSize
+
+// xferOffer 定义了文件传输提议的内容。
+type xferOffer struct {
+	Kind  string `json:"kind"`            // 类型: "file" 或 "dir"
+	Name  string `json:"name,omitempty"`  // 文件或目录名
+	Size  int64  `json:"size,omitempty"`  // 总字节数
+	Files int    `json:"files,omitempty"` // 文件数量 (仅目录)
+	Path  string `json:"path,omitempty"`  // 发送方建议的保存位置 (仅单个文件，以 / 分隔的相对路径)
+
+	SizeUnknown bool `json:"size_unknown,omitempty"` // 流式发送、事先不知道大小 (如没有 Content-Length 的 URL)
+}
+
+// 对端提议中 Size / Files 的上限。两者都由对端提供，会直接用于进度条总量与统计，
+// 超出合理范围的值 (如 math.MaxInt64) 会导致进度累加溢出，直接拒绝。
+const (
+	maxOfferSize  int64 = 1 << 50 // 1 PiB
+	maxOfferFiles       = 10_000_000
+)
+
+// validate 检查对端提议的类型与数值范围。
+func (o xferOffer) validate() error {
+	switch o.Kind {
+	case "file", "dir", "archive":
+	default:
+		return fmt.Errorf("unknown offer kind %q", o.Kind)
+	}
+	if o.Size < 0 || o.Size > maxOfferSize {
+		return fmt.Errorf("invalid offer size %d", o.Size)
+	}
+	if o.Files < 0 || o.Files > maxOfferFiles {
+		return fmt.Errorf("invalid offer file count %d", o.Files)
+	}
+	if o.Path != "" && o.Kind != "file" {
+		return fmt.Errorf("suggested path is only allowed for a single file")
+	}
+	return nil
+}
+
+// cleanSuggestedPath 规整发送方建议的保存位置 (xferOffer.Path)：必须是留在保存目录内的相对路径，
+// 不能含 ".."、不能是绝对路径，也不能指向保存目录本身。返回本地路径分隔符形式。
+func cleanSuggestedPath(p string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(p))
+	if rel == "." || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("unsafe suggested path %q", p)
+	}
+	return rel, nil
+}
+
+// ---------- 进度条 ----------
+
+// barEwmaAge 返回进度条使用的 EWMA 窗口：优先使用 -ewma-age，否则按总大小自动选择。
+func barEwmaAge(total int64) float64 {
+	if ewmaAge > 0 {
+		return ewmaAge
+	}
+	return transfer.EwmaAge(total)
+}
+
+// progressReporter 接收单个文件的传输进度，供进度条之外的输出方式使用 (见 -json)。
+// 发送方在流水线模式下会在另一个协程中报告 done，实现需要并发安全。
+type progressReporter interface {
+	start(name string, total int64) // 开始发送/接收一个文件，total 为 -1 表示大小未知
+	add(n int)                      // 当前文件又传输了 n 字节
+	done(name string, ok bool)      // 一次文件传输的结果 (重试的每次尝试各报告一次)
+}
+
+// nopReporter 是未启用 -json 时的 progressReporter。
+type nopReporter struct{}
+
+func (nopReporter) start(string, int64) {}
+func (nopReporter) add(int)             {}
+func (nopReporter) done(string, bool)   {}
+
+// jsonProgressEvery 是 -json 下同一文件两次 progress 事件的最小间隔。
+const jsonProgressEvery = 500 * time.Millisecond
+
+// jsonOutput 是 -json 事件的输出目标；jsonMu 保证并发的发送与接收不会交错写出半行。
+var (
+	jsonOutput io.Writer = os.Stdout
+	jsonMu     sync.Mutex
+)
+
+// emitJSON 把 v 编码为一行 JSON 写到 jsonOutput。
+func emitJSON(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	jsonMu.Lock()
+	defer jsonMu.Unlock()
+	_, _ = jsonOutput.Write(append(b, '\n'))
+}
+
+// progressEvent 与 fileDoneEvent 是 -json 输出的事件，dir 为 "send" 或 "recv"。
+type progressEvent struct {
+	Event string `json:"event"` // "progress"
+	Dir   string `json:"dir"`
+	File  string `json:"file"`
+	Bytes int64  `json:"bytes"`
+	Total int64  `json:"total"` // -1 表示大小未知
+	Rate  int64  `json:"rate"`  // 自该文件开始以来的平均速率，字节/秒
+}
+
+type fileDoneEvent struct {
+	Event string `json:"event"` // "file_done"
+	Dir   string `json:"dir"`
+	File  string `json:"file"`
+	OK    bool   `json:"ok"`
+}
+
+// jsonReporter 以 JSON 行报告进度：progress 事件按 every 节流，文件结束时补发一次最终进度。
+type jsonReporter struct {
+	dir   string
+	every time.Duration
+
+	mu          sync.Mutex
+	name        string
+	total, sent int64
+	began, last time.Time
+}
+
+// newProgressReporter 返回方向为 dir ("send"/"recv") 的 progressReporter，未启用 -json 时什么也不做。
+func newProgressReporter(dir string) progressReporter {
+	if !jsonOut {
+		return nopReporter{}
+	}
+	return &jsonReporter{dir: dir, every: jsonProgressEvery}
+}
+
+func (j *jsonReporter) start(name string, total int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.name, j.total, j.sent = name, total, 0
+	j.began, j.last = time.Now(), time.Time{}
+}
+
+func (j *jsonReporter) add(n int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.sent += int64(n)
+	if now := time.Now(); now.Sub(j.last) >= j.every {
+		j.last = now
+		j.emitLocked(now)
+	}
+}
+
+func (j *jsonReporter) done(name string, ok bool) {
+	j.mu.Lock()
+	if name == j.name && !j.last.IsZero() {
+		j.emitLocked(time.Now())
+		j.last = time.Time{}
+	}
+	j.mu.Unlock()
+	emitJSON(fileDoneEvent{Event: "file_done", Dir: j.dir, File: name, OK: ok})
+}
+
+func (j *jsonReporter) emitLocked(now time.Time) {
+	var rate int64
+	if el := now.Sub(j.began).Seconds(); el > 0 {
+		rate = int64(float64(j.sent) / el)
+	}
+	emitJSON(progressEvent{Event: "progress", Dir: j.dir, File: j.name, Bytes: j.sent, Total: j.total, Rate: rate})
+}
+
+// barHub 让同一进程中并发的发送与接收共用一个 mpb.Progress：双向同时传输时
+// 两边的进度条上下排列，而不是两个容器轮流重绘同一块终端区域。
+type barHub struct {
+	mu    sync.Mutex
+	p     *mpb.Progress
+	users int
+}
+
+// xferBars 是所有传输共用的进度条容器。
+var xferBars barHub
+
+// acquire 返回共享的 mpb.Progress，没有正在使用的实例时新建一个。
+func (b *barHub) acquire() *mpb.Progress {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.p == nil {
+		b.p = mpb.New(
+			mpb.WithWidth(64),
+			mpb.WithRefreshRate(120*time.Millisecond),
+			mpb.WithOutput(progressOutput()),
+		)
+	}
+	b.users++
+	return b.p
+}
+
+// release 归还 acquire 得到的实例。调用前须先用 settleBars 结束自己的进度条，
+// 最后一个使用者归还时等待渲染完成并关闭容器。
+func (b *barHub) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.users--; b.users > 0 {
+		return
+	}
+	b.p.Wait()
+	b.p = nil
+}
+
+// settleBars 等待本次传输的进度条渲染完毕，未完成的 (传输出错) 先中止，
+// 以免共享容器一直等待它们。只等自己的进度条，不受另一方向传输的影响。
+func settleBars(bars ...*mpb.Bar) {
+	for _, bar := range bars {
+		if bar == nil {
+			continue
+		}
+		bar.Abort(false)
+		bar.Wait()
+	}
+}
+
+// newFileBar 为单个文件传输创建一个新的进度条。
+func newFileBar(p *mpb.Progress, name string, total int64) *mpb.Bar {
+	return p.New(total,
+		mpb.BarStyle(),
+		mpb.BarPriority(0),
+		mpb.BarRemoveOnComplete(),
+		mpb.PrependDecorators(
+			decor.Name(name+" ", decor.WC{C: decor.DindentRight}),
+			decor.CountersKibiByte("% .1f / % .1f"),
+		),
+		mpb.AppendDecorators(
+			decor.Percentage(),
+			decor.Name(" | "),
+			decor.EwmaSpeed(decor.SizeB1024(0), "% .1f", barEwmaAge(total)),
+			decor.Name(" | "),
+			decor.EwmaETA(decor.ET_STYLE_MMSS, barEwmaAge(total)),
+		),
+	)
+}
+
+// newTotalBar 为目录传输创建一个显示总进度的进度条。
+func newTotalBar(p *mpb.Progress, total int64) *mpb.Bar {
+	return p.New(total,
+		mpb.BarStyle(),
+		mpb.BarPriority(1),
+		mpb.PrependDecorators(
+			decor.Name("TOTAL ", decor.WC{C: decor.DindentRight}),
+			decor.CountersKibiByte("% .1f / % .1f"),
+		),
+		mpb.AppendDecorators(
+			decor.Percentage(),
+			decor.Name(" | "),
+			decor.EwmaSpeed(decor.SizeB1024(0), "% .1f", barEwmaAge(total)),
+			decor.Name(" | "),
+			decor.EwmaETA(decor.ET_STYLE_MMSS, barEwmaAge(total)),
+		),
+	)
+}
+
+// xferResult 汇总一次发送的结果。
+type xferResult struct {
+	Total  int      // 计划发送的文件数，file 与以归档方式发送的目录均为 1
+	Sent   int      // 接收方确认送达的文件数
+	Failed []string // 未能送达的文件，含义见 sendXferOnly，可原样传回以重试
+}
+
+// xferOutcome 区分一次发送全部成功、部分成功与全部失败。
+type xferOutcome int32
+
+const (
+	xferAllOK xferOutcome = iota
+	xferPartial
+	xferAllFailed
+)
+
+// Outcome 根据送达的文件数判断发送结果；没有任何文件要发送的空目录视为成功。
+func (r xferResult) Outcome() xferOutcome {
+	switch {
+	case r.Sent >= r.Total:
+		return xferAllOK
+	case r.Sent == 0:
+		return xferAllFailed
+	}
+	return xferPartial
+}
+
+// sendOutcome 记录本次运行中所有发送的最差结果 (xferOutcome)，会话结束后据此设置进程退出码。
+var sendOutcome atomic.Int32
+
+// recordSendOutcome 在 o 比已记录的结果更差时更新 sendOutcome。
+func recordSendOutcome(o xferOutcome) {
+	for {
+		cur := sendOutcome.Load()
+		if int32(o) <= cur || sendOutcome.CompareAndSwap(cur, int32(o)) {
+			return
+		}
+	}
+}
+
+// exitCode 返回发送结果对应的进程退出码：部分文件未送达为 3，没有任何文件送达为 4，
+// 与 log.Fatalf 的 1 和参数错误的 2 区分开，便于脚本判断。
+func (o xferOutcome) exitCode() int {
+	switch o {
+	case xferPartial:
+		return 3
+	case xferAllFailed:
+		return 4
+	}
+	return 0
+}
+
+// xferIncompleteError 表示传输流程正常结束，但有文件未能送达。
+type xferIncompleteError struct {
+	Result xferResult
+}
+
+func (e *xferIncompleteError) Error() string {
+	r := e.Result
+	if r.Outcome() == xferAllFailed {
+		return fmt.Sprintf("xfer failed: none of %d file(s) delivered", r.Total)
+	}
+	return fmt.Sprintf("xfer completed with %d failure(s): %d of %d file(s) delivered", r.Total-r.Sent, r.Sent, r.Total)
+}
+
+// sendXfer 处理文件或目录的发送逻辑。
+func sendXfer(ctx context.Context, h host.Host, remote peer.ID, kind, arg string, ui *uiConsole, seed uint64) (xferResult, error) {
+	return sendXferOnly(ctx, h, remote, kind, arg, nil, ui, seed)
+}
+
+// sendXferOnly 与 sendXfer 相同，但当 only 非空时，目录传输只发送 only 中列出的相对路径。
+func sendXferOnly(ctx context.Context, h host.Host, remote peer.ID, kind, arg string, only []string, ui *uiConsole, seed uint64) (xferResult, error) {
+	return sendXferTo(ctx, h, remote, kind, arg, only, "", ui, seed)
+}
+
+// sendXferTo 是发送的完整实现。to 非空时 (仅 file) 在提议中附带建议的保存位置，接收方按
+// -honor-suggested-path 决定是否采用。结果中的 Failed 列出未能送达的文件 (file 为 arg 本身，dir 为相对 arg 的路径；以归档方式发送的目录
+// 失败时为 "."，表示整个目录)。有文件未送达时返回 *xferIncompleteError，其余错误表示传输流程本身中断。
+func sendXferTo(ctx context.Context, h host.Host, remote peer.ID, kind, arg string, only []string, to string, ui *uiConsole, seed uint64) (res xferResult, err error) {
+	var onlySet map[string]bool
+	if len(only) > 0 {
+		onlySet = make(map[string]bool, len(only))
+		for _, rel := range only {
+			onlySet[filepath.Clean(rel)] = true
+		}
+		if onlySet["."] {
+			onlySet = nil
+		}
+	}
+	// skipFile 报告目录中的文件是否因不在 only 中而被跳过
+	skipFile := func(root, p string) bool {
+		if onlySet == nil {
+			return false
+		}
+		rel, err := filepath.Rel(root, p)
+		return err != nil || !onlySet[rel]
+	}
+
+	// 聊天连接可能只经过中继 (limited conn)，传输流需要显式允许使用它
+	xs, err := h.NewStream(network.WithAllowLimitedConn(ctx, "wormhole-xfer"), remote, models.ProtoXfer)
+	if err != nil {
+		return res, err
+	}
+	defer xs.Close()
+	// ctx 结束 (如会话中再次 /bye) 时重置传输流，阻塞中的读写立即返回，对端据此中止接收
+	defer context.AfterFunc(ctx, func() { _ = xs.Reset() })()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("transfer aborted: %w", context.Cause(ctx))
+		}
+	}()
+
+	// 1. 根据类型 (file/dir/url) 创建传输提议。url 以单个文件的形式提议，响应体边下载边转发。
+	var off xferOffer
+	var body io.ReadCloser // kind 为 url 时尚未转发的响应体
+	var bodySize int64     // body 的 Content-Length，未知时为 -1
+	defer func() {
+		if body != nil {
+			_ = body.Close()
+		}
+	}()
+	switch kind {
+	case "file":
+		st, err := os.Stat(arg)
+		if err != nil {
+			return res, err
+		}
+		if !st.Mode().IsRegular() {
+			return res, fmt.Errorf("not a regular file")
+		}
+		off = xferOffer{Kind: "file", Name: filepath.Base(arg), Size: st.Size(), Path: to}
+		res.Total = 1
+	case "url":
+		resp, name, err := fetchURL(ctx, arg)
+		if err != nil {
+			return res, err
+		}
+		body, bodySize = resp.Body, resp.ContentLength
+		off = xferOffer{Kind: "file", Name: name, Size: max(bodySize, 0), SizeUnknown: bodySize < 0, Path: to}
+		res.Total = 1
+	case "dir":
+		if to != "" {
+			return res, fmt.Errorf("a suggested path can only be given for a single file")
+		}
+		files, total := planDir(arg, skipFile)
+		off = xferOffer{Kind: "dir", Name: filepath.Base(arg), Files: len(files), Size: total}
+		res.Total = len(files)
+		if asArchive {
+			off.Kind = "archive"
+			res.Total = 1
+		}
+	default:
+		return res, fmt.Errorf("unknown kind %q", kind)
+	}
+
+	// 2. 发送提议并等待对方响应。
+	b, _ := json.Marshal(off)
+	if err := writeFrame(xs, frameOffer, b); err != nil {
+		return res, err
+	}
+	typ, payload, err := readFrame(xs)
+	if err != nil {
+		return res, err
+	}
+	if typ == frameReject {
+		return res, rejectError(payload)
+	}
+	if typ == frameError {
+		return res, decodeXferError(payload)
+	}
+	if typ != frameAccept {
+		return res, fmt.Errorf("unexpected response")
+	}
+	prog := newXferProgress(progressFile, "send", off, remote, ui)
+	report := newProgressReporter("send")
+	var stats xferStats
+	digest := newTransferDigest(seed)
+	defer func() {
+		reportXferAsync(models.ReportSend, xs.Conn(), stats, len(res.Failed), err == nil)
+	}()
+
+	// 3. 初始化进度条。
+	var p *mpb.Progress
+	var fileBar, totalBar *mpb.Bar
+	if off.Size > 0 {
+		p = xferBars.acquire()
+		defer func() {
+			settleBars(fileBar, totalBar)
+			xferBars.release()
+		}()
+		if off.Kind != "file" {
+			totalBar = newTotalBar(p, off.Size)
+		}
+	} else if off.Kind == "file" && off.Size == 0 && !off.SizeUnknown {
+		ui.Infoln("note: sending empty file")
+	}
+	createdBar := func() bool { return fileBar != nil || totalBar != nil }
+
+	// 4. 定义发送单个文件的辅助函数。sendFrames 只负责写出文件头、数据块和 frameFileDone，
+	// 返回边发边算的哈希；sendOneAttempt 在此基础上等待接收方的确认。
+	// size 为 -1 时读到 EOF 为止；expectHash 为空时 (流式数据无法预先计算哈希)，
+	// 哈希在数据发送完后随 frameFileDone 一起发送。
+	// blocks 为分块哈希 (可为空)，接收方据此尽早发现损坏的块。
+	sendFrames := func(name string, r io.Reader, size int64, expectHash string, blocks []string) (string, int64, error) {
+		// 为当前文件创建或更新进度条
+		if p != nil {
+			if totalBar != nil && fileBar != nil {
+				fileBar.Abort(true)
+				fileBar.Wait()
+			}
+			if size > 0 {
+				fileBar = newFileBar(p, name, size)
+			} else {
+				fileBar = nil // 零大小文件不显示进度条
+			}
+		}
+
+		if fileBar != nil {
+			fileBar.DecoratorAverageAdjust(time.Now())
+		}
+		if totalBar != nil {
+			totalBar.DecoratorAverageAdjust(time.Now())
+		}
+
+		// 发送文件头信息 (元数据)
+		hdr := map[string]any{
+			"name": name,
+			"size": size,
+			"algo": "xxh3-128-seed",
+			"hash": expectHash,
+		}
+		if len(blocks) > 0 {
+			hdr["block_size"] = verifyBlockSize
+			hdr["blocks"] = blocks
+		}
+		b, _ := json.Marshal(hdr)
+		if err := writeFrame(xs, frameFileHdr, b); err != nil {
+			return "", 0, err
+		}
+		report.start(name, size)
+
+		// 分块发送文件数据
+		bufp := chunkBufPool.Get().(*[]byte)
+		defer chunkBufPool.Put(bufp)
+		buf := *bufp
+		var sent int64
+		hw := xxh3.NewSeed(seed)
+		for {
+			if size >= 0 && sent >= size {
+				break
+			}
+			start := time.Now()
+			n, er := r.Read(buf)
+			if n > 0 {
+				sent += int64(n)
+				_, _ = hw.Write(buf[:n])
+				if err := writeFrame(xs, frameChunk, buf[:n]); err != nil {
+					return "", 0, err
+				}
+				report.add(n)
+				// 更新进度条
+				if fileBar != nil {
+					fileBar.EwmaIncrBy(n, time.Since(start))
+				}
+				if totalBar != nil {
+					totalBar.EwmaIncrBy(n, time.Since(start))
+				}
+			}
+			if er == io.EOF {
+				break
+			}
+			if er != nil {
+				return "", 0, er
+			}
+		}
+		sum := hw.Sum128().Bytes()
+		got := fmt.Sprintf("%x", sum[:])
+		var trailer []byte
+		if expectHash == "" {
+			trailer, _ = json.Marshal(map[string]string{"hash": got})
+		}
+		if err := writeFrame(xs, frameFileDone, trailer); err != nil {
+			return "", 0, err
+		}
+		if fileBar != nil {
+			fileBar.SetTotal(size, true)
+		}
+		return got, sent, nil
+	}
+	sendOneAttempt := func(name string, r io.Reader, size int64, expectHash string, blocks []string) error {
+		got, sent, err := sendFrames(name, r, size, expectHash, blocks)
+		if err != nil {
+			report.done(name, false)
+			return err
+		}
+		// 等待接收方的确认 (ACK/NACK/ERROR)
+		typ, payload, err := readFrame(xs)
+		if err == nil {
+			err = fileResult(typ, payload, name, expectHash, got)
+		}
+		report.done(name, err == nil)
+		if err != nil {
+			return err
+		}
+		stats.add(sent)
+		res.Sent++
+		digest.add(name, got)
+		if err := prog.add(name, sent, got); err != nil {
+			ui.Logln("warn: progress file: " + err.Error())
+		}
+		return nil
+	}
+
+	// 5. 定义计算文件哈希的辅助函数，同一遍读取中计算分块哈希；不超过一个块的文件不需要分块哈希。
+	hashFile := func(path string) (string, []string, int64, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return "", nil, 0, err
+		}
+		h := xxh3.NewSeed(seed)
+		var blocks []string
+		bh := transfer.NewBlockHasher(seed, verifyBlockSize, func(_ int, sum string) error {
+			blocks = append(blocks, sum)
+			return nil
+		})
+		if _, err := io.Copy(io.MultiWriter(h, bh), f); err != nil {
+			return "", nil, 0, err
+		}
+		_ = bh.Flush()
+		if len(blocks) < 2 {
+			blocks = nil
+		}
+		sum := h.Sum128().Bytes()
+		return fmt.Sprintf("%x", sum[:]), blocks, st.Size(), nil
+	}
+
+	// 6. 开始传输。
+	failedFiles := make([]string, 0)
+	const maxRetries = 3
+
+	switch off.Kind {
+	case "file":
+		if kind == "url" {
+			// 响应体只能读一遍：哈希在转发完后随 frameFileDone 发送，重试时重新请求 URL
+			attempt := 0
+			for {
+				if body == nil {
+					var resp *http.Response
+					if resp, _, err = fetchURL(ctx, arg); err == nil {
+						body, bodySize = resp.Body, resp.ContentLength
+					}
+				}
+				if body != nil {
+					err = sendOneAttempt(off.Name, body, bodySize, "", nil)
+					_ = body.Close()
+					body = nil
+				}
+				if err == nil || attempt >= maxRetries || !retryableXferErr(err) {
+					if err != nil {
+						res.Failed = append(res.Failed, arg)
+						failedFiles = append(failedFiles, fmt.Sprintf("%s (%v)", off.Name, err))
+					}
+					break
+				}
+				attempt++
+				ui.Println(fmt.Sprintf("%v, retrying %s (%d/%d)…", err, off.Name, attempt, maxRetries))
+				time.Sleep(time.Duration(attempt) * 300 * time.Millisecond)
+			}
+			break
+		}
+		hv, blocks, sz, err := hashFile(arg)
+		if err != nil {
+			return res, err
+		}
+		if off.Size <= 0 {
+			off.Size = sz
+		}
+		attempt := 0
+		for {
+			f, er := os.Open(arg)
+			if er != nil {
+				return res, er
+			}
+			err = sendOneAttempt(off.Name, f, off.Size, hv, blocks)
+			_ = f.Close()
+			if err == nil || attempt >= maxRetries || !retryableXferErr(err) {
+				if err != nil {
+					res.Failed = append(res.Failed, arg)
+					failedFiles = append(failedFiles, fmt.Sprintf("%s (%v)", off.Name, err))
+				}
+				break
+			}
+			attempt++
+			ui.Println(fmt.Sprintf("%v, retrying %s (%d/%d)…", err, off.Name, attempt, maxRetries))
+			time.Sleep(time.Duration(attempt) * 300 * time.Millisecond)
+		}
+	case "archive":
+		// 目录实时打包为 tar 并作为一个文件发送，省去逐个文件的头部和 ACK 往返
+		name := off.Name + ".tar"
+		skip := func(p string, d fs.DirEntry) (bool, error) {
+			if skip, se := skipExcluded(arg, p, d); skip {
+				return true, se
+			}
+			return !d.IsDir() && skipFile(arg, p), nil
+		}
+		attempt := 0
+		for {
+			pr, pw := io.Pipe()
+			go func() { pw.CloseWithError(transfer.WriteTarDir(pw, arg, skip)) }()
+			err = sendOneAttempt(name, pr, -1, "", nil)
+			_ = pr.Close()
+			if err == nil || attempt >= maxRetries || !retryableXferErr(err) {
+				if err != nil {
+					res.Failed = append(res.Failed, ".")
+					failedFiles = append(failedFiles, fmt.Sprintf("%s (%v)", name, err))
+				}
+				break
+			}
+			attempt++
+			ui.Println(fmt.Sprintf("%v, retrying %s (%d/%d)…", err, name, attempt, maxRetries))
+			time.Sleep(time.Duration(attempt) * 300 * time.Millisecond)
+		}
+		if totalBar != nil {
+			totalBar.SetTotal(off.Size, true)
+		}
+	case "dir":
+		root := arg
+		// walk 依次产生目录中待发送的文件及其哈希；fn 返回 false 时停止遍历
+		walk := func(fn func(rel, path string, size int64, hv string, blocks []string) bool) {
+			filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+				if skip, se := skipExcluded(root, path, d); skip {
+					return se
+				}
+				if d.IsDir() {
+					return nil
+				}
+				if skipFile(root, path) {
+					return nil
+				}
+				rel, _ := filepath.Rel(root, path)
+				st, er := os.Stat(path)
+				if er != nil || !st.Mode().IsRegular() {
+					return nil
+				}
+				hv, blocks, _, er := hashFile(path)
+				if er != nil {
+					return nil
+				}
+				if !fn(rel, path, st.Size(), hv, blocks) {
+					return filepath.SkipAll
+				}
+				return nil
+			})
+		}
+		if ackWindow > 1 {
+			ackedFile := func(pf *pendingFile) {
+				stats.add(pf.size)
+				res.Sent++
+				digest.add(pf.rel, pf.got)
+				if err := prog.add(pf.rel, pf.size, pf.got); err != nil {
+					ui.Logln("warn: progress file: " + err.Error())
+				}
+			}
+			// 流水线模式：连续发送多个文件而不逐个等待 ACK，失败的文件在整轮结束后统一重试
+			queue, perr := sendDirPipelined(xs, ackWindow, maxRetries, func(send func(*pendingFile) bool) {
+				walk(func(rel, path string, size int64, hv string, blocks []string) bool {
+					return send(&pendingFile{rel: rel, path: path, size: size, hash: hv, blocks: blocks})
+				})
+			}, sendFrames, report, ackedFile, &res.Failed, &failedFiles)
+			for attempt := 1; perr == nil && len(queue) > 0; attempt++ {
+				for _, pf := range queue {
+					pf.attempt = attempt
+					ui.Println(fmt.Sprintf("%v, retrying %s (%d/%d)…", pf.err, pf.rel, attempt, maxRetries))
+				}
+				time.Sleep(time.Duration(attempt) * 300 * time.Millisecond)
+				retry := queue
+				queue, perr = sendDirPipelined(xs, ackWindow, maxRetries, func(send func(*pendingFile) bool) {
+					for _, pf := range retry {
+						if !send(pf) {
+							return
+						}
+					}
+				}, sendFrames, report, ackedFile, &res.Failed, &failedFiles)
+			}
+			if perr != nil {
+				return res, perr
+			}
+		} else {
+			walk(func(rel, path string, size int64, hv string, blocks []string) bool {
+				attempt := 0
+				for {
+					f, er := os.Open(path)
+					if er != nil {
+						return true
+					}
+					e := sendOneAttempt(rel, f, size, hv, blocks)
+					_ = f.Close()
+					if e == nil || attempt >= maxRetries || !retryableXferErr(e) {
+						if e != nil {
+							res.Failed = append(res.Failed, rel)
+							failedFiles = append(failedFiles, fmt.Sprintf("%s (%v)", rel, e))
+							if fatalXferErr(e) {
+								return false // 对端无法再接收任何文件
+							}
+						}
+						return true
+					}
+					attempt++
+					ui.Println(fmt.Sprintf("%v, retrying %s (%d/%d)…", e, rel, attempt, maxRetries))
+					time.Sleep(time.Duration(attempt) * 300 * time.Millisecond)
+				}
+			})
+		}
+		if totalBar != nil {
+			totalBar.SetTotal(off.Size, true)
+		}
+	}
+
+	// 7. 发送传输结束信号 (附带传输摘要，由接收方比对) 并清理。
+	done, _ := json.Marshal(xferDone{Digest: digest.hex()})
+	if err := writeFrame(xs, frameXferDone, done); err != nil {
+		return res, err
+	}
+	if p != nil && createdBar() {
+		settleBars(fileBar, totalBar)
+		ui.Refresh()
+	}
+	_ = xs.CloseWrite()
+	prog.finish(res.Outcome() == xferAllOK)
+	if showDigest {
+		ui.Println("transfer digest: " + digest.hex())
+	}
+	if len(failedFiles) > 0 {
+		ui.Println("some files were not delivered:")
+		for _, f := range failedFiles {
+			ui.Println("  - " + f)
+		}
+	}
+	if res.Outcome() != xferAllOK {
+		return res, &xferIncompleteError{Result: res}
+	}
+	return res, nil
+}
+
+// pendingFile 是流水线发送中已写出、等待接收方回复的文件。
+type pendingFile struct {
+	rel, path string
+	size      int64
+	hash      string
+	blocks    []string
+	attempt   int    // 已重试的次数
+	got       string // 发送时计算的哈希
+	err       error  // 上一次发送的结果
+}
+
+// sendDirPipelined 经 transfer.Pipeline 连续发送 feed 产生的文件，最多 window 个文件处于未确认状态。
+// 接收方回复中回显的文件名与队首不符时视为顺序错乱，中止整个传输。可重试且未超过 maxRetries
+// 的失败文件作为 retry 返回，其余失败记入 failed/failedFiles；确认送达的文件依次交给 acked。
+// 每个文件的结果同时报告给 report。读取回复出错或顺序错乱时返回 err。
+func sendDirPipelined(xs network.Stream, window, maxRetries int, feed func(send func(*pendingFile) bool),
+	sendFrames func(name string, r io.Reader, size int64, expectHash string, blocks []string) (string, int64, error),
+	report progressReporter, acked func(*pendingFile), failed, failedFiles *[]string) (retry []*pendingFile, err error) {
+	fatal := false
+	write := func(pf *pendingFile) (bool, error) {
+		f, err := os.Open(pf.path)
+		if err != nil {
+			return false, nil
+		}
+		defer f.Close()
+		if pf.got, _, err = sendFrames(pf.rel, f, pf.size, pf.hash, pf.blocks); err != nil {
+			report.done(pf.rel, false)
+			return false, err
+		}
+		return true, nil
+	}
+	reply := func(pf *pendingFile) (bool, error) {
+		typ, payload, err := readFrame(xs)
+		if err != nil {
+			return true, err
+		}
+		e := fileResult(typ, payload, pf.rel, pf.hash, pf.got)
+		if errors.Is(e, errAckOutOfOrder) {
+			return true, e
+		}
+		if e == nil {
+			report.done(pf.rel, true)
+			acked(pf)
+			return false, nil
+		}
+		report.done(pf.rel, false)
+		pf.err = e
+		if fatalXferErr(e) {
+			fatal = true
+		}
+		if !fatal && retryableXferErr(e) && pf.attempt < maxRetries {
+			retry = append(retry, pf)
+		} else {
+			*failed = append(*failed, pf.rel)
+			*failedFiles = append(*failedFiles, fmt.Sprintf("%s (%v)", pf.rel, e))
+		}
+		return fatal, nil
+	}
+	if err := transfer.Pipeline(window, feed, write, reply); err != nil {
+		return nil, err
+	}
+	if fatal {
+		// 对端已无法接收，等待重试的文件也不再重试
+		for _, pf := range retry {
+			*failed = append(*failed, pf.rel)
+			*failedFiles = append(*failedFiles, fmt.Sprintf("%s (%v)", pf.rel, pf.err))
+		}
+		retry = nil
+	}
+	return retry, nil
+}
+
+// promptReq 用于在主输入循环和需要用户输入的其他协程之间传递请求。
+type promptReq struct {
+	question string
+	resp     chan bool
+}
+
+// tryDequeuePrompt 尝试从通道中非阻塞地取出一个提示请求。
+func tryDequeuePrompt(ch chan *promptReq) *promptReq {
+	select {
+	case p := <-ch:
+		return p
+	default:
+		return nil
+	}
+}
+
+// xferQueue 串行化同一会话中同一方向的多个传输：同一时刻只处理一个，其余的依次等待，
+// 避免接受提示互相交错。发送与接收各用一个队列，两个方向可以同时进行。
+type xferQueue chan struct{}
+
+func newXferQueue() xferQueue { return make(xferQueue, 1) }
+
+// run 轮到当前传输时执行 fn，需要排队时先调用一次 onWait。
+// 轮到之前 ctx 已结束则不执行 fn 并返回 false。
+func (q xferQueue) run(ctx context.Context, onWait func(), fn func()) bool {
+	select {
+	case q <- struct{}{}:
+	default:
+		onWait()
+		select {
+		case q <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	defer func() { <-q }()
+	fn()
+	return true
+}
+
+// handleIncomingXfer 处理接收文件或目录的逻辑。
+// 每次调用只使用自己的局部状态，可以并发调用；但 ui 与 askYesNo 由调用方共享，
+// 会话中应通过 xferQueue 串行化，以免进度条与提示交错。
+func handleIncomingXfer(ctx context.Context, _ host.Host, xs network.Stream, dest xferDest, askYesNo func(q string, timeout time.Duration) bool, ui *uiConsole, seed uint64) {
+	defer xs.Close()
+	// ctx 结束 (如对端关闭了聊天) 时重置传输流，正在进行的接收随之中止
+	defer context.AfterFunc(ctx, func() { _ = xs.Reset() })()
+	// 1. 读取传输提议。
+	typ, payload, err := readFrame(xs)
+	if err != nil || typ != frameOffer {
+		return
+	}
+	var off xferOffer
+	if err = json.Unmarshal(payload, &off); err == nil {
+		err = off.validate()
+	}
+	if err != nil {
+		ui.Logln("xfer refused: " + err.Error())
+		_ = writeFrame(xs, frameError, (&xferError{Code: xferErrProtocol, Message: err.Error()}).payload())
+		return
+	}
+
+	// 确定保存位置；模板展开后的路径不能逃逸出保存目录
+	baseDir, err := dest.baseDir(off, xs.Conn().RemotePeer(), time.Now())
+	if err != nil {
+		ui.Logln("xfer refused: " + err.Error())
+		_ = writeFrame(xs, frameError, (&xferError{Code: xferErrProtocol, Message: err.Error()}).payload())
+		return
+	}
+
+	// 发送方为单个文件建议的保存位置：-honor-suggested-path 时采用 (规整后)，否则只做提示
+	var suggested string
+	if off.Path != "" {
+		if rel, err := cleanSuggestedPath(off.Path); err != nil {
+			ui.Logln("ignoring " + err.Error())
+		} else if dest.honorPath {
+			suggested = rel
+		} else {
+			ui.Logln(fmt.Sprintf("peer suggested saving as %q; ignored (see -honor-suggested-path)", filepath.ToSlash(rel)))
+		}
+	}
+
+	// 保存目录不可写时直接拒绝，不必让用户确认后再在传输中途失败
+	if err := checkOutDir(dest.outDir); err != nil {
+		ui.Logln("xfer refused: " + err.Error())
+		_ = writeFrame(xs, frameError, newXferIOError(err).payload())
+		return
+	}
+
+	// 2. 询问用户是否接受。
+	info := ""
+	switch off.Kind {
+	case "file":
+		info = fmt.Sprintf("Peer wants to send file %q (%d bytes).", off.Name, off.Size)
+		if off.SizeUnknown {
+			info = fmt.Sprintf("Peer wants to send file %q (size unknown, streamed).", off.Name)
+		}
+		if suggested != "" {
+			info = fmt.Sprintf("Peer wants to send file %q (%d bytes) as %q.", off.Name, off.Size, filepath.ToSlash(suggested))
+		}
+	case "dir":
+		info = fmt.Sprintf("Peer wants to send directory %q (%d files, total %d bytes).", off.Name, off.Files, off.Size)
+	case "archive":
+		info = fmt.Sprintf("Peer wants to send directory %q as a single tar stream (%d files, total %d bytes).", off.Name, off.Files, off.Size)
+	}
+	ui.Logln(info)
+	const askTimeout = 30 * time.Second
+	asked := time.Now()
+	if !askYesNo("Accept? [y/N]: ", askTimeout) {
+		rj := xferReject{Reason: rejectDeclined}
+		if time.Since(asked) >= askTimeout {
+			rj.Reason = rejectNoAnswer
+		}
+		b, _ := json.Marshal(rj)
+		_ = writeFrame(xs, frameReject, b)
+		return
+	}
+	// -outdir-by-code：会话子目录仅对当前用户可访问
+	if dest.byCode {
+		root, _ := dest.root()
+		if err := os.MkdirAll(root, 0o700); err != nil {
+			ui.Logln("xfer refused: " + err.Error())
+			_ = writeFrame(xs, frameError, newXferIOError(err).payload())
+			return
+		}
+	}
+	// 归档模式：目录中的文件写入 <baseDir>.<tar|zip>，在 frameXferDone 时完成
+	var arc *transfer.ArchiveWriter
+	if (off.Kind == "dir" || off.Kind == "archive") && dest.archive != "" {
+		if arc, err = transfer.NewArchiveWriter(dest.archive, baseDir+"."+dest.archive); err != nil {
+			ui.Logln("xfer refused: " + err.Error())
+			_ = writeFrame(xs, frameError, newXferIOError(err).payload())
+			return
+		}
+		defer func() {
+			if arc != nil { // 传输未正常结束
+				arc.Abort()
+			}
+		}()
+	}
+	if err := writeFrame(xs, frameAccept, nil); err != nil {
+		return
+	}
+	prog := newXferProgress(dest.progressFile, "recv", off, xs.Conn().RemotePeer(), ui)
+	report := newProgressReporter("recv")
+
+	// 3. 初始化进度条。
+	var p *mpb.Progress
+	var fileBar, totalBar *mpb.Bar
+	if off.Size > 0 {
+		p = xferBars.acquire()
+		defer func() {
+			settleBars(fileBar, totalBar)
+			xferBars.release()
+		}()
+		if off.Kind == "file" {
+			fileBar = newFileBar(p, off.Name, off.Size)
+		} else {
+			totalBar = newTotalBar(p, off.Size)
+		}
+	}
+	createdBar := func() bool { return p != nil && (fileBar != nil || totalBar != nil) }
+
+	// 4. 循环处理接收到的帧。
+	// 数据先写入 dstPath + partSuffix (或 -temp-dir 下的临时文件)，校验通过后才移动为 dstPath，
+	// 因此最终文件名下的文件一定是完整且经过校验的。
+	var fw *partWriter
+	var dstPath, partPath, curName string
+	defer func() {
+		if fw != nil { // 传输中断：保留 .part 文件，不产生截断的最终文件
+			_ = fw.Close()
+		}
+	}()
+	// commit 将通过校验的临时文件落盘：tar 流解包 (或转存进归档)，普通文件重命名 (或写入归档)
+	commit := func(closeErr error) error {
+		if off.Kind == "archive" {
+			if closeErr != nil {
+				return closeErr
+			}
+			return transfer.UnpackTar(partPath, baseDir, arc)
+		}
+		return finalizePart(closeErr, arc, partPath, dstPath, curName)
+	}
+	var expectHash string
+	var algo string
+	var curSize, curWritten int64        // 当前文件头声明的大小 (流式数据为 -1) 与已写入的字节数
+	var fileErr *xferError               // 当前文件的写入错误，在 frameFileDone 时报告给发送方
+	var blockCheck *transfer.BlockHasher // 当前文件的分块校验，发送方未提供分块哈希时为 nil
+	failedFiles := make([]string, 0)
+	var stats xferStats
+	completed := false // 收到 frameXferDone 且全部文件都已保存
+	defer func() {
+		reportXferAsync(models.ReportRecv, xs.Conn(), stats, len(failedFiles), completed)
+	}()
+	hasher := xxh3.NewSeed(seed)
+	digest := newTransferDigest(seed)
+	lastTick := time.Now()
+	// 帧内容读入复用的缓冲区：每个 payload 在读取下一帧之前都已处理完毕 (写盘或解析)
+	bufp := chunkBufPool.Get().(*[]byte)
+	defer chunkBufPool.Put(bufp)
+
+	for {
+		typ, payload, err = readFrameInto(xs, *bufp)
+		if err != nil {
+			cause := err
+			if ctx.Err() != nil {
+				cause = context.Cause(ctx)
+			}
+			if fw != nil {
+				ui.Println(fmt.Sprintf("✗ receive aborted (%v); incomplete file kept as %s", cause, partPath))
+			} else {
+				ui.Println(fmt.Sprintf("✗ receive aborted (%v)", cause))
+			}
+			return
+		}
+		switch typ {
+		case frameFileHdr: // 收到文件头，准备写入文件
+			var hdr struct {
+				Name string `json:"name"`
+				Size int64  `json:"size"`
+				Algo string `json:"algo"`
+				Hash string `json:"hash"`
+				// 可选的分块哈希，旧版本发送方不提供
+				BlockSize int64    `json:"block_size"`
+				Blocks    []string `json:"blocks"`
 			}
 			_ = json.Unmarshal(payload, &hdr)
-			dstPath = filepath.Join(baseDir, hdr.Name)
-			_ = os.MkdirAll(filepath.Dir(dstPath), 0o755)
-			fw, err = os.Create(dstPath)
-			if err != nil {
-				_ = writeFrame(xs, frameError, []byte(err.Error()))
+			// 文件名由对端提供，只能是保存目录内的相对路径 (-outdir-by-code 时也不能逃出密码牌目录)
+			if !filepath.IsLocal(filepath.FromSlash(hdr.Name)) {
+				msg := fmt.Sprintf("unsafe file name %q", hdr.Name)
+				ui.Logln("xfer refused: " + msg)
+				_ = writeFrame(xs, frameError, (&xferError{Code: xferErrProtocol, Message: msg}).payload())
 				return
 			}
+			blockCheck = nil
+			if hdr.BlockSize > 0 && len(hdr.Blocks) > 0 {
+				blockCheck = transfer.ExpectBlocks(seed, hdr.BlockSize, hdr.Blocks)
+			}
+			dstPath = filepath.Join(baseDir, hdr.Name)
+			if suggested != "" {
+				dstPath = filepath.Join(baseDir, suggested)
+			}
+			curName = hdr.Name
+			curSize = hdr.Size
+			curWritten = 0
+			fileErr = nil
+			if arc != nil || off.Kind == "archive" {
+				// 归档模式或 tar 流：先暂存到临时文件，校验通过后再写入归档或解包
+				tmpDir := filepath.Dir(baseDir)
+				if dest.tempDir != "" {
+					tmpDir = dest.tempDir
+				} else if arc != nil {
+					tmpDir = filepath.Dir(arc.Path())
+				}
+				if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+					fileErr = newXferIOError(err)
+				} else if f, err := os.CreateTemp(tmpDir, ".wormhole-*"+partSuffix); err != nil {
+					fileErr = newXferIOError(err)
+				} else {
+					fw = newPartWriter(f, writeBufSize)
+					partPath = f.Name()
+				}
+			} else if dest.tempDir != "" {
+				// -temp-dir：临时文件写在别处，校验通过后由 movePart 移动 (必要时跨文件系统复制)
+				if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+					fileErr = newXferIOError(err)
+				} else if f, err := os.CreateTemp(dest.tempDir, ".wormhole-*"+partSuffix); err != nil {
+					fileErr = newXferIOError(err)
+				} else {
+					fw = newPartWriter(f, writeBufSize)
+					partPath = f.Name()
+				}
+			} else {
+				partPath = dstPath + partSuffix
+				if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+					fileErr = newXferIOError(err)
+				} else if f, err := os.Create(partPath); err != nil {
+					fileErr = newXferIOError(err)
+				} else {
+					fw = newPartWriter(f, writeBufSize)
+				}
+			}
 			expectHash = strings.ToLower(strings.TrimSpace(hdr.Hash))
 			algo = strings.ToLower(strings.TrimSpace(hdr.Algo))
 			hasher.Reset()
 			lastTick = time.Now()
+			report.start(curName, curSize)
 
 			// 更新当前文件的进度条
 			if p != nil {
@@ -634,9 +2415,47 @@ func handleIncomingXfer(_ context.Context, _ host.Host, xs network.Stream, outDi
 			}
 
 		case frameChunk: // 收到数据块，写入文件并更新哈希
+			if fw == nil && fileErr == nil {
+				_ = writeFrame(xs, frameError, (&xferError{Code: xferErrProtocol, Message: "chunk before file header"}).payload())
+				return
+			}
 			if fw != nil {
-				_, _ = fw.Write(payload)
+				if _, err := fw.Write(payload); err != nil {
+					// 写入失败：丢弃该文件的剩余数据块，在 frameFileDone 时报告
+					fileErr = newXferIOError(err)
+					_ = fw.Close()
+					fw = nil
+					_ = os.Remove(partPath)
+					continue
+				}
+				curWritten += int64(len(payload))
+				report.add(len(payload))
 				_, _ = hasher.Write(payload)
+				if blockCheck != nil {
+					done := blockCheck.Blocks()
+					if _, err := blockCheck.Write(payload); err != nil {
+						// 某个块已损坏：立即删除临时文件，丢弃剩余数据块，在 frameFileDone 时请求重传
+						fileErr = &xferError{Code: xferErrHashMismatch, Message: err.Error()}
+						_ = fw.Close()
+						fw = nil
+						if kept := discardPart(partPath, dstPath, dest.keepFailed); kept != "" {
+							ui.Println(fmt.Sprintf("✗ %v, aborting, kept: %s", err, kept))
+						} else {
+							ui.Println(fmt.Sprintf("✗ %v, aborting: %s", err, dstPath))
+						}
+						continue
+					}
+					// 有块通过校验时立即写盘：临时文件中总是包含全部已校验的块，与不带缓冲写入时一致
+					if blockCheck.Blocks() != done {
+						if err := fw.Flush(); err != nil {
+							fileErr = newXferIOError(err)
+							_ = fw.Close()
+							fw = nil
+							_ = os.Remove(partPath)
+							continue
+						}
+					}
+				}
 				now := time.Now()
 				dt := now.Sub(lastTick)
 				lastTick = now
@@ -648,46 +2467,130 @@ func handleIncomingXfer(_ context.Context, _ host.Host, xs network.Stream, outDi
 				}
 			}
 		case frameFileDone: // 单个文件接收完成，校验哈希
-			if fw != nil {
-				_ = fw.Close()
+			if expectHash == "" && len(payload) > 0 {
+				// 流式数据的哈希在数据之后随 frameFileDone 发送
+				var trailer struct {
+					Hash string `json:"hash"`
+				}
+				_ = json.Unmarshal(payload, &trailer)
+				expectHash = strings.ToLower(strings.TrimSpace(trailer.Hash))
+			}
+			// 回复中回显文件名，流水线发送的一方据此核对回复与文件的对应关系
+			reply, _ := json.Marshal(fileReply{Name: curName})
+			fileOK := false
+			if fileErr != nil {
+				fileErr.Name = curName
+				_ = writeFrame(xs, frameError, fileErr.payload())
+				failedFiles = append(failedFiles, dstPath)
+				if fileErr.Code != xferErrHashMismatch { // 分块校验失败时已提示过
+					ui.Println(fmt.Sprintf("✗ write failed [%s], discarded: %s", fileErr.Code, dstPath))
+				}
+				fileErr = nil
+			} else if fw != nil {
+				cerr := fw.Close()
 				fw = nil
+				if curSize < 0 { // 流式数据 (tar 流、未知大小的 URL) 以实际写入的字节数计
+					curSize = curWritten
+				}
 				sumBytes := hasher.Sum128().Bytes()
 				got := fmt.Sprintf("%x", sumBytes[:])
-				if algo != "xxh3-128-seed" || (expectHash != "" && got != expectHash) {
-					// 校验失败，删除文件并发送 NACK
-					_ = os.Remove(dstPath)
-					_ = writeFrame(xs, frameFileNack, nil)
+				var blockErr error
+				if blockCheck != nil {
+					blockErr = blockCheck.Flush()
+				}
+				if algo != "xxh3-128-seed" || (expectHash != "" && got != expectHash) || blockErr != nil {
+					// 校验失败，删除 (或按 -keep-failed 保留) 临时文件并发送 NACK
+					kept := discardPart(partPath, dstPath, dest.keepFailed)
+					_ = writeFrame(xs, frameFileNack, reply)
+					failedFiles = append(failedFiles, dstPath)
+					if kept != "" {
+						ui.Println("✗ hash mismatch, kept: " + kept)
+					} else {
+						ui.Println("✗ hash mismatch, removed: " + dstPath)
+					}
+				} else if err := commit(cerr); err != nil {
+					// 校验通过但无法落盘为最终文件名
+					_ = os.Remove(partPath)
+					xe := newXferIOError(err)
+					xe.Name = curName
+					_ = writeFrame(xs, frameError, xe.payload())
 					failedFiles = append(failedFiles, dstPath)
-					ui.Println("✗ hash mismatch, removed: " + dstPath)
+					ui.Println(fmt.Sprintf("✗ write failed [%s], discarded: %s", xe.Code, dstPath))
 				} else {
 					// 校验成功，发送 ACK
+					fileOK = true
 					if fileBar != nil {
 						fileBar.SetTotal(fileBar.Current(), true)
 					}
-					_ = writeFrame(xs, frameFileAck, nil)
-					ui.Println("← received: " + dstPath)
+					_ = writeFrame(xs, frameFileAck, reply)
+					stats.add(curSize)
+					digest.add(curName, got)
+					if err := prog.add(curName, curSize, got); err != nil {
+						ui.Logln("warn: progress file: " + err.Error())
+					}
+					saved := dstPath
+					if off.Kind == "archive" && arc == nil {
+						saved = baseDir
+						ui.Println("← unpacked: " + baseDir)
+					} else if arc != nil {
+						saved = filepath.Join(arc.Path(), curName)
+						ui.Println("← archived: " + curName)
+					} else {
+						ui.Println("← received: " + dstPath)
+					}
+					if dest.index {
+						rel, _ := filepath.Rel(dest.outDir, saved)
+						rec := transfer.DownloadRecord{Time: time.Now().UTC(), Peer: xs.Conn().RemotePeer().String(), Path: filepath.ToSlash(rel), Size: curSize, Algo: algo, Hash: got}
+						if err := transfer.AppendDownloadRecord(dest.outDir, rec); err != nil {
+							ui.Logln("warn: download index: " + err.Error())
+						}
+					}
 				}
 			}
+			report.done(curName, fileOK)
 		case frameXferDone: // 全部传输完成，清理并退出
+			arcOK := true
+			if arc != nil {
+				if err := arc.Close(); err != nil {
+					arcOK = false
+					ui.Println("✗ archive failed: " + err.Error())
+				} else {
+					ui.Println("← saved archive: " + arc.Path())
+				}
+				arc = nil
+			}
+			// 比对发送方的传输摘要；旧版本发送方不提供时跳过
+			var sd xferDone
+			_ = json.Unmarshal(payload, &sd)
+			digestOK := sd.Digest == "" || strings.EqualFold(sd.Digest, digest.hex())
+			if !digestOK {
+				ui.Println(fmt.Sprintf("✗ transfer digest mismatch: peer %s, local %s (files missing or out of order)", sd.Digest, digest.hex()))
+			} else if showDigest {
+				ui.Println("transfer digest: " + digest.hex())
+			}
+			completed = arcOK && digestOK && len(failedFiles) == 0
+			prog.finish(completed)
 			if len(failedFiles) > 0 {
-				ui.Println("warning: integrity check failed for the following files (removed):")
+				ui.Println("warning: the following files were not saved (removed):")
 				for _, f := range failedFiles {
 					ui.Println("  - " + f)
 				}
 			}
 			if p != nil && createdBar() {
-				p.Wait()
+				settleBars(fileBar, totalBar)
 				ui.Refresh()
 			}
 			return
 		case frameError: // 收到错误信息
-			ui.Println("← xfer error: " + string(payload))
+			xe := decodeXferError(payload)
+			ui.Println(fmt.Sprintf("← xfer error [%s]: %s", xe.Code, xe.Message))
 			if p != nil && createdBar() {
-				p.Wait()
+				settleBars(fileBar, totalBar)
 				ui.Refresh()
 			}
 			return
 		default:
+			_ = writeFrame(xs, frameError, (&xferError{Code: xferErrProtocol, Message: fmt.Sprintf("unexpected frame 0x%02x", typ)}).payload())
 			return
 		}
 	}
@@ -695,8 +2598,43 @@ func handleIncomingXfer(_ context.Context, _ host.Host, xs network.Stream, outDi
 
 // ---------- 聊天会话 (/chat) ----------
 
-// askYesNoWithReadline 向用户提问并等待 y/N 回答，有超时。
-func askYesNoWithReadline(ui *uiConsole, question string, timeout time.Duration, defaultNo bool) bool {
+// idleWatch 在会话无活动超过 timeout 时调用一次 onIdle；busy 返回 true 时 (如文件传输进行中) 不视为空闲。
+// done 关闭时返回。
+func idleWatch(done <-chan struct{}, timeout time.Duration, lastActive func() time.Time, busy func() bool, onIdle func()) {
+	for {
+		wait := time.Until(lastActive().Add(timeout))
+		if wait <= 0 {
+			if !busy() {
+				onIdle()
+				return
+			}
+			wait = timeout
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// xferIdlePoll 是 /bye 等待进行中的传输结束时的检查间隔
+const xferIdlePoll = 200 * time.Millisecond
+
+// waitXfersIdle 等待 active() 降为 0 后返回 true；done 先关闭 (会话已因其他原因结束) 时返回 false。
+func waitXfersIdle(done <-chan struct{}, active func() int32, every time.Duration) bool {
+	for active() > 0 {
+		select {
+		case <-done:
+			return false
+		case <-time.After(every):
+		}
+	}
+	return true
+}
+
+// askYesNoWithReadline 向用户提问并等待 y/N 回答，有超时；ctx 取消（如收到信号）时视为拒绝。
+func askYesNoWithReadline(ctx context.Context, ui *uiConsole, question string, timeout time.Duration, defaultNo bool) bool {
 	restore := ui.PromptQuestionAndRestore(question)
 	defer restore()
 
@@ -716,13 +2654,180 @@ func askYesNoWithReadline(ui *uiConsole, question string, timeout time.Duration,
 	case <-time.After(timeout):
 		ui.Println("")
 		return !defaultNo
+	case <-ctx.Done():
+		ui.Println("")
+		return false
+	}
+}
+
+// askSASWithReadline 要求用户键入对端屏幕上显示的 SAS，只有与本端 sas 一致才返回 true；
+// 超时、ctx 取消或输入不符都视为拒绝。
+func askSASWithReadline(ctx context.Context, ui *uiConsole, question string, timeout time.Duration, sas string) bool {
+	restore := ui.PromptQuestionAndRestore(question)
+	defer restore()
+
+	ansCh := make(chan string, 1)
+	go func() {
+		line, err := ui.Readline()
+		if err != nil {
+			ansCh <- ""
+			return
+		}
+		ansCh <- line
+	}()
+	select {
+	case a := <-ansCh:
+		if sasEntryMatches(a, sas) {
+			return true
+		}
+		ui.Println("✗ the SAS you typed does not match ours")
+		return false
+	case <-time.After(timeout):
+		ui.Println("")
+		return false
+	case <-ctx.Done():
+		ui.Println("")
+		return false
+	}
+}
+
+// sasEntryMatches 报告用户键入的 entry 是否与本端 SAS 一致。entry 可以是 emoji，也可以是
+// 卡片上 "No." 一行的序号 (crypto.SASDigits)；忽略空白、'-'、',' 与 emoji 变体选择符
+// (U+FE0F)，后者常被输入法和终端随意增删。
+func sasEntryMatches(entry, sas string) bool {
+	norm := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) || r == '-' || r == ',' || r == '\uFE0F' {
+				return -1
+			}
+			return r
+		}, s)
+	}
+	e := norm(entry)
+	if e == "" {
+		return false
+	}
+	return e == norm(sas) || e == norm(crypto.SASDigits(sas))
+}
+
+// cardSAS 返回验证卡片上显示的 SAS。-strict-sas 时本端要键入对端显示的 SAS，
+// 不能同时看到自己的，否则照抄即可通过核对。
+func cardSAS(sas string) string {
+	if strictSAS {
+		return ""
+	}
+	return sas
+}
+
+// confirmPeer 请用户确认对端：-strict-sas 时必须在 30 秒内键入对端显示的 SAS，否则以 yesNo 提问 y/N。
+func confirmPeer(ctx context.Context, ui *uiConsole, yesNo, sas string) bool {
+	if strictSAS {
+		prompt := fmt.Sprintf("%s Type the SAS (emoji or No.) shown on the peer's screen within 30s: ", ts())
+		return askSASWithReadline(ctx, ui, prompt, 30*time.Second, sas)
+	}
+	return askYesNoWithReadline(ctx, ui, yesNo, 30*time.Second, true)
+}
+
+// verifyMode 决定握手时哪一方必须人工核对 SAS 并确认 (-verify-mode)。SAS 始终显示。
+type verifyMode string
+
+const (
+	verifyBoth       verifyMode = "both"
+	verifyDialerOnly verifyMode = "dialer-only"
+	verifyHostOnly   verifyMode = "host-only"
+	verifyNone       verifyMode = "none"
+)
+
+// parseVerifyMode 解析 -verify-mode；为空时按旧的 -verify 推导：
+// host 总要确认，-verify 决定连接方是否也要确认。
+func parseVerifyMode(s string, verify bool) (verifyMode, error) {
+	switch m := verifyMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "":
+		if verify {
+			return verifyBoth, nil
+		}
+		return verifyHostOnly, nil
+	case verifyBoth, verifyDialerOnly, verifyHostOnly, verifyNone:
+		return m, nil
 	}
+	return "", fmt.Errorf("unknown mode %q (want both|dialer-only|host-only|none)", s)
+}
+
+// confirms 报告该模式下本端 (dialer 为连接方) 是否需要人工确认。
+func (m verifyMode) confirms(dialer bool) bool {
+	switch m {
+	case verifyBoth:
+		return true
+	case verifyDialerOnly:
+		return dialer
+	case verifyHostOnly:
+		return !dialer
+	}
+	return false
+}
+
+// verifyNoneWarning 是 -verify-mode none 的安全警告：双方都不核对 SAS 时，
+// 中间人只要猜中代码即可冒充对端，且没有人会发现。
+const verifyNoneWarning = "WARNING: -verify-mode none: nobody confirms the SAS, so a man-in-the-middle who guesses the code goes unnoticed. Use only between machines you fully trust."
+
+// autoAcceptNote 是本端无需确认时打印的提示；none 模式下换成安全警告。
+func autoAcceptNote(m verifyMode) string {
+	if m == verifyNone {
+		return c(verifyNoneWarning, cBold)
+	}
+	return fmt.Sprintf("%s peer accepted without local confirmation (-verify-mode %s); compare the SAS with the peer anyway.", ts(), m)
+}
+
+// acceptLine 构造握手确认行；启用 -sas-check 时附带本端 SAS 的交叉校验标签。
+func acceptLine(lb crypto.Labels, K, tr []byte, sas, side string) string {
+	if !sasCheck {
+		return models.ChatAccept
+	}
+	return models.ChatAccept + " " + hex.EncodeToString(lb.SASCheckTag(K, tr, sas, side))
+}
+
+// splitAck 将对端的确认行拆分为控制令牌和可选的 SAS 校验标签。
+func splitAck(line string) (tok, tag string) {
+	fs := strings.Fields(line)
+	if len(fs) > 0 {
+		tok = fs[0]
+	}
+	if len(fs) > 1 {
+		tag = fs[1]
+	}
+	return tok, tag
+}
+
+// checkPeerSAS 使用本端的 SAS 校验对端 (角色 peerSide) 发来的交叉校验标签。
+// 对端未附带标签时，仅在本端启用 -sas-check 时视为失败。
+func checkPeerSAS(lb crypto.Labels, K, tr []byte, sas, peerSide, tag string) error {
+	if tag == "" {
+		if sasCheck {
+			return fmt.Errorf("peer sent no SAS check (enable -sas-check on both sides)")
+		}
+		return nil
+	}
+	raw, err := hex.DecodeString(tag)
+	if err != nil || !lb.VerifySASCheckTag(K, tr, sas, peerSide, raw) {
+		return fmt.Errorf("SAS cross-check mismatch, aborting")
+	}
+	return nil
+}
+
+// sessionSecrets 按协商的协议版本从共享密钥派生聊天摘要、SAS 和文件传输哈希种子。
+func sessionSecrets(lb crypto.Labels, K []byte, nameplate string, local, remote peer.ID) (trChat []byte, sas string, seed uint64) {
+	seed = lb.XferSeedFromKey(K, lb.BuildTranscript(nameplate, models.ProtoXfer, local, remote))
+	trChat = lb.BuildTranscript(nameplate, models.ProtoChat, local, remote)
+	return trChat, lb.SASFromKey(K, trChat), seed
 }
 
 // 异步向控制服务器报告会话状态
 
+// newChatConsole 创建聊天会话的控制台；测试中替换为脚本化的输入输出
+var newChatConsole = func() (*uiConsole, error) { return uipkg.NewConsole("> ") }
+
 // runAccepted 是在 P2P 连接建立后运行的核心函数，负责处理握手、聊天和文件传输。
-func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL, outDir string, verify bool, nameplate, passphrase string) {
+func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL, outDir string, vm verifyMode, nameplate, passphrase string, local localState) {
 	// 确保在上下文取消时关闭流
 	go func() {
 		<-ctx.Done()
@@ -732,21 +2837,43 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 	remote := s.Conn().RemotePeer()
 	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
 
-	ui, err := uipkg.NewConsole("> ")
+	ui, err := newChatConsole()
 	if err != nil {
 		fmt.Println("init console failed:", err)
 		_ = s.Close()
 		return
 	}
+	ui.SetQuiet(quiet)
 
 	handshakeSuccess := false
 	var xferSeed uint64 // 用于文件传输完整性校验的种子
+	var sas string      // 双方确认过的短认证字符串
 	defer func() {
 		if !handshakeSuccess {
 			postFailAsync(controlURL, nameplate)
 		}
 	}()
 
+	// 由流上协商出的协议版本选择密钥派生标签，版本未知时直接失败
+	labels, err := crypto.LabelsFor(s.Protocol())
+	if err != nil {
+		ui.Logln("handshake failed: " + err.Error())
+		_ = s.Close()
+		go ui.Close()
+		return
+	}
+
+	// 开始握手之前确认连接的加密：协商出弱加密或未知加密时中止，并记录实际使用的协议以便审计
+	cst := secLog.ConnState(s.Conn())
+	security, muxer := p2p.ConnSecurity(cst)
+	logger.Info("connection security", "security", security, "muxer", muxer, "transport", cst.Transport)
+	if err := p2p.CheckSecurity(cst); err != nil {
+		ui.Logln("aborting: " + err.Error())
+		_ = s.Close()
+		go ui.Close()
+		return
+	}
+
 	// ---------- 握手流程 ----------
 	// 包含 PAKE 协商、SAS 验证和用户确认。
 	if s.Stat().Direction == network.DirInbound {
@@ -760,19 +2887,22 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 		}
 		K, err := session.RunPAKEAndConfirm(ctx, s, false, passphrase, nameplate, models.ProtoChat, h.ID(), remote)
 		if err != nil {
-			ui.Logf("PAKE failed: %v", err)
+			logPAKEError(ui, err)
 			_ = s.Close()
 			go ui.Close()
 			return
 		}
-		// 从共享密钥派生出文件传输用的哈希种子
-		xferSeed = binary.LittleEndian.Uint64(crypto.HkdfBytes(K, "xfer-xxh3-seed", crypto.BuildTranscript(nameplate, models.ProtoXfer, h.ID(), remote), 8))
-
-		// 生成并显示 SAS，等待用户确认
-		sas := crypto.SASFromKey(K, crypto.BuildTranscript(nameplate, models.ProtoChat, h.ID(), remote))
-		uipkg.PrintPeerVerifyCard(ui, remote, sas)
-		prompt := fmt.Sprintf("%s Confirm peer within 30s [y/N]: ", ts())
-		accepted := askYesNoWithReadline(ui, prompt, 30*time.Second, true)
+		// 从共享密钥派生出文件传输用的哈希种子和 SAS，等待用户确认
+		var trChat []byte
+		trChat, sas, xferSeed = sessionSecrets(labels, K, nameplate, h.ID(), remote)
+		uipkg.PrintPeerVerifyCard(ui, remote, cardSAS(sas))
+		accepted := true
+		if vm.confirms(false) || strictSAS {
+			prompt := fmt.Sprintf("%s Confirm peer within 30s [y/N]: ", ts())
+			accepted = confirmPeer(ctx, ui, prompt, sas)
+		} else {
+			ui.Println(autoAcceptNote(vm))
+		}
 		if !accepted {
 			fmt.Fprintln(rw, models.ChatReject)
 			_ = rw.Flush()
@@ -781,7 +2911,7 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 			ui.Logln("aborted")
 			return
 		}
-		fmt.Fprintln(rw, models.ChatAccept)
+		fmt.Fprintln(rw, acceptLine(labels, K, trChat, sas, "B"))
 		if err := rw.Flush(); err != nil {
 			_ = s.Close()
 			go ui.Close()
@@ -795,8 +2925,15 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 			ui.Logln("handshake failed: peer didn't confirm in time")
 			return
 		}
-		switch strings.TrimSpace(peerAck) {
+		ackTok, ackTag := splitAck(peerAck)
+		switch ackTok {
 		case models.ChatAccept:
+			if err := checkPeerSAS(labels, K, trChat, sas, "A", ackTag); err != nil {
+				_ = s.Close()
+				go ui.Close()
+				ui.Logln("handshake failed: " + err.Error())
+				return
+			}
 			handshakeSuccess = true
 			postConsumeAsync(controlURL, nameplate)
 		case models.ChatReject:
@@ -821,28 +2958,28 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 		}
 		K, err := session.RunPAKEAndConfirm(ctx, s, true, passphrase, nameplate, models.ProtoChat, h.ID(), remote)
 		if err != nil {
-			ui.Logf("PAKE failed: %v", err)
+			logPAKEError(ui, err)
 			_ = s.Close()
 			go ui.Close()
 			return
 		}
-		xferSeed = binary.LittleEndian.Uint64(crypto.HkdfBytes(K, "xfer-xxh3-seed", crypto.BuildTranscript(nameplate, models.ProtoXfer, h.ID(), remote), 8))
-
-		sas := crypto.SASFromKey(K, crypto.BuildTranscript(nameplate, models.ProtoChat, h.ID(), remote))
-		uipkg.PrintPeerVerifyCard(ui, remote, sas)
+		var trChat []byte
+		trChat, sas, xferSeed = sessionSecrets(labels, K, nameplate, h.ID(), remote)
+		uipkg.PrintPeerVerifyCard(ui, remote, cardSAS(sas))
 		ui.Logln("Waiting for peer confirmation…")
 
 		localAccepted := true
-		if verify {
-			localAccepted = askYesNoWithReadline(ui,
-				fmt.Sprintf("%s Verify peer locally within 30s [y/N]: ", ts()),
-				30*time.Second, true)
+		if vm.confirms(true) || strictSAS {
+			localAccepted = confirmPeer(ctx, ui,
+				fmt.Sprintf("%s Verify peer locally within 30s [y/N]: ", ts()), sas)
 			if !localAccepted {
 				_ = s.Close()
 				go ui.Close()
 				ui.Logln("local reject or timeout")
 				return
 			}
+		} else {
+			ui.Println(autoAcceptNote(vm))
 		}
 		peerAck, err := session.ReadLineWithDeadline(rw, s, 30*time.Second)
 		if err != nil {
@@ -851,9 +2988,18 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 			go ui.Close()
 			return
 		}
-		switch strings.TrimSpace(peerAck) {
+		ackTok, ackTag := splitAck(peerAck)
+		switch ackTok {
 		case models.ChatAccept:
-			fmt.Fprintln(rw, models.ChatAccept)
+			if err := checkPeerSAS(labels, K, trChat, sas, "B", ackTag); err != nil {
+				fmt.Fprintln(rw, models.ChatReject)
+				_ = rw.Flush()
+				ui.Logln("handshake failed: " + err.Error())
+				_ = s.Close()
+				go ui.Close()
+				return
+			}
+			fmt.Fprintln(rw, acceptLine(labels, K, trChat, sas, "A"))
 			if err := rw.Flush(); err != nil {
 				_ = s.Close()
 				go ui.Close()
@@ -875,8 +3021,20 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 		}
 	}
 
-	pi := p2p.ClassifyPath(s.Conn())
-	uipkg.PrintConnCard(ui, pi, s.Conn().LocalMultiaddr(), s.Conn().RemoteMultiaddr(), verbose)
+	pi := classifyPath(s.Conn())
+	uipkg.PrintConnCard(ui, pi, s.Conn().LocalMultiaddr(), s.Conn().RemoteMultiaddr(), debugEnabled())
+
+	role := "connect"
+	if s.Stat().Direction == network.DirInbound {
+		role = "host"
+	}
+	if onConnect != "" {
+		env := hookEnv(role, remote, sas, pi, "")
+		go func() {
+			out, err := runHook(context.Background(), onConnect, env)
+			logHook(ui.Println, "on-connect", out, err)
+		}()
+	}
 
 	// 设置文件传输流处理器
 	promptCh := make(chan *promptReq, 4)
@@ -892,18 +3050,90 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 			return false
 		}
 	}
+	// 记录最近一次聊天或文件传输活动，用于 -idle-timeout
+	var lastActive atomic.Int64
+	var xfersActive atomic.Int32
+	touch := func() { lastActive.Store(time.Now().UnixNano()) }
+	touch()
+	// goXfer 在后台协程中运行传输 fn。计数在启动协程之前就已增加，紧随其后的 /bye 与空闲检查不会漏掉它
+	goXfer := func(fn func()) {
+		xfersActive.Add(1)
+		touch()
+		go func() {
+			defer func() {
+				touch()
+				xfersActive.Add(-1)
+			}()
+			fn()
+		}()
+	}
+
+	// 会话中的传输使用 xferCtx：再次 /bye、^C 或对端关闭聊天时取消，进行中的传输随之中止
+	xferCtx, cancelXfers := context.WithCancelCause(ctx)
+	defer cancelXfers(errors.New("session ended"))
+
+	// 保存目录可在会话中用 /outdir 修改，只影响之后开始的接收
+	var saveDir struct {
+		sync.Mutex
+		dir string
+	}
+	saveDir.dir = outDir
+
+	// 对端可能同时发起多个传输，每个流一个协程，在 recvQueue 中排队依次处理
+	recvQueue := newXferQueue()
 	h.SetStreamHandler(models.ProtoXfer, func(xs network.Stream) {
-		go handleIncomingXfer(ctx, h, xs, outDir, askYesNo, ui, xferSeed)
+		goXfer(func() {
+			ok := recvQueue.run(xferCtx, func() {
+				ui.Infoln("another incoming transfer is in progress; this one will start when it finishes")
+			}, func() {
+				saveDir.Lock()
+				dir := saveDir.dir
+				saveDir.Unlock()
+				dest := xferDest{outDir: dir, template: outTemplate, nameplate: nameplate, archive: archiveFormat, byCode: outdirByCode, index: !noIndex, keepFailed: keepFailed, progressFile: progressFile, honorPath: honorSuggestedPath, tempDir: tempDir}
+				handleIncomingXfer(xferCtx, h, xs, dest, askYesNo, ui, xferSeed)
+			})
+			if !ok {
+				_ = xs.Reset()
+			}
+		})
 	})
 	defer h.RemoveStreamHandler(models.ProtoXfer)
 
-	ui.Println(session.HelpText())
-	ui.Println("connected. type message to chat, or a command starting with '/'.")
+	ui.Infoln(session.HelpText())
+	ui.Infoln("connected. type message to chat, or a command starting with '/'.")
 
 	done := make(chan struct{})
 	reasonCh := make(chan string, 1)
 	var once sync.Once
 	thisConn := s.Conn()
+	// 会话期间当前对端的连接不会被连接管理器裁剪
+	h.ConnManager().Protect(thisConn.RemotePeer(), "peer")
+	defer h.ConnManager().Unprotect(thisConn.RemotePeer(), "peer")
+
+	// 聊天流的写入可能来自输入循环和空闲检测两个协程，需串行化
+	var wmu sync.Mutex
+	sendLine := func(line string) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		fmt.Fprintln(rw.Writer, line)
+		_ = rw.Writer.Flush()
+	}
+
+	if idleTimeout > 0 {
+		go idleWatch(done, idleTimeout,
+			func() time.Time { return time.Unix(0, lastActive.Load()) },
+			func() bool { return xfersActive.Load() > 0 },
+			func() {
+				once.Do(func() {
+					sendLine(models.ChatBye)
+					reasonCh <- "idle timeout"
+					close(done)
+					_ = s.CloseRead()
+					_ = s.CloseWrite()
+					go ui.Close()
+				})
+			})
+	}
 
 	// 监听连接断开事件
 	notifiee := &network.NotifyBundle{
@@ -922,10 +3152,26 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 
 	// 接收循环 (goroutine)
 	go func() {
-		r := bufio.NewScanner(rw.Reader)
-		for r.Scan() {
-			txt := r.Text()
+		for {
+			txt, err := readChatLine(rw.Reader, maxChatMsg)
+			if errors.Is(err, errChatTooLong) {
+				// 超长消息只丢弃这一条，会话继续
+				touch()
+				ui.Println("← (message dropped: " + err.Error() + ")")
+				continue
+			}
+			if err != nil {
+				logger.Debug("chat receive loop ended", "err", err)
+				once.Do(func() {
+					go ui.Close()
+					reasonCh <- chatEndReason(err)
+					close(done)
+				})
+				return
+			}
 			if strings.HasPrefix(txt, models.ChatBye) {
+				// 对端已离开，进行中的接收无法完成：中止并保留 .part 文件
+				cancelXfers(errors.New("peer closed the chat"))
 				once.Do(func() {
 					go ui.Close()
 					reasonCh <- "peer closed the chat"
@@ -936,58 +3182,124 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 			if strings.TrimSpace(txt) == "" {
 				continue
 			}
+			touch()
+			if !rawChat {
+				txt = uipkg.Sanitize(txt)
+			}
 			ui.Println("← " + txt)
 		}
-		once.Do(func() {
-			go ui.Close()
-			reasonCh <- "peer closed the stream"
-			close(done)
-		})
 	}()
 
 	// 用户输入循环 (goroutine)
 	go func() {
-		w := rw.Writer
-
-		handleSlash := func(cmd string) bool {
-			switch {
-			case cmd == "/bye":
-				fmt.Fprintln(w, models.ChatBye)
-				_ = w.Flush()
-				once.Do(func() {
-					reasonCh <- "you closed the chat"
-					close(done)
+		// 最近一次 /send 的参数及未送达的文件，供 /resend 使用
+		var lastSend struct {
+			sync.Mutex
+			kind, arg, to string
+			failed        []string
+		}
+		// 发送在后台协程中进行，输入循环仍能回答对端同时发来的接收提示 (双向互传)；
+		// 本端的多个发送在 sendQueue 中排队依次进行
+		sendQueue := newXferQueue()
+		// /bye 时若仍有传输在进行，先等待其结束；等待期间不再开始新的发送，再次 /bye 则取消传输并立即关闭
+		var byePending bool
+		send := func(kind, arg, to string, only []string) {
+			if byePending {
+				ui.Println("closing the chat; send skipped")
+				return
+			}
+			goXfer(func() {
+				sendQueue.run(xferCtx, func() {
+					ui.Infoln("another send is in progress; this one will start when it finishes")
+				}, func() {
+					res, err := sendXferTo(xferCtx, h, thisConn.RemotePeer(), kind, arg, only, to, ui, xferSeed)
+					var ie *xferIncompleteError
+					if err != nil && !errors.As(err, &ie) {
+						recordSendOutcome(xferAllFailed)
+						ui.Println("send failed: " + err.Error())
+						return
+					}
+					recordSendOutcome(res.Outcome())
+					lastSend.Lock()
+					lastSend.kind, lastSend.arg, lastSend.to, lastSend.failed = kind, arg, to, res.Failed
+					lastSend.Unlock()
+					switch {
+					case err == nil:
+						ui.Infoln("xfer done.")
+					case len(res.Failed) > 0:
+						ui.Println(err.Error() + "; use /resend to retry them.")
+					default:
+						ui.Println(err.Error())
+					}
 				})
+			})
+		}
+
+		// closeChat 通知对端并结束会话。等待传输结束的 goroutine 可能与再次 /bye 或 ^C 同时调用，
+		// 整个过程放在 once 中，保证只发送一次 bye、只关闭一次流与界面。
+		closeChat := func(reason string) {
+			once.Do(func() {
+				sendLine(models.ChatBye)
+				reasonCh <- reason
+				close(done)
 				_ = s.CloseRead()
 				_ = s.CloseWrite()
 				go ui.Close()
+			})
+		}
+		handleSlash := func(cmd string) bool {
+			switch {
+			case cmd == "/bye":
+				if n := xfersActive.Load(); n > 0 && !byePending {
+					byePending = true
+					ui.Println(fmt.Sprintf("waiting for %d transfer(s) to finish before closing; type /bye again to cancel them", n))
+					go func() {
+						if waitXfersIdle(done, xfersActive.Load, xferIdlePoll) {
+							closeChat("you closed the chat")
+						}
+					}()
+					return true
+				}
+				cancelXfers(errors.New("you closed the chat"))
+				closeChat("you closed the chat")
 				return true
 
 			case cmd == "/peer":
-				pi := p2p.ClassifyPath(thisConn)
+				pi := classifyPath(thisConn)
 				ui.Println("peer id: " + thisConn.RemotePeer().String())
 				if pi.Kind == "RELAY" {
 					ui.Println(fmt.Sprintf("path   : RELAY via %s (%s)", pi.RelayID, pi.Transport))
-					if verbose {
+					if debugEnabled() {
 						ui.Println("via    : " + pi.RelayVia)
 					}
 				} else {
 					ui.Println(fmt.Sprintf("path   : DIRECT (%s)", pi.Transport))
 				}
+				ui.Println("crypto : " + pi.Security)
+				ui.Println("muxer  : " + pi.Muxer)
 				ui.Println("local  : " + thisConn.LocalMultiaddr().String())
 				ui.Println("remote : " + thisConn.RemoteMultiaddr().String())
 				return true
 
+			case cmd == "/whoami":
+				for _, ln := range whoamiLines(h, local) {
+					ui.Println(ln)
+				}
+				return true
+
 			case strings.HasPrefix(cmd, "/send "):
 				rest := strings.TrimSpace(strings.TrimPrefix(cmd, "/send"))
 				if rest == "" {
-					ui.Println("usage: /send -f <file> | -d <dir>")
+					ui.Println("usage: /send -f <file> | -d <dir> | -u <url>")
 					return true
 				}
 				as := strings.Fields(rest)
-				var fileArg, dirArg string
+				var fileArg, dirArg, urlArg, to string
+				dryRun := false
 				for i := 0; i < len(as); i++ {
 					switch as[i] {
+					case "--dry-run", "-dry-run":
+						dryRun = true
 					case "-f":
 						i++
 						if i < len(as) {
@@ -998,6 +3310,16 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 						if i < len(as) {
 							dirArg = as[i]
 						}
+					case "-u":
+						i++
+						if i < len(as) {
+							urlArg = as[i]
+						}
+					case "-to":
+						i++
+						if i < len(as) {
+							to = as[i]
+						}
 					}
 				}
 				kind := ""
@@ -1007,35 +3329,85 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 					kind, arg = "file", fileArg
 				case dirArg != "":
 					kind, arg = "dir", dirArg
+				case urlArg != "":
+					kind, arg = "url", urlArg
 				}
 				if kind == "" {
-					ui.Println("usage: /send -f <file> | -d <dir>")
+					ui.Println("usage: /send -f <file> | -d <dir> | -u <url>")
+					return true
+				}
+				if to != "" {
+					rel, err := cleanSuggestedPath(to)
+					if kind == "dir" || err != nil {
+						ui.Println("usage: /send -f <file>|-u <url> -to <relative/path> (a path inside the peer's save directory)")
+						return true
+					}
+					to = filepath.ToSlash(rel)
+				}
+				if dryRun {
+					if kind != "dir" {
+						ui.Println("usage: /send -d <dir> --dry-run")
+					} else if err := printSendPlan(ui.Println, arg); err != nil {
+						ui.Println("dry run failed: " + err.Error())
+					}
+					return true
+				}
+				ui.Infoln("sending...")
+				send(kind, arg, to, nil)
+				return true
+
+			case cmd == "/outdir" || strings.HasPrefix(cmd, "/outdir "):
+				arg := strings.TrimSpace(strings.TrimPrefix(cmd, "/outdir"))
+				saveDir.Lock()
+				defer saveDir.Unlock()
+				if arg == "" {
+					ui.Println("saving incoming files to " + saveDir.dir)
+					return true
+				}
+				dir, err := resolveOutDir(arg)
+				if err != nil {
+					ui.Println("outdir unchanged: " + err.Error())
+					return true
+				}
+				saveDir.dir = dir
+				ui.Println("incoming files will now be saved to " + dir + " (transfers already in progress are unaffected)")
+				return true
+
+			case cmd == "/resend":
+				lastSend.Lock()
+				kind, arg, to, failed := lastSend.kind, lastSend.arg, lastSend.to, lastSend.failed
+				lastSend.Unlock()
+				if len(failed) == 0 {
+					ui.Println("nothing to resend.")
 					return true
 				}
-				ui.Println("sending...")
-				if err := sendXfer(ctx, h, thisConn.RemotePeer(), kind, arg, ui, xferSeed); err != nil {
-					ui.Println("send failed: " + err.Error())
+				ui.Infoln(fmt.Sprintf("resending %d file(s)...", len(failed)))
+				if kind == "dir" {
+					send("dir", arg, "", failed)
 				} else {
-					ui.Println("xfer done.")
+					send(kind, arg, to, nil)
 				}
 				return true
 			}
 			return false
 		}
 
+		// -send：握手成功后立即发送，完成后仍可继续聊天或 /send
+		if autoSend != "" && s.Stat().Direction == network.DirInbound {
+			if kind, err := sendKind(autoSend); err != nil {
+				ui.Println("auto send skipped: " + err.Error())
+			} else {
+				ui.Infoln(fmt.Sprintf("sending %s automatically...", autoSend))
+				send(kind, autoSend, "", nil)
+			}
+		}
+
 		for {
 			txt, err := ui.Readline()
 			if err != nil {
 				if errors.Is(err, readline.ErrInterrupt) {
-					fmt.Fprintln(w, models.ChatBye)
-					_ = w.Flush()
-					once.Do(func() {
-						reasonCh <- "interrupted (^C)"
-						close(done)
-					})
-					_ = s.CloseRead()
-					_ = s.CloseWrite()
-					go ui.Close()
+					cancelXfers(errors.New("interrupted (^C)"))
+					closeChat("interrupted (^C)")
 					return
 				}
 				if errors.Is(err, io.EOF) {
@@ -1058,6 +3430,7 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 				return
 			}
 			line := strings.TrimRight(txt, "\r\n")
+			touch()
 			// 检查是否有待处理的用户提示 (如文件接收确认)
 			if pending := tryDequeuePrompt(promptCh); pending != nil {
 				al := strings.ToLower(strings.TrimSpace(line))
@@ -1074,10 +3447,13 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 			if trim == "" {
 				continue
 			}
-			// 普通文本作为聊天消息发送
+			// 普通文本作为聊天消息发送；超长消息对端会丢弃，这里直接拒绝
+			if len(line) > maxChatMsg {
+				ui.Println(fmt.Sprintf("message too long (%d bytes, limit %d), not sent", len(line), maxChatMsg))
+				continue
+			}
 			ui.Println("→ " + line)
-			fmt.Fprintln(w, line)
-			_ = w.Flush()
+			sendLine(line)
 		}
 	}()
 
@@ -1085,19 +3461,98 @@ func runAccepted(ctx context.Context, h host.Host, s network.Stream, controlURL,
 	reason := <-reasonCh
 	ui.Println(reason)
 
+	if onDisconnect != "" {
+		hctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		out, err := runHook(hctx, onDisconnect, hookEnv(role, remote, sas, pi, reason))
+		cancel()
+		logHook(ui.Println, "on-disconnect", out, err)
+	}
+
 	_ = s.CloseRead()
 	_ = s.CloseWrite()
 	_ = s.Close()
 	go ui.Close()
 }
 
+// hookTimeout 是 -on-disconnect 命令的最长运行时间，超时后命令被终止，会话照常退出
+const hookTimeout = 30 * time.Second
+
+// maxHookValue 是传给钩子命令的单个环境变量值的最大长度
+const maxHookValue = 512
+
+// hookEnv 构造传给 -on-connect/-on-disconnect 命令的环境变量。
+// 值中的控制字符被转义并截断长度，使脚本可以安全地逐行记录；reason 仅在会话结束时非空。
+func hookEnv(role string, remote peer.ID, sas string, pi p2p.PathInfo, reason string) []string {
+	vars := [][2]string{
+		{"WORMHOLE_ROLE", role},
+		{"WORMHOLE_PEER_ID", remote.String()},
+		{"WORMHOLE_SAS", sas},
+		{"WORMHOLE_PATH", pi.Kind},
+		{"WORMHOLE_TRANSPORT", pi.Transport},
+		{"WORMHOLE_REMOTE_ADDR", pi.RemoteAddr},
+	}
+	if reason != "" {
+		vars = append(vars, [2]string{"WORMHOLE_REASON", reason})
+	}
+	env := make([]string, 0, len(vars))
+	for _, kv := range vars {
+		v := uipkg.Sanitize(kv[1])
+		if len(v) > maxHookValue {
+			v = v[:maxHookValue]
+		}
+		env = append(env, kv[0]+"="+v)
+	}
+	return env
+}
+
+// runHook 通过 shell 执行用户指定的命令并返回其合并输出。
+// 会话信息只通过环境变量传入，从不拼接进命令行，因此不会被 shell 解释；命令以当前用户的权限运行。
+func runHook(ctx context.Context, command string, env []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = time.Second // 超时后不再等待命令留下的子进程关闭输出
+	return cmd.CombinedOutput()
+}
+
+// logHook 逐行输出钩子命令的输出，命令失败时附上错误
+func logHook(emit func(string), name string, out []byte, err error) {
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line != "" {
+			emit("[" + name + "] " + uipkg.Sanitize(line))
+		}
+	}
+	if err != nil {
+		emit(fmt.Sprintf("[%s] command failed: %v", name, err))
+	}
+}
+
+// logPAKEError 报告 PAKE 失败；口令不一致时给出明确提示，而不是与网络错误混在一起。
+func logPAKEError(ui *uiConsole, err error) {
+	if errors.Is(err, session.ErrKeyConfirm) {
+		ui.Logln("PAKE failed: the code does not match the peer's (mistyped, or someone else tried to use it)")
+		return
+	}
+	ui.Logf("PAKE failed: %v", err)
+}
+
 // ---------- libp2p 主机和发现 ----------
 
 // newHost 创建并配置一个新的 libp2p 主机实例。
 func newHost(staticRelay *peer.AddrInfo, extraListen []ma.Multiaddr) (host.Host, error) {
+	// 限制长时间等待的 host 会话中由探测、中继与汇合点积累的连接数
+	cm, err := connmgr.NewConnManager(connLow, connHigh, connmgr.WithGracePeriod(connGrace))
+	if err != nil {
+		return nil, err
+	}
 	opts := []libp2p.Option{
 		libp2p.NATPortMap(),         // 尝试使用 UPnP/NAT-PMP 进行端口映射
 		libp2p.EnableHolePunching(), // 启用 NAT 穿透
+		libp2p.ConnectionManager(cm),
+		libp2p.SwarmOpts(swarm.WithDialRanker(transports.rank)),
+		secLog.Options(), // 记录协商出的加密，中继连接的 ConnState 不报告它
 	}
 	if staticRelay != nil {
 		// 配置一个静态中继节点，用于 AutoRelay
@@ -1112,12 +3567,223 @@ func newHost(staticRelay *peer.AddrInfo, extraListen []ma.Multiaddr) (host.Host,
 		return nil, err
 	}
 	pingsvc.NewPingService(h) // 启用 ping 服务以保持连接活跃
+	h.Network().Notify(secLog.Notifiee())
 	if staticRelay != nil {
 		h.Peerstore().AddAddrs(staticRelay.ID, staticRelay.Addrs, time.Hour)
 	}
 	return h, nil
 }
 
+// transportNames 是 -transports 接受的传输名称。
+var transportNames = []string{"tcp", "quic", "ws", "webtransport", "webrtc"}
+
+// transportClass 返回地址所属的 -transports 名称；中继 (circuit) 地址与无法识别的地址返回 ""，
+// 不受 -transports 限制 (中继连接本身经由到中继节点的地址拨号，那次拨号同样受限)。
+func transportClass(a ma.Multiaddr) string {
+	if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+		return ""
+	}
+	switch t := p2p.TransportHint(a); t {
+	case "quic-v1":
+		return "quic"
+	case "webrtc-direct":
+		return "webrtc"
+	case "tcp", "ws", "webtransport":
+		return t
+	default:
+		return ""
+	}
+}
+
+// parseTransports 解析 -transports，返回允许的传输集合。
+func parseTransports(s string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(transportNames, name) {
+			return nil, fmt.Errorf("unknown transport %q (want %s)", name, strings.Join(transportNames, ", "))
+		}
+		allowed[name] = true
+	}
+	if len(allowed) == 0 {
+		return nil, errors.New("no transports given")
+	}
+	return allowed, nil
+}
+
+// QUIC 自动降级的参数：直连拨号中 QUIC 地址连续失败 quicFailThreshold 次且本会话从未
+// 经 QUIC 连通时，认为所在网络屏蔽了 UDP；此后 QUIC 地址推迟 quicFallbackDelay 再拨，并不再向汇合点宣告。
+const (
+	quicFailThreshold = 3
+	quicFallbackDelay = 2 * time.Second
+)
+
+// transportPolicy 决定拨号与宣告使用哪些传输：allowed 来自 -transports 且不再改变，
+// 其余字段记录 QUIC 拨号的结果，用于在屏蔽 UDP 的网络中自动改用 TCP/WebSocket。
+// 零值允许全部传输。
+type transportPolicy struct {
+	allowed map[string]bool // nil 表示全部允许
+
+	mu        sync.Mutex
+	quicFails int  // 连续失败的 QUIC 直连次数
+	quicOK    bool // 本会话曾经经 QUIC 连通，不再降级
+	quicOff   bool // 已降级
+}
+
+// transports 是本进程的传输策略，main 按 -transports 设置。
+var transports = &transportPolicy{}
+
+// secLog 记录本进程的主机与各对端协商出的加密协议，用于核对中继连接的加密 (见 p2p.SecurityLog)
+var secLog = p2p.NewSecurityLog()
+
+// classifyPath 与 p2p.ClassifyPath 相同，但中继连接的加密由 secLog 补全
+func classifyPath(c network.Conn) p2p.PathInfo {
+	pi := p2p.ClassifyPath(c)
+	st := secLog.ConnState(c)
+	pi.Security, pi.Muxer = p2p.ConnSecurity(st)
+	pi.SecureOK = p2p.CheckSecurity(st) == nil
+	return pi
+}
+
+// allows 报告 -transports 是否允许地址 a 的传输。
+func (tp *transportPolicy) allows(a ma.Multiaddr) bool {
+	c := transportClass(a)
+	return tp.allowed == nil || c == "" || tp.allowed[c]
+}
+
+// deprioritized 报告地址 a 是否因 QUIC 自动降级而应推迟拨号、不再宣告。
+func (tp *transportPolicy) deprioritized(a ma.Multiaddr) bool {
+	tp.mu.Lock()
+	off := tp.quicOff
+	tp.mu.Unlock()
+	if !off {
+		return false
+	}
+	c := transportClass(a)
+	return c == "quic" || c == "webtransport"
+}
+
+// split 按策略把地址分为优先使用的 first 与降级后的 later，丢弃 -transports 不允许的地址。
+func (tp *transportPolicy) split(addrs []ma.Multiaddr) (first, later []ma.Multiaddr) {
+	for _, a := range addrs {
+		switch {
+		case !tp.allows(a):
+		case tp.deprioritized(a):
+			later = append(later, a)
+		default:
+			first = append(first, a)
+		}
+	}
+	return first, later
+}
+
+// rank 是主机的拨号排序：丢弃 -transports 不允许的地址，其余交给 libp2p 的默认排序；
+// QUIC 降级后若还有其他可用地址，QUIC 地址排在它们之后 quicFallbackDelay 才拨。
+func (tp *transportPolicy) rank(addrs []ma.Multiaddr) []network.AddrDelay {
+	first, later := tp.split(addrs)
+	if len(first) == 0 {
+		return swarm.DefaultDialRanker(later)
+	}
+	out := swarm.DefaultDialRanker(first)
+	if len(later) > 0 {
+		base := out[len(out)-1].Delay + quicFallbackDelay
+		for _, ad := range swarm.DefaultDialRanker(later) {
+			out = append(out, network.AddrDelay{Addr: ad.Addr, Delay: base + ad.Delay})
+		}
+		logger.Debug("dialing QUIC last", "deprioritized", len(later), "delay", base)
+	}
+	return out
+}
+
+// announce 过滤要向汇合点宣告的地址，规则同 rank：降级后不再宣告 QUIC，除非没有别的地址可宣告。
+func (tp *transportPolicy) announce(addrs []ma.Multiaddr) []ma.Multiaddr {
+	first, later := tp.split(addrs)
+	if len(first) == 0 {
+		return later
+	}
+	return first
+}
+
+// observeDial 记录一次直连拨号的结果：err 中含有 QUIC 地址的失败时计一次失败，
+// 经 QUIC 连通时 (conn 非 nil) 不再降级。达到阈值时降级并在日志中说明。
+func (tp *transportPolicy) observeDial(err error, conn network.Conn) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if conn != nil && strings.HasPrefix(conn.ConnState().Transport, "quic") {
+		tp.quicOK, tp.quicFails = true, 0
+		return
+	}
+	var de *swarm.DialError
+	if tp.quicOK || tp.quicOff || !errors.As(err, &de) {
+		return
+	}
+	for _, te := range de.DialErrors {
+		if transportClass(te.Address) == "quic" {
+			tp.quicFails++
+			if tp.quicFails >= quicFailThreshold {
+				tp.quicOff = true
+				logger.Info("QUIC dials keep failing (UDP is probably blocked); preferring TCP/WebSocket for this session",
+					"failures", tp.quicFails, "deprioritized", "quic,webtransport")
+			}
+			return
+		}
+	}
+}
+
+// watchReachability 订阅 AutoNAT 的可达性变化，返回查询当前可达性的函数；
+// 尚未得出结论时为 network.ReachabilityUnknown。订阅随主机关闭而结束。
+func watchReachability(h host.Host) func() network.Reachability {
+	var cur atomic.Int32
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return func() network.Reachability { return network.ReachabilityUnknown }
+	}
+	go func() {
+		defer sub.Close()
+		for ev := range sub.Out() {
+			cur.Store(int32(ev.(event.EvtLocalReachabilityChanged).Reachability))
+		}
+	}()
+	return func() network.Reachability { return network.Reachability(cur.Load()) }
+}
+
+// localState 汇总 /whoami 所需的本机状态。
+type localState struct {
+	announce     rzv.AddrsFactory            // 向汇合点公布地址时使用的过滤器，nil 时公布 h.Addrs()
+	relay        *peer.AddrInfo              // 持有预订的中继，nil 表示没有
+	reachability func() network.Reachability // AutoNAT 得出的可达性，可为 nil
+}
+
+// whoamiLines 返回 /whoami 的输出：本机 PeerID、监听与公布地址、中继预订与可达性。
+func whoamiLines(h host.Host, st localState) []string {
+	lines := []string{"peer id : " + h.ID().String()}
+	for _, a := range h.Network().ListenAddresses() {
+		lines = append(lines, "listen  : "+a.String())
+	}
+	announced := h.Addrs()
+	if st.announce != nil {
+		announced = st.announce(announced)
+	}
+	for _, a := range announced {
+		lines = append(lines, "announce: "+a.String())
+	}
+	if st.relay != nil && len(h.Network().ConnsToPeer(st.relay.ID)) > 0 {
+		lines = append(lines, "relay   : reserved via "+st.relay.ID.String())
+	} else if st.relay != nil {
+		lines = append(lines, "relay   : reserved via "+st.relay.ID.String()+" (disconnected)")
+	} else {
+		lines = append(lines, "relay   : none")
+	}
+	reach := network.ReachabilityUnknown
+	if st.reachability != nil {
+		reach = st.reachability()
+	}
+	return append(lines, "reach   : "+strings.ToLower(reach.String()))
+}
+
 // connectAny 尝试连接到地址列表中的任何一个节点，成功一个即返回。
 func connectAny(ctx context.Context, h host.Host, addrs []peer.AddrInfo) (*peer.AddrInfo, error) {
 	for _, ai := range addrs {
@@ -1128,6 +3794,234 @@ func connectAny(ctx context.Context, h host.Host, addrs []peer.AddrInfo) (*peer.
 	return nil, fmt.Errorf("connectAny failed")
 }
 
+// rendezvousClient 是 multiRendezvous 所用到的 rzv.RendezvousClient 方法子集。
+type rendezvousClient interface {
+	Register(ctx context.Context, ns string, ttl int) (time.Duration, error)
+	Unregister(ctx context.Context, ns string) error
+	Discover(ctx context.Context, ns string, limit int, cookie []byte) ([]peer.AddrInfo, []byte, error)
+}
+
+// rendezvousPoint 是单个汇合点服务器及其客户端。
+type rendezvousPoint struct {
+	id     peer.ID
+	client rendezvousClient
+}
+
+// rzvRegisterTTL 是注册的 TTL（秒），取汇合点协议允许的最小值。
+// 客户端会在 Register 的 ctx 存活期间自动续期，因此轮换时必须取消该 ctx 并注销旧主题，
+// 否则旧主题会一直被续期，干扰发现。
+const rzvRegisterTTL = 120
+
+// 汇合点注册失败后的重试间隔：从 rzvRetryMin 开始翻倍，不超过 rzvRetryMax
+var (
+	rzvRetryMin = time.Second
+	rzvRetryMax = 30 * time.Second
+)
+
+// registerWithRetry 调用 register 在汇合点注册，失败时按指数退避重试，直到成功、代码在 deadline 过期
+// 或 ctx 取消。重试期间代码保持不变：用户可能已经把它发给了对方，汇合点的短暂故障不应迫使其重新分享。
+// 每次重试前先调用 refresh (可为 nil)，例如刷新中继预订。放弃时返回最后一次注册的错误。
+func registerWithRetry(ctx context.Context, deadline time.Time, register func(context.Context) error, refresh func(context.Context)) error {
+	delay := rzvRetryMin
+	for {
+		err := register(ctx)
+		if err == nil {
+			return nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return err
+		}
+		wait = min(wait, delay)
+		logger.Warn(fmt.Sprintf("rendezvous register failed, retrying in %s (the code stays the same)", wait.Round(time.Second)), "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if time.Until(deadline) <= 0 {
+			return err
+		}
+		if refresh != nil {
+			refresh(ctx)
+		}
+		delay = min(2*delay, rzvRetryMax)
+	}
+}
+
+// multiRendezvous 将多个汇合点组合在一起：注册到所有汇合点，并合并各自的发现结果。
+// 只要有一个汇合点可用，操作即视为成功。它是 p2p.Discovery 的默认实现。
+type multiRendezvous struct {
+	points []rendezvousPoint
+}
+
+var _ p2p.Discovery = (*multiRendezvous)(nil)
+
+// newDiscovery 创建节点发现后端，默认连接控制服务器分配的汇合点。需要其他发现机制
+// (DHT、mDNS、静态节点列表、自定义信令服务器) 的构建可以在 init 中替换它。
+var newDiscovery = func(ctx context.Context, h host.Host, rendezvous []peer.AddrInfo, addrFac rzv.AddrsFactory) (p2p.Discovery, error) {
+	m, err := newMultiRendezvous(ctx, h, rendezvous, addrFac)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newMultiRendezvous 连接给定的所有汇合点服务器，为每个可达的服务器创建客户端。
+func newMultiRendezvous(ctx context.Context, h host.Host, servers []peer.AddrInfo, addrFac rzv.AddrsFactory) (*multiRendezvous, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no rendezvous servers")
+	}
+	m := &multiRendezvous{}
+	var errs []error
+	for _, ai := range servers {
+		if err := h.Connect(ctx, ai); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ai.ID, err))
+			continue
+		}
+		rp := rzv.NewRendezvousPoint(h, ai.ID, rzv.ClientWithAddrsFactory(addrFac))
+		m.points = append(m.points, rendezvousPoint{id: ai.ID, client: rzv.NewRendezvousClientWithPoint(rp)})
+	}
+	if len(m.points) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	for _, e := range errs {
+		logger.Debug("rendezvous unreachable", "err", e)
+	}
+	return m, nil
+}
+
+// Register 在所有汇合点上注册 ns，至少一个成功即返回 nil。
+func (m *multiRendezvous) Register(ctx context.Context, ns string, ttl int) error {
+	var errs []error
+	for _, p := range m.points {
+		if _, err := p.client.Register(ctx, ns, ttl); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.id, err))
+		}
+	}
+	if len(errs) == len(m.points) {
+		return errors.Join(errs...)
+	}
+	for _, e := range errs {
+		logger.Debug("rendezvous register failed", "err", e)
+	}
+	return nil
+}
+
+// Unregister 在所有汇合点上注销 ns，至少一个成功即返回 nil。
+func (m *multiRendezvous) Unregister(ctx context.Context, ns string) error {
+	var errs []error
+	for _, p := range m.points {
+		if err := p.client.Unregister(ctx, ns); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.id, err))
+		}
+	}
+	if len(errs) == len(m.points) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Discover 在所有汇合点上查询 ns，并按 PeerID 合并结果；全部失败时才返回错误。
+// 汇合点按注册 (续期) 的先后返回结果，这里倒序合并，使最近注册的节点排在前面：
+// 残留的过期注册通常是最早的那些。
+func (m *multiRendezvous) Discover(ctx context.Context, ns string, limit int) ([]peer.AddrInfo, error) {
+	var out []peer.AddrInfo
+	idx := make(map[peer.ID]int)
+	var errs []error
+	for _, p := range m.points {
+		infos, _, err := p.client.Discover(ctx, ns, limit, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.id, err))
+			continue
+		}
+		for j := len(infos) - 1; j >= 0; j-- {
+			ai := infos[j]
+			if i, ok := idx[ai.ID]; ok {
+				out[i].Addrs = mergeAddrs(out[i].Addrs, ai.Addrs)
+				continue
+			}
+			idx[ai.ID] = len(out)
+			out = append(out, ai)
+		}
+	}
+	if len(errs) == len(m.points) {
+		return nil, errors.Join(errs...)
+	}
+	return out, nil
+}
+
+// mergeAddrs 将 extra 中尚未出现在 base 里的地址追加到 base。
+func mergeAddrs(base, extra []ma.Multiaddr) []ma.Multiaddr {
+	for _, a := range extra {
+		dup := false
+		for _, b := range base {
+			if a.Equal(b) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			base = append(base, a)
+		}
+	}
+	return base
+}
+
+// relayPingTimeout 是 fastest 策略下连接并 ping 单个中继的时间上限。
+const relayPingTimeout = 3 * time.Second
+
+// rankRelays 按 strategy 返回尝试预订的中继顺序。fastest 会并发连接并 ping 每个中继，
+// 按 RTT 从低到高排序，无法 ping 通的排在最后并保持原顺序；全部失败时退回 first 的顺序。
+func rankRelays(ctx context.Context, h host.Host, relays []peer.AddrInfo, strategy string) []peer.AddrInfo {
+	if strategy != "fastest" || len(relays) < 2 {
+		return relays
+	}
+	rtts := make([]time.Duration, len(relays))
+	var wg sync.WaitGroup
+	for i, ai := range relays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, relayPingTimeout)
+			defer cancel()
+			rtts[i] = -1
+			if err := h.Connect(pctx, ai); err != nil {
+				return
+			}
+			if res, ok := <-pingsvc.Ping(pctx, h, ai.ID); ok && res.Error == nil {
+				rtts[i] = res.RTT
+			}
+		}()
+	}
+	wg.Wait()
+
+	idx := make([]int, len(relays))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		ra, rb := rtts[idx[a]], rtts[idx[b]]
+		if ra < 0 || rb < 0 {
+			return ra >= 0 && rb < 0
+		}
+		return ra < rb
+	})
+	if rtts[idx[0]] < 0 {
+		return relays
+	}
+	out := make([]peer.AddrInfo, len(relays))
+	for i, j := range idx {
+		out[i] = relays[j]
+		if rtts[j] < 0 {
+			logger.Debug("relay ping failed", "relay", relays[j].ID)
+		} else {
+			logger.Debug("relay ping", "relay", relays[j].ID, "rtt", rtts[j].Round(time.Millisecond))
+		}
+	}
+	return out
+}
+
 // reserveAnyRelay 尝试在给定的中继列表中预订一个槽位。
 func reserveAnyRelay(ctx context.Context, h host.Host, relays []peer.AddrInfo) *peer.AddrInfo {
 	for _, ai := range relays {
@@ -1136,33 +4030,117 @@ func reserveAnyRelay(ctx context.Context, h host.Host, relays []peer.AddrInfo) *
 			return &ai
 		}
 	}
-	return nil
+	return nil
+}
+
+// buildCircuitSelfAddrs 构建通过中继节点访问自身的 p2p-circuit 地址。
+func buildCircuitSelfAddrs(relay *peer.AddrInfo, self peer.ID) []ma.Multiaddr {
+	var out []ma.Multiaddr
+	if relay == nil {
+		return out
+	}
+	for _, ra := range relay.Addrs {
+		s := ra.String()
+		if !strings.Contains(s, "/p2p/") {
+			s += "/p2p/" + relay.ID.String()
+		}
+		s += "/p2p-circuit/p2p/" + self.String()
+		if via, err := ma.NewMultiaddr(s); err == nil {
+			out = append(out, via)
+		}
+	}
+	return out
+}
+
+// parseAnnounce 解析 -announce 给出的逗号分隔的对外地址。
+// 地址必须以 ip4/ip6/dns/dns4/dns6 开头并带 tcp 或 udp 端口，不能包含 /p2p/ 或 p2p-circuit (汇合点会附上本机 ID)。
+func parseAnnounce(csv string) ([]ma.Multiaddr, error) {
+	var out []ma.Multiaddr
+	for _, s := range strings.Split(csv, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		a, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", s, err)
+		}
+		if len(a.Protocols()) == 0 {
+			return nil, fmt.Errorf("%q: empty address", s)
+		}
+		switch a.Protocols()[0].Code {
+		case ma.P_IP4, ma.P_IP6, ma.P_DNS, ma.P_DNS4, ma.P_DNS6:
+		default:
+			return nil, fmt.Errorf("%q: must start with /ip4, /ip6, /dns, /dns4 or /dns6", s)
+		}
+		_, tcpErr := a.ValueForProtocol(ma.P_TCP)
+		_, udpErr := a.ValueForProtocol(ma.P_UDP)
+		if tcpErr != nil && udpErr != nil {
+			return nil, fmt.Errorf("%q: missing /tcp or /udp port", s)
+		}
+		if _, err := a.ValueForProtocol(ma.P_P2P); err == nil {
+			return nil, fmt.Errorf("%q: must not contain /p2p/", s)
+		}
+		if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			return nil, fmt.Errorf("%q: must not be a relay (p2p-circuit) address", s)
+		}
+		out = append(out, a)
+	}
+	return out, nil
 }
 
-// buildCircuitSelfAddrs 构建通过中继节点访问自身的 p2p-circuit 地址。
-func buildCircuitSelfAddrs(relay *peer.AddrInfo, self peer.ID) []ma.Multiaddr {
+// resolveAnnounce 解析 -announce 地址中的域名，无法解析视为配置错误。
+// 返回原地址及其解析出的 IP 形式：域名地址在 IP 变化后依然有效，IP 形式供不解析 DNS 地址的对端直接拨号。
+func resolveAnnounce(ctx context.Context, lookup func(ctx context.Context, network, host string) ([]net.IP, error), addrs []ma.Multiaddr) ([]ma.Multiaddr, error) {
+	seen := make(map[string]bool)
 	var out []ma.Multiaddr
-	if relay == nil {
-		return out
+	add := func(a ma.Multiaddr) {
+		if k := a.String(); !seen[k] {
+			seen[k] = true
+			out = append(out, a)
+		}
 	}
-	for _, ra := range relay.Addrs {
-		s := ra.String()
-		if !strings.Contains(s, "/p2p/") {
-			s += "/p2p/" + relay.ID.String()
+	for _, a := range addrs {
+		add(a)
+		p := a.Protocols()[0]
+		network := map[int]string{ma.P_DNS: "ip", ma.P_DNS4: "ip4", ma.P_DNS6: "ip6"}[p.Code]
+		if network == "" {
+			continue
 		}
-		s += "/p2p-circuit/p2p/" + self.String()
-		if via, err := ma.NewMultiaddr(s); err == nil {
-			out = append(out, via)
+		name, _ := a.ValueForProtocol(p.Code)
+		ips, err := lookup(ctx, network, name)
+		if err == nil && len(ips) == 0 {
+			err = fmt.Errorf("no addresses")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", name, err)
+		}
+		rest := strings.TrimPrefix(a.String(), "/"+p.Name+"/"+name)
+		for _, ip := range ips {
+			proto := "ip6"
+			if ip.To4() != nil {
+				proto = "ip4"
+			}
+			if r, err := ma.NewMultiaddr("/" + proto + "/" + ip.String() + rest); err == nil {
+				add(r)
+			}
 		}
 	}
-	return out
+	return out, nil
 }
 
 // rendezvousAddrsFactory 是一个地址工厂函数，用于过滤和添加要向汇合点宣告的地址。
+// -announce 给出的地址总是排在最前面，不受私有地址过滤的影响。
 func rendezvousAddrsFactory(h host.Host, reservedRelay *peer.AddrInfo, allowLocal bool) rzv.AddrsFactory {
 	return func(addrs []ma.Multiaddr) []ma.Multiaddr {
 		seen := make(map[string]bool)
 		var out []ma.Multiaddr
+		for _, a := range announceAddrs {
+			if k := a.String(); !seen[k] {
+				out = append(out, a)
+				seen[k] = true
+			}
+		}
 		for _, a := range addrs {
 			if client.IsUnspecified(a) { // 过滤掉 0.0.0.0
 				continue
@@ -1186,142 +4164,877 @@ func rendezvousAddrsFactory(h host.Host, reservedRelay *peer.AddrInfo, allowLoca
 			}
 		}
 		if len(out) == 0 {
-			return addrs
+			return transports.announce(addrs)
 		}
-		return out
+		return transports.announce(out)
+	}
+}
+
+// noRendezvousHint 是控制服务器没有给出可用汇合点时给终端用户的提示：这几乎总是服务端的配置问题。
+const noRendezvousHint = "the control server returned no usable rendezvous addresses; check the server's -public-addrs configuration"
+
+// parseRendezvous 解析控制服务器在 allocate/claim 响应中返回的汇合点地址，
+// 丢弃无法解析的地址与未指定 IP (0.0.0.0、::，服务端自动探测公网地址失败时的典型结果)，
+// 一个可拨号的地址都没有时返回带 noRendezvousHint 的错误，而不是原始的解析错误。
+func parseRendezvous(addrs []string) ([]peer.AddrInfo, error) {
+	rt := p2p.ParseRoutes(addrs)
+	var out []peer.AddrInfo
+	for _, ai := range rt.Peers {
+		var dialable []ma.Multiaddr
+		for _, a := range ai.Addrs {
+			if manet.IsIPUnspecified(a) {
+				logger.Debug("ignoring unspecified rendezvous addr", "addr", a)
+				continue
+			}
+			dialable = append(dialable, a)
+		}
+		if len(dialable) > 0 {
+			ai.Addrs = dialable
+			out = append(out, ai)
+		}
+	}
+	for _, a := range rt.Invalid {
+		logger.Debug("ignoring invalid rendezvous addr", "addr", a)
+	}
+	if len(out) == 0 {
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("%s (none were returned)", noRendezvousHint)
+		}
+		return nil, fmt.Errorf("%s (got %s)", noRendezvousHint, strings.Join(addrs, ", "))
+	}
+	return out, nil
+}
+
+// connectBootstrap 并行连接引导节点以预热 peerstore，改善严格 NAT 后的中继与汇合点可达性。
+// 引导节点只是锦上添花：无法解析或连接失败的地址被忽略 (仅在 -verbose 时输出)，返回成功连接的节点数。
+func connectBootstrap(ctx context.Context, h host.Host, addrs []string) int {
+	ais, err := p2p.ParseAddrInfos(addrs)
+	if err != nil {
+		return 0
+	}
+	var wg sync.WaitGroup
+	var ok atomic.Int32
+	for _, ai := range ais {
+		if ai.ID == h.ID() {
+			continue
+		}
+		wg.Add(1)
+		go func(ai peer.AddrInfo) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			if err := h.Connect(cctx, ai); err != nil {
+				logger.Debug("bootstrap connect failed", "peer", ai.ID, "err", err)
+				return
+			}
+			ok.Add(1)
+		}(ai)
+	}
+	wg.Wait()
+	logger.Debug("bootstrap done", "connected", ok.Load(), "total", len(ais))
+	return int(ok.Load())
+}
+
+// mergeRelaysFromRemote 将从远程节点地址中提取的中继信息与已知的中继列表合并。
+func mergeRelaysFromRemote(remote peer.AddrInfo, known []peer.AddrInfo) []peer.AddrInfo {
+	merged := make(map[peer.ID]peer.AddrInfo)
+	for _, r := range known {
+		merged[r.ID] = r
+	}
+	for _, a := range remote.Addrs {
+		r, ok, err := p2p.ParseCircuit(a)
+		if !ok || err != nil {
+			continue
+		}
+		if cur, ok := merged[r.Relay.ID]; ok {
+			cur.Addrs = append(cur.Addrs, r.Relay.Addrs...)
+			merged[r.Relay.ID] = cur
+		} else {
+			merged[r.Relay.ID] = r.Relay
+		}
+	}
+	out := make([]peer.AddrInfo, 0, len(merged))
+	for _, ai := range merged {
+		out = append(out, ai)
+	}
+	return out
+}
+
+// allRelayedAddrs 检查一个节点的所有地址是否都是中继地址。
+func allRelayedAddrs(ai peer.AddrInfo) bool {
+	if len(ai.Addrs) == 0 {
+		return false
+	}
+	for _, a := range ai.Addrs {
+		if !strings.Contains(a.String(), "/p2p-circuit") {
+			return false
+		}
+	}
+	return true
+}
+
+// directAddrs 返回去掉 p2p-circuit 地址后的 ai，-force-direct 时拨号不会经由对端宣告的中继地址。
+func directAddrs(ai peer.AddrInfo) peer.AddrInfo {
+	out := peer.AddrInfo{ID: ai.ID}
+	for _, a := range ai.Addrs {
+		if !strings.Contains(a.String(), "/p2p-circuit") {
+			out.Addrs = append(out.Addrs, a)
+		}
+	}
+	return out
+}
+
+// errRelayDisabled 是 -force-direct 时记录在中继一栏的原因。
+var errRelayDisabled = errors.New("relay fallback disabled by -force-direct")
+
+// dialAttempt 记录对单个对等节点的拨号情况，用于失败时输出诊断信息。
+type dialAttempt struct {
+	peer      peer.ID
+	rounds    int   // 尝试的轮数
+	relays    int   // 最近一次尝试时已知的中继数量
+	directErr error // 最近一次直连的错误 (nil 表示未尝试)
+	relayErr  error // 最近一次中继连接的错误 (nil 表示未尝试)
+}
+
+// openChatError 是 tryOpenChat 最终失败时返回的错误，汇总了所有发现与拨号尝试。
+// Error() 给出一行摘要，details() 给出逐个节点的详细信息。
+type openChatError struct {
+	discoverErr error // 最近一次发现失败的原因
+	attempts    []*dialAttempt
+}
+
+func (e *openChatError) attempt(id peer.ID) *dialAttempt {
+	for _, a := range e.attempts {
+		if a.peer == id {
+			return a
+		}
+	}
+	a := &dialAttempt{peer: id}
+	e.attempts = append(e.attempts, a)
+	return a
+}
+
+func (e *openChatError) Error() string {
+	if len(e.attempts) == 0 {
+		if e.discoverErr != nil {
+			return fmt.Sprintf("no peers discovered (%s)", shortDialErr(e.discoverErr))
+		}
+		return "no peers discovered"
+	}
+	var direct, relay []string
+	for _, a := range e.attempts {
+		direct = appendUnique(direct, shortDialErr(a.directErr))
+		relay = appendUnique(relay, shortDialErr(a.relayErr))
+	}
+	return fmt.Sprintf("discovered %d peer(s); direct failed (%s), relay failed (%s)",
+		len(e.attempts), strings.Join(direct, ", "), strings.Join(relay, ", "))
+}
+
+// details 返回每个节点的详细尝试记录，供 -verbose 模式打印。
+func (e *openChatError) details() []string {
+	var out []string
+	if e.discoverErr != nil {
+		out = append(out, "last discover error: "+e.discoverErr.Error())
+	}
+	for _, a := range e.attempts {
+		out = append(out, fmt.Sprintf("peer %s: %d round(s), %d relay(s) known", a.peer, a.rounds, a.relays))
+		if a.directErr != nil {
+			out = append(out, "  direct: "+a.directErr.Error())
+		}
+		if a.relayErr != nil {
+			out = append(out, "  relay : "+a.relayErr.Error())
+		}
+	}
+	return out
+}
+
+func appendUnique(ss []string, s string) []string {
+	for _, x := range ss {
+		if x == s {
+			return ss
+		}
+	}
+	return append(ss, s)
+}
+
+// shortDialErr 将 libp2p 的拨号错误归类为简短、可读的原因。
+func shortDialErr(err error) string {
+	if err == nil {
+		return "not tried"
+	}
+	msg := err.Error()
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), strings.Contains(msg, "deadline exceeded"), strings.Contains(msg, "timeout"):
+		return "timeout"
+	case strings.Contains(msg, "NO_RESERVATION"):
+		return "no reservation"
+	case strings.Contains(msg, "no relays"):
+		return "no relays known"
+	case strings.Contains(msg, "no addresses"), strings.Contains(msg, "no good addresses"):
+		return "no addresses"
+	case strings.Contains(msg, "protocols not supported"), strings.Contains(msg, "protocol not supported"):
+		return "protocol not supported"
+	case strings.Contains(msg, "no route"), strings.Contains(msg, "unreachable"),
+		strings.Contains(msg, "connection refused"), strings.Contains(msg, "failed to dial"):
+		return "no route"
+	}
+	if len(msg) > 60 {
+		msg = msg[:57] + "..."
+	}
+	return msg
+}
+
+// effectiveRelayDialTimeout 返回中继拨号实际使用的超时时间。未指定 -relay-dial-timeout 时
+// 按直连超时的 5/3 倍计算：中继路径要多经过一跳 (连接中继 + 建立电路)，默认 12s 直连对应 20s 中继。
+func effectiveRelayDialTimeout() time.Duration {
+	if relayDialTimeout > 0 {
+		return relayDialTimeout
+	}
+	return dialTimeout * 5 / 3
+}
+
+// logConnectErr 在 verbose 模式下打印 Connect 的失败原因 (连接被拒绝、超时、无路由等)，
+// 否则该错误只会体现为随后 NewStream 的一个笼统错误。
+func logConnectErr(what string, id peer.ID, err error) {
+	if err != nil {
+		logger.Debug("dial failed", "via", what, "peer", id, "reason", shortDialErr(err), "err", err)
+	}
+}
+
+// 连接建立后打开流的重试参数：刚建连时对端可能尚未完成协议注册、中继电路也可能尚未就绪，
+// 第一次 NewStream 会瞬时失败。重试总时长控制在 1 秒以内，不掩盖真正的失败。
+const (
+	newStreamAttempts   = 3
+	newStreamRetryDelay = 300 * time.Millisecond
+)
+
+// newStreamRetry 打开到 id 的流，失败且仍与对端保持连接时短暂等待后重试；
+// 没有任何连接 (Connect 本身失败) 或 ctx 结束时立即返回最后一次的错误。
+func newStreamRetry(ctx context.Context, h host.Host, id peer.ID, proto protocol.ID) (network.Stream, error) {
+	var err error
+	for i := 0; i < newStreamAttempts; i++ {
+		if i > 0 {
+			if len(h.Network().ConnsToPeer(id)) == 0 {
+				break
+			}
+			logger.Debug("open stream failed, retrying", "peer", id, "reason", shortDialErr(err))
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(newStreamRetryDelay):
+			}
+		}
+		var s network.Stream
+		if s, err = h.NewStream(ctx, id, proto); err == nil {
+			return s, nil
+		}
+	}
+	return nil, err
+}
+
+// raceHeadStart 是并行拨号时优先一路的领先时间 (RFC 8305 的 Connection Attempt Delay)：
+// 优先的一路在这段时间内成功则另一路不会启动，失败则另一路立即开始而不必等满。
+// 基准测试把它设为直连超时，以对比并行之前顺序拨号的耗时。
+var raceHeadStart = 250 * time.Millisecond
+
+// dialLeg 是 raceConnect 中的一路连接尝试。
+type dialLeg struct {
+	name string
+	dial func(ctx context.Context) error
+}
+
+// raceConnect 以 happy eyeballs 的方式并行建立连接：legs[0] 先行，headStart 之后
+// (或 legs[0] 提前失败时) 启动 legs[1]，最先成功的一路获胜并取消另一路。
+// 返回获胜一路的下标 (全部失败时为 -1) 与各路的错误；被取消的一路错误为 nil。
+func raceConnect(ctx context.Context, headStart time.Duration, legs ...dialLeg) (int, []error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result, len(legs))
+	start := func(i int) {
+		go func() { results <- result{i, legs[i].dial(ctx)} }()
+	}
+	errs := make([]error, len(legs))
+	started, pending := 0, 0
+	next := func() {
+		if started < len(legs) {
+			start(started)
+			started++
+			pending++
+		}
+	}
+	next()
+	timer := time.NewTimer(headStart)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			next()
+			if started < len(legs) {
+				timer.Reset(headStart)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.i, errs
+			}
+			errs[r.i] = r.err
+			next()
+		}
+	}
+	return -1, errs
+}
+
+// pickCandidates 返回本轮要拨号的节点：保持发现结果的顺序 (最近注册的在前)，跳过本周期内
+// 已经拨号失败的节点，避免每轮都先在残留的过期注册上耗尽超时。发现的节点都失败过时开始
+// 新的周期：清空 failed 后全部重试，对端可能只是还没准备好。
+func pickCandidates(infos []peer.AddrInfo, failed map[peer.ID]bool) []peer.AddrInfo {
+	var out []peer.AddrInfo
+	for _, ai := range infos {
+		if !failed[ai.ID] {
+			out = append(out, ai)
+		}
+	}
+	if len(out) == 0 {
+		clear(failed)
+		return infos
+	}
+	return out
+}
+
+// tryOpenChat 尝试通过 disc 发现对等节点并建立聊天流。
+// 失败时返回 *openChatError，其中包含每个节点的尝试记录。
+func tryOpenChat(ctx context.Context, h host.Host, disc p2p.Discovery, topic string, relays []peer.AddrInfo, maxWait time.Duration, relayFirst bool) (network.Stream, error) {
+	deadline := time.Now().Add(maxWait)
+	report := &openChatError{}
+	failed := make(map[peer.ID]bool) // 本周期内拨号失败的节点，见 pickCandidates
+
+	for time.Now().Before(deadline) {
+		// 1. 通过发现后端 (默认为汇合点) 查找同一主题下的其他节点。
+		infos, err := disc.Discover(ctx, topic, discoverLimit)
+		if err != nil || len(infos) == 0 {
+			if err != nil {
+				report.discoverErr = fmt.Errorf("discover: %w", err)
+			}
+			time.Sleep(1200 * time.Millisecond)
+			continue
+		}
+
+		// 2. 定义直连和通过中继建立连接的辅助函数。二者只负责建立连接，由 raceConnect 并行竞速；
+		// 同一对端的多个直连地址与传输之间的竞速由 libp2p 的拨号排序完成。
+		connectDirect := func(ctx context.Context, remote peer.AddrInfo) error {
+			dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			err := h.Connect(dialCtx, remote)
+			logConnectErr("direct", remote.ID, err)
+			var conn network.Conn
+			if conns := h.Network().ConnsToPeer(remote.ID); err == nil && len(conns) > 0 {
+				conn = conns[0]
+			}
+			transports.observeDial(err, conn)
+			return err
+		}
+		connectViaRelay := func(ctx context.Context, remote peer.AddrInfo, allRelays []peer.AddrInfo) error {
+			if len(allRelays) == 0 {
+				return fmt.Errorf("no relays")
+			}
+			dialCtx, cancel := context.WithTimeout(ctx, effectiveRelayDialTimeout())
+			defer cancel()
+			// 中继连接是 limited conn，默认不允许在其上打开流
+			dialCtx = network.WithAllowLimitedConn(dialCtx, "wormhole-relay")
+			for _, r := range allRelays {
+				logConnectErr("relay", r.ID, h.Connect(dialCtx, r))
+			}
+			for _, r := range allRelays {
+				for _, a := range r.Addrs {
+					viaStr := a.String()
+					if !strings.Contains(viaStr, "/p2p/") {
+						viaStr += fmt.Sprintf("/p2p/%s", r.ID.String())
+					}
+					viaStr += fmt.Sprintf("/p2p-circuit/p2p/%s", remote.ID.String())
+					if via, err := ma.NewMultiaddr(viaStr); err == nil {
+						h.Peerstore().AddAddr(remote.ID, via, 2*time.Minute)
+					}
+				}
+			}
+			err := h.Connect(dialCtx, remote)
+			logConnectErr("via relay", remote.ID, err)
+			return err
+		}
+		// openChat 在已建立的连接上打开唯一的聊天流；对端只接受第一个聊天流，
+		// 因此竞速只针对连接，不会同时打开多个流
+		openChat := func(remote peer.ID, limited bool) (network.Stream, error) {
+			streamCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			if limited {
+				streamCtx = network.WithAllowLimitedConn(streamCtx, "wormhole-relay")
+			}
+			return newStreamRetry(streamCtx, h, remote, models.ProtoChat)
+		}
+
+		// 3. 依次尝试本轮的候选节点；成功即返回，因此先记为失败
+		for _, remote := range pickCandidates(infos, failed) {
+			failed[remote.ID] = true
+			remoteRelays := mergeRelaysFromRemote(remote, relays)
+			preferRelay := relayFirst || allRelayedAddrs(remote) || len(remoteRelays) > 0
+
+			a := report.attempt(remote.ID)
+			a.rounds++
+			a.relays = len(remoteRelays)
+
+			if forceDirect { // 只尝试直连，从不回退到中继
+				a.relayErr = errRelayDisabled
+				if err := connectDirect(ctx, directAddrs(remote)); err != nil {
+					a.directErr = err
+					continue
+				}
+				s, err := openChat(remote.ID, false)
+				if err == nil {
+					return s, nil
+				}
+				a.directErr = err
+				continue
+			}
+
+			// 直连与中继并行竞速，优先的一路领先 raceHeadStart
+			direct := dialLeg{"direct", func(ctx context.Context) error { return connectDirect(ctx, remote) }}
+			relay := dialLeg{"relay", func(ctx context.Context) error { return connectViaRelay(ctx, remote, remoteRelays) }}
+			legs := []dialLeg{direct, relay}
+			if preferRelay {
+				legs = []dialLeg{relay, direct}
+			}
+			won, errs := raceConnect(ctx, raceHeadStart, legs...)
+			for i, leg := range legs {
+				switch {
+				case errs[i] == nil: // 获胜、被取消或未启动
+				case leg.name == "direct":
+					a.directErr = errs[i]
+				default:
+					a.relayErr = errs[i]
+				}
+			}
+			if won < 0 {
+				continue
+			}
+			logger.Debug("connected", "peer", remote.ID, "winner", legs[won].name)
+			s, err := openChat(remote.ID, legs[won].name == "relay")
+			if err == nil {
+				return s, nil
+			}
+			if legs[won].name == "direct" {
+				a.directErr = err
+			} else {
+				a.relayErr = err
+			}
+		}
+		time.Sleep(1200 * time.Millisecond)
+	}
+
+	return nil, report
+}
+
+// newPassphrase 从词表中随机选取 n 个单词，以 "-" 连接成口令。
+func newPassphrase(ws []string, n int) string {
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = client.RandWord(ws)
+	}
+	return strings.Join(parts, "-")
+}
+
+// normalizeCode 把人工输入的代码规整为唯一形式：去掉首尾空白、统一为小写并做 Unicode NFC 规范化，
+// 词与词之间的空白或连续的 "-" 都视为一个分隔符。口令会直接参与 PAKE，
+// 双方必须得到逐字节相同的字符串，否则肉眼一致的代码也会以密钥确认失败告终。
+func normalizeCode(code string) string {
+	code = norm.NFC.String(strings.ToLower(code))
+	parts := strings.FieldsFunc(code, func(r rune) bool { return r == '-' || unicode.IsSpace(r) })
+	return strings.Join(parts, "-")
+}
+
+// parseCode 将 '<nameplate>-<word>-<word>[-<word>...]' 拆分为密码牌和口令。
+// 口令可以包含任意数量 (至少两个) 的单词，传入前先经过 normalizeCode。
+// 在认领之前做预检，可以尽早发现只复制了一半的代码，而不是在 PAKE 阶段得到难以理解的错误。
+func parseCode(code string, minWords int) (nameplate, passphrase string, err error) {
+	code = normalizeCode(code)
+	parts := strings.Split(code, "-")
+	if len(parts) < 3 {
+		return "", "", fmt.Errorf("bad code format: want '<nameplate>-<word>-<word>'")
+	}
+	nameplate, words := parts[0], parts[1:]
+	if !nameplateRe.MatchString(nameplate) {
+		return "", "", fmt.Errorf("bad code format: nameplate %q should be 3-4 digits or letters", nameplate)
+	}
+	for _, w := range words {
+		if len(w) < minCodeWordLen || !codeWordRe.MatchString(w) {
+			return "", "", fmt.Errorf("that doesn't look like a full code: word %q is incomplete (did you copy the whole code?)", w)
+		}
+	}
+	if len(words) < minWords {
+		return "", "", fmt.Errorf("that doesn't look like a full code: got %d word(s), want at least %d (did you copy the whole code?)", len(words), minWords)
+	}
+	return nameplate, strings.Join(words, "-"), nil
+}
+
+// maxCodeLine 是 -code-from-stdin 读取的一行的最大长度，远超任何合法的代码或链接
+const maxCodeLine = 4096
+
+// readCodeLine 从 r 读取一行 (到换行或 EOF 为止) 并去掉首尾空白，用于 -code-from-stdin。
+// 逐字节读取而不经缓冲，之后的输入仍留在 r 中，可继续作为聊天输入或命令。
+func readCodeLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			if len(line) >= maxCodeLine {
+				return "", fmt.Errorf("first line of stdin is longer than %d bytes, not a code", maxCodeLine)
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("read code from stdin: %w", err)
+		}
+	}
+	code := strings.TrimSpace(string(line))
+	if code == "" {
+		return "", errors.New("no code on stdin (want '<nameplate>-<word>-<word>' on the first line)")
+	}
+	return code, nil
+}
+
+// minCodeWordLen 是按 "-" 切分后单词片段的最小长度：词表中最短的单词为 3 个字母，
+// 但 "yo-yo" 会被切分为两个 2 个字母的片段
+const minCodeWordLen = 2
+
+// nameplatePattern 同时接受纯数字密码牌与 alnum 字符集 (models.NameplateAlphabets) 生成的密码牌
+const nameplatePattern = `(\d{3,4}|[2-9a-hjkmnp-z]{3,4})`
+
+var (
+	nameplateRe = regexp.MustCompile(`^` + nameplatePattern + `$`)
+	codeWordRe  = regexp.MustCompile(`^[a-z]+$`)
+	codeRe      = regexp.MustCompile(`^` + nameplatePattern + `(-[a-z]+){2,}$`) // 规范化后的完整代码
+)
+
+// positionalCode 从位置参数中取出代码或 wormhole:// 链接，没有位置参数时返回空串。
+// 代码先经 normalizeCode 规范化，"4567-Able-Acid" 与未加引号的 4567 able acid 都能识别；
+// 其他参数返回错误，而不是被忽略后按 host 模式启动。
+func positionalCode(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	arg := strings.Join(args, " ")
+	if len(args) == 1 && strings.HasPrefix(strings.ToLower(arg), codeURIScheme) {
+		return arg, nil
+	}
+	if code := normalizeCode(arg); codeRe.MatchString(code) {
+		return code, nil
+	}
+	return "", fmt.Errorf("unrecognized argument %q: want a code like 4567-able-acid or a %s link", arg, codeURIScheme)
+}
+
+// checkNameplateCharset 在认领前向服务器查询密码牌格式：服务器只发放纯数字密码牌时，
+// 含字母的密码牌必然是输错了，直接报错而不是白白消耗一次认领。查询失败时不做判断。
+func checkNameplateCharset(ctx context.Context, controlURL, nameplate string) error {
+	if strings.Trim(nameplate, "0123456789") == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+	info, err := api.NewClient(controlURL).Info(ctx)
+	if err != nil {
+		return nil
 	}
+	if info.NameplateCharset == "" || info.NameplateCharset == models.NameplateCharsetDigits {
+		return fmt.Errorf("bad code format: this server only issues numeric nameplates, got %q (did you mistype the code?)", nameplate)
+	}
+	return nil
 }
 
-// mergeRelaysFromRemote 将从远程节点地址中提取的中继信息与已知的中继列表合并。
-func mergeRelaysFromRemote(remote peer.AddrInfo, known []peer.AddrInfo) []peer.AddrInfo {
-	merged := make(map[peer.ID]peer.AddrInfo)
-	for _, r := range known {
-		merged[r.ID] = r
+// codeURIScheme 是携带代码与控制服务器的链接前缀，形如
+// wormhole://<nameplate>-<word>-<word>?control=<url>，供扫码或配套应用直接加入会话。
+// 控制服务器地址本身带有 scheme 和路径，无法放进 URI 的主机部分，因此放在查询参数中。
+const codeURIScheme = "wormhole://"
+
+// codeURI 返回携带代码与控制服务器的 wormhole:// 链接，controlURL 为空时省略查询参数
+func codeURI(code, controlURL string) string {
+	u := codeURIScheme + code
+	if controlURL != "" {
+		u += "?" + url.Values{"control": {controlURL}}.Encode()
 	}
-	for _, a := range remote.Addrs {
-		s := a.String()
-		idx := strings.Index(s, "/p2p-circuit")
-		if idx < 0 {
-			continue
-		}
-		base := s[:idx]
-		m, err := ma.NewMultiaddr(base)
-		if err != nil {
-			continue
+	return u
+}
+
+// parseCodeURI 解析 codeURI 生成的链接，返回代码与控制服务器地址 (链接未携带时为空)。
+// 链接的结构、代码格式和控制服务器地址都在这里校验，出错时给出明确的原因。
+func parseCodeURI(s string) (code, controlURL string, err error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return "", "", fmt.Errorf("bad wormhole link: %v", err)
+	}
+	if u.Scheme != strings.TrimSuffix(codeURIScheme, "://") || u.Opaque != "" {
+		return "", "", fmt.Errorf("bad wormhole link: want %s<code>[?control=<url>]", codeURIScheme)
+	}
+	if u.User != nil || u.Port() != "" || (u.Path != "" && u.Path != "/") || u.Fragment != "" {
+		return "", "", fmt.Errorf("bad wormhole link: unexpected parts after the code in %q", s)
+	}
+	code = strings.ToLower(u.Host)
+	if _, _, err := parseCode(code, 2); err != nil {
+		return "", "", fmt.Errorf("bad wormhole link: %v", err)
+	}
+
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", "", fmt.Errorf("bad wormhole link: %v", err)
+	}
+	for k, v := range q {
+		if k != "control" {
+			return "", "", fmt.Errorf("bad wormhole link: unknown parameter %q", k)
 		}
-		ai, err := peer.AddrInfoFromP2pAddr(m)
-		if err != nil || ai.ID == "" {
-			continue
+		if len(v) != 1 {
+			return "", "", fmt.Errorf("bad wormhole link: control given %d times", len(v))
 		}
-		if cur, ok := merged[ai.ID]; ok {
-			cur.Addrs = append(cur.Addrs, ai.Addrs...)
-			merged[ai.ID] = cur
-		} else {
-			merged[ai.ID] = *ai
+	}
+	if controlURL = q.Get("control"); controlURL != "" {
+		cu, err := url.Parse(controlURL)
+		if err != nil || (cu.Scheme != "http" && cu.Scheme != "https") || cu.Host == "" || cu.User != nil {
+			return "", "", fmt.Errorf("bad wormhole link: control %q is not an http(s) URL", controlURL)
 		}
 	}
-	out := make([]peer.AddrInfo, 0, len(merged))
-	for _, ai := range merged {
-		out = append(out, ai)
+	return code, controlURL, nil
+}
+
+// printCodeQR 在终端打印 text 的二维码，编码失败 (内容过长) 时只给出提示
+func printCodeQR(text string) {
+	fmt.Print(codeQR(text))
+	fmt.Println(text)
+}
+
+// codeQR 将 text 编码为终端文本形式的二维码 (低纠错等级，四周留静默区)，每行字符对应上下两行模块。
+// 浅色模块用方块字符绘制、深色模块留空，因此适合深色背景的终端；编码失败时返回空串。
+func codeQR(text string) string {
+	q, err := qrcode.New(text, qrcode.Low)
+	if err != nil {
+		logger.Warn("cannot render QR code", "err", err)
+		return ""
 	}
-	return out
+	return q.ToSmallString(false)
 }
 
-// allRelayedAddrs 检查一个节点的所有地址是否都是中继地址。
-func allRelayedAddrs(ai peer.AddrInfo) bool {
-	if len(ai.Addrs) == 0 {
-		return false
+// selftestSize 是 selftest 传输的随机文件大小。
+const selftestSize = 4 << 20
+
+// newSelftestUI 创建不连接终端的控制台：自检不需要交互，会话输出直接丢弃。
+func newSelftestUI() (*uiConsole, error) {
+	return uipkg.NewPlainConsole(strings.NewReader(""), io.Discard, io.Discard, ""), nil
+}
+
+// runSelftest 在同一进程内完整走一遍流程：内存控制面 → 分配与双方认领 → 回环直连 →
+// PAKE 与 SAS → 文件传输与校验，逐阶段打印耗时，任一阶段失败即返回错误。
+// 汇合点发现与中继依赖外部服务，不在自检范围内，双方直接拨号对方的回环地址。
+func runSelftest(ctx context.Context, emit func(string), size int) error {
+	phase := func(name string, fn func() (string, error)) error {
+		start := time.Now()
+		detail, err := fn()
+		status := "ok"
+		if err != nil {
+			status = "FAIL: " + err.Error()
+		} else if detail != "" {
+			status += " (" + detail + ")"
+		}
+		emit(fmt.Sprintf("  %-9s %10s  %s", name, time.Since(start).Round(10*time.Microsecond), status))
+		return err
 	}
-	for _, a := range ai.Addrs {
-		if !strings.Contains(a.String(), "/p2p-circuit") {
-			return false
+
+	// 1. 内存控制面：复用 pkg/server 的处理器与 MemoryStore，只监听回环地址
+	var ctrl *api.Client
+	if err := phase("control", func() (string, error) {
+		hs := server.NewHTTPHandlers(server.NewMemoryStore(), server.NewIPLimiter(time.Minute, 1000, time.Minute, 1000),
+			"wormhole-selftest", nil, nil, nil, time.Minute, 3)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/v1/allocate", hs.HandleAllocate)
+		mux.HandleFunc("/v1/claim", hs.HandleClaim)
+		mux.HandleFunc("/v1/consume", hs.HandleConsume)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
 		}
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+		go func() { _ = srv.Serve(ln) }()
+		go func() {
+			<-ctx.Done()
+			_ = srv.Close()
+		}()
+		ctrl = api.NewClient("http://" + ln.Addr().String())
+		return ln.Addr().String(), nil
+	}); err != nil {
+		return err
 	}
-	return true
-}
 
-// tryOpenChat 尝试通过汇合点发现对等节点并建立聊天流。
-func tryOpenChat(ctx context.Context, h host.Host, rzvc rzv.RendezvousClient, topic string, relays []peer.AddrInfo, maxWait time.Duration, relayFirst bool) (network.Stream, error) {
-	deadline := time.Now().Add(maxWait)
-	var lastErr error
+	// 2. 分配密码牌，host 与 connect 依次认领
+	var nameplate string
+	if err := phase("claim", func() (string, error) {
+		alloc, err := ctrl.Allocate(ctx)
+		if err != nil {
+			return "", fmt.Errorf("allocate: %w", err)
+		}
+		nameplate = alloc.Nameplate
+		if cl, err := ctrl.Claim(ctx, nameplate, "host"); err != nil || cl.Status != string(models.StatusWaiting) {
+			return "", fmt.Errorf("host claim: %v %v", cl, err)
+		}
+		if cl, err := ctrl.Claim(ctx, nameplate, "connect"); err != nil || cl.Status != string(models.StatusPaired) {
+			return "", fmt.Errorf("connect claim: %v %v", cl, err)
+		}
+		return "nameplate " + nameplate, nil
+	}); err != nil {
+		return err
+	}
 
-	for time.Now().Before(deadline) {
-		// 1. 通过汇合点发现同一主题下的其他节点。
-		infos, _, err := rzvc.Discover(ctx, topic, 64, nil)
-		if err != nil || len(infos) == 0 {
-			if err != nil {
-				lastErr = fmt.Errorf("discover: %w", err)
-			} else {
-				lastErr = fmt.Errorf("discover: no peers yet")
+	// 3. 两个只监听回环地址的 libp2p 主机，connect 一侧直接拨号 host
+	var hostH, connH host.Host
+	defer func() {
+		for _, h := range []host.Host{hostH, connH} {
+			if h != nil {
+				_ = h.Close()
 			}
-			time.Sleep(1200 * time.Millisecond)
-			continue
 		}
-
-		// 2. 定义直连和通过中继连接的辅助函数。
-		dialDirect := func(remote peer.AddrInfo) (network.Stream, error) {
-			dialCtx, cancel := context.WithTimeout(ctx, 12*time.Second)
-			defer cancel()
-			_ = h.Connect(dialCtx, remote)
-			return h.NewStream(dialCtx, remote.ID, models.ProtoChat)
+	}()
+	if err := phase("dial", func() (string, error) {
+		var err error
+		if hostH, err = libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")); err != nil {
+			return "", err
 		}
-		dialViaRelay := func(remote peer.AddrInfo, allRelays []peer.AddrInfo) (network.Stream, error) {
-			if len(allRelays) == 0 {
-				return nil, fmt.Errorf("no relays")
-			}
-			dialCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
-			defer cancel()
-			for _, r := range allRelays {
-				_ = h.Connect(dialCtx, r)
-			}
-			for _, r := range allRelays {
-				for _, a := range r.Addrs {
-					viaStr := a.String()
-					if !strings.Contains(viaStr, "/p2p/") {
-						viaStr += fmt.Sprintf("/p2p/%s", r.ID.String())
-					}
-					viaStr += fmt.Sprintf("/p2p-circuit/p2p/%s", remote.ID.String())
-					if via, err := ma.NewMultiaddr(viaStr); err == nil {
-						h.Peerstore().AddAddr(remote.ID, via, 2*time.Minute)
-					}
-				}
-			}
-			_ = h.Connect(dialCtx, remote)
-			return h.NewStream(dialCtx, remote.ID, models.ProtoChat)
+		if connH, err = libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")); err != nil {
+			return "", err
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+		if err := connH.Connect(dialCtx, peer.AddrInfo{ID: hostH.ID(), Addrs: hostH.Addrs()}); err != nil {
+			return "", err
 		}
+		return p2p.ClassifyPath(connH.Network().ConnsToPeer(hostH.ID())[0]).Transport, nil
+	}); err != nil {
+		return err
+	}
 
-		// 3. 遍历发现的节点，尝试建立连接。
-		for _, remote := range infos {
-			remoteRelays := mergeRelaysFromRemote(remote, relays)
-			preferRelay := relayFirst || allRelayedAddrs(remote) || len(remoteRelays) > 0
+	// 4. 在聊天流上运行 PAKE，双方独立派生的 SAS 与传输种子必须一致
+	var seedHost, seedConn uint64
+	if err := phase("pake", func() (string, error) {
+		passphrase := newPassphrase(client.EFFWords(effShortWordlist), 2)
+		labels, err := crypto.LabelsFor(models.ProtoChat)
+		if err != nil {
+			return "", err
+		}
+		inbound := make(chan network.Stream, 1)
+		hostH.SetStreamHandler(models.ProtoChat, func(s network.Stream) { inbound <- s })
+		cs, err := connH.NewStream(ctx, hostH.ID(), models.ProtoChat)
+		if err != nil {
+			return "", err
+		}
+		defer cs.Close()
+		type pakeResult struct {
+			K   []byte
+			err error
+		}
+		connRes := make(chan pakeResult, 1)
+		go func() {
+			K, err := session.RunPAKEAndConfirm(ctx, cs, true, passphrase, nameplate, models.ProtoChat, connH.ID(), hostH.ID())
+			connRes <- pakeResult{K, err}
+		}()
+		var hs network.Stream
+		select {
+		case hs = <-inbound:
+		case <-time.After(dialTimeout):
+			return "", fmt.Errorf("host did not receive the chat stream")
+		}
+		defer hs.Close()
+		kHost, err := session.RunPAKEAndConfirm(ctx, hs, false, passphrase, nameplate, models.ProtoChat, hostH.ID(), connH.ID())
+		if err != nil {
+			return "", fmt.Errorf("host: %w", err)
+		}
+		cr := <-connRes
+		if cr.err != nil {
+			return "", fmt.Errorf("connect: %w", cr.err)
+		}
+		var sasHost, sasConn string
+		_, sasHost, seedHost = sessionSecrets(labels, kHost, nameplate, hostH.ID(), connH.ID())
+		_, sasConn, seedConn = sessionSecrets(labels, cr.K, nameplate, connH.ID(), hostH.ID())
+		if sasHost != sasConn || seedHost != seedConn {
+			return "", fmt.Errorf("SAS mismatch: host %s, connect %s", sasHost, sasConn)
+		}
+		if err := ctrl.Consume(ctx, nameplate); err != nil {
+			return "", fmt.Errorf("consume: %w", err)
+		}
+		return "SAS " + sasHost, nil
+	}); err != nil {
+		return err
+	}
 
-			var s network.Stream
-			var err error
-			if preferRelay { // 优先尝试中继
-				if s, err = dialViaRelay(remote, remoteRelays); err == nil {
-					return s, nil
-				}
-				if s, err = dialDirect(remote); err == nil {
-					return s, nil
-				}
-				lastErr = err
-			} else { // 优先尝试直连
-				if s, err = dialDirect(remote); err == nil {
-					return s, nil
-				}
-				if s, err = dialViaRelay(remote, remoteRelays); err == nil {
-					return s, nil
-				}
-				lastErr = err
+	// 5. 通过 XFER 协议传输随机文件，接收方校验哈希后落盘，再逐字节比对
+	return phase("transfer", func() (string, error) {
+		dir, err := os.MkdirTemp("", "wormhole-selftest-")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(dir)
+		srcDir, outDir := filepath.Join(dir, "src"), filepath.Join(dir, "out")
+		for _, d := range []string{srcDir, outDir} {
+			if err := os.Mkdir(d, 0o700); err != nil {
+				return "", err
 			}
 		}
-		time.Sleep(1200 * time.Millisecond)
-	}
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			return "", err
+		}
+		src := filepath.Join(srcDir, "selftest.bin")
+		if err := os.WriteFile(src, data, 0o600); err != nil {
+			return "", err
+		}
+		uiHost, err := newSelftestUI()
+		if err != nil {
+			return "", err
+		}
+		defer uiHost.Close()
+		uiConn, err := newSelftestUI()
+		if err != nil {
+			return "", err
+		}
+		defer uiConn.Close()
 
-	if lastErr == nil {
-		lastErr = fmt.Errorf("failed to establish stream (no peers or no dialable addrs)")
-	}
-	return nil, lastErr
+		received := make(chan struct{})
+		yes := func(string, time.Duration) bool { return true }
+		hostH.SetStreamHandler(models.ProtoXfer, func(xs network.Stream) {
+			defer close(received)
+			handleIncomingXfer(ctx, hostH, xs, xferDest{outDir: outDir}, yes, uiHost, seedHost)
+		})
+		start := time.Now()
+		if _, err := sendXfer(ctx, connH, hostH.ID(), "file", src, uiConn, seedConn); err != nil {
+			return "", err
+		}
+		select {
+		case <-received:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		elapsed := time.Since(start)
+		got, err := os.ReadFile(filepath.Join(outDir, "selftest.bin"))
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(got, data) {
+			return "", fmt.Errorf("received file differs from the original")
+		}
+		return fmt.Sprintf("%s, %.1f MiB/s", formatSize(int64(size)), float64(size)/(1<<20)/elapsed.Seconds()), nil
+	})
 }
 
 // ---------- 主函数 ----------
@@ -1329,33 +5042,214 @@ func main() {
 	var controlURL string
 	var code string
 	var codeShort string
+	var codeFromStdin bool
 	var mode string
 	var listen string
+	var announce string
+	var bootstrapCSV string
 	var outDir string
 	var verify bool
-	var jsonOut bool
+	var verifyModeStr string
+	var logLevelStr string
+	var verboseFlag bool
 	var dlDir string
+	var words int
+	var minWords int
+	var showQR bool
 
 	flag.StringVar(&controlURL, "control", "https://wormhole.pianlab.team", "control-plane base URL, e.g. http://ctrl:8080")
 	flag.StringVar(&code, "code", "", "join: code '<nameplate>-<word>-<word>'")
 	flag.StringVar(&codeShort, "c", "", "alias of -code")
+	flag.BoolVar(&codeFromStdin, "code-from-stdin", false, "join: read the code (or a wormhole:// link) from the first line of stdin, keeping it out of the process list and shell history")
 	flag.StringVar(&mode, "mode", "", "(deprecated) host|connect; auto-detected by -code/-c or positional code")
 	flag.StringVar(&listen, "listen", "", "optional listen multiaddrs (comma-separated)")
+	flag.StringVar(&bootstrapCSV, "bootstrap", "", "extra bootstrap multiaddrs (comma-separated) to connect to at startup, in addition to those sent by the server")
+	flag.StringVar(&announce, "announce", "", "external multiaddrs to advertise, e.g. /dns4/home.example.org/tcp/4001 for a port-forwarded host (comma-separated)")
 	flag.StringVar(&outDir, "outdir", ".", "directory to save incoming files")
 	flag.StringVar(&dlDir, "download-dir", "", "download directory (alias of -outdir)")
+	flag.IntVar(&words, "words", 2, "host: number of passphrase words in the generated code (2-8)")
+	flag.IntVar(&minWords, "min-words", 2, "connect: minimum number of passphrase words the code must contain (2-8)")
 	flag.BoolVar(&verify, "verify", true, "require local confirmation (y/N) on dialer side")
-	flag.BoolVar(&jsonOut, "json", false, "emit JSON logs (reserved)")
-	flag.BoolVar(&verbose, "verbose", false, "print verbose logs (reservation/announce addrs, etc.)")
+	flag.StringVar(&verifyModeStr, "verify-mode", "", "who must confirm the SAS: both | dialer-only | host-only | none (default: from -verify)")
+	flag.BoolVar(&jsonOut, "json", false, "emit transfer progress as JSON lines on stdout (progress/file_done events) instead of drawing progress bars")
+	flag.StringVar(&logLevelStr, "log-level", "", "log level for the app and libp2p: error | warn | info | debug (default info; warn with -quiet)")
+	flag.BoolVar(&verboseFlag, "verbose", false, "print verbose logs (reservation/announce addrs, etc.); same as -log-level debug")
+	flag.BoolVar(&quiet, "quiet", false, "only print the code, transfer results and errors (no banners, logs or progress bars)")
+	flag.BoolVar(&noReport, "no-report", false, "do not report transfer outcomes (file/byte counts, path type; no names or codes) to the control server")
+	flag.BoolVar(&strictSAS, "strict-sas", false, "confirm the peer by typing the SAS shown on its screen (emoji or No. digits) instead of answering y/N; implies confirming on this side whatever -verify-mode says and hides the local SAS, so the peer must run without -strict-sas")
+	flag.BoolVar(&sasCheck, "sas-check", false, "exchange an HMAC of the SAS after PAKE and abort automatically on mismatch (both sides)")
+	flag.StringVar(&outTemplate, "out-template", "{name}", "receive dir: path under -outdir, tokens {name} {date} {peer} {code}, e.g. {date}/{name}")
+	flag.StringVar(&relaySelect, "relay-select", "first", "relay reservation order: first (server order) | fastest (lowest ping RTT)")
+	flag.BoolVar(&asArchive, "as-archive", false, "send dir: stream the directory as one tar instead of file by file (faster for many small files over relays)")
+	flag.IntVar(&ackWindow, "ack-window", 1, "send dir: number of files to send ahead before waiting for their ACKs (1 = wait for each file)")
+	flag.Float64Var(&ewmaAge, "ewma-age", 0, "progress bars: EWMA window for speed/ETA smoothing (0 = pick by transfer size)")
+	flag.StringVar(&tempDir, "temp-dir", "", "receive: write in-progress "+partSuffix+" files here instead of next to the destination (copied over if on another filesystem)")
+	flag.BoolVar(&keepFailed, "keep-failed", false, "receive: keep files that fail the hash check as <name>"+corruptSuffix+" for inspection instead of deleting them")
+	flag.BoolVar(&noIndex, "no-index", false, "receive: do not record received files in <outdir>/"+transfer.DownloadIndexName)
+	flag.StringVar(&onConnect, "on-connect", "", "shell command to run once the peer is verified; session details are passed as WORMHOLE_* environment variables")
+	flag.StringVar(&onDisconnect, "on-disconnect", "", "shell command to run when the session ends (WORMHOLE_* variables plus WORMHOLE_REASON)")
+	flag.StringVar(&autoSend, "send", "", "host: send this file or directory automatically once the peer confirms the code")
+	flag.BoolVar(&showQR, "qr", false, "host: also print the code as a terminal QR code (encodes a wormhole:// link with the control server)")
+	flag.BoolVar(&outdirByCode, "outdir-by-code", false, "receive: save everything under <outdir>/<nameplate>/ of this session")
+	flag.StringVar(&archiveFormat, "archive", "", "receive dir: save into a single archive (tar|zip) instead of loose files")
+	flag.BoolVar(&honorSuggestedPath, "honor-suggested-path", false, "receive: save a single file at the relative path the sender suggests (/send -f <file> -to <path>) instead of under its name")
+	flag.BoolVar(&showDigest, "digest", false, "print a transfer-wide digest over all delivered files after each transfer; the receiver always checks it against the sender's")
+	flag.StringVar(&progressFile, "progress-file", "", "write a JSON list of acknowledged files to this path (as <name>-send/-recv.<ext>) during each transfer; removed once it completes")
+	flag.IntVar(&connLow, "conn-low", connLow, "connection manager: trim down to this many connections")
+	flag.IntVar(&connHigh, "conn-high", connHigh, "connection manager: start trimming above this many connections")
+	flag.DurationVar(&connGrace, "conn-grace", connGrace, "connection manager: new connections are never trimmed within this period")
+	flag.BoolVar(&forceDirect, "force-direct", false, "only connect to the peer directly and fail instead of falling back to a relay")
+	flag.StringVar(&transportsFlag, "transports", "", "comma-separated transports to dial and announce: tcp,quic,ws,webtransport,webrtc (default all; e.g. tcp,ws where UDP is blocked)")
+	flag.DurationVar(&dialTimeout, "dial-timeout", 12*time.Second, "timeout of each direct dial attempt to the peer")
+	flag.DurationVar(&relayDialTimeout, "relay-dial-timeout", 0, "timeout of each relayed dial attempt (0 = 5/3 of -dial-timeout)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "close the chat after this long without messages or transfers, e.g. 30m (0 disables)")
+	flag.Var(&excludes, "exclude", "send dir: skip files/dirs matching this pattern (repeatable, e.g. .git/ node_modules *.tmp)")
+	flag.BoolVar(&rawChat, "raw", false, "print peer chat messages unfiltered (allows terminal control sequences)")
+	flag.IntVar(&discoverLimit, "discover-limit", discoverLimit, "connect: maximum number of peers to request per rendezvous lookup")
+	flag.IntVar(&writeBufSize, "write-buffer", defaultWriteBuf, "receive: bytes of write buffering in front of each received file (0 = write every chunk straight to disk)")
+	flag.IntVar(&maxChatMsg, "max-chat-msg", defaultMaxChatMsg, "maximum size in bytes of a single chat message; longer messages are dropped instead of ending the session")
 	flag.Parse()
-	_ = jsonOut
 
-	// 支持通过位置参数传递代码
-	var codeRe = regexp.MustCompile(`^\d{3}-[a-z]+-[a-z]+$`)
+	// 配置文件 (如果存在) 提供默认值，命令行参数优先
+	loadedConfig, err := loadClientConfig(flag.CommandLine, clientConfigPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 子命令：wormhole version
+	if flag.NArg() == 1 && flag.Arg(0) == "version" {
+		for _, ln := range version.Lines() {
+			fmt.Println(ln)
+		}
+		return
+	}
+	// 日志级别：-log-level 优先，-verbose 等价于 debug，-quiet 只保留警告与错误
+	level := slog.LevelInfo
+	if verboseFlag {
+		level = slog.LevelDebug
+	} else if quiet {
+		level = slog.LevelWarn
+	}
+	if logLevelStr != "" {
+		if level, err = parseLogLevel(logLevelStr); err != nil {
+			log.Fatalf("invalid -log-level %q: %v", logLevelStr, err)
+		}
+		// 只有明确指定级别时才调整 libp2p 的日志，默认仍由 GOLOG_LOG_LEVEL 控制
+		setLibp2pLogLevel(level)
+	}
+	logLevel.Set(level)
+	if quiet && debugEnabled() {
+		log.Fatal("-quiet and -verbose (-log-level debug) are mutually exclusive")
+	}
+	for _, ln := range version.Lines() {
+		logger.Debug(ln)
+	}
+	if loadedConfig != "" {
+		logger.Debug("config loaded", "path", loadedConfig)
+	}
+	if words < 2 || words > 8 {
+		log.Fatalf("invalid -words %d, want 2..8", words)
+	}
+	if archiveFormat != "" && archiveFormat != "tar" && archiveFormat != "zip" {
+		log.Fatalf("invalid -archive %q, want tar or zip", archiveFormat)
+	}
+	if minWords < 2 || minWords > 8 {
+		log.Fatalf("invalid -min-words %d, want 2..8", minWords)
+	}
+	if dialTimeout <= 0 || relayDialTimeout < 0 {
+		log.Fatalf("invalid -dial-timeout %s / -relay-dial-timeout %s", dialTimeout, relayDialTimeout)
+	}
+	if relaySelect != "first" && relaySelect != "fastest" {
+		log.Fatalf("invalid -relay-select %q, want first or fastest", relaySelect)
+	}
+	if idleTimeout < 0 {
+		log.Fatalf("invalid -idle-timeout %v, want >= 0", idleTimeout)
+	}
+	if _, err := (xferDest{template: outTemplate}).baseDir(xferOffer{Kind: "dir", Name: "x"}, "", time.Now()); err != nil {
+		log.Fatalf("invalid -out-template %q: %v", outTemplate, err)
+	}
+	for _, p := range excludes {
+		if _, err := path.Match(strings.TrimSuffix(strings.TrimPrefix(p, "/"), "/"), ""); err != nil {
+			log.Fatalf("invalid -exclude %q: %v", p, err)
+		}
+	}
+
+	// 子命令：wormhole dry-run <dir>，按 -exclude 打印目录发送计划后退出，不连接任何服务器
+	if flag.NArg() == 2 && flag.Arg(0) == "dry-run" {
+		if err := printSendPlan(func(s string) { fmt.Println(s) }, flag.Arg(1)); err != nil {
+			log.Fatalf("dry run: %v", err)
+		}
+		return
+	}
+
+	// 子命令：wormhole downloads，列出保存目录下索引中记录的已接收文件
+	if flag.NArg() == 1 && flag.Arg(0) == "downloads" {
+		dir := outDir
+		if dlDir != "" {
+			dir = dlDir
+		}
+		if err := printDownloads(func(s string) { fmt.Println(s) }, dir); err != nil {
+			log.Fatalf("downloads: %v", err)
+		}
+		return
+	}
+
+	// 子命令：wormhole selftest，在本进程内跑通控制面、配对、PAKE 与文件传输，不依赖任何外部服务
+	if flag.NArg() == 1 && flag.Arg(0) == "selftest" {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		start := time.Now()
+		fmt.Println("selftest: in-process control server + loopback peers")
+		if err := runSelftest(ctx, func(s string) { fmt.Println(s) }, selftestSize); err != nil {
+			cancel()
+			log.Fatalf("selftest: FAIL: %v", err)
+		}
+		fmt.Printf("selftest: PASS (total %s)\n", time.Since(start).Round(time.Millisecond))
+		return
+	}
+
 	if code == "" && codeShort != "" {
 		code = codeShort
 	}
-	if code == "" && flag.NArg() == 1 && codeRe.MatchString(flag.Arg(0)) {
-		code = flag.Arg(0)
+	// 支持通过位置参数传递代码
+	if pc, err := positionalCode(flag.Args()); err != nil {
+		log.Fatal(err)
+	} else if pc != "" {
+		if code != "" {
+			log.Fatalf("code given both as -code and as argument %q", strings.Join(flag.Args(), " "))
+		}
+		code = pc
+	}
+	if codeFromStdin {
+		if code != "" {
+			log.Fatalf("-code-from-stdin conflicts with a code given on the command line")
+		}
+		line, err := readCodeLine(os.Stdin)
+		if err == nil && !strings.HasPrefix(strings.ToLower(line), codeURIScheme) {
+			_, _, err = parseCode(line, minWords)
+		}
+		if err != nil {
+			log.Fatalf("-code-from-stdin: %v", err)
+		}
+		code = line
+	}
+	// wormhole:// 链接同时携带代码与控制服务器，链接中的服务器优先于 -control
+	if strings.HasPrefix(strings.ToLower(code), codeURIScheme) {
+		c, ctrl, err := parseCodeURI(code)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		code = c
+		if ctrl != "" && ctrl != controlURL {
+			if !quiet {
+				fmt.Println("using control server from link:", ctrl)
+			}
+			controlURL = ctrl
+		}
+	}
+
+	if !noReport {
+		reportURL = controlURL
 	}
 
 	// 根据是否提供了 `-code` 参数来推断模式 (host 或 connect)
@@ -1366,12 +5260,65 @@ func main() {
 	if mode == "" {
 		mode = inferred
 	} else if mode != inferred {
-		fmt.Println("warn: -mode is deprecated and conflicts with inferred mode; proceeding with -mode =", mode)
+		logger.Warn("-mode is deprecated and conflicts with inferred mode; proceeding with -mode = " + mode)
 	}
 
 	if dlDir != "" {
 		outDir = dlDir
 	}
+	// 启动时即检查保存目录 (不存在则创建)，而不是在对端开始发送后才发现无法写入
+	if err := checkOutDir(outDir); err != nil {
+		log.Fatalf("invalid -outdir: %v", err)
+	}
+	if tempDir != "" {
+		if err := checkOutDir(tempDir); err != nil {
+			log.Fatalf("invalid -temp-dir: %v", err)
+		}
+	}
+	if connLow < 0 || connHigh < connLow || connGrace < 0 {
+		log.Fatalf("invalid -conn-low %d / -conn-high %d / -conn-grace %s", connLow, connHigh, connGrace)
+	}
+	vm, err := parseVerifyMode(verifyModeStr, verify)
+	if err != nil {
+		log.Fatalf("invalid -verify-mode: %v", err)
+	}
+	if vm == verifyNone {
+		fmt.Fprintln(os.Stderr, c(verifyNoneWarning, cBold))
+	}
+	if maxChatMsg < 1 {
+		log.Fatalf("invalid -max-chat-msg %d, want >= 1", maxChatMsg)
+	}
+	if discoverLimit < 1 {
+		log.Fatalf("invalid -discover-limit %d, want >= 1", discoverLimit)
+	}
+	if writeBufSize < 0 {
+		log.Fatalf("invalid -write-buffer %d, want >= 0", writeBufSize)
+	}
+	if ackWindow < 1 {
+		log.Fatalf("invalid -ack-window %d, want >= 1", ackWindow)
+	}
+	if ewmaAge < 0 {
+		log.Fatalf("invalid -ewma-age %v, want >= 0", ewmaAge)
+	}
+	if autoSend != "" {
+		if mode != "host" {
+			log.Fatalf("-send is only supported when hosting (without -code)")
+		}
+		if _, err := sendKind(autoSend); err != nil {
+			log.Fatalf("invalid -send: %v", err)
+		}
+	}
+	if showQR && mode != "host" {
+		log.Fatalf("-qr is only supported when hosting (without -code)")
+	}
+
+	if transportsFlag != "" {
+		allowed, err := parseTransports(transportsFlag)
+		if err != nil {
+			log.Fatalf("invalid -transports: %v", err)
+		}
+		transports.allowed = allowed
+	}
 
 	isLocalDev := func(u string) bool {
 		pu, err := url.Parse(u)
@@ -1403,11 +5350,43 @@ func main() {
 			extraListen = append(extraListen, a)
 		}
 	}
+	var extraBootstrap []string
+	for _, b := range strings.Split(bootstrapCSV, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			extraBootstrap = append(extraBootstrap, b)
+		}
+	}
+	if len(extraBootstrap) > 0 {
+		if _, err := p2p.ParseAddrInfos(extraBootstrap); err != nil {
+			log.Fatalf("invalid -bootstrap: %v (want /ip4/.../tcp/.../p2p/<id>)", err)
+		}
+	}
+	if announce != "" {
+		as, err := parseAnnounce(announce)
+		if err == nil {
+			rctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			announceAddrs, err = resolveAnnounce(rctx, net.DefaultResolver.LookupIP, as)
+			cancel()
+		}
+		if err != nil {
+			log.Fatalf("invalid -announce: %v", err)
+		}
+	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	// 所有清理完成后，按本次运行中发送的结果设置退出码
+	defer func() {
+		if code := xferOutcome(sendOutcome.Load()).exitCode(); code != 0 {
+			os.Exit(code)
+		}
+	}()
+	// 同时监听 SIGTERM，使 kill 或容器停止也能走正常的清理流程
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	// 最后执行：等待作废/消费报告发出后再退出
+	defer waitReports(reportTimeout)
 
 	var rendezvousAIs, relayAIs []peer.AddrInfo
+	var bootstrapAddrs []string // 服务器下发的引导节点，连同 -bootstrap 在主机创建后连接
 	var topic string
 	var nameplate string
 	var passphrase string
@@ -1418,26 +5397,33 @@ func main() {
 		if code == "" {
 			log.Fatalf("please pass -code '<nameplate>-<word>-<word>'")
 		}
-		parts := strings.Split(code, "-")
-		if len(parts) < 3 {
-			log.Fatalf("bad code format: want '<nameplate>-<word>-<word>'")
+		var err error
+		nameplate, passphrase, err = parseCode(code, minWords)
+		if err == nil {
+			err = checkNameplateCharset(ctx, controlURL, nameplate)
+		}
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
-		nameplate = parts[0]
-		passphrase = strings.Join(parts[1:], "-")
 		var clm models.ClaimResponse
 		if err := httpPostJSON(ctx, controlURL, "/v1/claim", models.ClaimRequest{Nameplate: nameplate, Side: "connect"}, &clm); err != nil {
 			log.Fatalf("claim: %v", err)
 		}
 		if clm.Status == "failed" {
+			if clm.Reason == models.ClaimReasonSideTaken {
+				log.Fatalf("claim failed: someone has already connected with this code. Are you both running connect mode? One side must run -mode host and share the code it prints.")
+			}
 			log.Fatalf("claim failed (possibly invalid/expired/duplicate). Ask the host to allocate a new code and retry.")
 		}
 		topic = clm.Topic
-		var err error
-		rendezvousAIs, err = p2p.ParseAddrInfos(clm.Rendezvous.Addrs)
+		reportToken = clm.ReportToken
+		printServerMessage(clm.Message)
+		rendezvousAIs, err = parseRendezvous(clm.Rendezvous.Addrs)
 		if err != nil {
-			log.Fatalf("rendezvous addrs: %v", err)
+			log.Fatalf("%v", err)
 		}
 		relayAIs, _ = p2p.ParseAddrInfos(clm.Relay.Addrs)
+		bootstrapAddrs = clm.Bootstrap
 
 	} else if mode != "host" {
 		// 如果模式不是 "connect" 也不是 "host"，则为未知模式。
@@ -1446,7 +5432,7 @@ func main() {
 
 	// 初始化 libp2p 主机
 	var autoRelayCandidate *peer.AddrInfo
-	if len(relayAIs) > 0 {
+	if len(relayAIs) > 0 && !forceDirect {
 		autoRelayCandidate = &relayAIs[0]
 	}
 	var reservedRelay *peer.AddrInfo
@@ -1456,9 +5442,15 @@ func main() {
 		log.Fatal(err)
 	}
 	defer h.Close()
+	defer func() { releaseRelay(h, reservedRelay) }()
+	reachability := watchReachability(h)
+	// 连接方在认领时已拿到服务器下发的引导节点；发起方的在第一次分配后连接
+	if mode != "host" {
+		go connectBootstrap(ctx, h, append(bootstrapAddrs, extraBootstrap...))
+	}
 
 	// 打印自己的 PeerID
-	fmt.Printf("Your PeerID: %s\n", h.ID().String())
+	infoln("Your PeerID:", h.ID().String())
 
 	// 注意：在 host 模式下，rendezvousAIs 在这里是空的，这没关系。
 	// 它会在下面的主循环中被正确填充，然后才会去连接 rendezvous 服务器。
@@ -1473,34 +5465,40 @@ func main() {
 		}
 	}
 
-	// 尝试预订一个中继槽位
-	if len(relayAIs) > 0 {
-		if r := reserveAnyRelay(ctx, h, relayAIs); r == nil {
-			if verbose {
-				fmt.Println("warn: relay reservation failed (will still try direct & autorelay)")
-			}
+	// 尝试预订一个中继槽位；-force-direct 时不预订，也不宣告中继地址
+	if forceDirect {
+		infoln("relay fallback disabled (-force-direct): the connection fails if no direct path to the peer is possible")
+	} else if len(relayAIs) > 0 {
+		if r := reserveAnyRelay(ctx, h, rankRelays(ctx, h, relayAIs, relaySelect)); r == nil {
+			logger.Debug("relay reservation failed (will still try direct & autorelay)")
 		} else {
 			reservedRelay = r
 			h.Peerstore().AddAddrs(reservedRelay.ID, reservedRelay.Addrs, time.Hour)
 			h.ConnManager().Protect(reservedRelay.ID, "relay")
-			if verbose {
-				fmt.Printf("relay reservation OK via %s (%d addrs)\n", reservedRelay.ID, len(reservedRelay.Addrs))
-			}
+			logger.Debug("relay reservation OK", "relay", reservedRelay.ID, "addrs", len(reservedRelay.Addrs))
 		}
 	}
 
+	// fatalf 在退出前释放中继预订并关闭主机：log.Fatalf 直接调用 os.Exit，上面的 defer 不会执行，
+	// 中继的预订槽位会一直被占用到过期
+	fatalf := func(format string, args ...any) {
+		releaseRelay(h, reservedRelay)
+		_ = h.Close()
+		log.Fatalf(format, args...)
+	}
+
 	// 配置汇合点客户端
 	addrFac := rendezvousAddrsFactory(h, reservedRelay, isLocalDev)
 
-	// 延迟 rendezvous client 的初始化，直到我们确定有了 rendezvous 服务器的地址
-	var rzvc rzv.RendezvousClient
+	// 延迟发现后端的初始化，直到我们确定有了 rendezvous 服务器的地址
+	var rzvc p2p.Discovery
 
-	if verbose {
+	if debugEnabled() {
 		pub := addrFac(h.Addrs())
 		if len(pub) > 0 {
-			fmt.Println("announce addrs:")
+			logger.Debug("announce addrs:")
 			for _, a := range pub {
-				fmt.Println("   ", a.String())
+				logger.Debug("    " + a.String())
 			}
 		}
 	}
@@ -1514,41 +5512,77 @@ func main() {
 			var alloc models.AllocateResponse
 			if err := httpPostJSON(ctx, controlURL, "/v1/allocate", nil, &alloc); err != nil {
 				// 如果在启动时分配失败，则致命退出。如果在循环中失败，可以选择重试或退出。
-				log.Fatalf("allocate: %v", err)
+				fatalf("allocate: %v", err)
 			}
 			nameplate = alloc.Nameplate
 			topic = alloc.Topic
+			reportToken = alloc.ReportToken
+			// 公告只在第一次分配时显示，轮换代码时不再重复
+			if rzvc == nil {
+				printServerMessage(alloc.Message)
+			}
 			// 从服务器获取 rendezvous 和 relay 信息
-			rendezvousAIs, err = p2p.ParseAddrInfos(alloc.Rendezvous.Addrs)
+			rendezvousAIs, err = parseRendezvous(alloc.Rendezvous.Addrs)
 			if err != nil {
-				log.Fatalf("rendezvous addrs: %v", err)
+				fatalf("%v", err)
 			}
 
 			// 第一次循环时，连接到 rendezvous 服务器
 			if rzvc == nil {
-				if _, err := connectAny(ctx, h, rendezvousAIs); err != nil {
-					log.Fatalf("connect rendezvous: %v", err)
+				go connectBootstrap(ctx, h, append(alloc.Bootstrap, extraBootstrap...))
+				// 连接所有可达的汇合点并初始化客户端
+				if rzvc, err = newDiscovery(ctx, h, rendezvousAIs, addrFac); err != nil {
+					fatalf("connect rendezvous: %v", err)
 				}
-				// 初始化客户端
-				rzvPeer := rendezvousAIs[0].ID
-				rp := rzv.NewRendezvousPoint(h, rzvPeer, rzv.ClientWithAddrsFactory(addrFac))
-				rzvc = rzv.NewRendezvousClientWithPoint(rp)
 			}
 
-			ws := client.EFFWords(effShortWordlist)
-			w1, w2 := client.RandWord(ws), client.RandWord(ws)
-			passphrase = fmt.Sprintf("%s-%s", w1, w2)
+			passphrase = newPassphrase(client.EFFWords(effShortWordlist), words)
 			fullCode := fmt.Sprintf("%s-%s", nameplate, passphrase)
 
 			// 2. 打印新的代码信息，使用本地时区显示过期时间
-			fmt.Printf("Starting session…\nYour code: %s\nAsk peer to run: wormhole -c %s\n(Expires: %s)\n",
-				fullCode, fullCode, ts())
-
-			// 3. 使用新主题在汇合点注册自己
-			if _, err := rzvc.Register(ctx, topic, 120); err != nil {
-				log.Printf("warn: rendezvous register failed: %v. will retry on next code rotation.", err)
-				// 等待一小段时间后重试循环，避免快速失败导致API滥用
-				time.Sleep(5 * time.Second)
+			// 安静模式下只输出代码本身，方便脚本直接读取
+			if quiet {
+				fmt.Println(fullCode)
+			} else {
+				fmt.Printf("Starting session…\nYour code: %s\nAsk peer to run: wormhole -c %s\n(Expires: %s)\n",
+					fullCode, fullCode, ts())
+				if showQR {
+					printCodeQR(codeURI(fullCode, controlURL))
+				}
+				if autoSend != "" {
+					fmt.Printf("%s will be sent automatically once the peer confirms the code.\n", autoSend)
+				}
+			}
+
+			// 3. 使用新主题在汇合点注册自己；regCtx 控制自动续期的生命周期
+			regCtx, regCancel := context.WithCancel(ctx)
+			unregister := func(ns string) {
+				regCancel()
+				uctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := rzvc.Unregister(uctx, ns); err != nil {
+					logger.Debug("rendezvous unregister failed", "err", err)
+				}
+			}
+			// 注册失败时只重试注册 (并刷新中继预订)，保留已经显示的代码，直到它真正过期
+			refreshRelay := func(c context.Context) {
+				if reservedRelay == nil {
+					return
+				}
+				_ = h.Connect(c, *reservedRelay)
+				if _, err := circuitv2.Reserve(c, h, *reservedRelay); err != nil {
+					logger.Debug("relay reservation refresh failed", "relay", reservedRelay.ID, "err", err)
+				}
+			}
+			register := func(c context.Context) error { return rzvc.Register(c, topic, rzvRegisterTTL) }
+			if err := registerWithRetry(regCtx, alloc.ExpiresAt, register, refreshRelay); err != nil {
+				regCancel()
+				if ctx.Err() != nil {
+					postFailAsync(controlURL, nameplate)
+					infoln("\nshutting down.")
+					return
+				}
+				infoln("\ncode expired before it could be registered, allocating a new one…")
 				continue
 			}
 
@@ -1556,6 +5590,11 @@ func main() {
 			inbound := make(chan network.Stream, 1)
 			var acceptOnce sync.Once
 			h.SetStreamHandler(models.ProtoChat, func(s network.Stream) {
+				if forceDirect && s.Conn().Stat().Limited {
+					// 对端经中继连入：-force-direct 时拒绝，等待其直连
+					_ = s.Reset()
+					return
+				}
 				ok := false
 				acceptOnce.Do(func() { // 只接受第一个连接
 					ok = true
@@ -1566,41 +5605,51 @@ func main() {
 					_ = s.Reset()
 				}
 			})
-			fmt.Println("waiting for peer…")
+			infoln("waiting for peer…")
 
 			// 5. 使用 select 等待连接、代码过期或程序中断
 			var s network.Stream
 			select {
 			case s = <-inbound:
-				// 成功接收连接，运行会话然后退出程序
-				runAccepted(ctx, h, s, controlURL, outDir, verify, nameplate, passphrase)
+				// 成功接收连接：只接受一个对端，注销主题后运行会话然后退出程序
+				unregister(topic)
+				runAccepted(ctx, h, s, controlURL, outDir, vm, nameplate, passphrase, localState{announce: addrFac, relay: reservedRelay, reachability: reachability})
 				return // 会话结束，程序退出
 
 			case <-time.After(time.Until(alloc.ExpiresAt)):
 				// 等待直到代码过期。time.Until会计算出距离过期时间的时长。
-				fmt.Println("\ncode expired, allocating a new one…")
+				infoln("\ncode expired, allocating a new one…")
 				h.RemoveStreamHandler(models.ProtoChat) // 清理旧的处理器
+				unregister(topic)                       // 停止续期并注销旧主题
 				continue                                // 继续循环，获取新代码
 
 			case <-ctx.Done():
-				// 用户按下了 Ctrl+C
-				fmt.Println("\nshutting down.")
+				// 用户按下了 Ctrl+C 或进程收到 SIGTERM：作废当前密码牌，避免其在过期前一直占用
+				unregister(topic)
+				postFailAsync(controlURL, nameplate)
+				infoln("\nshutting down.")
 				return // 退出程序
 			}
 		}
 
 	case "connect":
 		// 在 connect 模式下，现在才初始化 rendezvous client
-		rzvPeer := rendezvousAIs[0].ID
-		rp := rzv.NewRendezvousPoint(h, rzvPeer, rzv.ClientWithAddrsFactory(addrFac))
-		rzvc = rzv.NewRendezvousClientWithPoint(rp)
+		if rzvc, err = newDiscovery(ctx, h, rendezvousAIs, addrFac); err != nil {
+			fatalf("connect rendezvous: %v", err)
+		}
 
 		// 连接模式：通过汇合点发现主机并尝试连接
 		relayFirst := isLocalDev
 		s, err := tryOpenChat(ctx, h, rzvc, topic, relayAIs, 60*time.Second, relayFirst)
 		if err != nil {
-			log.Fatalf("open chat: %v", err)
+			var oe *openChatError
+			if errors.As(err, &oe) {
+				for _, ln := range oe.details() {
+					logger.Debug(ln)
+				}
+			}
+			fatalf("open chat: %v", err)
 		}
-		runAccepted(ctx, h, s, controlURL, outDir, verify, nameplate, passphrase)
+		runAccepted(ctx, h, s, controlURL, outDir, vm, nameplate, passphrase, localState{announce: addrFac, relay: reservedRelay, reachability: reachability})
 	}
 }
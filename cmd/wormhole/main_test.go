@@ -1,26 +1,53 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	libp2p "github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
 
 	ma "github.com/multiformats/go-multiaddr"
 
+	rzv "github.com/waku-org/go-libp2p-rendezvous"
+	rzvsqlite "github.com/waku-org/go-libp2p-rendezvous/db/sqlite"
+
 	readline "github.com/chzyer/readline"
+	xxh3 "github.com/zeebo/xxh3"
 
 	"github.com/Metaphorme/wormhole/pkg/client"
 	"github.com/Metaphorme/wormhole/pkg/crypto"
@@ -29,9 +56,10 @@ import (
 	"github.com/Metaphorme/wormhole/pkg/session"
 	"github.com/Metaphorme/wormhole/pkg/transfer"
 	uipkg "github.com/Metaphorme/wormhole/pkg/ui"
+	"github.com/Metaphorme/wormhole/pkg/version"
 )
 
-func ctxT(t *testing.T, d time.Duration) (context.Context, context.CancelFunc) {
+func ctxT(t testing.TB, d time.Duration) (context.Context, context.CancelFunc) {
 	t.Helper()
 	if d == 0 {
 		d = 15 * time.Second
@@ -39,7 +67,7 @@ func ctxT(t *testing.T, d time.Duration) (context.Context, context.CancelFunc) {
 	return context.WithTimeout(context.Background(), d)
 }
 
-func newLoopbackHost(t *testing.T) host.Host {
+func newLoopbackHost(t testing.TB) host.Host {
 	t.Helper()
 	// 仅回环 TCP，避免 CI/本机环境的 QUIC/HolePunching 干扰
 	h, err := libp2p.New(
@@ -52,7 +80,7 @@ func newLoopbackHost(t *testing.T) host.Host {
 	return h
 }
 
-func connect(t *testing.T, a, b host.Host) {
+func connect(t testing.TB, a, b host.Host) {
 	t.Helper()
 	ai := peer.AddrInfo{ID: b.ID(), Addrs: b.Addrs()}
 	ctx, cancel := ctxT(t, 10*time.Second)
@@ -62,7 +90,7 @@ func connect(t *testing.T, a, b host.Host) {
 	}
 }
 
-func newTestUI(t *testing.T) *uiConsole {
+func newTestUI(t testing.TB) *uiConsole {
 	t.Helper()
 	// 使用可填充的 stdin（io.ReadCloser）+ 内存 stdout，避免真实 TTY 依赖
 	inRC, inW := readline.NewFillableStdin(bytes.NewBuffer(nil))
@@ -89,6 +117,53 @@ func newTestUI(t *testing.T) *uiConsole {
 	return uipkg.NewConsoleWithReadline(rl, "")
 }
 
+// xferPair 是一对已连接的主机：R 接收 S 发来的传输，每处理完一个传输流向 handled 发送一次
+type xferPair struct {
+	S, R    host.Host
+	ui      *uiConsole // R 的控制台
+	seed    uint64
+	handled chan struct{}
+}
+
+// newXferPair 创建经回环 TCP 直连的 S 与 R，R 总是接受提议并按 dest 落盘
+func newXferPair(t testing.TB, dest xferDest, seed uint64) *xferPair {
+	t.Helper()
+	S, R := newLoopbackHost(t), newLoopbackHost(t)
+	connect(t, S, R)
+	return serveXfer(t, S, R, dest, seed)
+}
+
+// serveXfer 与 newXferPair 相同，但使用调用方已连接好的主机 (如 mocknet)
+func serveXfer(t testing.TB, S, R host.Host, dest xferDest, seed uint64) *xferPair {
+	p := &xferPair{S: S, R: R, ui: newTestUI(t), seed: seed, handled: make(chan struct{}, 64)}
+	p.receive(context.Background(), dest, acceptOffer)
+	return p
+}
+
+// acceptOffer 总是接受对端的提议
+func acceptOffer(string, time.Duration) bool { return true }
+
+// receive 替换 R 的传输流处理器：之后的传输流以 ctx、dest 与 ask 处理
+func (p *xferPair) receive(ctx context.Context, dest xferDest, ask func(string, time.Duration) bool) {
+	p.R.SetStreamHandler(models.ProtoXfer, func(xs network.Stream) {
+		handleIncomingXfer(ctx, p.R, xs, dest, ask, p.ui, p.seed)
+		select {
+		case p.handled <- struct{}{}:
+		default: // 没有测试等待时不阻塞处理器 (如基准测试)
+		}
+	})
+}
+
+// waitHandled 等待 R 处理完一个传输流
+func (p *xferPair) waitHandled(t testing.TB, d time.Duration) {
+	t.Helper()
+	select {
+	case <-p.handled:
+	case <-time.After(d):
+		t.Fatalf("receiver did not finish")
+	}
+}
+
 func writeTempFile(t *testing.T, dir, name string, data []byte) string {
 	t.Helper()
 	path := filepath.Join(dir, name)
@@ -124,6 +199,372 @@ func TestFrameReadWrite_RoundTrip(t *testing.T) {
 	}
 }
 
+// frameStream 让以 network.Stream 为参数的 session 帧函数读写内存缓冲区。
+type frameStream struct {
+	network.Stream
+	rw io.ReadWriter
+}
+
+func (s frameStream) Read(p []byte) (int, error)  { return s.rw.Read(p) }
+func (s frameStream) Write(p []byte) (int, error) { return s.rw.Write(p) }
+
+// SetReadDeadline 转发给支持读超时的底层连接 (如 net.Pipe)，否则忽略
+func (s frameStream) SetReadDeadline(t time.Time) error {
+	if d, ok := s.rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// TestFrameCodecs_Matrix 记录三套帧实现之间的 (不) 兼容关系：XFER 协议实际使用的是
+// main.go 中 9 字节小端帧头，pkg/transfer 与 pkg/session 使用 5 字节大端帧头。
+// 合并这些实现时，这里的期望应随之更新，而不是让两种格式在同一个流上混用。
+func TestFrameCodecs_Matrix(t *testing.T) {
+	type codec struct {
+		name   string
+		hdrLen int
+		write  func(b *bytes.Buffer, typ byte, payload []byte) error
+		read   func(b *bytes.Buffer) (byte, []byte, error)
+	}
+	codecs := []codec{
+		{"main", 9,
+			func(b *bytes.Buffer, typ byte, p []byte) error { return writeFrame(b, typ, p) },
+			func(b *bytes.Buffer) (byte, []byte, error) { return readFrame(b) }},
+		{"transfer", 5,
+			func(b *bytes.Buffer, typ byte, p []byte) error { return transfer.WriteFrame(b, typ, p) },
+			func(b *bytes.Buffer) (byte, []byte, error) { return transfer.ReadFrame(b) }},
+		{"session", 5,
+			func(b *bytes.Buffer, typ byte, p []byte) error { return session.WriteFrame(frameStream{rw: b}, typ, p) },
+			func(b *bytes.Buffer) (byte, []byte, error) { return session.ReadFrame(frameStream{rw: b}) }},
+	}
+	// 只有两个 5 字节大端实现在线路上互通
+	compatible := func(a, b string) bool {
+		return a == b || (a != "main" && b != "main")
+	}
+
+	const typ = byte(0x42)
+	payload := []byte("hello frame")
+	for _, w := range codecs {
+		for _, r := range codecs {
+			t.Run(w.name+"->"+r.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := w.write(&buf, typ, payload); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				if buf.Len() != w.hdrLen+len(payload) {
+					t.Fatalf("%s header is %d bytes, want %d", w.name, buf.Len()-len(payload), w.hdrLen)
+				}
+				gotTyp, got, err := r.read(&buf)
+				ok := err == nil && gotTyp == typ && bytes.Equal(got, payload)
+				if ok != compatible(w.name, r.name) {
+					t.Fatalf("compatible=%v but read gave typ=0x%02x payload=%q err=%v", compatible(w.name, r.name), gotTyp, got, err)
+				}
+			})
+		}
+	}
+}
+
+func TestReadFrameInto_ReusesBuffer(t *testing.T) {
+	var stream bytes.Buffer
+	_ = writeFrame(&stream, frameChunk, []byte("abc"))
+	_ = writeFrame(&stream, frameFileDone, nil)
+	_ = writeFrame(&stream, frameChunk, bytes.Repeat([]byte{'x'}, 32))
+
+	buf := make([]byte, 16)
+	typ, got, err := readFrameInto(&stream, buf)
+	if err != nil || typ != frameChunk || string(got) != "abc" || &got[0] != &buf[0] {
+		t.Fatalf("small frame should be read into buf: typ=%x got=%q err=%v", typ, got, err)
+	}
+	if typ, got, err = readFrameInto(&stream, buf); err != nil || typ != frameFileDone || len(got) != 0 {
+		t.Fatalf("empty frame: typ=%x len=%d err=%v", typ, len(got), err)
+	}
+	// 超出 buf 容量时回退为新分配
+	if typ, got, err = readFrameInto(&stream, buf); err != nil || len(got) != 32 || &got[0] == &buf[0] {
+		t.Fatalf("large frame: len=%d err=%v", len(got), err)
+	}
+}
+
+// chunkFrames 构造 n 个 chunkSize 大小的数据块帧，用于比较 readFrame 与 readFrameInto 的分配。
+func chunkFrames(b *testing.B, n int) []byte {
+	b.Helper()
+	var stream bytes.Buffer
+	chunk := bytes.Repeat([]byte{0xAB}, chunkSize)
+	for i := 0; i < n; i++ {
+		_ = writeFrame(&stream, frameChunk, chunk)
+	}
+	return stream.Bytes()
+}
+
+func BenchmarkReadFrame_Alloc(b *testing.B) {
+	data := chunkFrames(b, 16)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(data)
+		for {
+			if _, _, err := readFrame(r); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkReadFrame_Pooled(b *testing.B) {
+	data := chunkFrames(b, 16)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(data)
+		bufp := chunkBufPool.Get().(*[]byte)
+		for {
+			if _, _, err := readFrameInto(r, *bufp); err != nil {
+				break
+			}
+		}
+		chunkBufPool.Put(bufp)
+	}
+}
+
+// benchPayloadSizes 是帧基准使用的载荷大小：从控制消息量级到一个完整数据块
+var benchPayloadSizes = []int{64, 4 << 10, 64 << 10, chunkSize}
+
+// BenchmarkFrame_RoundTrip 测量 XFER 帧写入再读出的开销，分别对比每帧分配与复用缓冲区。
+func BenchmarkFrame_RoundTrip(b *testing.B) {
+	for _, size := range benchPayloadSizes {
+		payload := bytes.Repeat([]byte{0xAB}, size)
+		var buf bytes.Buffer
+		buf.Grow(size + 9)
+		b.Run(fmt.Sprintf("%d/alloc", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := writeFrame(&buf, frameChunk, payload); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := readFrame(&buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d/pooled", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			bufp := chunkBufPool.Get().(*[]byte)
+			defer chunkBufPool.Put(bufp)
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := writeFrame(&buf, frameChunk, payload); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := readFrameInto(&buf, *bufp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkHash_XXH3Chunk 测量按 chunkSize 喂入带种子 xxh3 (与传输时的文件哈希相同) 的吞吐。
+func BenchmarkHash_XXH3Chunk(b *testing.B) {
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), chunkSize/16)
+	h := xxh3.NewSeed(1932)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(chunk)))
+	for i := 0; i < b.N; i++ {
+		_, _ = h.Write(chunk)
+	}
+	_ = h.Sum128()
+}
+
+// TestXfer_TempDirCrossDevice 模拟 -temp-dir 与保存目录位于不同文件系统：从临时目录出发的
+// 重命名一律以 EXDEV 失败，文件应被复制到目标位置，且两边都不留下临时文件。
+func TestXfer_TempDirCrossDevice(t *testing.T) {
+	const seed uint64 = 1943
+	outDir, tmpDir := t.TempDir(), t.TempDir()
+	oldRename := renameFile
+	renameFile = func(oldpath, newpath string) error {
+		if strings.HasPrefix(oldpath, tmpDir) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	t.Cleanup(func() { renameFile = oldRename })
+
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatalf("mocknet: %v", err)
+	}
+	t.Cleanup(func() { _ = mn.Close() })
+	p := serveXfer(t, mn.Hosts()[0], mn.Hosts()[1], xferDest{outDir: outDir, tempDir: tmpDir}, seed)
+
+	data := bytes.Repeat([]byte("cross-device "), 10000)
+	src := filepath.Join(t.TempDir(), "moved.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sendXfer(context.Background(), p.S, p.R.ID(), "file", src, p.ui, seed); err != nil {
+		t.Fatalf("sendXfer: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(outDir, "moved.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, err %v", len(got), err)
+	}
+	for _, dir := range []string{outDir, tmpDir} {
+		ents, _ := os.ReadDir(dir)
+		for _, e := range ents {
+			if strings.HasSuffix(e.Name(), partSuffix) {
+				t.Fatalf("leftover temp file %s in %s", e.Name(), dir)
+			}
+		}
+	}
+}
+
+func TestPartWriter_FlushesOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x"+partSuffix)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newPartWriter(f, 1<<20)
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write(bytes.Repeat([]byte{byte('a' + i)}, 4<<10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi, _ := os.Stat(path); fi.Size() != 0 {
+		t.Fatalf("small chunks should stay buffered, file has %d bytes", fi.Size())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); len(b) != 12<<10 || b[0] != 'a' || b[len(b)-1] != 'c' {
+		t.Fatalf("after close: %d bytes", len(b))
+	}
+}
+
+func TestJSONReporter_ThrottlesAndReportsDone(t *testing.T) {
+	var buf bytes.Buffer
+	oldOut, oldJSON := jsonOutput, jsonOut
+	jsonOutput, jsonOut = &buf, true
+	t.Cleanup(func() { jsonOutput, jsonOut = oldOut, oldJSON })
+
+	rep := newProgressReporter("recv").(*jsonReporter)
+	rep.every = time.Hour
+	rep.start("a.bin", 300)
+	for i := 0; i < 3; i++ {
+		rep.add(100)
+	}
+	rep.done("a.bin", true)
+	rep.start("b.bin", -1)
+	rep.done("b.bin", false)
+
+	var got []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var ev map[string]any
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("not a JSON line: %q", line)
+		}
+		got = append(got, ev)
+	}
+	// 首个数据块立即报告，其余被节流，done 前补发最终进度；没有数据的文件只有 file_done
+	want := []string{"progress:100", "progress:300", "file_done:true", "file_done:false"}
+	if len(got) != len(want) {
+		t.Fatalf("events = %v", got)
+	}
+	for i, ev := range got {
+		var k string
+		if ev["event"] == "progress" {
+			k = fmt.Sprintf("progress:%v", ev["bytes"])
+			if ev["file"] != "a.bin" || ev["total"] != float64(300) || ev["dir"] != "recv" {
+				t.Fatalf("event %d = %v", i, ev)
+			}
+		} else {
+			k = fmt.Sprintf("%v:%v", ev["event"], ev["ok"])
+		}
+		if k != want[i] {
+			t.Fatalf("event %d = %v, want %s", i, ev, want[i])
+		}
+	}
+}
+
+// BenchmarkPartWriter 对比接收方写盘时直接写入与经 -write-buffer 缓冲的开销，
+// 数据块取 pkg/transfer 使用的 64 KiB 与更小的 4 KiB。
+func BenchmarkPartWriter(b *testing.B) {
+	const total = 16 << 20
+	for _, chunk := range []int{4 << 10, 64 << 10} {
+		data := bytes.Repeat([]byte{0xCD}, chunk)
+		for _, size := range []int{0, defaultWriteBuf} {
+			b.Run(fmt.Sprintf("chunk=%d/buf=%d", chunk, size), func(b *testing.B) {
+				path := filepath.Join(b.TempDir(), "bench"+partSuffix)
+				b.ReportAllocs()
+				b.SetBytes(total)
+				for i := 0; i < b.N; i++ {
+					f, err := os.Create(path)
+					if err != nil {
+						b.Fatal(err)
+					}
+					w := newPartWriter(f, size)
+					for n := 0; n < total; n += chunk {
+						if _, err := w.Write(data); err != nil {
+							b.Fatal(err)
+						}
+					}
+					if err := w.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkXfer_FileMocknet 与 BenchmarkXfer_FileLoopback 相同，但两端走 mocknet 的内存管道，
+// 不含 TCP、加密与多路复用，只剩协议本身 (分帧、哈希、校验、落盘) 的开销。
+func BenchmarkXfer_FileMocknet(b *testing.B) {
+	const seed uint64 = 1932
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		b.Fatalf("mocknet: %v", err)
+	}
+	b.Cleanup(func() { _ = mn.Close() })
+	p := serveXfer(b, mn.Hosts()[0], mn.Hosts()[1], xferDest{outDir: b.TempDir()}, seed)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<20) // 16 MiB
+	src := filepath.Join(b.TempDir(), "big.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sendXfer(context.Background(), p.S, p.R.ID(), "file", src, p.ui, seed); err != nil {
+			b.Fatalf("sendXfer: %v", err)
+		}
+	}
+}
+
+// BenchmarkXfer_FileLoopback 测量经回环直连 TCP (Noise + yamux) 发送单个文件的端到端吞吐，
+// 包括哈希计算、分帧与接收方校验落盘。
+func BenchmarkXfer_FileLoopback(b *testing.B) {
+	const seed uint64 = 3
+	p := newXferPair(b, xferDest{outDir: b.TempDir()}, seed)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4<<20) // 64 MiB
+	src := filepath.Join(b.TempDir(), "big.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sendXfer(context.Background(), p.S, p.R.ID(), "file", src, p.ui, seed); err != nil {
+			b.Fatalf("sendXfer: %v", err)
+		}
+	}
+}
+
 func TestFrameReadWrite_TooLarge(t *testing.T) {
 	var hdr [5]byte
 	hdr[0] = 0x7A
@@ -135,6 +576,141 @@ func TestFrameReadWrite_TooLarge(t *testing.T) {
 	}
 }
 
+func TestReadFrame_SlowPeerTimesOut(t *testing.T) {
+	old := transfer.FrameIdleTimeout
+	transfer.FrameIdleTimeout = 100 * time.Millisecond
+	defer func() { transfer.FrameIdleTimeout = old }()
+
+	// 对端声明 100 MiB 的帧后只发送几个字节就停住
+	slow := func(hdr []byte) net.Conn {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { c1.Close(); c2.Close() })
+		go func() {
+			_, _ = c1.Write(hdr)
+			_, _ = c1.Write([]byte("abc"))
+		}()
+		return c2
+	}
+	var hdr5 [5]byte
+	binary.BigEndian.PutUint32(hdr5[1:], 100<<20)
+	var hdr9 [9]byte
+	binary.LittleEndian.PutUint64(hdr9[1:], 100<<20)
+	for name, read := range map[string]func() error{
+		"transfer": func() error { _, _, err := transfer.ReadFrame(slow(hdr5[:])); return err },
+		"main":     func() error { _, _, err := readFrame(slow(hdr9[:])); return err },
+	} {
+		start := time.Now()
+		if err := read(); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("%s: want deadline exceeded, got %v", name, err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Fatalf("%s: took %s to give up", name, d)
+		}
+	}
+
+	// PAKE 帧的长度上限远小于传输帧，超出即拒绝，不分配内存
+	var buf bytes.Buffer
+	binary.BigEndian.PutUint32(hdr5[1:], session.MaxFrameSize+1)
+	buf.Write(hdr5[:])
+	if _, _, err := session.ReadFrame(frameStream{rw: &buf}); err == nil || !strings.Contains(err.Error(), "frame too large") {
+		t.Fatalf("oversized PAKE frame: %v", err)
+	}
+}
+
+func TestXferError_CodesAndCompat(t *testing.T) {
+	// JSON 载荷往返
+	in := &xferError{Code: xferErrDiskFull, Message: "no space left on device"}
+	got := decodeXferError(in.payload())
+	if got.Code != in.Code || got.Message != in.Message {
+		t.Fatalf("round trip mismatch: %+v", got)
+	}
+	if retryableXferErr(got) || !fatalXferErr(got) {
+		t.Fatalf("disk_full should be permanent and fatal")
+	}
+
+	// 旧版本对端发送的纯文本错误
+	old := decodeXferError([]byte("open x: permission denied"))
+	if old.Code != xferErrUnknown || old.Message != "open x: permission denied" {
+		t.Fatalf("plain string not preserved: %+v", old)
+	}
+	if retryableXferErr(old) {
+		t.Fatalf("unknown errors should not be retried")
+	}
+
+	// 临时性错误与 NACK 可重试
+	if !retryableXferErr(fmt.Errorf("wrap: %w", &xferError{Code: xferErrIO})) || !retryableXferErr(errHashMismatch) {
+		t.Fatalf("io_error and hash mismatch should be retryable")
+	}
+
+	// 本地文件系统错误的分类
+	if e := newXferIOError(fmt.Errorf("create: %w", os.ErrPermission)); e.Code != xferErrPermission {
+		t.Fatalf("want permission_denied, got %s", e.Code)
+	}
+	if e := newXferIOError(io.ErrUnexpectedEOF); e.Code != xferErrIO {
+		t.Fatalf("want io_error, got %s", e.Code)
+	}
+}
+
+func TestReadChatLine_MaxSize(t *testing.T) {
+	const max = 32
+	exact := strings.Repeat("a", max)
+	over := strings.Repeat("b", max+1)
+	huge := strings.Repeat("c", 10*max)
+	in := exact + "\n" + over + "\n" + "hi\r\n" + huge + "\r\n" + exact + "\r\n" + "tail"
+	// 小缓冲区使长行跨越多次 ReadSlice
+	r := bufio.NewReaderSize(strings.NewReader(in), 16)
+
+	want := []struct {
+		line    string
+		tooLong bool
+	}{
+		{exact, false}, // 恰好等于上限：照常送达
+		{"", true},     // 超出一个字节：丢弃
+		{"hi", false},  // 丢弃后流仍可继续读取
+		{"", true},
+		{exact, false}, // "\r\n" 不计入长度
+		{"tail", false},
+	}
+	for i, w := range want {
+		got, err := readChatLine(r, max)
+		if w.tooLong {
+			if !errors.Is(err, errChatTooLong) {
+				t.Fatalf("line %d: want errChatTooLong, got %q %v", i, got, err)
+			}
+			continue
+		}
+		if err != nil || got != w.line {
+			t.Fatalf("line %d: got %q %v, want %q", i, got, err, w.line)
+		}
+	}
+	if _, err := readChatLine(r, max); err != io.EOF {
+		t.Fatalf("want EOF at end, got %v", err)
+	}
+}
+
+func TestChatEndReason(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	_ = b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, timeoutErr := readChatLine(bufio.NewReader(b), 64)
+
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{io.EOF, "peer closed the stream"},
+		{network.ErrReset, "connection reset"},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), "connection reset"},
+		{timeoutErr, "read timeout"},
+		{errors.New("boom"), "read error: boom"},
+	} {
+		if got := chatEndReason(tc.err); got != tc.want {
+			t.Errorf("chatEndReason(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
 func TestHTTPPostJSON_RetryAfter(t *testing.T) {
 	// 这个测试验证 HTTP 重试逻辑，但由于 httpPostJSON 现在使用 api.Client
 	// 它不再支持任意路径。我们可以直接测试 api.Client 的重试行为
@@ -166,6 +742,79 @@ func TestEffWords_And_Emoji_SAS(t *testing.T) {
 	}
 }
 
+func TestSASCrossCheck(t *testing.T) {
+	K := []byte("0123456789abcdef0123456789abcdef")
+	tr := []byte("tr-1")
+	sas := crypto.SASFromKey(K, tr)
+
+	// A 发送的标签应能被持有相同 SAS 的 B 验证
+	tok, tag := splitAck(models.ChatAccept + " " + hex.EncodeToString(crypto.SASCheckTag(K, tr, sas, "A")))
+	if tok != models.ChatAccept {
+		t.Fatalf("splitAck token = %q", tok)
+	}
+	if err := checkPeerSAS(crypto.LabelsV1, K, tr, sas, "A", tag); err != nil {
+		t.Fatalf("matching SAS rejected: %v", err)
+	}
+	// 角色不符或 SAS 不同都应失败
+	if err := checkPeerSAS(crypto.LabelsV1, K, tr, sas, "B", tag); err == nil {
+		t.Fatalf("tag accepted for the wrong role")
+	}
+	if err := checkPeerSAS(crypto.LabelsV1, K, tr, crypto.SASFromKey(K, []byte("tr-2")), "A", tag); err == nil {
+		t.Fatalf("tag accepted for a different SAS")
+	}
+	if err := checkPeerSAS(crypto.LabelsV1, K, tr, sas, "A", "zz"); err == nil {
+		t.Fatalf("malformed tag accepted")
+	}
+
+	// 未附带标签：仅在启用 -sas-check 时失败
+	old := sasCheck
+	defer func() { sasCheck = old }()
+	sasCheck = false
+	if err := checkPeerSAS(crypto.LabelsV1, K, tr, sas, "A", ""); err != nil {
+		t.Fatalf("missing tag should be allowed without -sas-check: %v", err)
+	}
+	if got := acceptLine(crypto.LabelsV1, K, tr, sas, "B"); got != models.ChatAccept {
+		t.Fatalf("acceptLine without -sas-check = %q", got)
+	}
+	sasCheck = true
+	if err := checkPeerSAS(crypto.LabelsV1, K, tr, sas, "A", ""); err == nil {
+		t.Fatalf("missing tag should fail with -sas-check")
+	}
+	if _, tag := splitAck(acceptLine(crypto.LabelsV1, K, tr, sas, "B")); checkPeerSAS(crypto.LabelsV1, K, tr, sas, "B", tag) != nil {
+		t.Fatalf("acceptLine tag does not verify")
+	}
+}
+
+func TestVerifyMode_ParseAndConfirms(t *testing.T) {
+	for _, c := range []struct {
+		in             string
+		verify         bool
+		want           verifyMode
+		dialer, hostOK bool // 连接方 / host 是否需要确认
+	}{
+		{"", true, verifyBoth, true, true},
+		{"", false, verifyHostOnly, false, true},
+		{"both", false, verifyBoth, true, true},
+		{" Dialer-Only ", true, verifyDialerOnly, true, false},
+		{"host-only", true, verifyHostOnly, false, true},
+		{"none", true, verifyNone, false, false},
+	} {
+		m, err := parseVerifyMode(c.in, c.verify)
+		if err != nil || m != c.want {
+			t.Fatalf("parseVerifyMode(%q, %v) = %q, %v; want %q", c.in, c.verify, m, err, c.want)
+		}
+		if m.confirms(true) != c.dialer || m.confirms(false) != c.hostOK {
+			t.Fatalf("%s: confirms(dialer)=%v confirms(host)=%v", m, m.confirms(true), m.confirms(false))
+		}
+	}
+	if _, err := parseVerifyMode("kiosk", true); err == nil {
+		t.Fatalf("unknown mode accepted")
+	}
+	if !strings.Contains(autoAcceptNote(verifyNone), "WARNING") {
+		t.Fatalf("none mode should warn loudly")
+	}
+}
+
 func TestParseP2pAddrInfos(t *testing.T) {
 	// 构造两个 host，用它们的 PeerID 来保证 /p2p/<id> 可解析
 	h1 := newLoopbackHost(t)
@@ -173,7 +822,7 @@ func TestParseP2pAddrInfos(t *testing.T) {
 	addrs := []string{
 		"/ip4/127.0.0.1/tcp/1234/p2p/" + h1.ID().String(),
 		"/ip4/127.0.0.1/tcp/5678/p2p/" + h2.ID().String(),
-		// 带 /p2p-circuit 片段，parseP2pAddrInfos 会裁剪掉
+		// 带 /p2p-circuit 片段，经 h2 中继到达 h1，并入 h1 的地址
 		"/ip4/127.0.0.1/tcp/5678/p2p/" + h2.ID().String() + "/p2p-circuit/p2p/" + h1.ID().String(),
 	}
 	ais, err := p2p.ParseAddrInfos(addrs)
@@ -185,6 +834,74 @@ func TestParseP2pAddrInfos(t *testing.T) {
 	}
 }
 
+func TestParseRendezvous_ActionableErrors(t *testing.T) {
+	id := newLoopbackHost(t).ID().String()
+	for name, addrs := range map[string][]string{
+		"empty":       nil,
+		"garbage":     {"not-a-multiaddr"},
+		"no peer id":  {"/ip4/203.0.113.7/tcp/4001"},
+		"unspecified": {"/ip4/0.0.0.0/tcp/4001/p2p/" + id, "/ip6/::/udp/4001/quic-v1/p2p/" + id},
+	} {
+		if _, err := parseRendezvous(addrs); err == nil || !strings.Contains(err.Error(), "-public-addrs") {
+			t.Errorf("%s: want an actionable error, got %v", name, err)
+		}
+	}
+	ais, err := parseRendezvous([]string{"/ip4/0.0.0.0/tcp/4001/p2p/" + id, "junk", "/ip4/203.0.113.7/tcp/4001/p2p/" + id})
+	if err != nil || len(ais) != 1 || len(ais[0].Addrs) != 1 || ais[0].Addrs[0].String() != "/ip4/203.0.113.7/tcp/4001" {
+		t.Fatalf("want only the dialable addr, got %v, %v", ais, err)
+	}
+}
+
+func TestParseRoutes_CircuitKeepsRelayHop(t *testing.T) {
+	relay, target, other := newLoopbackHost(t).ID(), newLoopbackHost(t).ID(), newLoopbackHost(t).ID()
+	rs, ts, xs := relay.String(), target.String(), other.String()
+	rt := p2p.ParseRoutes([]string{
+		"/ip4/10.0.0.1/tcp/4001/p2p/" + rs + "/p2p-circuit/p2p/" + ts,
+		// 服务端下发的中继地址只有中继本身
+		"/ip4/10.0.0.1/udp/4001/quic-v1/p2p/" + rs + "/p2p-circuit",
+		// 多跳
+		"/p2p/" + rs + "/p2p-circuit/p2p/" + xs + "/p2p-circuit/p2p/" + ts,
+		// 中继段缺少 /p2p ID
+		"/ip4/10.0.0.1/tcp/4001/p2p-circuit/p2p/" + ts,
+		"/p2p-circuit/p2p/" + ts,
+		// 目标段多余的组件
+		"/p2p/" + rs + "/p2p-circuit/ip4/1.2.3.4/tcp/1/p2p/" + ts,
+		// 中继与目标相同
+		"/p2p/" + rs + "/p2p-circuit/p2p/" + rs,
+		"not-a-multiaddr",
+	})
+	if len(rt.Invalid) != 6 {
+		t.Fatalf("want 6 invalid, got %d: %v", len(rt.Invalid), rt.Invalid)
+	}
+	if len(rt.Circuit) != 2 || rt.Circuit[0].Target != target || rt.Circuit[1].Target != "" {
+		t.Fatalf("unexpected circuit routes: %+v", rt.Circuit)
+	}
+	if len(rt.Relays) != 1 || rt.Relays[0].ID != relay || len(rt.Relays[0].Addrs) != 2 {
+		t.Fatalf("relay hop lost: %+v", rt.Relays)
+	}
+	if len(rt.Peers) != 2 || rt.Peers[0].ID != target || rt.Peers[1].ID != relay {
+		t.Fatalf("unexpected peers: %+v", rt.Peers)
+	}
+	if got, want := rt.Peers[0].Addrs[0].String(), "/ip4/10.0.0.1/tcp/4001/p2p/"+rs+"/p2p-circuit"; got != want {
+		t.Fatalf("target dial addr = %s, want %s", got, want)
+	}
+
+	m, _ := ma.NewMultiaddr("/p2p/" + rs + "/p2p-circuit/p2p/" + xs + "/p2p-circuit/p2p/" + ts)
+	if _, ok, err := p2p.ParseCircuit(m); !ok || !errors.Is(err, p2p.ErrMultiHopCircuit) {
+		t.Fatalf("multi-hop: ok=%v err=%v", ok, err)
+	}
+	m, _ = ma.NewMultiaddr("/ip4/10.0.0.1/tcp/4001/p2p/" + ts)
+	if _, ok, err := p2p.ParseCircuit(m); ok || err != nil {
+		t.Fatalf("plain addr treated as circuit: ok=%v err=%v", ok, err)
+	}
+
+	// mergeRelaysFromRemote 与 ParseRoutes 走同一套拆分逻辑
+	merged := mergeRelaysFromRemote(rt.Peers[0], nil)
+	if len(merged) != 1 || merged[0].ID != relay || len(merged[0].Addrs) != 1 {
+		t.Fatalf("merge relays: %+v", merged)
+	}
+}
+
 func TestIsUnspecified_And_Private(t *testing.T) {
 	mk := func(s string) ma.Multiaddr {
 		m, err := ma.NewMultiaddr(s)
@@ -220,184 +937,3279 @@ func TestTransportHint(t *testing.T) {
 	}
 }
 
-func TestPAKE_RunAndConfirm(t *testing.T) {
+func TestWhoamiLines(t *testing.T) {
+	h := newLoopbackHost(t)
+	out := strings.Join(whoamiLines(h, localState{}), "\n")
+	for _, want := range []string{"peer id : " + h.ID().String(), "listen  : /ip4/127.0.0.1/tcp/", "announce: /ip4/127.0.0.1/tcp/", "relay   : none", "reach   : unknown"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+
+	// 公布地址经过过滤器；中继预订与可达性如实显示
+	relay := newLoopbackHost(t)
+	connect(t, h, relay)
+	ri := peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}
+	st := localState{
+		announce:     rendezvousAddrsFactory(h, &ri, false),
+		relay:        &ri,
+		reachability: func() network.Reachability { return network.ReachabilityPrivate },
+	}
+	out = strings.Join(whoamiLines(h, st), "\n")
+	for _, want := range []string{"/p2p-circuit/p2p/" + h.ID().String(), "relay   : reserved via " + relay.ID().String() + "\n", "reach   : private"} {
+		if !strings.Contains(out+"\n", want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestNewStreamRetry_HandlerLate(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skip in -short")
 	}
 	A := newLoopbackHost(t)
 	B := newLoopbackHost(t)
 	connect(t, A, B)
-
-	const pass = "correct horse battery staple"
-	const nameplate = "999"
-	// 使用任意测试协议打开 stream；runPAKEAndConfirm 使用我们显式提供的 proto 来构建 transcript
-	const testProto protocol.ID = "/wormhole/pake-test/1.0.0"
-
-	resB := make(chan []byte, 1)
-	errB := make(chan error, 1)
-	B.SetStreamHandler(testProto, func(s network.Stream) {
-		defer s.Close()
-		K, err := session.RunPAKEAndConfirm(context.Background(), s, false, pass, nameplate, models.ProtoChat, B.ID(), s.Conn().RemotePeer())
-		if err != nil {
-			errB <- err
-			return
-		}
-		resB <- K
-	})
-
+	const proto = protocol.ID("/wormhole-test/late/1")
 	ctx, cancel := ctxT(t, 10*time.Second)
 	defer cancel()
-	s, err := A.NewStream(ctx, B.ID(), testProto)
+
+	// 对端稍后才注册处理器：第一次打开失败，重试成功
+	time.AfterFunc(newStreamRetryDelay/2, func() {
+		B.SetStreamHandler(proto, func(s network.Stream) { _ = s.Close() })
+	})
+	s, err := newStreamRetry(ctx, A, B.ID(), proto)
 	if err != nil {
-		t.Fatalf("new stream: %v", err)
+		t.Fatalf("newStreamRetry: %v", err)
 	}
-	K1, err := session.RunPAKEAndConfirm(ctx, s, true, pass, nameplate, models.ProtoChat, A.ID(), s.Conn().RemotePeer())
-	if err != nil {
-		t.Fatalf("dialer runPAKE: %v", err)
+	_ = s.Close()
+
+	// 始终不支持的协议：有限次重试后返回错误
+	start := time.Now()
+	if _, err := newStreamRetry(ctx, A, B.ID(), "/wormhole-test/missing/1"); err == nil {
+		t.Fatalf("expected error for unsupported protocol")
 	}
-	select {
-	case e := <-errB:
-		t.Fatalf("responder runPAKE: %v", e)
-	case K2 := <-resB:
-		if !bytes.Equal(K1, K2) {
-			t.Fatal("shared key mismatch")
-		}
-		// 再次确认：SAS & xfer-seed 派生一致
-		trC := crypto.BuildTranscript(nameplate, models.ProtoChat, A.ID(), B.ID())
-		if crypto.SASFromKey(K1, trC) != crypto.SASFromKey(K2, trC) {
-			t.Fatal("SAS mismatch")
-		}
-		trX := crypto.BuildTranscript(nameplate, models.ProtoXfer, A.ID(), B.ID())
-		seed1 := binary.LittleEndian.Uint64(crypto.HkdfBytes(K1, "xfer-xxh3-seed", trX, 8))
-		seed2 := binary.LittleEndian.Uint64(crypto.HkdfBytes(K2, "xfer-xxh3-seed", trX, 8))
-		if seed1 != seed2 {
-			t.Fatal("xfer seed mismatch")
-		}
-	case <-ctx.Done():
-		t.Fatal("timeout waiting PAKE responder")
+	if d := time.Since(start); d > newStreamAttempts*newStreamRetryDelay+2*time.Second {
+		t.Fatalf("retries not bounded: %s", d)
 	}
-}
 
-func TestXfer_File_RoundTrip(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skip in -short")
+	// 没有连接时不重试
+	C := newLoopbackHost(t)
+	start = time.Now()
+	noAddrCtx, cancel2 := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel2()
+	if _, err := newStreamRetry(noAddrCtx, A, C.ID(), proto); err == nil {
+		t.Fatalf("expected error without a connection")
 	}
-	// 固定种子：绕过 PAKE，直接验证 XFER 协议与哈希校验
-	const seed uint64 = 0xdeadbeefcafebabe
-
-	S := newLoopbackHost(t)
-	R := newLoopbackHost(t)
-	connect(t, S, R)
+	if d := time.Since(start); d >= newStreamRetryDelay+2*time.Second {
+		t.Fatalf("should not retry without a connection: %s", d)
+	}
+}
 
+func TestClassifyPath_SecurityAndMuxer(t *testing.T) {
+	A := newLoopbackHost(t)
+	B := newLoopbackHost(t)
+	connect(t, A, B)
+	conns := A.Network().ConnsToPeer(B.ID())
+	if len(conns) == 0 {
+		t.Fatalf("no connection")
+	}
+	pi := p2p.ClassifyPath(conns[0])
+	if pi.Security != "/noise" && pi.Security != "/tls/1.0.0" {
+		t.Fatalf("security = %q", pi.Security)
+	}
+	if pi.Muxer != "/yamux/1.0.0" {
+		t.Fatalf("muxer = %q", pi.Muxer)
+	}
+	if !pi.SecureOK {
+		t.Fatalf("default libp2p security %q failed CheckSecurity", pi.Security)
+	}
+
+	// QUIC 不单独协商，主动拨出的中继连接不报告
+	if sec, mux := p2p.ConnSecurity(network.ConnectionState{Transport: "quic-v1"}); !strings.Contains(sec, "tls1.3") || !strings.Contains(mux, "quic-v1") {
+		t.Fatalf("quic: %q %q", sec, mux)
+	}
+	if sec, mux := p2p.ConnSecurity(network.ConnectionState{Transport: "p2p-circuit"}); sec != "unknown" || mux != "unknown" {
+		t.Fatalf("circuit: %q %q", sec, mux)
+	}
+}
+
+func TestCheckSecurity(t *testing.T) {
+	for _, c := range []struct {
+		st network.ConnectionState
+		ok bool
+	}{
+		{network.ConnectionState{Transport: "tcp", Security: "/noise"}, true},
+		{network.ConnectionState{Transport: "tcp", Security: "/tls/1.0.0"}, true},
+		{network.ConnectionState{Transport: "quic-v1"}, true},
+		{network.ConnectionState{Transport: "webtransport"}, true},
+		{network.ConnectionState{Transport: "webrtc-direct"}, true},
+		{network.ConnectionState{Transport: "p2p-circuit", Security: "/noise"}, true},
+		// 明文、未知协议，以及不自带加密的传输却没有协商加密
+		{network.ConnectionState{Transport: "tcp", Security: "/plaintext/2.0.0"}, false},
+		{network.ConnectionState{Transport: "tcp", Security: "/secio/1.0.0"}, false},
+		{network.ConnectionState{Transport: "tcp"}, false},
+		{network.ConnectionState{Transport: "p2p-circuit"}, false}, // 中继连接的加密未知
+		{network.ConnectionState{}, false},
+	} {
+		if err := p2p.CheckSecurity(c.st); (err == nil) != c.ok {
+			t.Errorf("CheckSecurity(%+v) = %v, want ok=%v", c.st, err, c.ok)
+		}
+	}
+}
+
+func TestMergeAddrs_Dedup(t *testing.T) {
+	mk := func(s string) ma.Multiaddr {
+		m, err := ma.NewMultiaddr(s)
+		if err != nil {
+			t.Fatalf("multiaddr: %v", err)
+		}
+		return m
+	}
+	base := []ma.Multiaddr{mk("/ip4/1.2.3.4/tcp/4001"), mk("/ip4/1.2.3.4/udp/4001/quic-v1")}
+	extra := []ma.Multiaddr{mk("/ip4/1.2.3.4/tcp/4001"), mk("/ip4/5.6.7.8/tcp/4001")}
+	got := mergeAddrs(base, extra)
+	if len(got) != 3 || !got[2].Equal(mk("/ip4/5.6.7.8/tcp/4001")) {
+		t.Fatalf("unexpected merge result: %v", got)
+	}
+}
+
+// fakeRendezvous 记录注册状态，并像真实客户端一样在 ctx 存活期间保持注册。
+type fakeRendezvous struct {
+	mu   sync.Mutex
+	regs map[string]context.Context
+	fail bool
+}
+
+func (f *fakeRendezvous) Register(ctx context.Context, ns string, ttl int) (time.Duration, error) {
+	if f.fail {
+		return 0, errors.New("unreachable")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.regs == nil {
+		f.regs = make(map[string]context.Context)
+	}
+	f.regs[ns] = ctx
+	return time.Duration(ttl) * time.Second, nil
+}
+
+func (f *fakeRendezvous) Unregister(_ context.Context, ns string) error {
+	if f.fail {
+		return errors.New("unreachable")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.regs, ns)
+	return nil
+}
+
+func (f *fakeRendezvous) Discover(_ context.Context, ns string, _ int, _ []byte) ([]peer.AddrInfo, []byte, error) {
+	return nil, nil, nil
+}
+
+// live 返回仍在注册且未被取消续期的主题数量。
+func (f *fakeRendezvous) live() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, ctx := range f.regs {
+		if ctx.Err() == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMultiRendezvous_RegistrationLifecycle(t *testing.T) {
+	ok := &fakeRendezvous{}
+	down := &fakeRendezvous{fail: true}
+	m := &multiRendezvous{points: []rendezvousPoint{{id: "ok", client: ok}, {id: "down", client: down}}}
+
+	// 模拟两次代码轮换：每次轮换前取消旧注册的续期并注销旧主题
+	for _, topic := range []string{"/wormhole/111", "/wormhole/222"} {
+		regCtx, regCancel := context.WithCancel(context.Background())
+		if err := m.Register(regCtx, topic, rzvRegisterTTL); err != nil {
+			t.Fatalf("register %s: %v", topic, err)
+		}
+		if n := ok.live(); n != 1 {
+			t.Fatalf("after registering %s: %d live registrations, want 1", topic, n)
+		}
+		regCancel()
+		if err := m.Unregister(context.Background(), topic); err != nil {
+			t.Fatalf("unregister %s: %v", topic, err)
+		}
+	}
+	if n := ok.live(); n != 0 {
+		t.Fatalf("stale registrations left: %d", n)
+	}
+
+	// 所有汇合点都不可用时返回错误
+	m = &multiRendezvous{points: []rendezvousPoint{{id: "down", client: down}}}
+	if err := m.Unregister(context.Background(), "/wormhole/333"); err == nil {
+		t.Fatalf("expected error when all points fail")
+	}
+}
+
+// listRendezvous 是只实现 Discover 的汇合点客户端，按注册先后返回固定的节点列表
+type listRendezvous struct {
+	fakeRendezvous
+	peers []peer.AddrInfo
+}
+
+func (l *listRendezvous) Discover(context.Context, string, int, []byte) ([]peer.AddrInfo, []byte, error) {
+	return l.peers, nil, nil
+}
+
+func TestTransportPolicy_QUICFallback(t *testing.T) {
+	tcp := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	quic := ma.StringCast("/ip4/1.2.3.4/udp/4001/quic-v1")
+	circuit := ma.StringCast("/ip4/5.6.7.8/udp/4001/quic-v1/p2p/12D3KooWDpJ7As7BWAwRMfu1VU2WCqNjvq387JEYKDBj4kx6nXTN/p2p-circuit")
+	addrs := []ma.Multiaddr{quic, tcp, circuit}
+
+	if _, err := parseTransports("tcp,carrier-pigeon"); err == nil {
+		t.Fatal("unknown transport accepted")
+	}
+	allowed, err := parseTransports(" TCP , ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	excl := &transportPolicy{allowed: allowed}
+	for _, ad := range excl.rank(addrs) {
+		if ad.Addr.Equal(quic) {
+			t.Fatal("-transports tcp,ws still dials QUIC")
+		}
+	}
+	if got := excl.announce(addrs); len(got) != 2 { // circuit 地址不受限制
+		t.Fatalf("announce = %v", got)
+	}
+
+	tp := &transportPolicy{}
+	dialErr := &swarm.DialError{DialErrors: []swarm.TransportError{{Address: quic, Cause: context.DeadlineExceeded}}}
+	for i := 0; i < quicFailThreshold; i++ {
+		if r := tp.rank(addrs); !r[0].Addr.Equal(quic) {
+			t.Fatalf("QUIC deprioritized after %d failures: %v", i, r)
+		}
+		tp.observeDial(fmt.Errorf("wrapped: %w", dialErr), nil)
+	}
+	r := tp.rank(addrs)
+	last := r[len(r)-1]
+	if !last.Addr.Equal(quic) || last.Delay < quicFallbackDelay {
+		t.Fatalf("after fallback rank = %v, want QUIC last and delayed", r)
+	}
+	for _, a := range tp.announce(addrs) {
+		if a.Equal(quic) {
+			t.Fatal("QUIC still announced after fallback")
+		}
+	}
+	if got := tp.announce([]ma.Multiaddr{quic}); len(got) != 1 {
+		t.Fatal("only QUIC available, but nothing announced")
+	}
+}
+
+func TestDiscover_NewestFirstAndSkipFailed(t *testing.T) {
+	a, b, c := peer.AddrInfo{ID: "a"}, peer.AddrInfo{ID: "b"}, peer.AddrInfo{ID: "c"}
+	m := &multiRendezvous{points: []rendezvousPoint{
+		{id: "r1", client: &listRendezvous{peers: []peer.AddrInfo{a, b}}},
+		{id: "r2", client: &listRendezvous{peers: []peer.AddrInfo{c, b}}},
+	}}
+	infos, err := m.Discover(context.Background(), "/wormhole/1", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := func(ais []peer.AddrInfo) string {
+		var out []string
+		for _, ai := range ais {
+			out = append(out, string(ai.ID))
+		}
+		return strings.Join(out, ",")
+	}
+	if got := ids(infos); got != "b,a,c" {
+		t.Fatalf("merged order = %s, want newest first b,a,c", got)
+	}
+
+	failed := map[peer.ID]bool{"b": true}
+	if got := ids(pickCandidates(infos, failed)); got != "a,c" {
+		t.Fatalf("candidates = %s, want a,c", got)
+	}
+	failed["a"], failed["c"] = true, true
+	if got := ids(pickCandidates(infos, failed)); got != "b,a,c" || len(failed) != 0 {
+		t.Fatalf("all failed: candidates = %s, failed = %v; want a fresh cycle", got, failed)
+	}
+}
+
+func TestIdleWatch(t *testing.T) {
+	start := time.Now()
+	last := func() time.Time { return start }
+
+	// 无活动：超时后触发一次
+	fired := make(chan struct{})
+	go idleWatch(make(chan struct{}), 30*time.Millisecond, last, func() bool { return false }, func() { close(fired) })
+	select {
+	case <-fired:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("idle callback not fired")
+	}
+
+	// 传输进行中不触发；done 关闭后退出
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		idleWatch(done, 20*time.Millisecond, last, func() bool { return true }, func() { t.Errorf("fired while busy") })
+		close(exited)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(done)
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("idleWatch did not return after done")
+	}
+}
+
+func TestWaitXfersIdle(t *testing.T) {
+	// 传输结束后返回 true (对应 /bye 等待后关闭)
+	var active atomic.Int32
+	active.Store(2)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		active.Add(-1)
+		time.Sleep(30 * time.Millisecond)
+		active.Add(-1)
+	}()
+	if !waitXfersIdle(make(chan struct{}), active.Load, 5*time.Millisecond) {
+		t.Fatal("want true once transfers finish")
+	}
+
+	// 等待期间会话已结束 (对端 BYE 或再次 /bye)：返回 false，不再关闭一次
+	active.Store(1)
+	done := make(chan struct{})
+	go func() { time.Sleep(30 * time.Millisecond); close(done) }()
+	if waitXfersIdle(done, active.Load, 5*time.Millisecond) {
+		t.Fatal("want false when the session ended first")
+	}
+}
+
+func TestRankRelays_FastestSkipsUnreachable(t *testing.T) {
+	h := newLoopbackHost(t)
+	live := newLoopbackHost(t)
+	gone := newLoopbackHost(t)
+	dead := peer.AddrInfo{ID: gone.ID(), Addrs: gone.Addrs()}
+	_ = gone.Close()
+	relays := []peer.AddrInfo{dead, {ID: live.ID(), Addrs: live.Addrs()}}
+
+	ctx, cancel := ctxT(t, 0)
+	defer cancel()
+	if got := rankRelays(ctx, h, relays, "first"); got[0].ID != dead.ID {
+		t.Fatalf("first should keep server order")
+	}
+	got := rankRelays(ctx, h, relays, "fastest")
+	if len(got) != 2 || got[0].ID != live.ID() || got[1].ID != dead.ID {
+		t.Fatalf("fastest order = %v, want live relay first", got)
+	}
+	// 全部无法 ping 通时退回原顺序
+	if got := rankRelays(ctx, h, []peer.AddrInfo{dead, dead}, "fastest"); got[0].ID != dead.ID || len(got) != 2 {
+		t.Fatalf("fallback order = %v", got)
+	}
+}
+
+func TestQuiet_SuppressesProgress(t *testing.T) {
+	defer func() { quiet = false }()
+
+	quiet = false
+	if progressOutput() != os.Stderr {
+		t.Fatalf("progress should go to stderr by default")
+	}
+	quiet = true
+	if progressOutput() != io.Discard {
+		t.Fatalf("progress should be discarded in quiet mode")
+	}
+}
+
+func TestPostFailAsync_WaitReports(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req models.FailRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		time.Sleep(50 * time.Millisecond) // 模拟较慢的控制服务器
+		mu.Lock()
+		got = append(got, r.URL.Path+" "+req.Nameplate)
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"ok":"true"}`))
+	}))
+	defer srv.Close()
+
+	// 模拟信号触发的退出：报告发出后立即等待，必须在进程退出前送达
+	postFailAsync(srv.URL, "123")
+	postConsumeAsync(srv.URL, "456")
+	if !waitReports(reportTimeout) {
+		t.Fatalf("reports not flushed before timeout")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("got %v, want fail and consume reports", got)
+	}
+}
+
+func TestVersionLines(t *testing.T) {
+	old := version.Version
+	defer func() { version.Version = old }()
+	version.Version = "v9.9.9-test"
+	ls := version.Lines()
+	all := strings.Join(ls, "\n")
+	for _, want := range []string{"wormhole v9.9.9-test", models.ProtoChat, models.ProtoXfer, "wire v1", "go1"} {
+		if !strings.Contains(all, want) {
+			t.Fatalf("version output missing %q:\n%s", want, all)
+		}
+	}
+}
+
+func TestSanitizeChatText(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"hello, world", "hello, world"},
+		{"tab\tkept", "tab\tkept"},
+		{"\x1b[2J\x1b[Hpwned", "\\x1b[2J\\x1b[Hpwned"},
+		{"over\rwrite", "over\\x0dwrite"},
+		{"bell\a del\x7f", "bell\\x07 del\\x7f"},
+		{"c1\u009bcsi", "c1\\x9bcsi"},
+		{"你好 😀", "你好 😀"},
+	}
+	for _, c := range cases {
+		if got := uipkg.Sanitize(c.in); got != c.want {
+			t.Fatalf("Sanitize(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestOpenChatErrorSummary(t *testing.T) {
+	h1 := newLoopbackHost(t)
+	h2 := newLoopbackHost(t)
+
+	empty := &openChatError{}
+	if got := empty.Error(); got != "no peers discovered" {
+		t.Fatalf("empty summary = %q", got)
+	}
+	empty.discoverErr = fmt.Errorf("discover: %w", context.DeadlineExceeded)
+	if got := empty.Error(); got != "no peers discovered (timeout)" {
+		t.Fatalf("discover summary = %q", got)
+	}
+
+	rep := &openChatError{}
+	a := rep.attempt(h1.ID())
+	a.rounds++
+	a.directErr = errors.New("failed to dial: no route to host")
+	a.relayErr = errors.New("no relays")
+	b := rep.attempt(h2.ID())
+	b.rounds++
+	b.relays = 1
+	b.directErr = errors.New("failed to dial: connection refused")
+	b.relayErr = errors.New("error opening relay circuit: NO_RESERVATION (204)")
+	if rep.attempt(h1.ID()) != a {
+		t.Fatalf("attempt() must reuse the record for a known peer")
+	}
+
+	want := "discovered 2 peer(s); direct failed (no route), relay failed (no relays known, no reservation)"
+	if got := rep.Error(); got != want {
+		t.Fatalf("summary = %q, want %q", got, want)
+	}
+	if d := rep.details(); len(d) != 6 || !strings.Contains(d[3], "1 relay(s) known") {
+		t.Fatalf("unexpected details: %q", d)
+	}
+}
+
+func TestRelayDialTimeout_Scaled(t *testing.T) {
+	defer func(d, r time.Duration) { dialTimeout, relayDialTimeout = d, r }(dialTimeout, relayDialTimeout)
+
+	dialTimeout, relayDialTimeout = 12*time.Second, 0
+	if got := effectiveRelayDialTimeout(); got != 20*time.Second {
+		t.Fatalf("default relay timeout = %s, want 20s", got)
+	}
+	dialTimeout = 30 * time.Second
+	if got := effectiveRelayDialTimeout(); got != 50*time.Second {
+		t.Fatalf("scaled relay timeout = %s, want 50s", got)
+	}
+	relayDialTimeout = 45 * time.Second
+	if got := effectiveRelayDialTimeout(); got != relayDialTimeout {
+		t.Fatalf("explicit relay timeout = %s, want %s", got, relayDialTimeout)
+	}
+}
+
+func TestPAKE_RunAndConfirm(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	A := newLoopbackHost(t)
+	B := newLoopbackHost(t)
+	connect(t, A, B)
+
+	const pass = "correct horse battery staple"
+	const nameplate = "999"
+	// 使用任意测试协议打开 stream；runPAKEAndConfirm 使用我们显式提供的 proto 来构建 transcript
+	const testProto protocol.ID = "/wormhole/pake-test/1.0.0"
+
+	resB := make(chan []byte, 1)
+	errB := make(chan error, 1)
+	B.SetStreamHandler(testProto, func(s network.Stream) {
+		defer s.Close()
+		K, err := session.RunPAKEAndConfirm(context.Background(), s, false, pass, nameplate, models.ProtoChat, B.ID(), s.Conn().RemotePeer())
+		if err != nil {
+			errB <- err
+			return
+		}
+		resB <- K
+	})
+
+	ctx, cancel := ctxT(t, 10*time.Second)
+	defer cancel()
+	s, err := A.NewStream(ctx, B.ID(), testProto)
+	if err != nil {
+		t.Fatalf("new stream: %v", err)
+	}
+	K1, err := session.RunPAKEAndConfirm(ctx, s, true, pass, nameplate, models.ProtoChat, A.ID(), s.Conn().RemotePeer())
+	if err != nil {
+		t.Fatalf("dialer runPAKE: %v", err)
+	}
+	select {
+	case e := <-errB:
+		t.Fatalf("responder runPAKE: %v", e)
+	case K2 := <-resB:
+		if !bytes.Equal(K1, K2) {
+			t.Fatal("shared key mismatch")
+		}
+		// 再次确认：SAS & xfer-seed 派生一致
+		trC := crypto.BuildTranscript(nameplate, models.ProtoChat, A.ID(), B.ID())
+		if crypto.SASFromKey(K1, trC) != crypto.SASFromKey(K2, trC) {
+			t.Fatal("SAS mismatch")
+		}
+		trX := crypto.BuildTranscript(nameplate, models.ProtoXfer, A.ID(), B.ID())
+		seed1 := binary.LittleEndian.Uint64(crypto.HkdfBytes(K1, "xfer-xxh3-seed", trX, 8))
+		seed2 := binary.LittleEndian.Uint64(crypto.HkdfBytes(K2, "xfer-xxh3-seed", trX, 8))
+		if seed1 != seed2 {
+			t.Fatal("xfer seed mismatch")
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting PAKE responder")
+	}
+}
+
+// teeStream 记录写入流的所有字节，用于检查实际发出的帧。
+type teeStream struct {
+	network.Stream
+	out *bytes.Buffer
+}
+
+func (s teeStream) Write(p []byte) (int, error) {
+	s.out.Write(p)
+	return s.Stream.Write(p)
+}
+
+func TestPAKE_WrongPassphraseAborts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	A := newLoopbackHost(t)
+	B := newLoopbackHost(t)
+	connect(t, A, B)
+	const nameplate = "999"
+	const testProto protocol.ID = "/wormhole/pake-test/1.0.0"
+
+	type result struct {
+		K   []byte
+		err error
+	}
+	resB := make(chan result, 1)
+	var sentB bytes.Buffer
+	B.SetStreamHandler(testProto, func(s network.Stream) {
+		defer s.Close()
+		K, err := session.RunPAKEAndConfirm(context.Background(), teeStream{s, &sentB}, false, "able-acid", nameplate, models.ProtoChat, B.ID(), s.Conn().RemotePeer())
+		resB <- result{K, err}
+	})
+
+	ctx, cancel := ctxT(t, 10*time.Second)
+	defer cancel()
+	s, err := A.NewStream(ctx, B.ID(), testProto)
+	if err != nil {
+		t.Fatalf("new stream: %v", err)
+	}
+	defer s.Close()
+	KA, errA := session.RunPAKEAndConfirm(ctx, s, true, "able-acme", nameplate, models.ProtoChat, A.ID(), s.Conn().RemotePeer())
+	var rb result
+	select {
+	case rb = <-resB:
+	case <-ctx.Done():
+		t.Fatal("timeout waiting PAKE responder")
+	}
+
+	// 双方都失败且不返回密钥，错误可识别为密钥确认失败而不是传输错误
+	for side, r := range map[string]result{"dialer": {KA, errA}, "responder": rb} {
+		if r.err == nil || r.K != nil {
+			t.Fatalf("%s: want error and no key, got key=%x err=%v", side, r.K, r.err)
+		}
+		if !errors.Is(r.err, session.ErrKeyConfirm) {
+			t.Fatalf("%s: want ErrKeyConfirm, got %v", side, r.err)
+		}
+	}
+
+	// 响应方校验失败后发出了 FramePakeAbort
+	var last byte
+	for sentB.Len() > 0 {
+		typ, _, err := session.ReadFrame(frameStream{rw: &sentB})
+		if err != nil {
+			t.Fatalf("parse responder frames: %v", err)
+		}
+		last = typ
+	}
+	if last != session.FramePakeAbort {
+		t.Fatalf("responder's last frame = 0x%02x, want FramePakeAbort", last)
+	}
+
+	// 传输中断不会被误判为口令不一致
+	c1, c2 := net.Pipe()
+	_ = c2.Close()
+	_, err = session.RunPAKEAndConfirm(ctx, frameStream{rw: c1}, true, "able-acid", nameplate, models.ProtoChat, A.ID(), B.ID())
+	if err == nil || errors.Is(err, session.ErrKeyConfirm) {
+		t.Fatalf("closed stream should be a transport error, got %v", err)
+	}
+}
+
+func TestPAKE_VersionedLabels(t *testing.T) {
+	// 协商出的协议 ID 选择标签集合，未知版本直接拒绝
+	if l, err := crypto.LabelsFor(models.ProtoChat); err != nil || l != crypto.LabelsV1 {
+		t.Fatalf("LabelsFor(%s) = %+v, %v", models.ProtoChat, l, err)
+	}
+	if v := crypto.ProtoVersion(models.ProtoXfer); v != crypto.LabelsV1.Version {
+		t.Fatalf("ProtoVersion(%s) = %q", models.ProtoXfer, v)
+	}
+	const protoV2 protocol.ID = "/wormhole/2.0.0/chat"
+	if _, err := crypto.LabelsFor(protoV2); !errors.Is(err, crypto.ErrUnsupportedVersion) {
+		t.Fatalf("unknown version: want ErrUnsupportedVersion, got %v", err)
+	}
+	var sent bytes.Buffer
+	_, err := session.RunPAKEAndConfirm(context.Background(), frameStream{rw: &sent}, true, "able-acid", "7", protoV2, peer.ID("a"), peer.ID("b"))
+	if !errors.Is(err, crypto.ErrUnsupportedVersion) || sent.Len() != 0 {
+		t.Fatalf("unknown version: err=%v, wrote %d bytes", err, sent.Len())
+	}
+
+	// 模拟一个只改动了标签的 v2：口令相同、SPAKE2 密钥相同，但密钥确认必须失败
+	v2 := crypto.LabelsV1
+	v2.Version, v2.Prefix, v2.Confirm = "2.0.0", "wormhole-pake-v2", "confirm-v2"
+	run := func(la, lb crypto.Labels) bool {
+		a := crypto.NewPAKEStateWithLabels(la, true, "able-acid", "7", models.ProtoChat, peer.ID("a"), peer.ID("b"))
+		b := crypto.NewPAKEStateWithLabels(lb, false, "able-acid", "7", models.ProtoChat, peer.ID("b"), peer.ID("a"))
+		ma, mb := a.Start(), b.Start()
+		KA, err := a.Finish(mb)
+		if err != nil {
+			t.Fatalf("finish A: %v", err)
+		}
+		KB, err := b.Finish(ma)
+		if err != nil {
+			t.Fatalf("finish B: %v", err)
+		}
+		if !bytes.Equal(KA, KB) {
+			t.Fatal("labels must not affect the SPAKE2 key itself")
+		}
+		return b.VerifyConfirmTag(KB, "A", a.ComputeConfirmTag(KA, "A"))
+	}
+	if !run(crypto.LabelsV1, crypto.LabelsV1) {
+		t.Fatal("same version: confirmation failed")
+	}
+	if run(crypto.LabelsV1, v2) {
+		t.Fatal("v1/v2 confirmation succeeded, want a clean failure")
+	}
+}
+
+func TestPAKE_FourWordCodeRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	// host 端生成 4 个单词的口令，connect 端从完整代码中解析
+	ws := client.EFFWords(effShortWordlist)
+	hostPass := newPassphrase(ws, 4)
+	if n := len(strings.Split(hostPass, "-")); n != 4 {
+		t.Fatalf("want 4 words, got %d (%q)", n, hostPass)
+	}
+	code := "4321-" + hostPass
+	nameplate, connPass, err := parseCode(code, 4)
+	if err != nil {
+		t.Fatalf("parseCode: %v", err)
+	}
+	if nameplate != "4321" || connPass != hostPass {
+		t.Fatalf("parseCode(%q) = %q, %q", code, nameplate, connPass)
+	}
+
+	A := newLoopbackHost(t)
+	B := newLoopbackHost(t)
+	connect(t, A, B)
+	const testProto protocol.ID = "/wormhole/pake-test/1.0.0"
+
+	resB := make(chan []byte, 1)
+	errB := make(chan error, 1)
+	B.SetStreamHandler(testProto, func(s network.Stream) {
+		defer s.Close()
+		K, err := session.RunPAKEAndConfirm(context.Background(), s, false, hostPass, "4321", models.ProtoChat, B.ID(), s.Conn().RemotePeer())
+		if err != nil {
+			errB <- err
+			return
+		}
+		resB <- K
+	})
+
+	ctx, cancel := ctxT(t, 10*time.Second)
+	defer cancel()
+	s, err := A.NewStream(ctx, B.ID(), testProto)
+	if err != nil {
+		t.Fatalf("new stream: %v", err)
+	}
+	K1, err := session.RunPAKEAndConfirm(ctx, s, true, connPass, nameplate, models.ProtoChat, A.ID(), s.Conn().RemotePeer())
+	if err != nil {
+		t.Fatalf("dialer runPAKE: %v", err)
+	}
+	select {
+	case e := <-errB:
+		t.Fatalf("responder runPAKE: %v", e)
+	case K2 := <-resB:
+		if !bytes.Equal(K1, K2) {
+			t.Fatal("shared key mismatch")
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout waiting PAKE responder")
+	}
+}
+
+func TestParseCode_BadFormat(t *testing.T) {
+	for _, c := range []string{"123", "123-one", "", "12-able-acid", "ab1-able-acid", "12345-able-acid", "123-able-a", "123-able-", "123-able-ac1d"} {
+		if _, _, err := parseCode(c, 2); err == nil {
+			t.Fatalf("parseCode(%q) should fail", c)
+		}
+	}
+	// 要求的单词数多于代码中的单词数
+	if _, _, err := parseCode("123-able-acid", 3); err == nil || !strings.Contains(err.Error(), "full code") {
+		t.Fatalf("expected incomplete-code error, got %v", err)
+	}
+	// 首尾空白与大写字母是可以接受的
+	np, pass, err := parseCode("  4567-Able-ACID-yo-yo ", 3)
+	if err != nil || np != "4567" || pass != "able-acid-yo-yo" {
+		t.Fatalf("parseCode: %q %q %v", np, pass, err)
+	}
+}
+
+// 朗读后手工输入的代码在大小写、空白和 Unicode 形式上的差异，应规整为同一口令并协商出同一密钥
+func TestParseCode_NormalizedVariantsAgreeOnKey(t *testing.T) {
+	variants := []string{
+		"4567-able-acid-yo-yo",
+		"  4567-Able-ACID-yo-yo\t\n",
+		"4567 able acid yo-yo",
+		"4567 - able - acid - yo - yo",
+		"\u00a04567--able-acid-YO-YO\u00a0",
+	}
+	for _, v := range variants {
+		np, pass, err := parseCode(v, 3)
+		if err != nil || np != "4567" || pass != "able-acid-yo-yo" {
+			t.Fatalf("parseCode(%q) = %q, %q, %v", v, np, pass, err)
+		}
+		// host 使用生成的原始口令，connect 使用规整后的输入，双方必须通过密钥确认
+		a := crypto.NewPAKEState(true, "able-acid-yo-yo", "4567", models.ProtoChat, peer.ID("a"), peer.ID("b"))
+		b := crypto.NewPAKEState(false, pass, np, models.ProtoChat, peer.ID("b"), peer.ID("a"))
+		ma, mb := a.Start(), b.Start()
+		KA, err := a.Finish(mb)
+		if err != nil {
+			t.Fatalf("finish A: %v", err)
+		}
+		KB, err := b.Finish(ma)
+		if err != nil {
+			t.Fatalf("finish B: %v", err)
+		}
+		if !bytes.Equal(KA, KB) || !b.VerifyConfirmTag(KB, "A", a.ComputeConfirmTag(KA, "A")) {
+			t.Fatalf("%q: keys disagree", v)
+		}
+	}
+	// 组合字符序列规整为 NFC 预组合形式
+	if got := normalizeCode("Cafe\u0301-X"); got != "caf\u00e9-x" {
+		t.Fatalf("normalizeCode NFC: %q", got)
+	}
+}
+
+// 作为位置参数给出的代码先规范化再识别；无法识别的参数报错，而不是被忽略后进入 host 模式
+func TestPositionalCode(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"4567-able-acid"}, "4567-able-acid"},
+		{[]string{"4567-Able-Acid"}, "4567-able-acid"},
+		{[]string{"4567 able acid"}, "4567-able-acid"},
+		{[]string{"4567", "able", "acid"}, "4567-able-acid"},
+		{[]string{"K7x-able-acid"}, "k7x-able-acid"},
+		{[]string{"Wormhole://4567-able-acid"}, "Wormhole://4567-able-acid"},
+	} {
+		if got, err := positionalCode(tc.args); err != nil || got != tc.want {
+			t.Errorf("positionalCode(%q) = %q, %v; want %q", tc.args, got, err, tc.want)
+		}
+	}
+	for _, args := range [][]string{{"4567-able"}, {"hello"}, {"sned", "file.txt"}, {"4567-able-acid", "x.txt"}} {
+		if got, err := positionalCode(args); err == nil {
+			t.Errorf("positionalCode(%q) = %q, want error", args, got)
+		}
+	}
+}
+
+func TestParseCode_AlnumNameplate(t *testing.T) {
+	np, pass, err := parseCode("K7x-able-acid", 2)
+	if err != nil || np != "k7x" || pass != "able-acid" {
+		t.Fatalf("parseCode: %q %q %v", np, pass, err)
+	}
+	// 易混淆字符不在 alnum 字母表中
+	for _, c := range []string{"k0x-able-acid", "kox-able-acid", "klx-able-acid", "kix-able-acid"} {
+		if _, _, err := parseCode(c, 2); err == nil {
+			t.Fatalf("parseCode(%q) should fail", c)
+		}
+	}
+
+	charset := models.NameplateCharsetDigits
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/v1/info" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(models.InfoResponse{NameplateDigits: 3, NameplateCharset: charset})
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	if err := checkNameplateCharset(ctx, ts.URL, "k7x"); err == nil || !strings.Contains(err.Error(), "numeric") {
+		t.Fatalf("digits server should reject alnum nameplate, got %v", err)
+	}
+	if err := checkNameplateCharset(ctx, ts.URL, "123"); err != nil {
+		t.Fatalf("numeric nameplate: %v", err)
+	}
+	charset = models.NameplateCharsetAlnum
+	if err := checkNameplateCharset(ctx, ts.URL, "k7x"); err != nil {
+		t.Fatalf("alnum server: %v", err)
+	}
+}
+
+func TestCodeURI_QR(t *testing.T) {
+	u := codeURI("123-able-acid", "https://ctrl.example:8443/wh")
+	if u != "wormhole://123-able-acid?control=https%3A%2F%2Fctrl.example%3A8443%2Fwh" {
+		t.Fatalf("codeURI = %q", u)
+	}
+	if u := codeURI("123-able-acid", ""); u != "wormhole://123-able-acid" {
+		t.Fatalf("codeURI without control = %q", u)
+	}
+
+	// 每行字符表示两行模块，四周各留 4 个模块的静默区；链接很短，版本不超过 4 (33x33)
+	lines := strings.Split(strings.TrimSuffix(codeQR(u), "\n"), "\n")
+	width := utf8.RuneCountInString(lines[0])
+	if size := width - 8; size < 21 || size > 33 || (size-17)%4 != 0 {
+		t.Fatalf("unexpected size %d for %d bytes", size, len(u))
+	}
+	if len(lines) != (width+1)/2 {
+		t.Fatalf("%d lines for width %d", len(lines), width)
+	}
+	for _, l := range lines {
+		if n := utf8.RuneCountInString(l); n != width {
+			t.Fatalf("line width %d, want %d", n, width)
+		}
+	}
+	// 第 3 行字符对应模块行 4、5：静默区是浅色 (方块)，左上角定位图形的左边框是深色 (空白)
+	if row := []rune(lines[2]); row[3] != '█' || row[4] != ' ' {
+		t.Fatalf("finder pattern not where expected: %q", lines[2])
+	}
+
+	// 过长的内容报错而不是生成无法扫描的图形
+	if got := codeQR(strings.Repeat("x", 4000)); got != "" {
+		t.Fatalf("expected no QR code for an oversized payload")
+	}
+}
+
+func TestParseCodeURI(t *testing.T) {
+	for _, c := range []struct{ in, code, control string }{
+		{codeURI("123-able-acid", "https://ctrl.example:8443/wh"), "123-able-acid", "https://ctrl.example:8443/wh"},
+		{"wormhole://123-able-acid", "123-able-acid", ""},
+		{" WORMHOLE://K7x-Able-Acid-yo-yo/?control=http%3A%2F%2F127.0.0.1%3A8080 ", "k7x-able-acid-yo-yo", "http://127.0.0.1:8080"},
+	} {
+		code, control, err := parseCodeURI(c.in)
+		if err != nil || code != c.code || control != c.control {
+			t.Fatalf("parseCodeURI(%q) = %q, %q, %v", c.in, code, control, err)
+		}
+	}
+
+	for _, in := range []string{
+		"wormhole://",
+		"wormhole:123-able-acid",
+		"https://123-able-acid",
+		"wormhole://123-able",
+		"wormhole://123-able-acid/extra",
+		"wormhole://123-able-acid#frag",
+		"wormhole://me@123-able-acid",
+		"wormhole://123-able-acid:80",
+		"wormhole://123-able-acid?foo=1",
+		"wormhole://123-able-acid?control=ftp%3A%2F%2Fx",
+		"wormhole://123-able-acid?control=ctrl.example",
+		"wormhole://123-able-acid?control=https%3A%2F%2Fa&control=https%3A%2F%2Fb",
+		"wormhole://123-able-acid?control=%zz",
+	} {
+		if _, _, err := parseCodeURI(in); err == nil || !strings.Contains(err.Error(), "bad wormhole link") {
+			t.Fatalf("parseCodeURI(%q) should fail clearly, got %v", in, err)
+		}
+	}
+}
+
+func TestReadCodeLine(t *testing.T) {
+	r := strings.NewReader("  123-able-acid \r\n/send -f x\n")
+	code, err := readCodeLine(r)
+	if err != nil || code != "123-able-acid" {
+		t.Fatalf("readCodeLine = %q, %v", code, err)
+	}
+	// 只消费第一行，后续输入留给聊天
+	if rest, _ := io.ReadAll(r); string(rest) != "/send -f x\n" {
+		t.Fatalf("rest of stdin = %q", rest)
+	}
+	if code, err := readCodeLine(strings.NewReader("wormhole://123-able-acid")); err != nil || code != "wormhole://123-able-acid" {
+		t.Fatalf("link without newline = %q, %v", code, err)
+	}
+	for _, in := range []string{"", "\n", "   \nlater\n", strings.Repeat("a", maxCodeLine+1)} {
+		if _, err := readCodeLine(strings.NewReader(in)); err == nil {
+			t.Fatalf("readCodeLine(%.20q) should fail", in)
+		}
+	}
+}
+
+func TestResolveOutDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	got, err := resolveOutDir("~/incoming")
+	if err != nil || got != filepath.Join(home, "incoming") {
+		t.Fatalf("resolveOutDir(~/incoming) = %q, %v", got, err)
+	}
+	if st, err := os.Stat(got); err != nil || !st.IsDir() {
+		t.Fatalf("directory not created: %v", err)
+	}
+	t.Chdir(home)
+	if got, err := resolveOutDir("rel"); err != nil || got != filepath.Join(home, "rel") {
+		t.Fatalf("relative dir = %q, %v", got, err)
+	}
+	if got, _ := expandHome("~user/x"); got != "~user/x" {
+		t.Fatalf("~user should not be expanded, got %q", got)
+	}
+	file := filepath.Join(home, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveOutDir(file); err == nil {
+		t.Fatal("a regular file accepted as save directory")
+	}
+}
+
+func TestXferDest_Template(t *testing.T) {
+	now := time.Date(2025, 3, 9, 12, 0, 0, 0, time.UTC)
+	remote := newLoopbackHost(t).ID()
+	out := t.TempDir()
+	dir := xferOffer{Kind: "dir", Name: "photos"}
+
+	cases := []struct {
+		tmpl string
+		want string
+	}{
+		{"", "photos"},
+		{"{date}/{name}", filepath.Join("2025-03-09", "photos")},
+		{"{code}-{name}", "123-photos"},
+		{"from/{peer}/{name}", filepath.Join("from", remote.String(), "photos")},
+	}
+	for _, c := range cases {
+		d := xferDest{outDir: out, template: c.tmpl, nameplate: "123"}
+		got, err := d.baseDir(dir, remote, now)
+		if err != nil || got != filepath.Join(out, c.want) {
+			t.Fatalf("template %q: got %q err=%v, want %q", c.tmpl, got, err, filepath.Join(out, c.want))
+		}
+	}
+
+	// 单文件传输不受模板影响
+	d := xferDest{outDir: out, template: "{date}/{name}"}
+	if got, _ := d.baseDir(xferOffer{Kind: "file", Name: "a.txt"}, remote, now); got != out {
+		t.Fatalf("file transfer should land in outdir, got %q", got)
+	}
+
+	// 路径穿越：来自模板或对端提供的目录名都必须被拒绝
+	for _, bad := range []struct{ tmpl, name string }{
+		{"../{name}", "photos"},
+		{"{name}", "../../etc"},
+		{"{name}", ".."},
+		{"/abs/{name}", "photos"},
+		// 展开后仍在 outdir 内，但 {name} 越出了自己的一段，进入其他对端或其他日期的目录
+		{"{peer}/{name}", "../otherpeer/x"},
+		{"{date}/{name}", "../x"},
+		{"{date}/{name}", "a/b"},
+	} {
+		d := xferDest{outDir: out, template: bad.tmpl}
+		if got, err := d.baseDir(xferOffer{Kind: "dir", Name: bad.name}, remote, now); err == nil {
+			t.Fatalf("template %q name %q: expected error, got %q", bad.tmpl, bad.name, got)
+		}
+	}
+}
+
+func TestXferDest_ByCode(t *testing.T) {
+	now := time.Date(2025, 3, 9, 12, 0, 0, 0, time.UTC)
+	remote := newLoopbackHost(t).ID()
+	out := t.TempDir()
+
+	d := xferDest{outDir: out, nameplate: "4821", byCode: true}
+	if got, err := d.baseDir(xferOffer{Kind: "file", Name: "a.txt"}, remote, now); err != nil || got != filepath.Join(out, "4821") {
+		t.Fatalf("file: got %q err=%v", got, err)
+	}
+	d.template = "{date}/{name}"
+	want := filepath.Join(out, "4821", "2025-03-09", "photos")
+	if got, err := d.baseDir(xferOffer{Kind: "dir", Name: "photos"}, remote, now); err != nil || got != want {
+		t.Fatalf("dir: got %q err=%v, want %q", got, err, want)
+	}
+	// 对端提供的目录名仍需经过路径校验
+	if got, err := d.baseDir(xferOffer{Kind: "dir", Name: "../x"}, remote, now); err == nil {
+		t.Fatalf("expected traversal to be rejected, got %q", got)
+	}
+	// 非法密码牌不能作为子目录名
+	for _, np := range []string{"", "..", "../1"} {
+		bad := xferDest{outDir: out, nameplate: np, byCode: true}
+		if got, err := bad.baseDir(xferOffer{Kind: "file", Name: "a.txt"}, remote, now); err == nil {
+			t.Fatalf("nameplate %q: expected error, got %q", np, got)
+		}
+	}
+}
+
+func TestClientConfig_XDGAndOverride(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	path := clientConfigPath()
+	if path != filepath.Join(xdg, "wormhole", "config.toml") {
+		t.Fatalf("config path = %q", path)
+	}
+
+	newFS := func() (*flag.FlagSet, *string, *string, *bool) {
+		fs := flag.NewFlagSet("wormhole", flag.ContinueOnError)
+		ctrl := fs.String("control", "https://default", "")
+		out := fs.String("outdir", ".", "")
+		ver := fs.Bool("verify", true, "")
+		fs.String("code", "", "")
+		return fs, ctrl, out, ver
+	}
+
+	// 文件不存在时静默跳过
+	fs, ctrl, _, _ := newFS()
+	if loaded, err := loadClientConfig(fs, path); err != nil || loaded != "" || *ctrl != "https://default" {
+		t.Fatalf("missing config: loaded=%q err=%v ctrl=%q", loaded, err, *ctrl)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("control = \"http://self-hosted:8080\"\noutdir = \"/srv/in\"\nverify = false\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs, ctrl, out, ver := newFS()
+	if err := fs.Parse([]string{"-outdir", "/cli"}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadClientConfig(fs, path)
+	if err != nil || loaded != path {
+		t.Fatalf("load: loaded=%q err=%v", loaded, err)
+	}
+	if *ctrl != "http://self-hosted:8080" || *ver {
+		t.Fatalf("config defaults not applied: control=%q verify=%v", *ctrl, *ver)
+	}
+	if *out != "/cli" {
+		t.Fatalf("command line must win, outdir=%q", *out)
+	}
+
+	// 代码只能来自命令行
+	if err := os.WriteFile(path, []byte("code = \"123-a-b\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs, _, _, _ = newFS()
+	if _, err := loadClientConfig(fs, path); err == nil {
+		t.Fatalf("code in config file should be rejected")
+	}
+}
+
+func TestServerMessageLines_Sanitized(t *testing.T) {
+	if got := serverMessageLines("  \n"); len(got) != 0 {
+		t.Fatalf("blank message: %q", got)
+	}
+	got := serverMessageLines("Terms: be nice\r\n\n\x1b[2Jmaintenance Sunday")
+	if len(got) != 2 || got[0] != "Terms: be nice" || strings.ContainsRune(got[1], 0x1b) || !strings.HasSuffix(got[1], "maintenance Sunday") {
+		t.Fatalf("unexpected lines: %q", got)
+	}
+	long := serverMessageLines(strings.Repeat("é", models.MaxMessageLen))
+	if len(long) != 1 || len(long[0]) > models.MaxMessageLen+len("…") || !utf8.ValidString(long[0]) {
+		t.Fatalf("long message not truncated cleanly: %d bytes", len(long[0]))
+	}
+}
+
+func TestBarEwmaAge(t *testing.T) {
+	defer func(v float64) { ewmaAge = v }(ewmaAge)
+	ewmaAge = 0
+	small, large := barEwmaAge(100<<20), barEwmaAge(10<<30)
+	if small <= 0 || large <= small {
+		t.Fatalf("auto ewma: 100MiB=%v 10GiB=%v, want a longer window for the larger transfer", small, large)
+	}
+	if got := barEwmaAge(0); got != transfer.EwmaAge(0) {
+		t.Fatalf("empty transfer: got %v", got)
+	}
+	ewmaAge = 42
+	if got := barEwmaAge(10 << 30); got != 42 {
+		t.Fatalf("override: got %v, want 42", got)
+	}
+}
+
+func TestSendKind(t *testing.T) {
+	dir := t.TempDir()
+	f := writeTempFile(t, dir, "a.txt", []byte("x"))
+	if k, err := sendKind(f); err != nil || k != "file" {
+		t.Fatalf("file: %q %v", k, err)
+	}
+	if k, err := sendKind(dir); err != nil || k != "dir" {
+		t.Fatalf("dir: %q %v", k, err)
+	}
+	if _, err := sendKind(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("missing path should fail")
+	}
+}
+
+func TestXferOffer_Validate(t *testing.T) {
+	for _, ok := range []xferOffer{
+		{Kind: "file", Name: "a", Size: 0},
+		{Kind: "dir", Name: "d", Files: 3, Size: 1 << 40},
+		{Kind: "archive", Name: "d", Files: maxOfferFiles, Size: maxOfferSize},
+	} {
+		if err := ok.validate(); err != nil {
+			t.Fatalf("%+v: unexpected error %v", ok, err)
+		}
+	}
+	for _, bad := range []xferOffer{
+		{Kind: "exe", Name: "a"},
+		{Kind: "file", Name: "a", Size: -1},
+		{Kind: "file", Name: "a", Size: math.MaxInt64},
+		{Kind: "dir", Name: "d", Files: -5},
+		{Kind: "dir", Name: "d", Files: maxOfferFiles + 1},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Fatalf("%+v: expected error", bad)
+		}
+	}
+}
+
+func TestXfer_File_RoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	// 固定种子：绕过 PAKE，直接验证 XFER 协议与哈希校验
+	const seed uint64 = 0xdeadbeefcafebabe
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, seed)
+
+	// 发送端准备文件
+	srcDir := t.TempDir()
+	data := bytes.Repeat([]byte("ABCdef123!@#"), 4096) // ~48KB
+	src := writeTempFile(t, srcDir, "one.bin", data)
+
+	uiS := newTestUI(t)
+	ctx, cancel := ctxT(t, 20*time.Second)
+	defer cancel()
+	if _, err := sendXfer(ctx, p.S, p.R.ID(), "file", src, uiS, seed); err != nil {
+		t.Fatalf("sendXfer(file): %v", err)
+	}
+
+	dst := filepath.Join(outDir, "one.bin")
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("read dst: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("file content mismatch")
+	}
+}
+
+func TestXfer_BidirectionalSwap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 0x5eed5eed5eed5eed
+
+	outA, outB := t.TempDir(), t.TempDir()
+	ab := newXferPair(t, xferDest{outDir: outB}, seed)           // A → B
+	ba := serveXfer(t, ab.R, ab.S, xferDest{outDir: outA}, seed) // B → A，同一条连接
+
+	// 两个文件足够大，保证两个方向的传输在时间上重叠
+	srcDir := t.TempDir()
+	dataA := bytes.Repeat([]byte("from-A:0123456789"), 256*1024)
+	dataB := bytes.Repeat([]byte("from-B:9876543210"), 192*1024)
+	srcA := writeTempFile(t, srcDir, "a.bin", dataA)
+	srcB := writeTempFile(t, srcDir, "b.bin", dataB)
+
+	ctx, cancel := ctxT(t, 30*time.Second)
+	defer cancel()
+	errs := make(chan error, 2)
+	go func() { _, err := sendXfer(ctx, ab.S, ab.R.ID(), "file", srcA, ba.ui, seed); errs <- err }()
+	go func() { _, err := sendXfer(ctx, ba.S, ba.R.ID(), "file", srcB, ab.ui, seed); errs <- err }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("sendXfer: %v", err)
+		}
+	}
+
+	for _, c := range []struct {
+		path string
+		want []byte
+	}{{filepath.Join(outB, "a.bin"), dataA}, {filepath.Join(outA, "b.bin"), dataB}} {
+		got, err := os.ReadFile(c.path)
+		if err != nil {
+			t.Fatalf("read %s: %v", c.path, err)
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Fatalf("%s: content mismatch", c.path)
+		}
+	}
+
+	// 两个方向都结束后共享的进度条容器应已关闭 (接收端的 handler 可能稍晚返回)
+	released := func() bool {
+		xferBars.mu.Lock()
+		defer xferBars.mu.Unlock()
+		return xferBars.p == nil && xferBars.users == 0
+	}
+	for deadline := time.Now().Add(5 * time.Second); !released(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("shared progress not released")
+		}
+	}
+}
+
+func TestXfer_ReportsOutcome(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 0x0badc0ffee
+	var mu sync.Mutex
+	var got []models.TransferReport
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rep models.TransferReport
+		if r.URL.Path != "/v1/report" || json.NewDecoder(r.Body).Decode(&rep) != nil {
+			http.Error(w, "bad", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		got = append(got, rep)
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]string{"ok": "true"})
+	}))
+	defer ts.Close()
+
+	p := newXferPair(t, xferDest{outDir: t.TempDir()}, seed)
+	data := bytes.Repeat([]byte("report"), 1000)
+	srcDir := t.TempDir()
+	ctx, cancel := ctxT(t, 20*time.Second)
+	defer cancel()
+
+	send := func(name string) {
+		t.Helper()
+		src := writeTempFile(t, srcDir, name, data)
+		if _, err := sendXfer(ctx, p.S, p.R.ID(), "file", src, newTestUI(t), seed); err != nil {
+			t.Fatalf("sendXfer: %v", err)
+		}
+		p.waitHandled(t, 5*time.Second)
+		if !waitReports(5 * time.Second) {
+			t.Fatalf("reports did not finish")
+		}
+	}
+
+	// -no-report：reportURL 为空，不发出任何报告
+	send("quiet.bin")
+	if len(got) != 0 {
+		t.Fatalf("reported with reporting disabled: %+v", got)
+	}
+
+	reportURL, reportToken = ts.URL, "host.123.1.abc"
+	defer func() { reportURL, reportToken = "", "" }()
+	send("loud.bin")
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Slice(got, func(i, j int) bool { return got[i].Direction < got[j].Direction })
+	want := []models.TransferReport{
+		{Direction: models.ReportRecv, Path: models.ReportPathDirect, Files: 1, Bytes: int64(len(data)), OK: true, Token: "host.123.1.abc"},
+		{Direction: models.ReportSend, Path: models.ReportPathDirect, Files: 1, Bytes: int64(len(data)), OK: true, Token: "host.123.1.abc"},
+	}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("reports = %+v, want %+v", got, want)
+	}
+}
+
+func TestDirectAddrs_DropsCircuit(t *testing.T) {
+	id := peer.ID("remote")
+	ai := peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{
+		ma.StringCast("/ip4/192.0.2.1/tcp/4001"),
+		ma.StringCast("/ip4/198.51.100.7/tcp/4001/p2p-circuit"),
+		ma.StringCast("/ip6/2001:db8::1/udp/4001/quic-v1"),
+	}}
+	got := directAddrs(ai)
+	if got.ID != id || len(got.Addrs) != 2 || allRelayedAddrs(got) {
+		t.Fatalf("circuit addrs not removed: %v", got.Addrs)
+	}
+	if len(directAddrs(peer.AddrInfo{ID: id, Addrs: ai.Addrs[1:2]}).Addrs) != 0 {
+		t.Fatalf("relay-only peer should have no direct addrs")
+	}
+}
+
+func TestAnnounceAddrs_ParseResolveAdvertise(t *testing.T) {
+	for _, bad := range []string{
+		"/dns4/home.example.org", // 没有端口
+		"/tcp/4001",              // 没有主机
+		"/ip4/192.0.2.1/tcp/4001/p2p/QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N",
+		"/ip4/192.0.2.1/tcp/4001/p2p-circuit",
+		"not-a-multiaddr",
+	} {
+		if _, err := parseAnnounce(bad); err == nil {
+			t.Fatalf("parseAnnounce(%q) accepted", bad)
+		}
+	}
+	as, err := parseAnnounce(" /dns4/home.example.org/tcp/4001 , /ip4/192.168.1.5/udp/4001/quic-v1")
+	if err != nil || len(as) != 2 {
+		t.Fatalf("parseAnnounce: %v %v", as, err)
+	}
+
+	lookup := func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if network != "ip4" || host != "home.example.org" {
+			return nil, fmt.Errorf("unexpected lookup %s %s", network, host)
+		}
+		return []net.IP{net.ParseIP("203.0.113.9")}, nil
+	}
+	got, err := resolveAnnounce(context.Background(), lookup, as)
+	if err != nil {
+		t.Fatalf("resolveAnnounce: %v", err)
+	}
+	want := []string{"/dns4/home.example.org/tcp/4001", "/ip4/203.0.113.9/tcp/4001", "/ip4/192.168.1.5/udp/4001/quic-v1"}
+	if len(got) != len(want) {
+		t.Fatalf("resolved = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("resolved[%d] = %s, want %s", i, got[i], want[i])
+		}
+	}
+	fail := func(ctx context.Context, network, host string) ([]net.IP, error) {
+		return nil, errors.New("no such host")
+	}
+	if _, err := resolveAnnounce(context.Background(), fail, as); err == nil {
+		t.Fatalf("unresolvable name accepted")
+	}
+
+	// 公布的地址排在最前面，且不受私有地址过滤影响
+	old := announceAddrs
+	announceAddrs = got
+	defer func() { announceAddrs = old }()
+	pub := rendezvousAddrsFactory(nil, nil, false)([]ma.Multiaddr{
+		ma.StringCast("/ip4/10.0.0.2/tcp/4001"),
+		ma.StringCast("/ip4/198.51.100.1/tcp/4001"),
+	})
+	if len(pub) != 4 || pub[0].String() != want[0] || pub[2].String() != want[2] || pub[3].String() != "/ip4/198.51.100.1/tcp/4001" {
+		t.Fatalf("advertised = %v", pub)
+	}
+}
+
+func TestHooks_EnvOnlyAndTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook test uses sh")
+	}
+	marker := filepath.Join(t.TempDir(), "injected")
+	pi := p2p.PathInfo{Kind: "RELAY", Transport: "tcp", RemoteAddr: "/ip4/192.0.2.1/tcp/4001"}
+	env := hookEnv("host", peer.ID("remote"), "😀 😂", pi, "$(touch "+marker+")\nbye")
+
+	out, err := runHook(context.Background(), `printf '%s|%s|%s|%s\n' "$WORMHOLE_ROLE" "$WORMHOLE_PATH" "$WORMHOLE_SAS" "$WORMHOLE_REASON"`, env)
+	if err != nil {
+		t.Fatalf("runHook: %v (%s)", err, out)
+	}
+	// 环境变量的值不会被 shell 解释，控制字符被转义
+	want := "host|RELAY|😀 😂|$(touch " + marker + ")\\x0abye\n"
+	if string(out) != want {
+		t.Fatalf("hook output = %q, want %q", out, want)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatalf("value was evaluated by the shell")
+	}
+
+	var lines []string
+	logHook(func(l string) { lines = append(lines, l) }, "on-connect", []byte("a\nb\n"), errors.New("exit status 1"))
+	if len(lines) != 3 || lines[0] != "[on-connect] a" || !strings.Contains(lines[2], "exit status 1") {
+		t.Fatalf("logHook lines = %q", lines)
+	}
+
+	// -on-disconnect 的超时会终止命令
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := runHook(ctx, "sleep 5", env); err == nil || time.Since(start) > 3*time.Second {
+		t.Fatalf("hook not killed on timeout: err=%v after %s", err, time.Since(start))
+	}
+}
+
+func TestConnectBootstrap_Opportunistic(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	oldTimeout := dialTimeout
+	dialTimeout = 2 * time.Second
+	defer func() { dialTimeout = oldTimeout }()
+
+	A := newLoopbackHost(t)
+	B := newLoopbackHost(t)
+	gone := newLoopbackHost(t)
+	goneAddr := gone.Addrs()[0].String() + "/p2p/" + gone.ID().String()
+	_ = gone.Close()
+
+	ctx, cancel := ctxT(t, 10*time.Second)
+	defer cancel()
+	n := connectBootstrap(ctx, A, []string{
+		B.Addrs()[0].String() + "/p2p/" + B.ID().String(),
+		A.Addrs()[0].String() + "/p2p/" + A.ID().String(), // 自身被跳过
+		goneAddr, // 无法连接的节点被忽略
+		"not-a-multiaddr",
+	})
+	if n != 1 || A.Network().Connectedness(B.ID()) != network.Connected {
+		t.Fatalf("connected %d bootstrap peers, B connectedness %v", n, A.Network().Connectedness(B.ID()))
+	}
+	if connectBootstrap(ctx, A, nil) != 0 {
+		t.Fatalf("empty bootstrap list should connect to nothing")
+	}
+}
+
+func TestNewHost_ConnManagerLimits(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	oldLow, oldHigh, oldGrace := connLow, connHigh, connGrace
+	connLow, connHigh, connGrace = 5, 10, 30*time.Second
+	defer func() { connLow, connHigh, connGrace = oldLow, oldHigh, oldGrace }()
+
+	h, err := newHost(nil, nil)
+	if err != nil {
+		t.Fatalf("newHost: %v", err)
+	}
+	defer h.Close()
+	cm, ok := h.ConnManager().(*connmgr.BasicConnMgr)
+	if !ok {
+		t.Fatalf("unexpected conn manager %T", h.ConnManager())
+	}
+	info := cm.GetInfo()
+	if info.LowWater != 5 || info.HighWater != 10 || info.GracePeriod != 30*time.Second {
+		t.Fatalf("limits not applied: %+v", info)
+	}
+}
+
+// TestReleaseRelay_FreesReservationSlot 验证退出时释放中继后，中继立即回收预订槽位，
+// 而不是等到预订过期。
+func TestReleaseRelay_FreesReservationSlot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short (integration)")
+	}
+	ctx, cancel := ctxT(t, 30*time.Second)
+	defer cancel()
+
+	// 只允许一个预订的中继
+	srv := newLoopbackHost(t)
+	rc := relayv2.DefaultResources()
+	rc.MaxReservations = 1
+	if _, err := relayv2.New(srv, relayv2.WithResources(rc)); err != nil {
+		t.Fatalf("relay service: %v", err)
+	}
+	srvAI := []peer.AddrInfo{{ID: srv.ID(), Addrs: srv.Addrs()}}
+
+	A, B := newLoopbackHost(t), newLoopbackHost(t)
+	reserved := reserveAnyRelay(ctx, A, srvAI)
+	if reserved == nil {
+		t.Fatalf("first reservation failed")
+	}
+	A.ConnManager().Protect(reserved.ID, "relay")
+	if reserveAnyRelay(ctx, B, srvAI) != nil {
+		t.Fatalf("relay accepted a second reservation beyond its capacity")
+	}
+
+	releaseRelay(A, reserved)
+	if A.ConnManager().IsProtected(reserved.ID, "relay") {
+		t.Fatalf("relay still protected after release")
+	}
+	// 中继在连接断开后异步删除预订
+	deadline := time.Now().Add(10 * time.Second)
+	for reserveAnyRelay(ctx, B, srvAI) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("reservation slot not freed after release")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// TestE2E_RelayOnly 在只能经中继互通的两个客户端之间走完整流程：
+// 汇合点发现、经 circuit 地址拨号、PAKE 以及一次文件传输。
+func TestE2E_RelayOnly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short (integration)")
+	}
+	ctx, cancel := ctxT(t, 60*time.Second)
+	defer cancel()
+
+	// 服务器：与 wormhole-server 相同，同时提供 Relay v2 与 Rendezvous 服务
+	srv := newLoopbackHost(t)
+	if _, err := relayv2.New(srv); err != nil {
+		t.Fatalf("relay service: %v", err)
+	}
+	rdb, err := rzvsqlite.OpenDB(ctx, filepath.Join(t.TempDir(), "rzv.db"))
+	if err != nil {
+		t.Fatalf("open rendezvous db: %v", err)
+	}
+	_ = rzv.NewRendezvousService(srv, rdb)
+	srvAI := []peer.AddrInfo{{ID: srv.ID(), Addrs: srv.Addrs()}}
+
+	// 客户端：不监听任何地址，模拟 NAT 后无法被直连的节点。
+	// NoListenAddrs 会同时关闭 circuit 传输，需显式打开，否则中继地址无法拨号 ("no transport for protocol")
+	secs := p2p.NewSecurityLog()
+	natHost := func() host.Host {
+		h, err := libp2p.New(libp2p.NoListenAddrs, libp2p.EnableRelay(), secs.Options())
+		if err != nil {
+			t.Fatalf("new client host: %v", err)
+		}
+		h.Network().Notify(secs.Notifiee())
+		t.Cleanup(func() { _ = h.Close() })
+		return h
+	}
+	A, B := natHost(), natHost()
+	const topic = "/wormhole/e2e-relay"
+	const nameplate = "321"
+	const pass = "relay-only-code"
+
+	// A (host)：预订中继并只宣告 circuit 地址
+	reserved := reserveAnyRelay(ctx, A, srvAI)
+	if reserved == nil {
+		t.Fatalf("relay reservation failed")
+	}
+	rzA, err := newMultiRendezvous(ctx, A, srvAI, rendezvousAddrsFactory(A, reserved, true))
+	if err != nil {
+		t.Fatalf("host rendezvous: %v", err)
+	}
+	if err := rzA.Register(ctx, topic, rzvRegisterTTL); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// A 的聊天流处理器：作为 PAKE 响应方，随后设置传输流处理器
+	outDir := t.TempDir()
+	uiA := newTestUI(t)
+	keyA := make(chan []byte, 1)
+	errA := make(chan error, 1)
+	A.SetStreamHandler(models.ProtoChat, func(s network.Stream) {
+		K, err := session.RunPAKEAndConfirm(ctx, s, false, pass, nameplate, models.ProtoChat, A.ID(), s.Conn().RemotePeer())
+		if err != nil {
+			errA <- err
+			return
+		}
+		seed := binary.LittleEndian.Uint64(crypto.HkdfBytes(K, "xfer-xxh3-seed", crypto.BuildTranscript(nameplate, models.ProtoXfer, A.ID(), s.Conn().RemotePeer()), 8))
+		A.SetStreamHandler(models.ProtoXfer, func(xs network.Stream) {
+			handleIncomingXfer(ctx, A, xs, xferDest{outDir: outDir}, acceptOffer, uiA, seed)
+		})
+		keyA <- K
+	})
+
+	// B (connect)：经汇合点发现 A，只能通过中继拨号成功
+	rzB, err := newMultiRendezvous(ctx, B, srvAI, rendezvousAddrsFactory(B, nil, true))
+	if err != nil {
+		t.Fatalf("connect rendezvous: %v", err)
+	}
+	// -force-direct：A 无法直连，拨号应失败而不是回退到中继
+	forceDirect = true
+	_, err = tryOpenChat(ctx, B, rzB, topic, srvAI, 3*time.Second, true)
+	forceDirect = false
+	if err == nil || !strings.Contains(err.Error(), "-force-direct") {
+		t.Fatalf("want failure with relay fallback disabled, got %v", err)
+	}
+
+	s, err := tryOpenChat(ctx, B, rzB, topic, srvAI, 30*time.Second, true)
+	if err != nil {
+		t.Fatalf("open chat over relay: %v", err)
+	}
+	defer s.Close()
+	if !s.Conn().Stat().Limited {
+		t.Fatalf("chat stream is not relayed: %s", s.Conn().RemoteMultiaddr())
+	}
+	// 拨出的中继连接不报告加密，只能由握手时的记录补全
+	if err := p2p.CheckSecurity(s.Conn().ConnState()); err == nil {
+		t.Fatalf("unreported circuit security accepted: %+v", s.Conn().ConnState())
+	}
+	if st := secs.ConnState(s.Conn()); p2p.CheckSecurity(st) != nil {
+		t.Fatalf("recorded circuit security rejected: %+v", st)
+	}
+	KB, err := session.RunPAKEAndConfirm(ctx, s, true, pass, nameplate, models.ProtoChat, B.ID(), A.ID())
+	if err != nil {
+		t.Fatalf("dialer PAKE: %v", err)
+	}
+	select {
+	case err := <-errA:
+		t.Fatalf("responder PAKE: %v", err)
+	case KA := <-keyA:
+		if !bytes.Equal(KA, KB) {
+			t.Fatalf("shared key mismatch")
+		}
+	case <-ctx.Done():
+		t.Fatalf("timeout waiting for responder PAKE")
+	}
+
+	// 经同一中继发送文件；默认中继限制每个方向 128KiB，文件保持在该限制以内
+	seedB := binary.LittleEndian.Uint64(crypto.HkdfBytes(KB, "xfer-xxh3-seed", crypto.BuildTranscript(nameplate, models.ProtoXfer, B.ID(), A.ID()), 8))
+	data := bytes.Repeat([]byte("relay!"), 8<<10) // 48KiB
+	src := writeTempFile(t, t.TempDir(), "relayed.bin", data)
+	if _, err := sendXfer(ctx, B, A.ID(), "file", src, newTestUI(t), seedB); err != nil {
+		t.Fatalf("sendXfer over relay: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(outDir, "relayed.bin"))
+	if err != nil {
+		t.Fatalf("read received file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("relayed file content mismatch")
+	}
+
+	// 记录属于这条连接：连接关闭后随之删除，不会被之后到同一对端的连接沿用
+	c := s.Conn()
+	_ = c.Close()
+	for deadline := time.Now().Add(5 * time.Second); secs.ConnState(c).Security != ""; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("circuit security still recorded after close: %+v", secs.ConnState(c))
+		}
+	}
+}
+
+func TestXfer_Dir_RoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 0x0123456789abcdef
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, seed)
+
+	// 构造目录（含空文件与子目录）
+	srcRoot := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(srcRoot, "sub/a"), 0o755)
+	writeTempFile(t, srcRoot, "sub/a/aa.txt", []byte("hello A"))
+	writeTempFile(t, srcRoot, "sub/bb.txt", []byte("hello B"))
+	writeTempFile(t, srcRoot, "empty.bin", nil)
+
+	uiS := newTestUI(t)
+	ctx, cancel := ctxT(t, 30*time.Second)
+	defer cancel()
+	res, err := sendXfer(ctx, p.S, p.R.ID(), "dir", srcRoot, uiS, seed)
+	if err != nil || res.Total != 3 || res.Sent != 3 || len(res.Failed) != 0 || res.Outcome() != xferAllOK {
+		t.Fatalf("sendXfer(dir): %+v %v", res, err)
+	}
+
+	// 校验目标存在并内容一致
+	// 注意：目录传输会在 outDir 下创建一个与源目录同名的子目录
+	dirName := filepath.Base(srcRoot)
+	checkSame := func(rel string) {
+		src := filepath.Join(srcRoot, rel)
+		dst := filepath.Join(outDir, dirName, rel)
+		s, _ := os.ReadFile(src)
+		d, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatalf("missing %s: %v", rel, err)
+		}
+		if !bytes.Equal(s, d) {
+			t.Fatalf("dir file mismatch: %s", rel)
+		}
+	}
+	checkSame("sub/a/aa.txt")
+	checkSame("sub/bb.txt")
+	checkSame("empty.bin")
+}
+
+func TestDownloadIndex_RecordsAndLists(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 11
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir, index: true}, seed)
+	ctx, cancel := ctxT(t, 15*time.Second)
+	defer cancel()
+
+	src := t.TempDir()
+	writeTempFile(t, src, "a.txt", []byte("hello"))
+	writeTempFile(t, filepath.Join(src, "sub"), "b.txt", []byte("world!"))
+	if _, err := sendXfer(ctx, p.S, p.R.ID(), "dir", src, newTestUI(t), seed); err != nil {
+		t.Fatalf("sendXfer: %v", err)
+	}
+
+	recs, err := transfer.ReadDownloadIndex(outDir)
+	if err != nil || len(recs) != 2 {
+		t.Fatalf("index: %d records, err=%v", len(recs), err)
+	}
+	base := filepath.Base(src)
+	got := map[string]int64{}
+	for _, r := range recs {
+		if r.Peer != p.S.ID().String() || r.Hash == "" || r.Time.IsZero() {
+			t.Fatalf("incomplete record: %+v", r)
+		}
+		got[r.Path] = r.Size
+	}
+	if got[base+"/a.txt"] != 5 || got[base+"/sub/b.txt"] != 6 {
+		t.Fatalf("unexpected records: %v", got)
+	}
+	if st, err := os.Stat(filepath.Join(outDir, transfer.DownloadIndexName)); err != nil || st.Mode().Perm() != 0o600 {
+		t.Fatalf("index file mode: %v %v", st, err)
+	}
+
+	// 并发追加不会交错，半行记录被跳过
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = transfer.AppendDownloadRecord(outDir, transfer.DownloadRecord{Time: time.Now(), Path: fmt.Sprintf("p%d", i), Size: int64(i)})
+		}(i)
+	}
+	wg.Wait()
+	f, _ := os.OpenFile(filepath.Join(outDir, transfer.DownloadIndexName), os.O_WRONLY|os.O_APPEND, 0)
+	_, _ = f.WriteString(`{"time":"2025-`)
+	_ = f.Close()
+	if recs, err = transfer.ReadDownloadIndex(outDir); err != nil || len(recs) != 22 {
+		t.Fatalf("after concurrent appends: %d records, err=%v", len(recs), err)
+	}
+
+	var lines []string
+	if err := printDownloads(func(s string) { lines = append(lines, s) }, outDir); err != nil {
+		t.Fatalf("printDownloads: %v", err)
+	}
+	if len(lines) != 23 || !strings.Contains(strings.Join(lines, "\n"), base+"/sub/b.txt") {
+		t.Fatalf("unexpected listing: %q", lines)
+	}
+
+	// 索引不存在时返回空列表
+	empty := t.TempDir()
+	if recs, err := transfer.ReadDownloadIndex(empty); err != nil || recs != nil {
+		t.Fatalf("missing index: %v %v", recs, err)
+	}
+}
+
+func TestXfer_Dir_Exclude(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 42
+
+	old := excludes
+	excludes = multiFlag{"node_modules/", "*.tmp", "/docs/private"}
+	defer func() { excludes = old }()
+
+	if !excludeMatch(excludes, "a/b/node_modules", true) || excludeMatch(excludes, "node_modules", false) {
+		t.Fatalf("dir-only pattern mismatch")
+	}
+	if !excludeMatch(excludes, "docs/private", true) || excludeMatch(excludes, "x/docs/private", true) {
+		t.Fatalf("anchored pattern mismatch")
+	}
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, seed)
+
+	srcRoot := t.TempDir()
+	writeTempFile(t, srcRoot, "keep.txt", []byte("keep"))
+	writeTempFile(t, srcRoot, "scratch.tmp", []byte("tmp"))
+	writeTempFile(t, srcRoot, "node_modules/pkg/index.js", []byte("js"))
+	writeTempFile(t, srcRoot, "docs/private/secret.txt", []byte("secret"))
+	writeTempFile(t, srcRoot, "docs/readme.txt", []byte("docs"))
+
+	uiS := newTestUI(t)
+	ctx, cancel := ctxT(t, 30*time.Second)
+	defer cancel()
+	if _, err := sendXfer(ctx, p.S, p.R.ID(), "dir", srcRoot, uiS, seed); err != nil {
+		t.Fatalf("sendXfer(dir): %v", err)
+	}
+
+	dst := filepath.Join(outDir, filepath.Base(srcRoot))
+	for _, rel := range []string{"keep.txt", "docs/readme.txt"} {
+		if _, err := os.Stat(filepath.Join(dst, rel)); err != nil {
+			t.Fatalf("missing %s: %v", rel, err)
+		}
+	}
+	for _, rel := range []string{"scratch.tmp", "node_modules", "docs/private"} {
+		if _, err := os.Stat(filepath.Join(dst, rel)); !os.IsNotExist(err) {
+			t.Fatalf("excluded %s present on receiver (err=%v)", rel, err)
+		}
+	}
+}
+
+func TestSendPlan_DryRun(t *testing.T) {
+	old := excludes
+	excludes = multiFlag{"*.tmp", "cache/"}
+	defer func() { excludes = old }()
+
+	root := t.TempDir()
+	writeTempFile(t, root, "a.txt", bytes.Repeat([]byte("a"), 10))
+	writeTempFile(t, root, "sub/b.bin", bytes.Repeat([]byte("b"), 2048))
+	writeTempFile(t, root, "skip.tmp", []byte("x"))
+	writeTempFile(t, root, "cache/c.bin", []byte("x"))
+
+	var lines []string
+	if err := printSendPlan(func(s string) { lines = append(lines, s) }, root); err != nil {
+		t.Fatalf("printSendPlan: %v", err)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("unexpected plan: %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], "  a.txt") || !strings.Contains(lines[0], "10 B") ||
+		!strings.HasSuffix(lines[1], "  sub/b.bin") || !strings.Contains(lines[1], "2.0 KiB") {
+		t.Fatalf("unexpected file lines: %q", lines[:2])
+	}
+	if !strings.HasPrefix(lines[2], "dry run: 2 file(s), 2.0 KiB") {
+		t.Fatalf("unexpected summary: %q", lines[2])
+	}
+	if err := printSendPlan(func(string) {}, filepath.Join(root, "a.txt")); err == nil {
+		t.Fatalf("expected error for a non-directory")
+	}
+	if got := formatSize(3 << 30); got != "3.0 GiB" {
+		t.Fatalf("formatSize = %q", got)
+	}
+}
+
+func TestXfer_Dir_OnlySelectedFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 7
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, seed)
+
+	srcRoot := t.TempDir()
+	writeTempFile(t, srcRoot, "ok.txt", []byte("already delivered"))
+	writeTempFile(t, srcRoot, "sub/retry.txt", []byte("failed last time"))
+
+	// 模拟 /resend：只重发上次失败的 sub/retry.txt
+	uiS := newTestUI(t)
+	ctx, cancel := ctxT(t, 30*time.Second)
+	defer cancel()
+	res, err := sendXferOnly(ctx, p.S, p.R.ID(), "dir", srcRoot, []string{filepath.Join("sub", "retry.txt")}, uiS, seed)
+	if err != nil || res.Total != 1 || res.Sent != 1 {
+		t.Fatalf("sendXferOnly: %+v err=%v", res, err)
+	}
+
+	dst := filepath.Join(outDir, filepath.Base(srcRoot))
+	if b, err := os.ReadFile(filepath.Join(dst, "sub", "retry.txt")); err != nil || string(b) != "failed last time" {
+		t.Fatalf("resent file missing or wrong: %q %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "ok.txt")); !os.IsNotExist(err) {
+		t.Fatalf("file outside the resend set was sent (err=%v)", err)
+	}
+}
+
+func TestXfer_AbortLeavesNoTruncatedFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 99
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, seed)
+
+	ctx, cancel := ctxT(t, 10*time.Second)
+	defer cancel()
+	xs, err := p.S.NewStream(ctx, p.R.ID(), models.ProtoXfer)
+	if err != nil {
+		t.Fatalf("new stream: %v", err)
+	}
+	off, _ := json.Marshal(xferOffer{Kind: "file", Name: "big.bin", Size: 100})
+	if err := writeFrame(xs, frameOffer, off); err != nil {
+		t.Fatalf("write offer: %v", err)
+	}
+	if typ, _, err := readFrame(xs); err != nil || typ != frameAccept {
+		t.Fatalf("expected accept, got 0x%02x %v", typ, err)
+	}
+	hdr, _ := json.Marshal(map[string]any{"name": "big.bin", "size": 100, "algo": "xxh3-128-seed", "hash": "00"})
+	_ = writeFrame(xs, frameFileHdr, hdr)
+	_ = writeFrame(xs, frameChunk, bytes.Repeat([]byte("x"), 10))
+	_ = xs.Reset() // 传输中途断开
+
+	select {
+	case <-p.handled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("receiver did not exit after abort")
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "big.bin")); !os.IsNotExist(err) {
+		t.Fatalf("truncated file exists at final name (err=%v)", err)
+	}
+}
+
+func TestXfer_BlockHashAbortsEarly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 7
+	old := verifyBlockSize
+	verifyBlockSize = 4
+	defer func() { verifyBlockSize = old }()
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, seed)
+	ctx, cancel := ctxT(t, 15*time.Second)
+	defer cancel()
+
+	// 多块文件正常送达
+	data := []byte("0123456789abcdefXY")
+	src := writeTempFile(t, t.TempDir(), "multi.bin", data)
+	if _, err := sendXfer(ctx, p.S, p.R.ID(), "file", src, newTestUI(t), seed); err != nil {
+		t.Fatalf("sendXfer: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(outDir, "multi.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("multi-block file not received intact: %v", err)
+	}
+
+	// 第二块损坏：接收方在该块结束时删除临时文件，文件结束时回复 hash_mismatch
+	var blocks []string
+	bh := transfer.NewBlockHasher(seed, verifyBlockSize, func(_ int, sum string) error { blocks = append(blocks, sum); return nil })
+	_, _ = bh.Write([]byte("aaaabbbbcccc"))
+	_ = bh.Flush()
+
+	xs, err := p.S.NewStream(ctx, p.R.ID(), models.ProtoXfer)
+	if err != nil {
+		t.Fatalf("new stream: %v", err)
+	}
+	defer xs.Close()
+	off, _ := json.Marshal(xferOffer{Kind: "file", Name: "bad.bin", Size: 12})
+	_ = writeFrame(xs, frameOffer, off)
+	if typ, _, err := readFrame(xs); err != nil || typ != frameAccept {
+		t.Fatalf("expected accept, got 0x%02x %v", typ, err)
+	}
+	hdr, _ := json.Marshal(map[string]any{"name": "bad.bin", "size": 12, "algo": "xxh3-128-seed", "hash": "00", "block_size": verifyBlockSize, "blocks": blocks})
+	_ = writeFrame(xs, frameFileHdr, hdr)
+	part := filepath.Join(outDir, "bad.bin"+partSuffix)
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	_ = writeFrame(xs, frameChunk, []byte("aaaa"))
+	waitFor("first block written", func() bool { st, err := os.Stat(part); return err == nil && st.Size() == 4 })
+	_ = writeFrame(xs, frameChunk, []byte("bXbb"))
+	waitFor("partial file removed after a corrupt block", func() bool { _, err := os.Stat(part); return os.IsNotExist(err) })
+	_ = writeFrame(xs, frameChunk, []byte("cccc"))
+	_ = writeFrame(xs, frameFileDone, nil)
+	typ, payload, err := readFrame(xs)
+	if err != nil || typ != frameError {
+		t.Fatalf("expected error frame, got 0x%02x %v", typ, err)
+	}
+	if xe := decodeXferError(payload); xe.Code != xferErrHashMismatch || !retryableXferErr(xe) {
+		t.Fatalf("unexpected error: %+v", xe)
+	}
+	_ = writeFrame(xs, frameXferDone, nil)
+	if _, err := os.Stat(filepath.Join(outDir, "bad.bin")); !os.IsNotExist(err) {
+		t.Fatalf("corrupt file exists (err=%v)", err)
+	}
+}
+
+func TestXfer_KeepFailed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 11
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir, keepFailed: true}, seed)
+	ctx, cancel := ctxT(t, 15*time.Second)
+	defer cancel()
+
+	xs, err := p.S.NewStream(ctx, p.R.ID(), models.ProtoXfer)
+	if err != nil {
+		t.Fatalf("new stream: %v", err)
+	}
+	defer xs.Close()
+	off, _ := json.Marshal(xferOffer{Kind: "file", Name: "bad.bin", Size: 5})
+	_ = writeFrame(xs, frameOffer, off)
+	if typ, _, err := readFrame(xs); err != nil || typ != frameAccept {
+		t.Fatalf("expected accept, got 0x%02x %v", typ, err)
+	}
+	hdr, _ := json.Marshal(map[string]any{"name": "bad.bin", "size": 5, "algo": "xxh3-128-seed", "hash": "00"})
+	_ = writeFrame(xs, frameFileHdr, hdr)
+	_ = writeFrame(xs, frameChunk, []byte("hello"))
+	_ = writeFrame(xs, frameFileDone, nil)
+	// 仍然回复 NACK，让发送方重试
+	if typ, _, err := readFrame(xs); err != nil || typ != frameFileNack {
+		t.Fatalf("expected NACK, got 0x%02x %v", typ, err)
+	}
+	_ = writeFrame(xs, frameXferDone, nil)
+	p.waitHandled(t, 5*time.Second)
+
+	if got, err := os.ReadFile(filepath.Join(outDir, "bad.bin"+corruptSuffix)); err != nil || string(got) != "hello" {
+		t.Fatalf("corrupt bytes not kept: %q %v", got, err)
+	}
+	for _, name := range []string{"bad.bin", "bad.bin" + partSuffix} {
+		if _, err := os.Stat(filepath.Join(outDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s exists (err=%v)", name, err)
+		}
+	}
+}
+
+// 文件头中的文件名来自对端，不能逃出保存目录 (-outdir-by-code 时为密码牌目录)
+func TestXfer_RejectsUnsafeFileName(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 1880
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir, nameplate: "4821", byCode: true}, seed)
+
+	for _, name := range []string{"../../x", "../x", "/abs/x", ".."} {
+		ctx, cancel := ctxT(t, 15*time.Second)
+		xs, err := p.S.NewStream(ctx, p.R.ID(), models.ProtoXfer)
+		if err != nil {
+			t.Fatalf("new stream: %v", err)
+		}
+		off, _ := json.Marshal(xferOffer{Kind: "dir", Name: "photos", Size: 1, Files: 1})
+		_ = writeFrame(xs, frameOffer, off)
+		if typ, _, err := readFrame(xs); err != nil || typ != frameAccept {
+			t.Fatalf("%s: expected accept, got 0x%02x %v", name, typ, err)
+		}
+		hdr, _ := json.Marshal(map[string]any{"name": name, "size": 1, "algo": "xxh3-128-seed", "hash": "00"})
+		_ = writeFrame(xs, frameFileHdr, hdr)
+		if typ, _, err := readFrame(xs); err != nil || typ != frameError {
+			t.Fatalf("%s: expected error frame, got 0x%02x %v", name, typ, err)
+		}
+		select {
+		case <-p.handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: receiver did not finish", name)
+		}
+		_ = xs.Close()
+		cancel()
+	}
+	// 除了密码牌目录本身，什么都不应被创建
+	entries, _ := os.ReadDir(outDir)
+	for _, e := range entries {
+		if e.Name() != "4821" {
+			t.Fatalf("unexpected entry in outdir: %s", e.Name())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(outDir), "x")); !os.IsNotExist(err) {
+		t.Fatalf("file escaped outdir (err=%v)", err)
+	}
+}
+
+func TestXfer_Dir_IntoArchive(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 2024
+
+	srcRoot := t.TempDir()
+	want := map[string]string{
+		"a.txt":       "alpha",
+		"sub/b.txt":   "bravo",
+		"sub/c/d.txt": "delta",
+	}
+	for name, body := range want {
+		writeTempFile(t, srcRoot, name, []byte(body))
+	}
+
+	for _, format := range []string{"tar", "zip"} {
+		t.Run(format, func(t *testing.T) {
+			outDir := t.TempDir()
+			p := newXferPair(t, xferDest{outDir: outDir, archive: format}, seed)
+
+			uiS := newTestUI(t)
+			ctx, cancel := ctxT(t, 30*time.Second)
+			defer cancel()
+			if _, err := sendXfer(ctx, p.S, p.R.ID(), "dir", srcRoot, uiS, seed); err != nil {
+				t.Fatalf("sendXfer(dir): %v", err)
+			}
+			p.waitHandled(t, 5*time.Second)
+
+			// 只生成一个归档文件，没有散落的文件或临时文件
+			entries, _ := os.ReadDir(outDir)
+			arcPath := filepath.Join(outDir, filepath.Base(srcRoot)+"."+format)
+			if len(entries) != 1 || entries[0].Name() != filepath.Base(arcPath) {
+				t.Fatalf("unexpected outdir contents: %v", entries)
+			}
+
+			got := map[string]string{}
+			switch format {
+			case "tar":
+				f, err := os.Open(arcPath)
+				if err != nil {
+					t.Fatalf("open archive: %v", err)
+				}
+				defer f.Close()
+				tr := tar.NewReader(f)
+				for {
+					hdr, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("read tar: %v", err)
+					}
+					b, _ := io.ReadAll(tr)
+					got[hdr.Name] = string(b)
+				}
+			case "zip":
+				zr, err := zip.OpenReader(arcPath)
+				if err != nil {
+					t.Fatalf("open zip: %v", err)
+				}
+				defer zr.Close()
+				for _, zf := range zr.File {
+					rc, err := zf.Open()
+					if err != nil {
+						t.Fatalf("open entry: %v", err)
+					}
+					b, _ := io.ReadAll(rc)
+					rc.Close()
+					got[zf.Name] = string(b)
+				}
+			}
+			if len(got) != len(want) {
+				t.Fatalf("archive entries = %v, want %v", got, want)
+			}
+			for name, body := range want {
+				if got[name] != body {
+					t.Fatalf("entry %s = %q, want %q", name, got[name], body)
+				}
+			}
+		})
+	}
+}
+
+func TestXfer_Dir_AsArchiveStream(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 31337
+
+	old := asArchive
+	asArchive = true
+	defer func() { asArchive = old }()
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, seed)
+
+	srcRoot := t.TempDir()
+	want := map[string][]byte{
+		"one.txt":         []byte("1"),
+		"nested/two.txt":  bytes.Repeat([]byte("2"), 3*chunkSize+17),
+		"nested/deep/3.b": nil,
+	}
+	for name, body := range want {
+		writeTempFile(t, srcRoot, name, body)
+	}
+
+	uiS := newTestUI(t)
+	ctx, cancel := ctxT(t, 30*time.Second)
+	defer cancel()
+	res, err := sendXferOnly(ctx, p.S, p.R.ID(), "dir", srcRoot, nil, uiS, seed)
+	if err != nil || res.Total != 1 || res.Sent != 1 {
+		t.Fatalf("send as archive: %+v err=%v", res, err)
+	}
+	p.waitHandled(t, 5*time.Second)
+
+	// 接收方默认解包到与源目录同名的子目录，且不留下临时文件
+	dst := filepath.Join(outDir, filepath.Base(srcRoot))
+	for name, body := range want {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || !bytes.Equal(got, body) {
+			t.Fatalf("unpacked %s mismatch (err=%v)", name, err)
+		}
+	}
+	if parts, _ := filepath.Glob(filepath.Join(outDir, "*"+partSuffix)); len(parts) != 0 {
+		t.Fatalf("leftover temp files: %v", parts)
+	}
+}
+
+func TestXfer_Dir_PipelinedAcks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 4242
+
+	old := ackWindow
+	ackWindow = 8
+	defer func() { ackWindow = old }()
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, seed)
+
+	srcRoot := t.TempDir()
+	want := map[string][]byte{"big.bin": bytes.Repeat([]byte("b"), 2*chunkSize+5)}
+	for i := 0; i < 40; i++ {
+		want[fmt.Sprintf("d%d/f%02d.txt", i%3, i)] = []byte(fmt.Sprintf("file %d", i))
+	}
+	for name, body := range want {
+		writeTempFile(t, srcRoot, name, body)
+	}
+	// 接收方目标位置已被一个非空目录占用，该文件每次都无法落盘，重试耗尽后应恰好报告一次
+	writeTempFile(t, srcRoot, "d1/blocked.txt", []byte("blocked"))
+	dst := filepath.Join(outDir, filepath.Base(srcRoot))
+	writeTempFile(t, dst, "d1/blocked.txt/keep", []byte("x"))
+
+	uiS := newTestUI(t)
+	ctx, cancel := ctxT(t, 60*time.Second)
+	defer cancel()
+	res, err := sendXferOnly(ctx, p.S, p.R.ID(), "dir", srcRoot, nil, uiS, seed)
+	var ie *xferIncompleteError
+	if !errors.As(err, &ie) || ie.Result.Outcome() != xferPartial {
+		t.Fatalf("send pipelined: want partial success, got %v", err)
+	}
+	if len(res.Failed) != 1 || res.Failed[0] != filepath.Join("d1", "blocked.txt") {
+		t.Fatalf("want only d1/blocked.txt failed, got %v", res.Failed)
+	}
+	if res.Total != len(want)+1 || res.Sent != len(want) {
+		t.Fatalf("want %d of %d sent, got %+v", len(want), len(want)+1, res)
+	}
+	p.waitHandled(t, 5*time.Second)
+	for name, body := range want {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || !bytes.Equal(got, body) {
+			t.Fatalf("received %s mismatch (err=%v)", name, err)
+		}
+	}
+
+	// 回复中的文件名与队首文件不符时中止；旧版本对端的空载荷照常接受
+	ack, _ := json.Marshal(fileReply{Name: "a.txt"})
+	if err := fileResult(frameFileAck, ack, "b.txt", "", ""); !errors.Is(err, errAckOutOfOrder) {
+		t.Fatalf("want out-of-order error, got %v", err)
+	}
+	if err := fileResult(frameFileNack, nil, "b.txt", "", ""); !errors.Is(err, errHashMismatch) {
+		t.Fatalf("want hash mismatch for legacy NACK, got %v", err)
+	}
+	xe := &xferError{Code: xferErrIO, Message: "boom", Name: "a.txt"}
+	if err := fileResult(frameError, xe.payload(), "b.txt", "", ""); !errors.Is(err, errAckOutOfOrder) {
+		t.Fatalf("want out-of-order error for mismatched frameError, got %v", err)
+	}
+}
+
+func TestXfer_ReadOnlyOutDir(t *testing.T) {
+	// 不存在的保存目录会被创建；普通文件不能作为保存目录
+	base := t.TempDir()
+	if err := checkOutDir(filepath.Join(base, "new", "dir")); err != nil {
+		t.Fatalf("missing outdir should be created: %v", err)
+	}
+	file := writeTempFile(t, base, "file.txt", []byte("x"))
+	if err := checkOutDir(file); err == nil {
+		t.Fatalf("regular file accepted as outdir")
+	}
+
+	ro := filepath.Join(base, "ro")
+	if err := os.Mkdir(ro, 0o555); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	defer os.Chmod(ro, 0o755)
+	if f, err := os.CreateTemp(ro, "probe"); err == nil {
+		f.Close()
+		t.Skip("directory permissions are not enforced (running as root?)")
+	}
+	if err := checkOutDir(ro); err == nil {
+		t.Fatalf("read-only outdir accepted")
+	}
+	if testing.Short() {
+		return
+	}
+
+	// 接收方在询问用户之前就以 permission_denied 拒绝提议
+	const seed uint64 = 99
+	p := newXferPair(t, xferDest{outDir: ro}, seed)
+	var asked atomic.Bool
+	p.receive(context.Background(), xferDest{outDir: ro}, func(_ string, _ time.Duration) bool { asked.Store(true); return true })
+	src := writeTempFile(t, t.TempDir(), "a.txt", []byte("abc"))
+	ctx, cancel := ctxT(t, 10*time.Second)
+	defer cancel()
+	_, err := sendXfer(ctx, p.S, p.R.ID(), "file", src, newTestUI(t), seed)
+	var xe *xferError
+	if !errors.As(err, &xe) || xe.Code != xferErrPermission {
+		t.Fatalf("want permission_denied, got %v", err)
+	}
+	if asked.Load() {
+		t.Fatalf("user was asked to accept an offer that cannot be saved")
+	}
+}
+
+func TestXferQueue_Serializes(t *testing.T) {
+	q := newXferQueue()
+	var running, maxRunning, waits atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.run(context.Background(), func() { waits.Add(1) }, func() {
+				n := running.Add(1)
+				if n > maxRunning.Load() {
+					maxRunning.Store(n)
+				}
+				time.Sleep(20 * time.Millisecond)
+				running.Add(-1)
+			})
+		}()
+	}
+	wg.Wait()
+	if maxRunning.Load() != 1 {
+		t.Fatalf("transfers overlapped: %d at once", maxRunning.Load())
+	}
+	if waits.Load() == 0 {
+		t.Fatalf("queued transfers were not announced")
+	}
+
+	// 排队期间会话结束：不再执行
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go q.run(context.Background(), func() {}, func() { close(started); <-release })
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if q.run(ctx, func() {}, func() { t.Fatalf("ran after cancel") }) {
+		t.Fatalf("run should report false when ctx ends while queued")
+	}
+	close(release)
+}
+
+func TestTransferPkg_ZeroByteFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 77
+	const proto = "/wormhole-test/transfer-pkg"
+
+	S := newLoopbackHost(t)
+	R := newLoopbackHost(t)
+	connect(t, S, R)
 	outDir := t.TempDir()
 	uiR := newTestUI(t)
-	askYes := func(_ string, _ time.Duration) bool { return true }
+	ctx, cancel := ctxT(t, 10*time.Second)
+	defer cancel()
+	R.SetStreamHandler(proto, func(xs network.Stream) {
+		transfer.HandleIncomingXfer(ctx, R, xs, outDir, acceptOffer, uiR, seed)
+	})
+
+	// 手工驱动发送方：零字节文件没有任何 FrameChunk，只有文件头与 FrameFileDone
+	send := func(name, hash string) byte {
+		t.Helper()
+		xs, err := S.NewStream(ctx, R.ID(), proto)
+		if err != nil {
+			t.Fatalf("new stream: %v", err)
+		}
+		defer xs.Close()
+		off, _ := json.Marshal(transfer.XferOffer{Kind: "file", Name: name})
+		_ = transfer.WriteFrame(xs, transfer.FrameOffer, off)
+		if typ, _, err := transfer.ReadFrame(xs); err != nil || typ != transfer.FrameAccept {
+			t.Fatalf("expected accept, got 0x%02x %v", typ, err)
+		}
+		hdr, _ := json.Marshal(map[string]any{"name": name, "size": 0, "algo": "xxh3-128-seed", "hash": hash})
+		_ = transfer.WriteFrame(xs, transfer.FrameFileHdr, hdr)
+		_ = transfer.WriteFrame(xs, transfer.FrameFileDone, nil)
+		typ, _, err := transfer.ReadFrame(xs)
+		if err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		_ = transfer.WriteFrame(xs, transfer.FrameXferDone, nil)
+		return typ
+	}
+
+	// 空输入的带种子 xxh3 哈希与发送方 (main.go) 的计算方式一致；大小写不影响校验
+	sum := xxh3.NewSeed(seed).Sum128().Bytes()
+	if typ := send("empty.bin", strings.ToUpper(fmt.Sprintf("%x", sum[:]))); typ != transfer.FrameFileAck {
+		t.Fatalf("empty file: want ACK, got 0x%02x", typ)
+	}
+	if st, err := os.Stat(filepath.Join(outDir, "empty.bin")); err != nil || st.Size() != 0 {
+		t.Fatalf("empty file not created: %v", err)
+	}
+
+	if typ := send("bad.bin", "00"); typ != transfer.FrameFileNack {
+		t.Fatalf("wrong hash: want NACK, got 0x%02x", typ)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "bad.bin")); !os.IsNotExist(err) {
+		t.Fatalf("mismatched empty file kept (err=%v)", err)
+	}
+}
+
+func TestXferProgress_File(t *testing.T) {
+	if got := progressPath("/tmp/p.json", "send"); got != "/tmp/p-send.json" {
+		t.Fatalf("progressPath: %s", got)
+	}
+	if got := progressPath("state", "recv"); got != "state-recv" {
+		t.Fatalf("progressPath without ext: %s", got)
+	}
+
+	// 未启用时所有方法都是空操作
+	var none *xferProgress
+	if newXferProgress("", "send", xferOffer{}, "", newTestUI(t)) != nil || none.add("a", 1, "h") != nil {
+		t.Fatalf("disabled progress should be nil and inert")
+	}
+	none.finish(true)
+
+	base := filepath.Join(t.TempDir(), "progress.json")
+	p := newXferProgress(base, "send", xferOffer{Kind: "dir", Name: "photos"}, "peer", newTestUI(t))
+	read := func() *xferProgress {
+		t.Helper()
+		got := new(xferProgress) // 含互斥锁，按指针返回
+		b, err := os.ReadFile(progressPath(base, "send"))
+		if err != nil || json.Unmarshal(b, got) != nil {
+			t.Fatalf("read progress: %v", err)
+		}
+		return got
+	}
+	if got := read(); got.Kind != "dir" || got.Name != "photos" || got.Completed == nil || len(got.Completed) != 0 {
+		t.Fatalf("initial progress: %+v", got)
+	}
+	_ = p.add(filepath.Join("a", "1.jpg"), 10, "h1")
+	_ = p.add("2.jpg", 20, "h2")
+	got := read()
+	if len(got.Completed) != 2 || got.Completed[0] != (progressEntry{Path: "a/1.jpg", Size: 10, Hash: "h1"}) {
+		t.Fatalf("completed: %+v", got.Completed)
+	}
+	p.finish(false) // 有失败的文件：保留
+	_ = read()
+	p.finish(true)
+	if _, err := os.Stat(progressPath(base, "send")); !os.IsNotExist(err) {
+		t.Fatalf("progress file not removed after success (err=%v)", err)
+	}
+}
+
+func TestXfer_Dir_ProgressFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 1907
+
+	base := filepath.Join(t.TempDir(), "progress.json")
+	old := progressFile
+	progressFile = base
+	defer func() { progressFile = old }()
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir, progressFile: base}, seed)
+
+	srcRoot := t.TempDir()
+	writeTempFile(t, srcRoot, "a.txt", []byte("alpha"))
+	writeTempFile(t, srcRoot, "sub/b.txt", []byte("bravo"))
+	writeTempFile(t, srcRoot, "sub/blocked.txt", []byte("never"))
+	// 目标位置被非空目录占用，该文件无法落盘：传输结束时仍有失败，进度文件保留
+	writeTempFile(t, filepath.Join(outDir, filepath.Base(srcRoot)), "sub/blocked.txt/keep", []byte("x"))
+
+	ctx, cancel := ctxT(t, 30*time.Second)
+	defer cancel()
+	res, err := sendXferOnly(ctx, p.S, p.R.ID(), "dir", srcRoot, nil, newTestUI(t), seed)
+	var ie *xferIncompleteError
+	if !errors.As(err, &ie) || len(res.Failed) != 1 || res.Sent != 2 || res.Total != 3 {
+		t.Fatalf("send: %+v err=%v", res, err)
+	}
+	p.waitHandled(t, 5*time.Second)
+
+	// 双方各自记录了已确认的两个文件，且哈希一致
+	var views [2]xferProgress
+	for i, role := range []string{"send", "recv"} {
+		b, err := os.ReadFile(progressPath(base, role))
+		if err != nil || json.Unmarshal(b, &views[i]) != nil {
+			t.Fatalf("%s progress: %v", role, err)
+		}
+		var paths []string
+		for _, e := range views[i].Completed {
+			paths = append(paths, e.Path)
+		}
+		sort.Strings(paths)
+		if strings.Join(paths, ",") != "a.txt,sub/b.txt" {
+			t.Fatalf("%s completed: %v", role, paths)
+		}
+	}
+	for i := range views[0].Completed {
+		if views[0].Completed[i] != views[1].Completed[i] {
+			t.Fatalf("views differ: %+v vs %+v", views[0].Completed[i], views[1].Completed[i])
+		}
+	}
+}
+
+func TestXfer_OfferRejected(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	const seed uint64 = 123
 
-	// 接收端设置 handler
-	R.SetStreamHandler(models.ProtoXfer, func(xs network.Stream) {
-		handleIncomingXfer(context.Background(), R, xs, outDir, askYes, uiR, seed)
-	})
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, seed)
+	askNo := func(_ string, _ time.Duration) bool { return false } // 拒绝
+	p.receive(context.Background(), xferDest{outDir: outDir}, askNo)
 
-	// 发送端准备文件
 	srcDir := t.TempDir()
-	data := bytes.Repeat([]byte("ABCdef123!@#"), 4096) // ~48KB
-	src := writeTempFile(t, srcDir, "one.bin", data)
-
+	src := writeTempFile(t, srcDir, "nope.txt", []byte("xxx"))
 	uiS := newTestUI(t)
+
+	ctx, cancel := ctxT(t, 10*time.Second)
+	defer cancel()
+	_, err := sendXfer(ctx, p.S, p.R.ID(), "file", src, uiS, seed)
+	if err == nil || err.Error() != "peer rejected: "+rejectDeclined {
+		t.Fatalf("expected rejection error with reason, got %v", err)
+	}
+}
+
+func TestRejectError_Payloads(t *testing.T) {
+	for _, c := range []struct {
+		payload []byte
+		want    string
+	}{
+		{nil, "peer rejected"}, // 旧版本接收方
+		{[]byte("not json"), "peer rejected"},
+		{[]byte(`{"reason":"  "}`), "peer rejected"},
+		{[]byte(`{"reason":"insufficient disk space"}`), "peer rejected: insufficient disk space"},
+		{[]byte(`{"reason":"bad\u001b[2Jterm"}`), "peer rejected: bad\\x1b[2Jterm"},
+	} {
+		if got := rejectError(c.payload).Error(); got != c.want {
+			t.Errorf("rejectError(%q) = %q, want %q", c.payload, got, c.want)
+		}
+	}
+	long, _ := json.Marshal(xferReject{Reason: strings.Repeat("x", 1000)})
+	if got := rejectError(long).Error(); len(got) > len("peer rejected: ")+maxRejectReason {
+		t.Fatalf("reason not truncated: %d bytes", len(got))
+	}
+}
+
+// selftest 应在进程内跑通全部阶段，并按顺序为每个阶段输出一行耗时
+func TestSelftest_FullLoop(t *testing.T) {
+	if testing.Short() {
+		t.Skip("selftest spins up libp2p hosts")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var lines []string
+	if err := runSelftest(ctx, func(s string) { lines = append(lines, s) }, 256<<10); err != nil {
+		t.Fatalf("selftest: %v\n%s", err, strings.Join(lines, "\n"))
+	}
+	phases := []string{"control", "claim", "dial", "pake", "transfer"}
+	if len(lines) != len(phases) {
+		t.Fatalf("want %d phase lines, got %q", len(phases), lines)
+	}
+	for i, p := range phases {
+		if f := strings.Fields(lines[i]); len(f) < 3 || f[0] != p || f[2] != "ok" {
+			t.Fatalf("phase %d: want %q ok, got %q", i, p, lines[i])
+		}
+	}
+}
+
+// 发送结果区分全部成功、部分成功与全部失败，并映射到不同的退出码；记录的总是最差的结果
+func TestXferResult_OutcomeAndExitCode(t *testing.T) {
+	cases := []struct {
+		r    xferResult
+		want xferOutcome
+		code int
+	}{
+		{xferResult{Total: 3, Sent: 3}, xferAllOK, 0},
+		{xferResult{}, xferAllOK, 0},
+		{xferResult{Total: 3, Sent: 2, Failed: []string{"a"}}, xferPartial, 3},
+		{xferResult{Total: 1, Failed: []string{"."}}, xferAllFailed, 4},
+	}
+	for _, c := range cases {
+		if got := c.r.Outcome(); got != c.want || got.exitCode() != c.code {
+			t.Fatalf("%+v: outcome %d (exit %d), want %d (exit %d)", c.r, got, got.exitCode(), c.want, c.code)
+		}
+	}
+	if msg := (&xferIncompleteError{Result: cases[2].r}).Error(); !strings.Contains(msg, "1 failure(s)") || !strings.Contains(msg, "2 of 3") {
+		t.Fatalf("partial message: %q", msg)
+	}
+	if msg := (&xferIncompleteError{Result: cases[3].r}).Error(); !strings.Contains(msg, "none of 1") {
+		t.Fatalf("total failure message: %q", msg)
+	}
+
+	defer sendOutcome.Store(0)
+	for _, o := range []xferOutcome{xferPartial, xferAllOK, xferAllFailed, xferPartial} {
+		recordSendOutcome(o)
+	}
+	if got := xferOutcome(sendOutcome.Load()); got != xferAllFailed {
+		t.Fatalf("recorded outcome %d, want the worst (%d)", got, xferAllFailed)
+	}
+}
+
+// 传输摘要与确认顺序相关；两端顺序一致时摘要相同，发送方给出的摘要不符时接收方不把传输视为完成
+func TestXfer_TransferDigest(t *testing.T) {
+	const seed uint64 = 1927
+	fileHash := func(b []byte) string {
+		h := xxh3.NewSeed(seed)
+		_, _ = h.Write(b)
+		sum := h.Sum128().Bytes()
+		return fmt.Sprintf("%x", sum[:])
+	}
+	digestOf := func(names ...string) string {
+		d := newTransferDigest(seed)
+		for _, n := range names {
+			d.add(n, fileHash([]byte(n)))
+		}
+		return d.hex()
+	}
+	if digestOf("a", "b") != digestOf("a", "b") || digestOf("a", "b") == digestOf("b", "a") || digestOf("a", "b") == digestOf("a") {
+		t.Fatal("digest must be deterministic and sensitive to order and missing files")
+	}
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+
+	base := filepath.Join(t.TempDir(), "progress.json")
+	p := newXferPair(t, xferDest{outDir: t.TempDir(), progressFile: base}, seed)
 	ctx, cancel := ctxT(t, 20*time.Second)
 	defer cancel()
-	if err := sendXfer(ctx, S, R.ID(), "file", src, uiS, seed); err != nil {
-		t.Fatalf("sendXfer(file): %v", err)
+
+	// 正常的目录传输：摘要一致，接收方的进度文件在完成后删除
+	srcRoot := t.TempDir()
+	writeTempFile(t, srcRoot, "a", []byte("a"))
+	writeTempFile(t, srcRoot, "b", []byte("b"))
+	if _, err := sendXfer(ctx, p.S, p.R.ID(), "dir", srcRoot, newTestUI(t), seed); err != nil {
+		t.Fatalf("sendXfer: %v", err)
+	}
+	p.waitHandled(t, 5*time.Second)
+	if _, err := os.Stat(progressPath(base, "recv")); !os.IsNotExist(err) {
+		t.Fatalf("matching digest: progress file kept (err=%v)", err)
 	}
 
-	dst := filepath.Join(outDir, "one.bin")
-	got, err := os.ReadFile(dst)
+	// 每个文件都通过校验，但发送方声明的摘要对应另一种顺序
+	xs, err := p.S.NewStream(ctx, p.R.ID(), models.ProtoXfer)
 	if err != nil {
-		t.Fatalf("read dst: %v", err)
+		t.Fatalf("new stream: %v", err)
 	}
-	if !bytes.Equal(got, data) {
-		t.Fatalf("file content mismatch")
+	defer xs.Close()
+	off, _ := json.Marshal(xferOffer{Kind: "dir", Name: "d", Files: 2, Size: 2})
+	_ = writeFrame(xs, frameOffer, off)
+	if typ, _, err := readFrame(xs); err != nil || typ != frameAccept {
+		t.Fatalf("expected accept, got 0x%02x %v", typ, err)
+	}
+	for _, n := range []string{"a", "b"} {
+		hdr, _ := json.Marshal(map[string]any{"name": n, "size": 1, "algo": "xxh3-128-seed", "hash": fileHash([]byte(n))})
+		_ = writeFrame(xs, frameFileHdr, hdr)
+		_ = writeFrame(xs, frameChunk, []byte(n))
+		_ = writeFrame(xs, frameFileDone, nil)
+		if typ, _, err := readFrame(xs); err != nil || typ != frameFileAck {
+			t.Fatalf("%s: expected ACK, got 0x%02x %v", n, typ, err)
+		}
+	}
+	done, _ := json.Marshal(xferDone{Digest: digestOf("b", "a")})
+	_ = writeFrame(xs, frameXferDone, done)
+	p.waitHandled(t, 5*time.Second)
+	if _, err := os.Stat(progressPath(base, "recv")); err != nil {
+		t.Fatalf("mismatching digest: progress file should be kept: %v", err)
 	}
 }
 
-func TestXfer_Dir_RoundTrip(t *testing.T) {
+// 标准输入不是终端时使用的非交互控制台：逐行读取，问题提示单独成行，Close 让阻塞的读取立即返回
+func TestPlainConsole_ScriptedInput(t *testing.T) {
+	var out, errOut bytes.Buffer
+	ui := uipkg.NewPlainConsole(strings.NewReader("y\r\nhello\n/bye"), &out, &errOut, "> ")
+	defer ui.Close()
+
+	ctx, cancel := ctxT(t, 5*time.Second)
+	defer cancel()
+	if !askYesNoWithReadline(ctx, ui, "Accept? [y/N]: ", 5*time.Second, true) {
+		t.Fatal("scripted 'y' should accept")
+	}
+	for _, want := range []string{"hello", "/bye"} {
+		if got, err := ui.Readline(); err != nil || got != want {
+			t.Fatalf("Readline = %q, %v; want %q", got, err, want)
+		}
+	}
+	if _, err := ui.Readline(); !errors.Is(err, io.EOF) {
+		t.Fatalf("want io.EOF at end of input, got %v", err)
+	}
+	ui.Println("← received: a.txt")
+	ui.Errorln("oops")
+	if got := out.String(); got != "Accept? [y/N]: \n← received: a.txt\n" {
+		t.Fatalf("stdout = %q", got)
+	}
+	if errOut.String() != "oops\n" {
+		t.Fatalf("stderr = %q", errOut.String())
+	}
+
+	// 输入一直没有数据时，Close 仍能结束阻塞中的 Readline
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	idle := uipkg.NewPlainConsole(pr, io.Discard, io.Discard, "> ")
+	errc := make(chan error, 1)
+	go func() {
+		_, err := idle.Readline()
+		errc <- err
+	}()
+	idle.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("want io.EOF after Close, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Readline still blocked after Close")
+	}
+}
+
+// -log-level 的取值与纯文本日志格式：低于级别的记录被丢弃，警告带前缀，属性附在消息后
+func TestLogLevel_ParseAndLineHandler(t *testing.T) {
+	for in, want := range map[string]slog.Level{"error": slog.LevelError, "WARN": slog.LevelWarn, "warning": slog.LevelWarn, "info": slog.LevelInfo, " debug ": slog.LevelDebug} {
+		if got, err := parseLogLevel(in); err != nil || got != want {
+			t.Fatalf("parseLogLevel(%q) = %v, %v", in, got, err)
+		}
+	}
+	if _, err := parseLogLevel("trace"); err == nil {
+		t.Fatal("unknown level should be rejected")
+	}
+
+	var buf bytes.Buffer
+	lv := new(slog.LevelVar)
+	l := slog.New(&lineHandler{mu: new(sync.Mutex), w: &buf, level: lv})
+	l.Debug("hidden")
+	l.Info("waiting for peer…")
+	l.With("peer", "12D3").Warn("rendezvous register failed", "err", errors.New("timeout"))
+	lv.Set(slog.LevelDebug)
+	l.Debug("relay ping", "rtt", 25*time.Millisecond)
+	want := "waiting for peer…\nwarn: rendezvous register failed peer=12D3 err=timeout\nrelay ping rtt=25ms\n"
+	if buf.String() != want {
+		t.Fatalf("log output:\n%q\nwant\n%q", buf.String(), want)
+	}
+}
+
+// 注册的短暂失败只触发注册重试 (并刷新中继)，不会放弃当前代码；代码过期或 ctx 取消时才放弃
+func TestRegisterWithRetry_KeepsCodeAcrossFailures(t *testing.T) {
+	oldMin, oldMax := rzvRetryMin, rzvRetryMax
+	rzvRetryMin, rzvRetryMax = 5*time.Millisecond, 20*time.Millisecond
+	defer func() { rzvRetryMin, rzvRetryMax = oldMin, oldMax }()
+	ctx := context.Background()
+	errDown := errors.New("rendezvous down")
+
+	var attempts, refreshes int
+	err := registerWithRetry(ctx, time.Now().Add(5*time.Second), func(context.Context) error {
+		attempts++
+		if attempts <= 3 {
+			return errDown
+		}
+		return nil
+	}, func(context.Context) { refreshes++ })
+	if err != nil || attempts != 4 || refreshes != 3 {
+		t.Fatalf("err=%v attempts=%d refreshes=%d, want success after 3 retries", err, attempts, refreshes)
+	}
+
+	// 一直失败：代码过期时放弃并返回最后的错误
+	start := time.Now()
+	err = registerWithRetry(ctx, start.Add(60*time.Millisecond), func(context.Context) error { return errDown }, nil)
+	if !errors.Is(err, errDown) || time.Since(start) > 2*time.Second {
+		t.Fatalf("want errDown once the code expires, got %v after %s", err, time.Since(start))
+	}
+
+	// 用户中断：立即放弃
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := registerWithRetry(cctx, time.Now().Add(time.Minute), func(context.Context) error { return errDown }, nil); !errors.Is(err, errDown) {
+		t.Fatalf("cancelled: %v", err)
+	}
+}
+
+func TestXfer_SuggestedPath(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"photos/2024/img.jpg", filepath.Join("photos", "2024", "img.jpg"), true},
+		{"a/./b/../c.txt", filepath.Join("a", "c.txt"), true},
+		{"../escape.txt", "", false},
+		{"a/../../escape.txt", "", false},
+		{"/etc/passwd", "", false},
+		{".", "", false},
+		{"", "", false},
+	} {
+		got, err := cleanSuggestedPath(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("cleanSuggestedPath(%q) = %q, %v; want %q ok=%v", tc.in, got, err, tc.want, tc.ok)
+		}
+	}
+	if err := (xferOffer{Kind: "dir", Name: "d", Path: "x/d"}).validate(); err == nil {
+		t.Errorf("validate: suggested path on a dir offer accepted")
+	}
 	if testing.Short() {
 		t.Skip("skip in -short")
 	}
-	const seed uint64 = 0x0123456789abcdef
 
-	S := newLoopbackHost(t)
-	R := newLoopbackHost(t)
-	connect(t, S, R)
+	p := newXferPair(t, xferDest{}, 1931)
+	src := writeTempFile(t, t.TempDir(), "img.jpg", []byte("jpeg"))
+	for _, honor := range []bool{true, false} {
+		outDir := t.TempDir()
+		p.receive(context.Background(), xferDest{outDir: outDir, honorPath: honor}, acceptOffer)
+		ctx, cancel := ctxT(t, 20*time.Second)
+		if _, err := sendXferTo(ctx, p.S, p.R.ID(), "file", src, nil, "photos/2024/img.jpg", newTestUI(t), 1931); err != nil {
+			cancel()
+			t.Fatalf("honor=%v: sendXferTo: %v", honor, err)
+		}
+		cancel()
+		select {
+		case <-p.handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("honor=%v: receiver did not finish", honor)
+		}
+		want := filepath.Join(outDir, "img.jpg")
+		if honor {
+			want = filepath.Join(outDir, "photos", "2024", "img.jpg")
+		}
+		if b, err := os.ReadFile(want); err != nil || string(b) != "jpeg" {
+			t.Fatalf("honor=%v: %s = %q, %v", honor, want, b, err)
+		}
+	}
+}
 
-	outDir := t.TempDir()
-	uiR := newTestUI(t)
-	askYes := func(_ string, _ time.Duration) bool { return true }
+func TestStrictSAS_TypedEntry(t *testing.T) {
+	const sas = "🐼 🍪 ⛰️ 🎲 🍫"
+	if got := crypto.SASDigits(sas); got != "19 58 51 39 59" {
+		t.Fatalf("SASDigits = %q", got)
+	}
+	if crypto.SASDigits("🐼 x") != "" {
+		t.Fatal("SASDigits with an unknown emoji should be empty")
+	}
+	for entry, want := range map[string]bool{
+		"🐼 🍪 ⛰️ 🎲 🍫":       true,
+		"🐼🍪⛰🎲🍫":            true, // 输入法去掉了变体选择符
+		" 19 58 51 39 59 ": true,
+		"19-58-51-39-59":   true,
+		"1958513959":       true,
+		"19 58 51 39":      false,
+		"🐼 🍪 ⛰️ 🎲 🍩":       false,
+		"y":                false,
+		"":                 false,
+	} {
+		if got := sasEntryMatches(entry, sas); got != want {
+			t.Errorf("sasEntryMatches(%q) = %v, want %v", entry, got, want)
+		}
+	}
+
+	ctx, cancel := ctxT(t, 5*time.Second)
+	defer cancel()
+	ui := uipkg.NewPlainConsole(strings.NewReader("19 58 51 39 59\ny\n"), io.Discard, io.Discard, "> ")
+	defer ui.Close()
+	if !askSASWithReadline(ctx, ui, "SAS: ", 5*time.Second, sas) {
+		t.Fatal("typed digits should be accepted")
+	}
+	if askSASWithReadline(ctx, ui, "SAS: ", 5*time.Second, sas) {
+		t.Fatal("a bare 'y' must not pass strict SAS confirmation")
+	}
+
+	// 键入 SAS 的一侧不能在自己的卡片上看到它
+	old := strictSAS
+	defer func() { strictSAS = old }()
+	for _, strict := range []bool{false, true} {
+		strictSAS = strict
+		var out bytes.Buffer
+		card := uipkg.NewPlainConsole(strings.NewReader(""), &out, io.Discard, "> ")
+		uipkg.PrintPeerVerifyCard(card, "peer", cardSAS(sas))
+		card.Close()
+		shown := strings.Contains(out.String(), sas) || strings.Contains(out.String(), "19 58 51 39 59")
+		if shown == strict {
+			t.Fatalf("strict=%v: card shows local SAS = %v:\n%s", strict, shown, out.String())
+		}
+	}
+}
 
-	R.SetStreamHandler(models.ProtoXfer, func(xs network.Stream) {
-		handleIncomingXfer(context.Background(), R, xs, outDir, askYes, uiR, seed)
+// TestTryOpenChat_StaticDiscovery 用固定节点列表代替汇合点，验证 tryOpenChat 只依赖 p2p.Discovery。
+func TestTryOpenChat_StaticDiscovery(t *testing.T) {
+	disc := p2p.StaticDiscovery{Peers: []peer.AddrInfo{{ID: "a"}, {ID: "b"}, {ID: "c"}}}
+	if got, _ := disc.Discover(context.Background(), "/wormhole/x", 2); len(got) != 2 {
+		t.Fatalf("limit ignored: %d peers", len(got))
+	}
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+
+	A := newLoopbackHost(t)
+	B := newLoopbackHost(t)
+	accepted := make(chan struct{}, 1)
+	A.SetStreamHandler(models.ProtoChat, func(s network.Stream) {
+		defer s.Close()
+		if line, err := bufio.NewReader(s).ReadString('\n'); err == nil && line == "hello\n" {
+			accepted <- struct{}{}
+		}
 	})
+	ctx, cancel := ctxT(t, 20*time.Second)
+	defer cancel()
+	disc = p2p.StaticDiscovery{Peers: []peer.AddrInfo{{ID: A.ID(), Addrs: A.Addrs()}}}
+	s, err := tryOpenChat(ctx, B, disc, "/wormhole/static", nil, 10*time.Second, false)
+	if err != nil {
+		t.Fatalf("tryOpenChat: %v", err)
+	}
+	defer s.Close()
+	if s.Conn().RemotePeer() != A.ID() {
+		t.Fatalf("connected to %s, want %s", s.Conn().RemotePeer(), A.ID())
+	}
+	// 协议协商是惰性的，只有写入数据后对端的处理函数才会被调用
+	if _, err := io.WriteString(s, "hello\n"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("host never saw the chat stream")
+	}
+}
 
-	// 构造目录（含空文件与子目录）
-	srcRoot := t.TempDir()
-	_ = os.MkdirAll(filepath.Join(srcRoot, "sub/a"), 0o755)
-	writeTempFile(t, srcRoot, "sub/a/aa.txt", []byte("hello A"))
-	writeTempFile(t, srcRoot, "sub/bb.txt", []byte("hello B"))
-	writeTempFile(t, srcRoot, "empty.bin", nil)
+// fakeLeg 模拟一路连接：after 之后返回 err，ctx 取消时提前返回
+func fakeLeg(name string, after time.Duration, err error, started *atomic.Int32) dialLeg {
+	return dialLeg{name, func(ctx context.Context) error {
+		if started != nil {
+			started.Add(1)
+		}
+		select {
+		case <-time.After(after):
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+}
+
+func TestRaceConnect_HappyEyeballs(t *testing.T) {
+	ctx := context.Background()
+	blackhole := errors.New("i/o timeout")
+
+	// 优先的一路在领先时间内成功：另一路不会启动
+	var started atomic.Int32
+	won, errs := raceConnect(ctx, 100*time.Millisecond,
+		fakeLeg("direct", 5*time.Millisecond, nil, &started), fakeLeg("relay", 0, nil, &started))
+	if won != 0 || started.Load() != 1 || errs[1] != nil {
+		t.Fatalf("won=%d started=%d errs=%v", won, started.Load(), errs)
+	}
+
+	// 直连被黑洞：中继在领先时间后启动并获胜，不必等直连超时
+	begin := time.Now()
+	won, errs = raceConnect(ctx, 20*time.Millisecond,
+		fakeLeg("direct", 5*time.Second, blackhole, nil), fakeLeg("relay", 10*time.Millisecond, nil, nil))
+	if won != 1 || errs[0] != nil {
+		t.Fatalf("won=%d errs=%v", won, errs)
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Fatalf("race took %v, slower leg was not raced", d)
+	}
+
+	// 优先的一路提前失败：另一路立即启动，不等满领先时间
+	begin = time.Now()
+	won, errs = raceConnect(ctx, 5*time.Second,
+		fakeLeg("relay", 0, errors.New("no relays"), nil), fakeLeg("direct", 10*time.Millisecond, nil, nil))
+	if won != 1 || errs[0] == nil || time.Since(begin) > time.Second {
+		t.Fatalf("won=%d errs=%v after %v", won, errs, time.Since(begin))
+	}
+
+	// 全部失败：返回 -1 与各自的错误
+	won, errs = raceConnect(ctx, time.Millisecond,
+		fakeLeg("direct", 0, blackhole, nil), fakeLeg("relay", 0, errors.New("no reservation"), nil))
+	if won != -1 || errs[0] != blackhole || errs[1] == nil {
+		t.Fatalf("won=%d errs=%v", won, errs)
+	}
+}
+
+// BenchmarkConnect_SequentialVsRace 测量 tryOpenChat 的实际建连耗时。服务器下发了中继，因此中继一路优先，
+// 但中继地址被黑洞 (接受 TCP 却从不应答，握手一直等到中继拨号超时)，对端只能经回环直连。
+// sequential 把领先时间设为中继拨号超时，即中继失败后才开始直连 (并行拨号之前的行为)；
+// race 使用默认的 raceHeadStart。
+func BenchmarkConnect_SequentialVsRace(b *testing.B) {
+	ctx := context.Background()
+	A := newLoopbackHost(b)
+	A.SetStreamHandler(models.ProtoChat, func(s network.Stream) { _ = s.Reset() })
+	B := newLoopbackHost(b)
+	disc := p2p.StaticDiscovery{Peers: []peer.AddrInfo{{ID: A.ID(), Addrs: A.Addrs()}}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		var held []net.Conn
+		defer func() {
+			for _, c := range held {
+				_ = c.Close()
+			}
+		}()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			held = append(held, c)
+		}
+	}()
+	hole := ma.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", ln.Addr().(*net.TCPAddr).Port))
+	relays := []peer.AddrInfo{{ID: newLoopbackHost(b).ID(), Addrs: []ma.Multiaddr{hole}}}
+
+	oldTimeout, oldHead := dialTimeout, raceHeadStart
+	defer func() { dialTimeout, raceHeadStart = oldTimeout, oldHead }()
+	dialTimeout = 600 * time.Millisecond // 中继拨号超时为其 5/3，即 1s
+	for _, c := range []struct {
+		name string
+		head time.Duration
+	}{
+		{"sequential", effectiveRelayDialTimeout()},
+		{"race", oldHead},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			raceHeadStart = c.head
+			for i := 0; i < b.N; i++ {
+				s, err := tryOpenChat(ctx, B, disc, "/wormhole/bench", relays, 10*time.Second, false)
+				if err != nil {
+					b.Fatalf("tryOpenChat: %v", err)
+				}
+				if s.Conn().Stat().Limited {
+					b.Fatal("connected via the blackholed relay")
+				}
+				// 每轮都从头建连：断开并清除拨号退避，否则黑洞地址会被直接跳过
+				b.StopTimer()
+				_ = s.Reset()
+				_ = B.Network().ClosePeer(A.ID())
+				for _, id := range []peer.ID{A.ID(), relays[0].ID} {
+					B.Network().(*swarm.Swarm).Backoff().Clear(id)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestXfer_SendURL(t *testing.T) {
+	data := bytes.Repeat([]byte("wormhole"), 300<<10) // 2.4 MiB，多于一个数据块
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files/report.bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		_, _ = w.Write(data)
+	})
+	mux.HandleFunc("/stream/live.bin", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < len(data); i += 64 << 10 {
+			_, _ = w.Write(data[i:min(i+64<<10, len(data))])
+			w.(http.Flusher).Flush() // 不带 Content-Length
+		}
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/files/report.bin", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
 
-	uiS := newTestUI(t)
 	ctx, cancel := ctxT(t, 30*time.Second)
 	defer cancel()
-	if err := sendXfer(ctx, S, R.ID(), "dir", srcRoot, uiS, seed); err != nil {
-		t.Fatalf("sendXfer(dir): %v", err)
+	if _, _, err := fetchURL(ctx, srv.URL+"/missing"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("want a 404 error, got %v", err)
+	}
+	if _, _, err := fetchURL(ctx, "ftp://example.com/x"); err == nil {
+		t.Fatal("non-http URL accepted")
+	}
+	resp, name, err := fetchURL(ctx, srv.URL+"/moved")
+	if err != nil || name != "moved" {
+		t.Fatalf("redirect: name=%q err=%v", name, err)
+	}
+	_ = resp.Body.Close()
+	if testing.Short() {
+		t.Skip("skip in -short")
 	}
 
-	// 校验目标存在并内容一致
-	// 注意：目录传输会在 outDir 下创建一个与源目录同名的子目录
-	dirName := filepath.Base(srcRoot)
-	checkSame := func(rel string) {
-		src := filepath.Join(srcRoot, rel)
-		dst := filepath.Join(outDir, dirName, rel)
-		s, _ := os.ReadFile(src)
-		d, err := os.ReadFile(dst)
-		if err != nil {
-			t.Fatalf("missing %s: %v", rel, err)
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, 1937)
+	for _, u := range []string{"/files/report.bin", "/stream/live.bin"} {
+		res, err := sendXferTo(ctx, p.S, p.R.ID(), "url", srv.URL+u, nil, "", newTestUI(t), 1937)
+		if err != nil || res.Sent != 1 {
+			t.Fatalf("%s: res=%+v err=%v", u, res, err)
 		}
-		if !bytes.Equal(s, d) {
-			t.Fatalf("dir file mismatch: %s", rel)
+		select {
+		case <-p.handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: receiver did not finish", u)
+		}
+		if got, err := os.ReadFile(filepath.Join(outDir, path.Base(u))); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: received %d bytes, %v", u, len(got), err)
 		}
 	}
-	checkSame("sub/a/aa.txt")
-	checkSame("sub/bb.txt")
-	checkSame("empty.bin")
+	if _, err := sendXferTo(ctx, p.S, p.R.ID(), "url", srv.URL+"/missing", nil, "", newTestUI(t), 1937); err == nil {
+		t.Fatal("sending a 404 URL should fail")
+	}
 }
 
-func TestXfer_OfferRejected(t *testing.T) {
+// 传输进行中会话结束：发送方取消 (再次 /bye) 与接收方取消 (对端 BYE) 都应中止传输，
+// 只留下 .part 文件而不产生截断的最终文件
+// scriptedOutput 收集会话控制台的输出；answer 非空时，每出现一次接收提示就经 in 回答一行 answer
+type scriptedOutput struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	in     io.Writer
+	answer string
+}
+
+func (w *scriptedOutput) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.answer != "" && bytes.Contains(p, []byte("Accept? [y/N]")) {
+		go func() { _, _ = io.WriteString(w.in, w.answer+"\n") }()
+	}
+	return w.buf.Write(p)
+}
+
+func (w *scriptedOutput) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// TestSession_SendThenBye 经 runAccepted 的输入循环在 /send 之后立即 /bye：
+// 关闭要等发送完成，而不是把刚开始的发送当作空闲直接取消。
+func TestSession_SendThenBye(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skip in -short")
 	}
-	const seed uint64 = 123
-
 	S := newLoopbackHost(t)
 	R := newLoopbackHost(t)
 	connect(t, S, R)
+	ctx, cancel := ctxT(t, 30*time.Second)
+	defer cancel()
 
-	outDir := t.TempDir()
-	uiR := newTestUI(t)
-	askNo := func(_ string, _ time.Duration) bool { return false } // 拒绝
+	inS, inSW := io.Pipe()
+	inR, inRW := io.Pipe()
+	defer inSW.Close()
+	defer inRW.Close()
+	outS := &scriptedOutput{}
+	outR := &scriptedOutput{in: inRW, answer: "y"}
+	// 第一个控制台给拨号方；接收方的处理函数等它取走之后才进入 runAccepted
+	consoles := make(chan *uiConsole, 2)
+	consoles <- uipkg.NewPlainConsole(inS, outS, io.Discard, "> ")
+	consoles <- uipkg.NewPlainConsole(inR, outR, io.Discard, "> ")
+	senderUI := make(chan struct{})
+	old := newChatConsole
+	newChatConsole = func() (*uiConsole, error) {
+		c := <-consoles
+		if len(consoles) == 1 {
+			close(senderUI)
+		}
+		return c, nil
+	}
+	defer func() { newChatConsole = old }()
 
-	R.SetStreamHandler(models.ProtoXfer, func(xs network.Stream) {
-		handleIncomingXfer(context.Background(), R, xs, outDir, askNo, uiR, seed)
+	const nameplate, pass = "1949", "1949-send-bye"
+	outDir := t.TempDir()
+	recvDone := make(chan struct{})
+	R.SetStreamHandler(models.ProtoChat, func(s network.Stream) {
+		<-senderUI
+		runAccepted(ctx, R, s, "", outDir, verifyNone, nameplate, pass, localState{})
+		close(recvDone)
 	})
+	s, err := S.NewStream(ctx, R.ID(), models.ProtoChat)
+	if err != nil {
+		t.Fatalf("open chat: %v", err)
+	}
+	data := bytes.Repeat([]byte("send-then-bye "), 300<<10) // 约 4 MiB，/bye 到达时发送仍在进行
+	src := writeTempFile(t, t.TempDir(), "big.bin", data)
+	sendDone := make(chan struct{})
+	go func() {
+		runAccepted(ctx, S, s, "", t.TempDir(), verifyNone, nameplate, pass, localState{})
+		close(sendDone)
+	}()
+	go func() { _, _ = io.WriteString(inSW, "/send -f "+src+"\n/bye\n") }()
 
-	srcDir := t.TempDir()
-	src := writeTempFile(t, srcDir, "nope.txt", []byte("xxx"))
-	uiS := newTestUI(t)
+	for _, ch := range []chan struct{}{sendDone, recvDone} {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			t.Fatalf("session did not end\nsender:\n%s\nreceiver:\n%s", outS, outR)
+		}
+	}
+	if !strings.Contains(outS.String(), "waiting for 1 transfer(s) to finish") || !strings.Contains(outS.String(), "you closed the chat") {
+		t.Fatalf("sender did not wait for the send before closing:\n%s", outS)
+	}
+	if !strings.Contains(outR.String(), "peer closed the chat") {
+		t.Fatalf("receiver end reason:\n%s", outR)
+	}
+	got, err := os.ReadFile(filepath.Join(outDir, "big.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("file not delivered intact before closing (%d bytes, %v)\nreceiver:\n%s", len(got), err, outR)
+	}
+}
 
-	ctx, cancel := ctxT(t, 10*time.Second)
-	defer cancel()
-	err := sendXfer(ctx, S, R.ID(), "file", src, uiS, seed)
-	if err == nil || !strings.Contains(err.Error(), "rejected") {
-		t.Fatalf("expected rejection error, got %v", err)
+func TestXfer_AbortOnBye(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip in -short")
+	}
+	// 响应体先发出一部分，然后挂起直到请求被取消或测试放行
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 256<<10))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	outDir := t.TempDir()
+	p := newXferPair(t, xferDest{outDir: outDir}, 1949)
+
+	for _, c := range []struct {
+		name       string
+		cancelSend bool // true：发送方取消；false：接收方取消
+		cause      string
+	}{
+		{"a.bin", true, "you closed the chat"},
+		{"b.bin", false, "peer closed the chat"},
+	} {
+		recvCtx, cancelRecv := context.WithCancelCause(context.Background())
+		sendCtx, cancelSend := context.WithCancelCause(context.Background())
+		p.receive(recvCtx, xferDest{outDir: outDir}, acceptOffer)
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := sendXferTo(sendCtx, p.S, p.R.ID(), "url", srv.URL+"/"+c.name, nil, "", newTestUI(t), 1949)
+			errCh <- err
+		}()
+
+		part := filepath.Join(outDir, c.name+partSuffix)
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, err := os.Stat(part); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: receive did not start", c.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if c.cancelSend {
+			cancelSend(errors.New(c.cause))
+		} else {
+			cancelRecv(errors.New(c.cause))
+		}
+		select {
+		case <-p.handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: receiver did not abort", c.name)
+		}
+		if !c.cancelSend {
+			release <- struct{}{} // 让挂起的响应体结束，发送方随后发现流已被重置
+		}
+		select {
+		case err := <-errCh:
+			if err == nil {
+				t.Fatalf("%s: send succeeded after abort", c.name)
+			}
+			if c.cancelSend && !strings.Contains(err.Error(), "transfer aborted: "+c.cause) {
+				t.Fatalf("%s: err = %v", c.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: sender did not return", c.name)
+		}
+		if _, err := os.Stat(filepath.Join(outDir, c.name)); !os.IsNotExist(err) {
+			t.Fatalf("%s: truncated final file exists (%v)", c.name, err)
+		}
+		if _, err := os.Stat(part); err != nil {
+			t.Fatalf("%s: .part not kept: %v", c.name, err)
+		}
+		cancelRecv(nil)
+		cancelSend(nil)
 	}
 }
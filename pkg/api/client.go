@@ -23,6 +23,15 @@ func NewClient(baseURL string) *Client {
 	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
 }
 
+// Info 获取控制服务器的静态配置 (密码牌格式、有效期等)
+func (c *Client) Info(ctx context.Context) (*models.InfoResponse, error) {
+	var resp models.InfoResponse
+	if err := c.doJSON(ctx, http.MethodGet, "/v1/info", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Allocate 向控制服务器申请一个新的密码牌
 func (c *Client) Allocate(ctx context.Context) (*models.AllocateResponse, error) {
 	var resp models.AllocateResponse
@@ -59,8 +68,19 @@ func (c *Client) Fail(ctx context.Context, nameplate string) error {
 	return c.postJSON(ctx, "/v1/fail", req, &resp)
 }
 
+// Report 向控制面报告一次文件传输的结果
+func (c *Client) Report(ctx context.Context, r models.TransferReport) error {
+	var resp map[string]string
+	return c.postJSON(ctx, "/v1/report", r, &resp)
+}
+
 // postJSON 发送一个带指数退避重试的 HTTP POST 请求
 func (c *Client) postJSON(ctx context.Context, path string, body any, out any) error {
+	return c.doJSON(ctx, http.MethodPost, path, body, out)
+}
+
+// doJSON 以给定方法发送请求并解码 JSON 响应，失败时按指数退避重试
+func (c *Client) doJSON(ctx context.Context, method, path string, body any, out any) error {
 	u := c.BaseURL + path
 	const maxAttempts = 5
 	backoff := 2 * time.Second
@@ -71,7 +91,7 @@ func (c *Client) postJSON(ctx context.Context, path string, body any, out any) e
 			b, _ := json.Marshal(body)
 			buf = bytes.NewReader(b)
 		}
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, buf)
+		req, err := http.NewRequestWithContext(ctx, method, u, buf)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Load 读取一个扁平的配置文件，返回键到值的映射。键与命令行标志同名 (不带 "-")。
+//
+// 支持 TOML 与 YAML 的常用子集，按扩展名区分 (.yaml/.yml 为 YAML，其余按 TOML)：
+//
+//	# TOML                              # YAML
+//	listen = "/ip4/0.0.0.0/tcp/4001"    listen: /ip4/0.0.0.0/tcp/4001
+//	nameplate-digits = 4                nameplate-digits: 4
+//	public-addrs = ["a", "b"]           public-addrs: [a, b]
+//
+// 数组会以 "," 连接，对应逗号分隔的标志；不支持表、多行字符串和嵌套结构。
+func Load(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sep := "="
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		sep = ":"
+	}
+	vals := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, sep)
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%s:%d: want key %s value", path, n, sep)
+		}
+		if _, dup := vals[k]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate key %q", path, n, k)
+		}
+		v, err := parseValue(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, n, k, err)
+		}
+		vals[k] = v
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// stripComment 去掉行尾的 "#" 注释 (引号内的 "#" 保留)。
+func stripComment(s string) string {
+	var quote rune
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// parseValue 解析标量或单行数组，数组元素以 "," 连接。
+func parseValue(v string) (string, error) {
+	if strings.HasPrefix(v, "[") {
+		if !strings.HasSuffix(v, "]") {
+			return "", fmt.Errorf("unterminated array")
+		}
+		inner := strings.TrimSpace(v[1 : len(v)-1])
+		if inner == "" {
+			return "", nil
+		}
+		var items []string
+		for _, it := range strings.Split(inner, ",") {
+			s, err := parseScalar(strings.TrimSpace(it))
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return parseScalar(v)
+}
+
+func parseScalar(v string) (string, error) {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') {
+		if v[len(v)-1] != v[0] {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if v[0] == '\'' { // 单引号字符串不处理转义
+			return v[1 : len(v)-1], nil
+		}
+		return strconv.Unquote(v)
+	}
+	return v, nil
+}
+
+// ApplyFlags 将配置值写入 fs 中同名的标志，命令行上显式给出的标志优先，不会被覆盖。
+// 未知的键或无法解析的值会返回错误；skip 中的键 (如 "config" 本身) 不允许出现在配置文件中。
+func ApplyFlags(fs *flag.FlagSet, vals map[string]string, skip ...string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, s := range skip {
+			if k == s {
+				return fmt.Errorf("key %q is not allowed in a config file", k)
+			}
+		}
+		if fs.Lookup(k) == nil {
+			return fmt.Errorf("unknown key %q", k)
+		}
+		if set[k] {
+			continue
+		}
+		if err := fs.Set(k, vals[k]); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", k, vals[k], err)
+		}
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package crypto
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -14,17 +16,71 @@ import (
 	_ "salsa.debian.org/vasudev/gospake2/ed25519group"
 )
 
+// Labels 汇总一个协议版本在密钥派生中使用的全部标签。
+// 任何标签或 SAS 格式的变化都必须引入新的版本 (新的协议 ID)，而不是修改已有的取值：
+// 不同版本的标签会进入会话摘要和确认 MAC，使跨版本的两端在密钥确认阶段干净地失败，
+// 而不是各自派生出不一致的 SAS 或传输种子。
+type Labels struct {
+	Version  string // 协议 ID 中的版本段，例如 "1.0.0"
+	Prefix   string // 会话摘要前缀
+	Confirm  string // 密钥确认 MAC 的 HKDF 标签
+	SAS      string // SAS 的 HKDF 标签
+	SASCheck string // SAS 交叉校验的 HKDF 标签
+	XferSeed string // 文件传输 xxh3 种子的 HKDF 标签
+}
+
+// LabelsV1 是 /wormhole/1.0.0/* 协议使用的标签
+var LabelsV1 = Labels{
+	Version:  "1.0.0",
+	Prefix:   "wormhole-pake-v1",
+	Confirm:  "confirm",
+	SAS:      "sas",
+	SASCheck: "sas-check",
+	XferSeed: "xfer-xxh3-seed",
+}
+
+// labelsByVersion 按协议版本索引已知的标签集合
+var labelsByVersion = map[string]Labels{
+	LabelsV1.Version: LabelsV1,
+}
+
+// ErrUnsupportedVersion 表示协议 ID 中的版本没有对应的标签集合
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// ProtoVersion 返回协议 ID 中的版本段，例如 "/wormhole/1.0.0/chat" 返回 "1.0.0"
+func ProtoVersion(proto protocol.ID) string {
+	parts := strings.Split(string(proto), "/")
+	if len(parts) < 4 || parts[0] != "" || parts[1] != "wormhole" {
+		return ""
+	}
+	return parts[2]
+}
+
+// LabelsFor 返回协商出的协议 ID 对应的标签集合
+func LabelsFor(proto protocol.ID) (Labels, error) {
+	l, ok := labelsByVersion[ProtoVersion(proto)]
+	if !ok {
+		return Labels{}, fmt.Errorf("%w: %q", ErrUnsupportedVersion, proto)
+	}
+	return l, nil
+}
+
 // BuildTranscript 构建一个唯一的会话摘要，用于密钥派生和确认
 // 它将双方的 PeerID 按字典序排序，以确保双方生成相同的摘要
-func BuildTranscript(nameplate string, proto protocol.ID, a, b peer.ID) []byte {
+func (l Labels) BuildTranscript(nameplate string, proto protocol.ID, a, b peer.ID) []byte {
 	ids := []string{a.String(), b.String()}
 	if ids[0] > ids[1] {
 		ids[0], ids[1] = ids[1], ids[0]
 	}
-	s := strings.Join([]string{"wormhole-pake-v1", nameplate, string(proto), ids[0], ids[1]}, "|")
+	s := strings.Join([]string{l.Prefix, nameplate, string(proto), ids[0], ids[1]}, "|")
 	return []byte(s)
 }
 
+// BuildTranscript 使用 LabelsV1 构建会话摘要
+func BuildTranscript(nameplate string, proto protocol.ID, a, b peer.ID) []byte {
+	return LabelsV1.BuildTranscript(nameplate, proto, a, b)
+}
+
 // HkdfBytes 使用 HKDF 从输入密钥材料(ikm)派生出指定长度的密钥
 func HkdfBytes(ikm []byte, label string, transcript []byte, n int) []byte {
 	info := append([]byte(label+"|"), transcript...)
@@ -49,9 +105,9 @@ func EmojiList() []string {
 }
 
 // SASFromKey 从共享密钥生成一个短认证字符串(SAS)，由5个 emoji 组成，用于人工验证
-func SASFromKey(K []byte, transcript []byte) string {
+func (l Labels) SASFromKey(K []byte, transcript []byte) string {
 	em := EmojiList()
-	b := HkdfBytes(K, "sas", transcript, 4) // 派生32位数据
+	b := HkdfBytes(K, l.SAS, transcript, 4) // 派生32位数据
 	acc := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
 	parts := make([]string, 0, 5)
 	for i := 0; i < 5; i++ {
@@ -61,17 +117,80 @@ func SASFromKey(K []byte, transcript []byte) string {
 	return strings.Join(parts, " ")
 }
 
+// SASDigits 把 emoji 形式的 SAS 换成每个 emoji 在 EmojiList 中的两位序号 (如 "19 58 51 39 59")，
+// 便于在不方便输入 emoji 的设备上念出或键入；含未知 emoji 时返回空串
+func SASDigits(sas string) string {
+	em := EmojiList()
+	fields := strings.Fields(sas)
+	out := make([]string, 0, len(fields))
+	for _, f := range fields {
+		idx := -1
+		for i, e := range em {
+			if e == f {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return ""
+		}
+		out = append(out, fmt.Sprintf("%02d", idx))
+	}
+	return strings.Join(out, " ")
+}
+
+// SASCheckTag 计算 SAS 交叉校验标签，side 为计算方的角色 ("A" 或 "B")
+// 双方通过已确认的信道交换该标签，即可自动发现两端显示的 SAS 不一致 (通常意味着摘要构造错误)
+func (l Labels) SASCheckTag(K []byte, transcript []byte, sas, side string) []byte {
+	Kc := HkdfBytes(K, l.SASCheck, transcript, 32)
+	mac := hmac.New(sha256.New, Kc)
+	mac.Write([]byte(side + "|"))
+	mac.Write([]byte(sas))
+	return mac.Sum(nil)
+}
+
+// VerifySASCheckTag 使用本端的 SAS 验证对方发来的交叉校验标签
+func (l Labels) VerifySASCheckTag(K []byte, transcript []byte, sas, side string, tag []byte) bool {
+	return hmac.Equal(l.SASCheckTag(K, transcript, sas, side), tag)
+}
+
+// XferSeedFromKey 从共享密钥派生文件传输使用的 xxh3 哈希种子，transcript 应基于传输协议构建
+func (l Labels) XferSeedFromKey(K []byte, transcript []byte) uint64 {
+	return binary.LittleEndian.Uint64(HkdfBytes(K, l.XferSeed, transcript, 8))
+}
+
+// SASFromKey 使用 LabelsV1 生成 SAS
+func SASFromKey(K []byte, transcript []byte) string {
+	return LabelsV1.SASFromKey(K, transcript)
+}
+
+// SASCheckTag 使用 LabelsV1 计算 SAS 交叉校验标签
+func SASCheckTag(K []byte, transcript []byte, sas, side string) []byte {
+	return LabelsV1.SASCheckTag(K, transcript, sas, side)
+}
+
+// VerifySASCheckTag 使用 LabelsV1 验证 SAS 交叉校验标签
+func VerifySASCheckTag(K []byte, transcript []byte, sas, side string, tag []byte) bool {
+	return LabelsV1.VerifySASCheckTag(K, transcript, sas, side, tag)
+}
+
 // PAKEState 封装了 SPAKE2 状态和配置信息
 type PAKEState struct {
 	state      spake2.SPAKE2
+	labels     Labels
 	transcript []byte
 	roleA      bool
 }
 
-// NewPAKEState 创建一个新的 PAKE 状态
+// NewPAKEState 使用 LabelsV1 创建一个新的 PAKE 状态
 // roleA=true 表示是发起方(Dialer)
 func NewPAKEState(roleA bool, passphrase, nameplate string, proto protocol.ID, local, remote peer.ID) *PAKEState {
-	transcript := BuildTranscript(nameplate, proto, local, remote)
+	return NewPAKEStateWithLabels(LabelsV1, roleA, passphrase, nameplate, proto, local, remote)
+}
+
+// NewPAKEStateWithLabels 使用指定版本的标签创建 PAKE 状态，标签通常来自 LabelsFor
+func NewPAKEStateWithLabels(l Labels, roleA bool, passphrase, nameplate string, proto protocol.ID, local, remote peer.ID) *PAKEState {
+	transcript := l.BuildTranscript(nameplate, proto, local, remote)
 	pw := spake2.NewPassword(passphrase)
 	var state spake2.SPAKE2
 	if roleA {
@@ -81,6 +200,7 @@ func NewPAKEState(roleA bool, passphrase, nameplate string, proto protocol.ID, l
 	}
 	return &PAKEState{
 		state:      state,
+		labels:     l,
 		transcript: transcript,
 		roleA:      roleA,
 	}
@@ -102,7 +222,7 @@ func (p *PAKEState) Finish(peerMsg []byte) ([]byte, error) {
 
 // ComputeConfirmTag 计算密钥确认 MAC 标签
 func (p *PAKEState) ComputeConfirmTag(K []byte, side string) []byte {
-	Kc := HkdfBytes(K, "confirm", p.transcript, 32)
+	Kc := HkdfBytes(K, p.labels.Confirm, p.transcript, 32)
 	mac := hmac.New(sha256.New, Kc)
 	mac.Write([]byte(side + "|"))
 	mac.Write(p.transcript)
@@ -120,6 +240,11 @@ func (p *PAKEState) GetTranscript() []byte {
 	return p.transcript
 }
 
+// Labels 返回该状态使用的标签集合
+func (p *PAKEState) Labels() Labels {
+	return p.labels
+}
+
 // IsRoleA 返回是否为发起方角色
 func (p *PAKEState) IsRoleA() bool {
 	return p.roleA
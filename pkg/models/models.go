@@ -14,15 +14,42 @@ type ConnectionInfo struct {
 	Relay      AddrBundle `json:"relay"`               // Relay (中继) 服务器信息
 	Bootstrap  []string   `json:"bootstrap,omitempty"` // 引导节点地址列表 (可选)
 	Topic      string     `json:"topic"`               // 用于双方通信的 PubSub 主题
+	Message    string     `json:"message,omitempty"`   // 服务器公告 (使用条款、维护通知等，可选)
+}
+
+// MaxMessageLen 是服务器公告的最大长度 (字节)，服务端启动时校验，客户端显示时截断
+const MaxMessageLen = 512
+
+// 密码牌字符集，由服务端 -nameplate-charset 选择，并通过 /v1/info 告知客户端
+const (
+	NameplateCharsetDigits = "digits" // 纯数字 (默认)
+	NameplateCharsetAlnum  = "alnum"  // 小写字母与数字，去掉了易混淆的 0/o、1/l/i
+)
+
+// NameplateAlphabets 是各字符集生成密码牌时使用的字母表
+var NameplateAlphabets = map[string]string{
+	NameplateCharsetDigits: "0123456789",
+	NameplateCharsetAlnum:  "23456789abcdefghjkmnpqrstuvwxyz",
 }
 
 // AllocateResponse 是 /v1/allocate 接口的成功响应体
 type AllocateResponse struct {
-	Nameplate string    `json:"nameplate"`  // 新分配的密码牌
-	ExpiresAt time.Time `json:"expires_at"` // 密码牌的过期时间
+	Nameplate   string    `json:"nameplate"`              // 新分配的密码牌
+	ExpiresAt   time.Time `json:"expires_at"`             // 密码牌的过期时间
+	ReportToken string    `json:"report_token,omitempty"` // 报告传输结果时使用的令牌，见 TransferReport.Token
 	ConnectionInfo
 }
 
+// InfoResponse 是 /v1/info 接口的响应体，只包含服务器的静态配置，供客户端在分配前了解服务能力
+type InfoResponse struct {
+	NameplateDigits  int        `json:"nameplate_digits"`            // 密码牌的长度 (字符数)
+	NameplateCharset string     `json:"nameplate_charset,omitempty"` // 密码牌字符集，为空表示旧服务器，即 digits
+	NameplateTTL     int64      `json:"nameplate_ttl"`               // 密码牌有效期，单位秒
+	Rendezvous       AddrBundle `json:"rendezvous"`                  // Rendezvous 服务器信息
+	Relay            AddrBundle `json:"relay"`                       // Relay (中继) 服务器信息
+	Bootstrap        []string   `json:"bootstrap,omitempty"`         // 引导节点地址列表 (可选)
+}
+
 // ClaimRequest 是 /v1/claim 接口的请求体
 type ClaimRequest struct {
 	Nameplate string `json:"nameplate"` // 要认领的密码牌
@@ -31,11 +58,16 @@ type ClaimRequest struct {
 
 // ClaimResponse 是 /v1/claim 接口的响应体
 type ClaimResponse struct {
-	Status    string    `json:"status"`     // 认领后的状态 (waiting/paired/failed)
-	ExpiresAt time.Time `json:"expires_at"` // 密码牌的过期时间
+	Status      string    `json:"status"`                 // 认领后的状态 (waiting/paired/failed)
+	Reason      string    `json:"reason,omitempty"`       // 认领失败的原因，目前只有 ClaimReasonSideTaken，其余失败不给出原因
+	ExpiresAt   time.Time `json:"expires_at"`             // 密码牌的过期时间
+	ReportToken string    `json:"report_token,omitempty"` // 认领成功时下发的报告令牌，见 TransferReport.Token
 	ConnectionInfo
 }
 
+// ClaimReasonSideTaken 表示请求认领的一侧已被其他客户端认领，常见于双方都以 connect 模式运行
+const ClaimReasonSideTaken = "side_taken"
+
 // ConsumeRequest 是 /v1/consume 接口的请求体
 type ConsumeRequest struct {
 	Nameplate string `json:"nameplate"`
@@ -46,6 +78,27 @@ type FailRequest struct {
 	Nameplate string `json:"nameplate"`
 }
 
+// TransferReport 是 /v1/report 接口的请求体：客户端在一次文件传输结束后报告结果，
+// 只含聚合数字与路径类型，不含文件名或 PeerID。Token 是分配或认领时下发的报告令牌，
+// 服务器只统计每个令牌的第一份报告，即每次会话的每一侧一次
+type TransferReport struct {
+	Direction   string `json:"direction"`    // 本端的方向，ReportSend 或 ReportRecv
+	Path        string `json:"path"`         // 连接路径，ReportPathDirect 或 ReportPathRelay
+	Files       int    `json:"files"`        // 确认送达 (或校验通过并保存) 的文件数
+	FailedFiles int    `json:"failed_files"` // 未送达或未保存的文件数
+	Bytes       int64  `json:"bytes"`        // 确认送达的文件的总字节数
+	OK          bool   `json:"ok"`           // 传输是否完整结束且没有失败的文件
+	Token       string `json:"token"`        // 报告令牌，见 AllocateResponse.ReportToken
+}
+
+// TransferReport 的方向与路径取值
+const (
+	ReportSend       = "send"
+	ReportRecv       = "recv"
+	ReportPathDirect = "direct"
+	ReportPathRelay  = "relay"
+)
+
 // PlateStatus 定义了密码牌（nameplate）的几种状态
 type PlateStatus string
 
@@ -64,6 +117,9 @@ const (
 	ProtoXfer = "/wormhole/1.0.0/xfer"
 )
 
+// XferWireVersion 是 XFER 帧格式的版本号，帧布局或帧类型发生不兼容变化时递增
+const XferWireVersion = 1
+
 // 聊天协议控制令牌
 const (
 	ChatHello  = "##HELLO"
@@ -0,0 +1,37 @@
+package p2p
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Discovery 抽象节点发现后端：双方在同一主题 (由配对代码派生) 下公布自己并查找对方。
+// 默认实现基于 libp2p 汇合点协议；在汇合点协议被封锁的网络中，可以换成 DHT、mDNS、
+// 静态节点列表或自定义的 HTTP 信令服务器，只要实现这三个方法即可。
+type Discovery interface {
+	// Register 在 topic 下公布本节点，有效期 ttl 秒；实现可以在 ctx 存活期间自动续期，
+	// 因此调用方不再需要该注册时应取消 ctx 并调用 Unregister。
+	Register(ctx context.Context, topic string, ttl int) error
+	// Unregister 撤销 topic 下本节点的公布。
+	Unregister(ctx context.Context, topic string) error
+	// Discover 返回 topic 下已公布的节点，最多 limit 个，结果中不应包含本节点。
+	Discover(ctx context.Context, topic string, limit int) ([]peer.AddrInfo, error)
+}
+
+// StaticDiscovery 是固定节点列表的 Discovery：Register/Unregister 什么都不做，
+// Discover 不论主题总是返回 Peers。适用于已知对端地址、无需汇合点的场景。
+type StaticDiscovery struct {
+	Peers []peer.AddrInfo
+}
+
+func (StaticDiscovery) Register(context.Context, string, int) error { return nil }
+
+func (StaticDiscovery) Unregister(context.Context, string) error { return nil }
+
+func (d StaticDiscovery) Discover(_ context.Context, _ string, limit int) ([]peer.AddrInfo, error) {
+	if limit > 0 && len(d.Peers) > limit {
+		return d.Peers[:limit], nil
+	}
+	return d.Peers, nil
+}
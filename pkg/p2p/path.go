@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
@@ -16,10 +17,58 @@ type PathInfo struct {
 	RelayID    string
 	RelayVia   string
 	Transport  string
+	Security   string // 加密协议，如 "/noise"、"/tls/1.0.0"
+	SecureOK   bool   // 加密通过 CheckSecurity 的检查
+	Muxer      string // 流复用器，如 "/yamux/1.0.0"
 	LocalAddr  string
 	RemoteAddr string
 }
 
+// ConnSecurity 从连接状态中取出加密协议与流复用器。QUIC 与 WebTransport 自带 TLS 1.3
+// 和原生多路复用，libp2p 不会为其单独协商，这里如实标出；主动拨出的中继连接虽然同样经过
+// 加密升级，但 ConnState 不报告这两项，此时返回 "unknown"。
+func ConnSecurity(st network.ConnectionState) (security, muxer string) {
+	security, muxer = string(st.Security), string(st.StreamMultiplexer)
+	if security == "" {
+		switch {
+		case strings.HasPrefix(st.Transport, "quic"), st.Transport == "webtransport":
+			security, muxer = "tls1.3 (built into "+st.Transport+")", st.Transport+" (native)"
+		default:
+			security = "unknown"
+		}
+	}
+	if muxer == "" {
+		muxer = "unknown"
+	}
+	return security, muxer
+}
+
+// strongSecurity 是可接受的协商加密协议：Noise 与 libp2p TLS (/tls/1.0.0 只使用 TLS 1.3)。
+var strongSecurity = map[string]bool{"/noise": true, "/tls/1.0.0": true}
+
+// builtinSecurity 是自带加密、libp2p 不单独协商加密协议的传输：QUIC 与 WebTransport 使用 TLS 1.3，
+// WebRTC 使用 DTLS 并在其上完成 Noise 握手。中继连接 (p2p-circuit) 不在此列：电路上协商的加密
+// 要由 SecurityLog.ConnState 补全，补全不了时按未知加密拒绝。
+var builtinSecurity = map[string]bool{"quic-v1": true, "quic": true, "webtransport": true, "webrtc-direct": true}
+
+// CheckSecurity 断言连接协商出的加密是预期的强加密之一，否则返回错误。
+// libp2p 的默认配置下不会失败；显式检查是为了在配置错误或未知传输导致降级时中止，而不是默默继续。
+func CheckSecurity(st network.ConnectionState) error {
+	sec := string(st.Security)
+	switch {
+	case strongSecurity[sec]:
+		return nil
+	case sec == "" && builtinSecurity[st.Transport]:
+		return nil
+	case sec == "" && st.Transport == circuitTransport:
+		return fmt.Errorf("relayed connection does not report its encryption")
+	case sec == "":
+		return fmt.Errorf("connection over %q did not negotiate any encryption", st.Transport)
+	default:
+		return fmt.Errorf("connection over %q negotiated unexpected encryption %q (want Noise or TLS 1.3)", st.Transport, sec)
+	}
+}
+
 // reRelayBeforeCircuit 用于从 multiaddr 中识别中继地址
 var reRelayBeforeCircuit = regexp.MustCompile(`/p2p/([^/]+)/p2p-circuit`)
 
@@ -50,6 +99,8 @@ func ClassifyPath(c network.Conn) PathInfo {
 		LocalAddr:  c.LocalMultiaddr().String(),
 		RemoteAddr: c.RemoteMultiaddr().String(),
 	}
+	pi.Security, pi.Muxer = ConnSecurity(c.ConnState())
+	pi.SecureOK = CheckSecurity(c.ConnState()) == nil
 	rm := c.RemoteMultiaddr()
 	lm := c.LocalMultiaddr()
 	rs := rm.String()
@@ -78,54 +129,117 @@ func ClassifyPath(c network.Conn) PathInfo {
 	return pi
 }
 
-// ParseAddrInfos 解析地址字符串列表为 peer.AddrInfo
-// 会自动合并同一个 peer 的多个地址，并处理中继地址
-func ParseAddrInfos(addrs []string) ([]peer.AddrInfo, error) {
-	// 使用 map 来合并同一 peer 的多个地址
-	peerMap := make(map[peer.ID]*peer.AddrInfo)
+// ErrMultiHopCircuit 表示地址中出现了多个 /p2p-circuit；circuit v2 只支持单跳中继。
+var ErrMultiHopCircuit = errors.New("multi-hop circuit address not supported")
 
-	for _, s := range addrs {
-		if strings.HasPrefix(s, "dnsaddr://") {
-			// 跳过 dnsaddr，这里简化处理
+// CircuitRoute 是一条 circuit 地址拆出的中继路由：经 Relay 到达 Target。
+// 形如 <中继地址>/p2p/R/p2p-circuit 的地址只声明中继本身，此时 Target 为空。
+type CircuitRoute struct {
+	Relay  peer.AddrInfo
+	Target peer.ID
+	Dial   ma.Multiaddr // <中继地址>/p2p/R/p2p-circuit，可直接作为 Target 的拨号地址
+}
+
+// Routes 是 ParseRoutes 的结构化结果。
+type Routes struct {
+	Peers   []peer.AddrInfo // 地址所指向的节点；经中继的地址以 Dial 形式并入目标的 Addrs
+	Relays  []peer.AddrInfo // circuit 地址中出现的中继节点
+	Circuit []CircuitRoute
+	Invalid []string // 无法解析的地址（含多跳与缺少中继 ID 的 circuit 地址）
+}
+
+// ParseCircuit 拆分一条 circuit 地址；非 circuit 地址返回 ok=false。
+// 中继段必须以 /p2p/<ID> 结尾，目标段要么为空，要么恰为 /p2p/<ID>。
+func ParseCircuit(m ma.Multiaddr) (r CircuitRoute, ok bool, err error) {
+	idx := -1
+	for i, c := range m {
+		if c.Code() != ma.P_CIRCUIT {
 			continue
 		}
+		if idx >= 0 {
+			return r, true, ErrMultiHopCircuit
+		}
+		idx = i
+	}
+	if idx < 0 {
+		return r, false, nil
+	}
+	relay, err := peer.AddrInfoFromP2pAddr(m[:idx])
+	if err != nil {
+		return r, true, fmt.Errorf("circuit %s: relay hop has no /p2p id", m)
+	}
+	r.Relay = *relay
+	r.Dial = m[:idx+1]
+	switch rest := m[idx+1:]; {
+	case len(rest) == 0:
+	case len(rest) == 1 && rest[0].Code() == ma.P_P2P:
+		r.Target = peer.ID(rest[0].RawValue())
+		if r.Target == r.Relay.ID {
+			return r, true, fmt.Errorf("circuit %s: relay and target are the same peer", m)
+		}
+	default:
+		return r, true, fmt.Errorf("circuit %s: unexpected components after /p2p-circuit", m)
+	}
+	return r, true, nil
+}
 
-		// 处理包含 /p2p-circuit 的中继地址
-		// 对于 /p2p/A/p2p-circuit/p2p/B 这样的地址，我们提取最终目标 B
-		if strings.Contains(s, "/p2p-circuit/p2p/") {
-			// 提取 /p2p-circuit 之后的部分
-			parts := strings.Split(s, "/p2p-circuit")
-			if len(parts) >= 2 {
-				s = parts[len(parts)-1] // 取最后一部分
-			}
+// ParseRoutes 解析地址字符串列表，按 peer 合并地址并保持首次出现的顺序。
+// circuit 地址同时记入目标与中继，不会丢掉中继这一跳。
+func ParseRoutes(addrs []string) Routes {
+	var out Routes
+	peerIdx := make(map[peer.ID]int)
+	relayIdx := make(map[peer.ID]int)
+	add := func(list *[]peer.AddrInfo, idx map[peer.ID]int, ai peer.AddrInfo) {
+		if i, ok := idx[ai.ID]; ok {
+			(*list)[i].Addrs = append((*list)[i].Addrs, ai.Addrs...)
+			return
 		}
+		idx[ai.ID] = len(*list)
+		*list = append(*list, ai)
+	}
 
+	for _, s := range addrs {
+		if strings.HasPrefix(s, "dnsaddr://") {
+			// 跳过 dnsaddr，这里简化处理
+			continue
+		}
 		maddr, err := ma.NewMultiaddr(s)
 		if err != nil {
+			out.Invalid = append(out.Invalid, s)
 			continue
 		}
-		ai, err := peer.AddrInfoFromP2pAddr(maddr)
+		r, isCircuit, err := ParseCircuit(maddr)
 		if err != nil {
+			out.Invalid = append(out.Invalid, s)
 			continue
 		}
-
-		// 如果这个 peer 已经存在，合并地址
-		if existing, ok := peerMap[ai.ID]; ok {
-			existing.Addrs = append(existing.Addrs, ai.Addrs...)
-		} else {
-			peerMap[ai.ID] = ai
+		if isCircuit {
+			out.Circuit = append(out.Circuit, r)
+			add(&out.Relays, relayIdx, r.Relay)
+			if r.Target == "" {
+				// 地址指向中继本身
+				add(&out.Peers, peerIdx, r.Relay)
+			} else {
+				add(&out.Peers, peerIdx, peer.AddrInfo{ID: r.Target, Addrs: []ma.Multiaddr{r.Dial}})
+			}
+			continue
+		}
+		ai, err := peer.AddrInfoFromP2pAddr(maddr)
+		if err != nil {
+			out.Invalid = append(out.Invalid, s)
+			continue
 		}
+		add(&out.Peers, peerIdx, *ai)
 	}
+	return out
+}
 
-	if len(peerMap) == 0 {
+// ParseAddrInfos 解析地址字符串列表为 peer.AddrInfo
+// 会自动合并同一个 peer 的多个地址；中继路由详见 ParseRoutes
+func ParseAddrInfos(addrs []string) ([]peer.AddrInfo, error) {
+	rt := ParseRoutes(addrs)
+	if len(rt.Peers) == 0 {
 		return nil, fmt.Errorf("no valid addresses")
 	}
-
-	// 转换 map 为 slice
-	var out []peer.AddrInfo
-	for _, ai := range peerMap {
-		out = append(out, *ai)
-	}
-
-	return out, nil
+	return rt.Peers, nil
 }
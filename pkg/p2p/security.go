@@ -0,0 +1,123 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/sec"
+	tptu "github.com/libp2p/go-libp2p/p2p/net/upgrader"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// SecurityLog 记录每条中继连接 (p2p-circuit) 在电路上握手时实际协商出的加密协议。
+// 主动拨出的中继连接同样经过加密升级，但其 ConnState 不报告结果，ConnState 方法由这里的记录补全。
+// 只有用 Options 构建的主机才会记录；连接断开后由 Notifiee 删除对应的记录。
+type SecurityLog struct {
+	mu   sync.Mutex
+	seen map[connKey]protocol.ID
+}
+
+// connKey 标识一条连接：对端与两端的多地址。经同一条中继连接到同一对端的多条电路
+// 共用一个键，它们都由同一主机的 Options 升级，记录的是其中最近一次握手的结果。
+type connKey struct {
+	peer          peer.ID
+	local, remote string
+}
+
+// NewSecurityLog 创建一个空的记录
+func NewSecurityLog() *SecurityLog {
+	return &SecurityLog{seen: make(map[connKey]protocol.ID)}
+}
+
+// Options 以 libp2p 默认的 TLS 与 Noise 作为主机的加密协议，每次握手成功后记录协商结果。
+func (l *SecurityLog) Options() libp2p.Option {
+	return libp2p.ChainOptions(
+		libp2p.Security(libp2ptls.ID, func(id protocol.ID, key crypto.PrivKey, muxers []tptu.StreamMuxer) (*loggedSecurity, error) {
+			t, err := libp2ptls.New(id, key, muxers)
+			if err != nil {
+				return nil, err
+			}
+			return &loggedSecurity{SecureTransport: t, log: l}, nil
+		}),
+		libp2p.Security(noise.ID, func(id protocol.ID, key crypto.PrivKey, muxers []tptu.StreamMuxer) (*loggedSecurity, error) {
+			t, err := noise.New(id, key, muxers)
+			if err != nil {
+				return nil, err
+			}
+			return &loggedSecurity{SecureTransport: t, log: l}, nil
+		}),
+	)
+}
+
+// Notifiee 返回在连接断开时删除其记录的通知器，应注册到主机的 Network()
+func (l *SecurityLog) Notifiee() network.Notifiee {
+	return &network.NotifyBundle{DisconnectedF: func(_ network.Network, c network.Conn) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.seen, keyOf(c.RemotePeer(), c))
+	}}
+}
+
+// keyOf 以 p 与 c 的两端多地址构造记录的键
+func keyOf(p peer.ID, c network.ConnMultiaddrs) connKey {
+	return connKey{peer: p, local: c.LocalMultiaddr().String(), remote: c.RemoteMultiaddr().String()}
+}
+
+// record 记录 insecure 上与 p 协商出的 id；只记录电路连接，其他连接的 ConnState 自带结果
+func (l *SecurityLog) record(insecure net.Conn, p peer.ID, id protocol.ID) {
+	mc, ok := insecure.(network.ConnMultiaddrs)
+	if !ok {
+		return
+	}
+	if _, err := mc.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT); err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seen[keyOf(p, mc)] = id
+}
+
+// ConnState 返回 c 的 ConnState；主动拨出的中继连接不报告加密时，以这条连接握手时记录的协议补全。
+// l 为 nil 或没有记录时原样返回，CheckSecurity 会把空的加密视为未知而拒绝。
+func (l *SecurityLog) ConnState(c network.Conn) network.ConnectionState {
+	st := c.ConnState()
+	if l != nil && st.Security == "" && st.Transport == circuitTransport {
+		l.mu.Lock()
+		st.Security = l.seen[keyOf(c.RemotePeer(), c)]
+		l.mu.Unlock()
+	}
+	return st
+}
+
+// circuitTransport 是中继连接在 ConnState 中报告的传输名
+const circuitTransport = "p2p-circuit"
+
+// loggedSecurity 包装一个加密协议，握手成功后把协议记入 log
+type loggedSecurity struct {
+	sec.SecureTransport
+	log *SecurityLog
+}
+
+func (t *loggedSecurity) SecureInbound(ctx context.Context, insecure net.Conn, p peer.ID) (sec.SecureConn, error) {
+	c, err := t.SecureTransport.SecureInbound(ctx, insecure, p)
+	if err == nil {
+		t.log.record(insecure, c.RemotePeer(), t.ID())
+	}
+	return c, err
+}
+
+func (t *loggedSecurity) SecureOutbound(ctx context.Context, insecure net.Conn, p peer.ID) (sec.SecureConn, error) {
+	c, err := t.SecureTransport.SecureOutbound(ctx, insecure, p)
+	if err == nil {
+		t.log.record(insecure, c.RemotePeer(), t.ID())
+	}
+	return c, err
+}
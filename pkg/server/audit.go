@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditLog 以 JSON 行记录每次认领的结果 (时间、IP、密码牌哈希、侧、状态)，供排查猜码攻击与配对失败。
+// 不记录明文密码牌：密码牌只有几千种取值，普通哈希可被穷举还原，因此使用每次启动随机生成的 HMAC 密钥，
+// 同一次运行中同一密码牌的记录可以关联，但无法由日志反推密码牌，也无法跨重启关联。
+// 文件超过 maxBytes 时轮转为 <path>.1，只保留一份旧文件。
+type AuditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	key      []byte
+	f        *os.File
+	size     int64
+}
+
+// AuditRecord 是审计日志中的一行
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	Nameplate string    `json:"nameplate_hash"`
+	Side      string    `json:"side"`
+	Status    string    `json:"status"`           // waiting / paired / failed / error
+	Reason    string    `json:"reason,omitempty"` // 失败原因，见 ClaimFailReason
+	Exists    bool      `json:"exists"`           // 密码牌是否存在；大量不存在的认领通常意味着猜码
+}
+
+// maxAuditSide 是记录的 side 的最大长度，side 由客户端任意给出
+const maxAuditSide = 32
+
+// OpenAuditLog 以追加方式打开 path 处的审计日志，maxBytes 为单个文件的大小上限。
+func OpenAuditLog(path string, maxBytes int64) (*AuditLog, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("audit log size limit must be > 0")
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	a := &AuditLog{path: path, maxBytes: maxBytes, key: key}
+	if err := a.openLocked(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) openLocked() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	a.f, a.size = f, st.Size()
+	return nil
+}
+
+// HashNameplate 返回密码牌在本次运行中的 HMAC 摘要 (前 16 字节的十六进制)。
+func (a *AuditLog) HashNameplate(nameplate string) string {
+	m := hmac.New(sha256.New, a.key)
+	m.Write([]byte(nameplate))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// RecordClaim 记录一次认领的结果；a 为 nil 时什么也不做。写入失败不影响认领本身。
+func (a *AuditLog) RecordClaim(now time.Time, ip, nameplate, side, status, reason string, exists bool) {
+	if a == nil {
+		return
+	}
+	if len(side) > maxAuditSide {
+		side = side[:maxAuditSide]
+	}
+	rec := AuditRecord{Time: now.UTC(), IP: ip, Nameplate: a.HashNameplate(nameplate), Side: side, Status: status, Reason: reason, Exists: exists}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return
+	}
+	if a.size > 0 && a.size+int64(len(b)) > a.maxBytes {
+		_ = a.f.Close()
+		a.f = nil
+		_ = os.Rename(a.path, a.path+".1")
+		if err := a.openLocked(); err != nil {
+			return
+		}
+	}
+	n, _ := a.f.Write(b)
+	a.size += int64(n)
+}
+
+// Close 关闭审计日志文件
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/Metaphorme/wormhole/pkg/models"
 	_ "modernc.org/sqlite" // 引入 CGO-free 的 SQLite 驱动
 )
 
@@ -30,6 +32,14 @@ type NameplateRow struct {
 	Consumed    int64          // 是否已被消耗（成功建立连接后由客户端报告）。0 表示未消耗，1 表示已消耗
 	FailCount   int64          // 失败计数器，用于记录无效认领等失败操作的次数
 	LastIP      sql.NullString // 最后一次操作该记录的客户端 IP
+	// HostClaimedAt/ConnectClaimedAt 是 host/connect 一侧首次认领成功的 Unix 时间戳，未认领时为 NULL
+	HostClaimedAt    sql.NullInt64
+	ConnectClaimedAt sql.NullInt64
+	// HostIP/ConnectIP 是首次认领 host/connect 一侧的客户端 IP，用于判断重复认领能否视为重连
+	HostIP    sql.NullString
+	ConnectIP sql.NullString
+	// ConsumedAt 是首次标记为已消耗的 Unix 时间戳，未消耗或由旧版本标记时为 NULL
+	ConsumedAt sql.NullInt64
 }
 
 // Expired 判断密码牌在给定的时间点是否已过期
@@ -38,18 +48,79 @@ func (r *NameplateRow) Expired(at time.Time) bool {
 	return at.UTC().After(expires)
 }
 
-// ControlDB 是控制面数据库的封装，包含一个互斥锁以支持并发操作
+// ClaimResumeGrace 是重复认领同一侧时可视为重连的宽限期，从该侧首次认领成功时算起
+const ClaimResumeGrace = 2 * time.Minute
+
+// sideBit 返回认领方 side 在 claimed_mask 中对应的位 (host 为 1，connect 为 2)，无效的 side 返回 0
+func sideBit(side string) int64 {
+	switch toLower(side) {
+	case "host", "a":
+		return 1
+	case "connect", "b":
+		return 2
+	}
+	return 0
+}
+
+// ClaimFailReason 返回认领失败时可以告诉客户端的原因 (models.ClaimResponse.Reason)。
+// 只区分 "该侧已被认领"，让两端都以 connect 模式运行的用户得到明确提示；不存在、过期、
+// 已消耗与 side 无效仍然不给出原因，避免向猜测者泄露密码牌的更多状态。
+func ClaimFailReason(st PlateStatus, row *NameplateRow, side string) string {
+	if st != StatusFailed || row == nil || row.Consumed != 0 {
+		return ""
+	}
+	if bit := sideBit(side); bit != 0 && row.ClaimedMask&bit != 0 {
+		return models.ClaimReasonSideTaken
+	}
+	return ""
+}
+
+// canResume 判断对已认领一侧 (bit) 的重复认领能否视为同一客户端崩溃后的重连：
+// 必须来自首次认领该侧的 IP，且仍在宽限期内。宽限期不会因重连而延长；
+// 其他 IP 得到 failed 与 ClaimReasonSideTaken (见 ClaimFailReason)。
+func (r *NameplateRow) canResume(bit int64, ip string, now time.Time) bool {
+	sideIP, at := r.HostIP, r.HostClaimedAt
+	if bit == 2 {
+		sideIP, at = r.ConnectIP, r.ConnectClaimedAt
+	}
+	if ip == "" || !sideIP.Valid || !at.Valid || sideIP.String != ip {
+		return false
+	}
+	return now.UTC().Unix()-at.Int64 <= int64(ClaimResumeGrace/time.Second)
+}
+
+// status 返回密码牌当前的认领状态
+func (r *NameplateRow) status() PlateStatus {
+	if r.ClaimedMask == 3 {
+		return StatusPaired
+	}
+	return StatusWaiting
+}
+
+// ControlDB 是 Store 基于 SQLite 的实现（生产环境默认），包含一个互斥锁以支持并发操作
 type ControlDB struct {
 	mu sync.Mutex
 	db *sql.DB
 }
 
+// sqliteMaxOpenConns 是控制面 SQLite 连接池的大小，见 OpenControlDB 中的说明
+const sqliteMaxOpenConns = 1
+
 // OpenControlDB 打开或创建一个 SQLite 数据库文件，并进行初始化配置
 func OpenControlDB(path string) (*ControlDB, error) {
 	db, err := sql.Open("sqlite", path)
 	if err != nil {
 		return nil, err
 	}
+	// 连接池限制：SQLite 同一时刻只允许一个写者，多个连接只会在文件锁上互相等待，
+	// 因此控制面只使用一个长期存活的连接，由 database/sql 在连接池层面排队。
+	// 这也保证了下面按连接生效的 PRAGMA (如 busy_timeout) 始终作用于实际使用的连接，
+	// 所以不设置连接的最大存活/空闲时间。
+	db.SetMaxOpenConns(sqliteMaxOpenConns)
+	db.SetMaxIdleConns(sqliteMaxOpenConns)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+
 	// 启用 WAL (Write-Ahead Logging) 模式，可以显著提高并发写入性能
 	if _, err := db.Exec(`PRAGMA journal_mode=WAL;`); err != nil {
 		_ = db.Close()
@@ -61,41 +132,45 @@ func OpenControlDB(path string) (*ControlDB, error) {
 		return nil, fmt.Errorf("set busy_timeout: %w", err)
 	}
 
-	// 定义并执行数据库表结构（如果表不存在）
-	schema := `
-CREATE TABLE IF NOT EXISTS nameplates(
-  nameplate TEXT PRIMARY KEY,
-  created_at INTEGER NOT NULL,
-  ttl_seconds INTEGER NOT NULL,
-  claimed_mask INTEGER NOT NULL DEFAULT 0,
-  consumed INTEGER NOT NULL DEFAULT 0,
-  fail_count INTEGER NOT NULL DEFAULT 0,
-  last_ip TEXT
-);
-CREATE INDEX IF NOT EXISTS idx_nameplates_created ON nameplates(created_at);
-`
-	if _, err := db.Exec(schema); err != nil {
+	// 按版本依次执行尚未应用的表结构迁移，见 migrate.go
+	if err := migrate(db); err != nil {
 		_ = db.Close()
-		return nil, err
+		return nil, fmt.Errorf("migrate control db: %w", err)
 	}
 	return &ControlDB{db: db}, nil
 }
 
+// statsDay 返回用于按天汇总统计的日期键 (UTC)
+func statsDay(t time.Time) string { return t.UTC().Format("2006-01-02") }
+
 // Close 关闭数据库连接
 func (c *ControlDB) Close() error { return c.db.Close() }
 
-// InsertNew 向数据库中插入一条新的密码牌记录
+// Ping 执行一次 SELECT 1，确认数据库可以正常查询
+func (c *ControlDB) Ping(ctx context.Context) error {
+	var one int
+	return c.db.QueryRowContext(ctx, `SELECT 1`).Scan(&one)
+}
+
+// SchemaVersion 返回数据库当前已应用的迁移版本号
+func (c *ControlDB) SchemaVersion() (int, error) { return schemaVersion(c.db) }
+
+// InsertNew 向数据库中插入一条新的密码牌记录，并计入当天的分配次数
 func (c *ControlDB) InsertNew(nameplate string, ttl time.Duration, now time.Time, ip string) error {
-	_, err := c.db.Exec(`INSERT INTO nameplates(nameplate, created_at, ttl_seconds, claimed_mask, consumed, fail_count, last_ip)
-VALUES(?, ?, ?, 0, 0, 0, ?)`, nameplate, now.UTC().Unix(), int64(ttl/time.Second), ip)
+	if _, err := c.db.Exec(`INSERT INTO nameplates(nameplate, created_at, ttl_seconds, claimed_mask, consumed, fail_count, last_ip)
+VALUES(?, ?, ?, 0, 0, 0, ?)`, nameplate, now.UTC().Unix(), int64(ttl/time.Second), ip); err != nil {
+		return err
+	}
+	_, err := c.db.Exec(`INSERT INTO usage_daily(day, allocations) VALUES(?, 1)
+ON CONFLICT(day) DO UPDATE SET allocations = allocations + 1`, statsDay(now))
 	return err
 }
 
 // Load 从数据库加载指定密码牌的信息
 func (c *ControlDB) Load(nameplate string) (*NameplateRow, error) {
-	row := c.db.QueryRow(`SELECT nameplate, created_at, ttl_seconds, claimed_mask, consumed, fail_count, last_ip FROM nameplates WHERE nameplate=?`, nameplate)
+	row := c.db.QueryRow(`SELECT nameplate, created_at, ttl_seconds, claimed_mask, consumed, fail_count, last_ip, host_claimed_at, connect_claimed_at, host_ip, connect_ip, consumed_at FROM nameplates WHERE nameplate=?`, nameplate)
 	var r NameplateRow
-	if err := row.Scan(&r.Nameplate, &r.CreatedAt, &r.TTLSeconds, &r.ClaimedMask, &r.Consumed, &r.FailCount, &r.LastIP); err != nil {
+	if err := row.Scan(&r.Nameplate, &r.CreatedAt, &r.TTLSeconds, &r.ClaimedMask, &r.Consumed, &r.FailCount, &r.LastIP, &r.HostClaimedAt, &r.ConnectClaimedAt, &r.HostIP, &r.ConnectIP, &r.ConsumedAt); err != nil {
 		return nil, err
 	}
 	return &r, nil
@@ -118,76 +193,115 @@ func (c *ControlDB) Delete(nameplate string) error {
 func (c *ControlDB) FailAndConsume(nameplate string) error {
 	_, err := c.db.Exec(`
         UPDATE nameplates
-           SET fail_count = fail_count + CASE WHEN consumed=0 THEN 1 ELSE 0 END,
-               consumed   = 1
-         WHERE nameplate = ?`, nameplate)
+           SET fail_count  = fail_count + CASE WHEN consumed=0 THEN 1 ELSE 0 END,
+               consumed    = 1,
+               consumed_at = CASE WHEN consumed=0 THEN ? ELSE consumed_at END
+         WHERE nameplate = ?`, time.Now().UTC().Unix(), nameplate)
 	return err
 }
 
 // Claim 处理客户端的认领请求，是核心业务逻辑之一
 // 它会检查密码牌的有效性，处理重复认领和无效 side 的情况，并更新认领状态
+// 重复认领同一侧通常计为失败，但来自原 IP 且在 ClaimResumeGrace 内的会返回当前状态，见 canResume
 // 如果密码牌已过期，会直接从数据库删除
+//
+// 读取与更新之间没有事务：更新使用乐观并发控制，只有当 claimed_mask 仍等于读取到的值时才生效，
+// 否则重新读取并判断。因此两个并发的认领不会同时得到 paired。
 func (c *ControlDB) Claim(nameplate, side string, now time.Time, ip string) (PlateStatus, *NameplateRow, error) {
-	r, err := c.Load(nameplate)
-	if err != nil {
-		// 如果密码牌不存在，直接返回 failed 状态
-		if err == sql.ErrNoRows {
-			return StatusFailed, nil, nil
-		}
-		return "", nil, err
-	}
-	// 如果密码牌已过期，删除它并返回 failed
-	if r.Expired(now) {
-		_ = c.Delete(nameplate)
-		return StatusFailed, nil, nil
-	}
-	// 如果密码牌已被消耗，返回 failed
-	if r.Consumed != 0 {
-		return StatusFailed, r, nil
+	bit := sideBit(side)
+	var claimedCol, ipCol string // 记录该侧认领时间与认领 IP 的列
+	switch bit {
+	case 1:
+		claimedCol, ipCol = "host_claimed_at", "host_ip"
+	case 2:
+		claimedCol, ipCol = "connect_claimed_at", "connect_ip"
 	}
 
-	var bit int64
-	side = toLower(side)
-	switch side {
-	case "host", "a":
-		bit = 1 // bit0 for host side
-	case "connect", "b":
-		bit = 2 // bit1 for connect side
-	default:
-		// 无效的 side 参数，增加失败计数并返回 failed
-		_ = c.IncrFail(nameplate)
-		return StatusFailed, r, nil
-	}
+	// claimed_mask 只会增加置位，因此冲突重试的次数是有限的
+	for attempt := 0; attempt < 4; attempt++ {
+		r, err := c.Load(nameplate)
+		if err != nil {
+			// 如果密码牌不存在，直接返回 failed 状态
+			if err == sql.ErrNoRows {
+				return StatusFailed, nil, nil
+			}
+			return "", nil, err
+		}
+		// 如果密码牌已过期，删除它并返回 failed
+		if r.Expired(now) {
+			_ = c.Delete(nameplate)
+			return StatusFailed, nil, nil
+		}
+		// 如果密码牌已被消耗，返回 failed
+		if r.Consumed != 0 {
+			return StatusFailed, r, nil
+		}
+		if bit == 0 {
+			// 无效的 side 参数，增加失败计数并返回 failed
+			_ = c.IncrFail(nameplate)
+			return StatusFailed, r, nil
+		}
 
-	newMask := r.ClaimedMask | bit
-	if newMask == r.ClaimedMask {
-		// 重复认领同一侧，视为失败操作，增加失败计数
-		_ = c.IncrFail(nameplate)
-		return StatusFailed, r, nil
-	}
+		newMask := r.ClaimedMask | bit
+		if newMask == r.ClaimedMask {
+			// 原客户端崩溃后重新认领：返回当前状态，不计入失败
+			if r.canResume(bit, ip, now) {
+				return r.status(), r, nil
+			}
+			// 重复认领同一侧，视为失败操作，增加失败计数
+			_ = c.IncrFail(nameplate)
+			return StatusFailed, r, nil
+		}
 
-	// 更新数据库中的认领掩码和最后操作IP
-	if _, err := c.db.Exec(`UPDATE nameplates SET claimed_mask=?, last_ip=? WHERE nameplate=?`, newMask, ip, nameplate); err != nil {
-		return "", nil, err
-	}
-	r.ClaimedMask = newMask
-	r.LastIP = sql.NullString{String: ip, Valid: true}
+		// 仅当认领掩码未被并发修改时才更新认领掩码、认领时间和最后操作IP
+		at := now.UTC().Unix()
+		res, err := c.db.Exec(`UPDATE nameplates SET claimed_mask=?, last_ip=?, `+claimedCol+`=?, `+ipCol+`=? WHERE nameplate=? AND claimed_mask=? AND consumed=0`,
+			newMask, ip, at, ip, nameplate, r.ClaimedMask)
+		if err != nil {
+			return "", nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return "", nil, err
+		} else if n == 0 {
+			continue // 被并发的认领抢先，重新读取后再判断
+		}
+		r.ClaimedMask = newMask
+		r.LastIP = sql.NullString{String: ip, Valid: true}
+		if bit == 1 {
+			r.HostClaimedAt = sql.NullInt64{Int64: at, Valid: true}
+			r.HostIP = r.LastIP
+		} else {
+			r.ConnectClaimedAt = sql.NullInt64{Int64: at, Valid: true}
+			r.ConnectIP = r.LastIP
+		}
+		// 只在两侧都已认领 (claimed_mask 变为 3) 时计为一次配对，单侧认领后被放弃的密码牌不计入
+		if newMask == 3 {
+			if _, err := c.db.Exec(`INSERT INTO usage_daily(day, pairs, pair_seconds) VALUES(?, 1, ?)
+ON CONFLICT(day) DO UPDATE SET pairs = pairs + 1, pair_seconds = pair_seconds + excluded.pair_seconds`,
+				statsDay(now), pairSeconds(r, at)); err != nil {
+				return "", nil, err
+			}
+		}
 
-	if newMask == 3 { // bit0 和 bit1 都被设置，表示双方都已认领
-		return StatusPaired, r, nil
+		return r.status(), r, nil
 	}
-	return StatusWaiting, r, nil
+	return "", nil, fmt.Errorf("claim %s: too much contention", nameplate)
 }
 
 // Consume 将密码牌标记为已消耗，通常在客户端成功建立连接后调用
 func (c *ControlDB) Consume(nameplate string) error {
-	_, err := c.db.Exec(`UPDATE nameplates SET consumed=1 WHERE nameplate=?`, nameplate)
+	_, err := c.db.Exec(`UPDATE nameplates SET consumed_at=CASE WHEN consumed=0 THEN ? ELSE consumed_at END, consumed=1 WHERE nameplate=?`, time.Now().UTC().Unix(), nameplate)
 	return err
 }
 
 // CleanupExpired 定期清理数据库中已过期或已消耗的密码牌记录
-func (c *ControlDB) CleanupExpired(now time.Time) (int64, error) {
-	res, err := c.db.Exec(`DELETE FROM nameplates WHERE (created_at + ttl_seconds) < ? OR consumed=1`, now.UTC().Unix())
+// 过期或消耗之后的 grace 内记录仍被保留，使迟到的 /v1/claim、/v1/consume、/v1/fail 看到真实状态，
+// 而不是因记录已被清理得到 failed；没有消耗时间的旧记录不受宽限期保护
+func (c *ControlDB) CleanupExpired(now time.Time, grace time.Duration) (int64, error) {
+	g := int64(grace / time.Second)
+	res, err := c.db.Exec(`DELETE FROM nameplates
+ WHERE (created_at + ttl_seconds + ?) < ?
+    OR (consumed=1 AND COALESCE(consumed_at, 0) + ? <= ?)`, g, now.UTC().Unix(), g, now.UTC().Unix())
 	if err != nil {
 		return 0, err
 	}
@@ -195,6 +309,59 @@ func (c *ControlDB) CleanupExpired(now time.Time) (int64, error) {
 	return n, nil
 }
 
+// Stats 汇总匿名的使用统计：当天的分配与配对次数来自按天累计的计数，
+// 当前活跃与已配对未消耗的数量来自尚未清理的密码牌
+func (c *ControlDB) Stats(now time.Time) (*UsageStats, error) {
+	st := &UsageStats{Day: statsDay(now)}
+	var pairSecs int64
+	err := c.db.QueryRow(`SELECT allocations, pairs, pair_seconds FROM usage_daily WHERE day=?`, st.Day).
+		Scan(&st.AllocationsToday, &st.PairsToday, &pairSecs)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	unix := now.UTC().Unix()
+	err = c.db.QueryRow(`SELECT
+  COUNT(*),
+  COALESCE(SUM(CASE WHEN claimed_mask=3 THEN 1 ELSE 0 END), 0)
+FROM nameplates WHERE consumed=0 AND (created_at + ttl_seconds) >= ?`, unix).
+		Scan(&st.ActiveNameplates, &st.PairedNotConsumed)
+	if err != nil {
+		return nil, err
+	}
+	st.setAvgTimeToPair(pairSecs)
+	rows, err := c.db.Query(`SELECT direction, path, reports, failed_reports, files, failed_files, bytes
+FROM transfer_daily WHERE day=? ORDER BY direction, path`, st.Day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t TransferStats
+		if err := rows.Scan(&t.Direction, &t.Path, &t.Reports, &t.FailedReports, &t.Files, &t.FailedFiles, &t.Bytes); err != nil {
+			return nil, err
+		}
+		st.Transfers = append(st.Transfers, t)
+	}
+	return st, rows.Err()
+}
+
+// RecordTransfer 把一次传输报告累加到 transfer_daily 中当天对应方向与路径的一行
+func (c *ControlDB) RecordTransfer(r models.TransferReport, now time.Time) error {
+	failed := 0
+	if !r.OK {
+		failed = 1
+	}
+	_, err := c.db.Exec(`INSERT INTO transfer_daily(day, direction, path, reports, failed_reports, files, failed_files, bytes)
+VALUES(?, ?, ?, 1, ?, ?, ?, ?)
+ON CONFLICT(day, direction, path) DO UPDATE SET
+  reports = reports + 1,
+  failed_reports = failed_reports + excluded.failed_reports,
+  files = files + excluded.files,
+  failed_files = failed_files + excluded.failed_files,
+  bytes = bytes + excluded.bytes`, statsDay(now), r.Direction, r.Path, failed, r.Files, r.FailedFiles, r.Bytes)
+	return err
+}
+
 // Lock 获取数据库锁
 func (c *ControlDB) Lock() {
 	c.mu.Lock()
@@ -1,17 +1,23 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	ma "github.com/multiformats/go-multiaddr"
+
 	"github.com/Metaphorme/wormhole/pkg/models"
 )
 
 // HTTPHandlers 封装了 HTTP 处理器所需的依赖
 type HTTPHandlers struct {
-	DB             *ControlDB
+	DB             Store
 	Limiter        *IPLimiter
 	RzvNamespace   string
 	AdvertisedAddr []string
@@ -19,10 +25,40 @@ type HTTPHandlers struct {
 	Bootstrap      []string
 	TTL            time.Duration
 	Digits         int
+	Charset        string                // 密码牌字符集 (models.NameplateCharset*)，为空时使用纯数字
+	TopicPrefix    string                // 主题前缀，为空时使用 DefaultTopicPrefix
+	ListenAddrs    func() []ma.Multiaddr // libp2p 主机的监听地址，用于就绪探针
+	AdminToken     string                // /admin/* 接口的 Bearer 令牌，为空时这些接口不可用
+	Message        string                // 随分配/认领响应下发给客户端的公告，为空时不下发
+	Audit          *AuditLog             // 非 nil 时记录每次认领的结果 (-audit-log)
+	Reports        *ReportTokens         // 签发与核验 /v1/report 的令牌，为 nil 时拒绝所有报告
+}
+
+// DefaultTopicPrefix 是未配置 -topic-prefix 时使用的主题前缀
+const DefaultTopicPrefix = "/wormhole"
+
+// Topic 返回密码牌对应的通信主题，分配与认领两侧必须使用同一规则生成
+func (h *HTTPHandlers) Topic(nameplate string) string {
+	prefix := strings.TrimRight(h.TopicPrefix, "/")
+	if prefix == "" {
+		prefix = DefaultTopicPrefix
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix + "/" + nameplate
+}
+
+// charset 返回实际使用的密码牌字符集
+func (h *HTTPHandlers) charset() string {
+	if h.Charset == "" {
+		return models.NameplateCharsetDigits
+	}
+	return h.Charset
 }
 
 // NewHTTPHandlers 创建 HTTP 处理器实例
-func NewHTTPHandlers(db *ControlDB, limiter *IPLimiter, rzvNamespace string, advertisedAddr, relayAddrs, bootstrap []string, ttl time.Duration, digits int) *HTTPHandlers {
+func NewHTTPHandlers(db Store, limiter *IPLimiter, rzvNamespace string, advertisedAddr, relayAddrs, bootstrap []string, ttl time.Duration, digits int) *HTTPHandlers {
 	return &HTTPHandlers{
 		DB:             db,
 		Limiter:        limiter,
@@ -32,14 +68,22 @@ func NewHTTPHandlers(db *ControlDB, limiter *IPLimiter, rzvNamespace string, adv
 		Bootstrap:      bootstrap,
 		TTL:            ttl,
 		Digits:         digits,
+		Reports:        NewReportTokens(),
 	}
 }
 
 // WithRateLimit 是一个中间件，用于在处理请求前进行频率检查
+// 所有响应都带有 X-RateLimit-Limit / X-RateLimit-Remaining / X-RateLimit-Reset 头，
+// 其中 Reset 为距配额释放的秒数，便于客户端在触发 429 之前自行退避
 func (h *HTTPHandlers) WithRateLimit(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ip := ClientIP(r)
-		ok, wait := h.Limiter.Allow(ip, time.Now())
+		now := time.Now()
+		ok, wait := h.Limiter.Allow(ip, now)
+		st := h.Limiter.Status(ip, now)
+		w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", st.Limit))
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", st.Remaining))
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", (st.Reset.Sub(now)+time.Second-1)/time.Second))
 		if !ok {
 			// 如果请求被限制，返回 429 Too Many Requests，并附带 Retry-After 头
 			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())))
@@ -50,6 +94,24 @@ func (h *HTTPHandlers) WithRateLimit(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// RequireAdmin 是一个中间件，要求请求携带 "Authorization: Bearer <AdminToken>"
+// 未配置 AdminToken 时返回 404，不暴露管理接口的存在
+func (h *HTTPHandlers) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(tok), []byte(h.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
 // HandleAllocate 处理 /v1/allocate 接口 - 分配一个新的密码牌
 func (h *HTTPHandlers) HandleAllocate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -57,24 +119,43 @@ func (h *HTTPHandlers) HandleAllocate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ip := ClientIP(r)
-	np, exp, err := AllocateNameplate(h.DB, h.Digits, h.TTL, time.Now(), ip)
+	np, exp, err := AllocateNameplateFrom(h.DB, models.NameplateAlphabets[h.charset()], h.Digits, h.TTL, time.Now(), ip)
 	if err != nil {
 		http.Error(w, "allocate failed", http.StatusInternalServerError)
 		return
 	}
 	resp := models.AllocateResponse{
-		Nameplate: np,
-		ExpiresAt: exp,
+		Nameplate:   np,
+		ExpiresAt:   exp,
+		ReportToken: h.Reports.Issue(np, "host", time.Now()),
 		ConnectionInfo: models.ConnectionInfo{
 			Rendezvous: models.AddrBundle{Namespace: h.RzvNamespace, Addrs: h.AdvertisedAddr},
 			Relay:      models.AddrBundle{Namespace: "circuit-relay-v2", Addrs: h.RelayAddrs},
 			Bootstrap:  h.Bootstrap,
-			Topic:      fmt.Sprintf("/wormhole/%s", np),
+			Topic:      h.Topic(np),
+			Message:    h.Message,
 		},
 	}
 	writeJSON(w, http.StatusOK, resp)
 }
 
+// HandleInfo 处理 /v1/info 接口 - 返回服务器的静态配置，不分配任何资源
+func (h *HTTPHandlers) HandleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	resp := models.InfoResponse{
+		NameplateDigits:  h.Digits,
+		NameplateCharset: h.charset(),
+		NameplateTTL:     int64(h.TTL / time.Second),
+		Rendezvous:       models.AddrBundle{Namespace: h.RzvNamespace, Addrs: h.AdvertisedAddr},
+		Relay:            models.AddrBundle{Namespace: "circuit-relay-v2", Addrs: h.RelayAddrs},
+		Bootstrap:        h.Bootstrap,
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
 // HandleClaim 处理 /v1/claim 接口 - 认领一个密码牌的其中一侧
 func (h *HTTPHandlers) HandleClaim(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -97,9 +178,12 @@ func (h *HTTPHandlers) HandleClaim(w http.ResponseWriter, r *http.Request) {
 	ip := ClientIP(r)
 	st, row, err := h.DB.Claim(req.Nameplate, req.Side, time.Now(), ip)
 	if err != nil {
+		h.Audit.RecordClaim(time.Now(), ip, req.Nameplate, req.Side, "error", "", false)
 		http.Error(w, "claim failed", http.StatusInternalServerError)
 		return
 	}
+	reason := ClaimFailReason(st, row, req.Side)
+	h.Audit.RecordClaim(time.Now(), ip, req.Nameplate, req.Side, string(st), reason, row != nil)
 
 	// 统一构造过期时间：如果 row 为 nil (密码牌不存在)，则使用当前时间，避免泄露信息
 	var exp time.Time
@@ -114,14 +198,23 @@ func (h *HTTPHandlers) HandleClaim(w http.ResponseWriter, r *http.Request) {
 		h.Limiter.RecordFail(ip, time.Now())
 	}
 
+	// 认领成功的一侧才能在之后报告传输结果
+	var token string
+	if st != StatusFailed {
+		token = h.Reports.Issue(req.Nameplate, req.Side, time.Now())
+	}
+
 	resp := models.ClaimResponse{
-		Status:    string(st),
-		ExpiresAt: exp,
+		Status:      string(st),
+		Reason:      reason,
+		ExpiresAt:   exp,
+		ReportToken: token,
 		ConnectionInfo: models.ConnectionInfo{
 			Rendezvous: models.AddrBundle{Namespace: h.RzvNamespace, Addrs: h.AdvertisedAddr},
 			Relay:      models.AddrBundle{Namespace: "circuit-relay-v2", Addrs: h.RelayAddrs},
 			Bootstrap:  h.Bootstrap,
-			Topic:      fmt.Sprintf("/wormhole/%s", req.Nameplate),
+			Topic:      h.Topic(req.Nameplate),
+			Message:    h.Message,
 		},
 	}
 	writeJSON(w, http.StatusOK, resp)
@@ -172,6 +265,88 @@ func (h *HTTPHandlers) HandleFail(w http.ResponseWriter, r *http.Request) {
 	WriteJSON(w, http.StatusOK, map[string]string{"ok": "true"})
 }
 
+// HandleReport 处理 /v1/report 接口 - 客户端报告一次文件传输的结果，计入当天的传输统计
+// 报告须携带分配/认领时下发的令牌 (见 ReportTokens)；统计中不保存密码牌或客户端标识，只用于评估实际的传输可靠性
+func (h *HTTPHandlers) HandleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req models.TransferReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if err := ValidTransferReport(req); err != nil {
+		h.Limiter.RecordFail(ClientIP(r), time.Now())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 只接受持有分配/认领时下发的令牌的报告，每次会话的每一侧只计入一次
+	switch err := h.Reports.Redeem(req.Token, time.Now()); {
+	case errors.Is(err, ErrReportTokenUsed):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		h.Limiter.RecordFail(ClientIP(r), time.Now())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := h.DB.RecordTransfer(req, time.Now()); err != nil {
+		http.Error(w, "report failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"ok": "true"})
+}
+
+// HandleHealthz 处理 /healthz 接口 - 存活探针，进程能够响应即返回 200
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// HandleReadyz 处理 /readyz 接口 - 就绪探针，要求数据库可查询且 libp2p 主机至少有一个监听地址
+func (h *HTTPHandlers) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	checks := map[string]string{"db": "ok", "listen": "ok"}
+	ready := true
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := h.DB.Ping(ctx); err != nil {
+		checks["db"] = err.Error()
+		ready = false
+	}
+	if h.ListenAddrs == nil || len(h.ListenAddrs()) == 0 {
+		checks["listen"] = "no listen addresses"
+		ready = false
+	}
+	if !ready {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "unavailable", "checks": checks})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "checks": checks})
+}
+
+// HandleStats 处理 /admin/stats 接口 - 返回不含客户端信息的聚合使用统计
+func (h *HTTPHandlers) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	st, err := h.DB.Stats(time.Now())
+	if err != nil {
+		http.Error(w, "stats failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
 // WriteJSON 是一个辅助函数，用于将数据结构序列化为 JSON 并写入 HTTP 响应
 func WriteJSON(w http.ResponseWriter, code int, v any) {
 	w.Header().Set("Content-Type", "application/json")
@@ -95,6 +95,32 @@ func (l *IPLimiter) Allow(ip string, now time.Time) (bool, time.Duration) {
 	return true, 0
 }
 
+// RateStatus 描述某个 IP 在请求窗口内的配额使用情况
+type RateStatus struct {
+	Limit     int       // 窗口内允许的最大请求数
+	Remaining int       // 窗口内剩余的请求数，不小于 0
+	Reset     time.Time // 最早的请求移出窗口、释放配额的时刻；窗口内没有请求时为 now
+}
+
+// Status 返回 ip 当前的请求配额状态，不计为一次请求
+func (l *IPLimiter) Status(ip string, now time.Time) RateStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := RateStatus{Limit: l.maxReqs, Remaining: l.maxReqs, Reset: now}
+	n := 0
+	for _, t := range l.reqs[ip] {
+		if now.Sub(t) > l.reqWindow {
+			continue
+		}
+		if n == 0 {
+			st.Reset = t.Add(l.reqWindow)
+		}
+		n++
+	}
+	st.Remaining = max(l.maxReqs-n, 0)
+	return st
+}
+
 // RecordFail 记录一次来自特定 IP 的失败操作
 func (l *IPLimiter) RecordFail(ip string, now time.Time) {
 	l.mu.Lock()
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Metaphorme/wormhole/pkg/models"
+)
+
+// MemoryStore 是 Store 的内存实现，主要用于测试
+// 它与 ControlDB 的语义保持一致，并支持为指定操作注入错误，以模拟难以用 SQLite 触发的异常情况
+type MemoryStore struct {
+	mu     sync.Mutex // 对应 ControlDB 的分配锁
+	dataMu sync.Mutex // 保护 rows、daily 和 errs
+	rows   map[string]NameplateRow
+	daily  map[string]memUsageDay
+	xfers  map[memTransferKey]TransferStats
+	errs   map[string]error
+}
+
+// memUsageDay 对应 ControlDB 的 usage_daily 表中的一行
+type memUsageDay struct {
+	allocations, pairs, pairSeconds int64
+}
+
+// memTransferKey 对应 ControlDB 的 transfer_daily 表的主键
+type memTransferKey struct {
+	day, direction, path string
+}
+
+// NewMemoryStore 创建一个空的内存存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		rows:  make(map[string]NameplateRow),
+		daily: make(map[string]memUsageDay),
+		xfers: make(map[memTransferKey]TransferStats),
+		errs:  make(map[string]error),
+	}
+}
+
+// SetError 让名为 op 的操作（如 "Consume"、"Claim"）返回指定错误；err 为 nil 时取消注入
+func (m *MemoryStore) SetError(op string, err error) {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	if err == nil {
+		delete(m.errs, op)
+		return
+	}
+	m.errs[op] = err
+}
+
+// injected 返回为 op 注入的错误，需要在 dataMu 保护下调用
+func (m *MemoryStore) injected(op string) error {
+	return m.errs[op]
+}
+
+// Close 对内存存储没有实际作用
+func (m *MemoryStore) Close() error { return nil }
+
+// Ping 总是成功，除非为 "Ping" 注入了错误
+func (m *MemoryStore) Ping(_ context.Context) error {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	return m.injected("Ping")
+}
+
+// InsertNew 插入一条新的密码牌记录，如果记录已存在则返回错误（模拟主键冲突）
+func (m *MemoryStore) InsertNew(nameplate string, ttl time.Duration, now time.Time, ip string) error {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	if err := m.injected("InsertNew"); err != nil {
+		return err
+	}
+	if _, ok := m.rows[nameplate]; ok {
+		return fmt.Errorf("nameplate %s already exists", nameplate)
+	}
+	m.rows[nameplate] = NameplateRow{
+		Nameplate:  nameplate,
+		CreatedAt:  now.UTC().Unix(),
+		TTLSeconds: int64(ttl / time.Second),
+		LastIP:     sql.NullString{String: ip, Valid: true},
+	}
+	d := m.daily[statsDay(now)]
+	d.allocations++
+	m.daily[statsDay(now)] = d
+	return nil
+}
+
+// Load 加载指定密码牌的信息，不存在时返回 sql.ErrNoRows
+func (m *MemoryStore) Load(nameplate string) (*NameplateRow, error) {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	return m.loadLocked(nameplate)
+}
+
+func (m *MemoryStore) loadLocked(nameplate string) (*NameplateRow, error) {
+	if err := m.injected("Load"); err != nil {
+		return nil, err
+	}
+	r, ok := m.rows[nameplate]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &r, nil
+}
+
+// IncrFail 增加指定密码牌的失败计数
+func (m *MemoryStore) IncrFail(nameplate string) error {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	if err := m.injected("IncrFail"); err != nil {
+		return err
+	}
+	m.incrFailLocked(nameplate)
+	return nil
+}
+
+func (m *MemoryStore) incrFailLocked(nameplate string) {
+	if r, ok := m.rows[nameplate]; ok {
+		r.FailCount++
+		m.rows[nameplate] = r
+	}
+}
+
+// Delete 删除指定的密码牌
+func (m *MemoryStore) Delete(nameplate string) error {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	if err := m.injected("Delete"); err != nil {
+		return err
+	}
+	delete(m.rows, nameplate)
+	return nil
+}
+
+// FailAndConsume 将密码牌标记为已消耗，仅当之前未被消耗时增加失败计数
+func (m *MemoryStore) FailAndConsume(nameplate string) error {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	if err := m.injected("FailAndConsume"); err != nil {
+		return err
+	}
+	if r, ok := m.rows[nameplate]; ok {
+		if r.Consumed == 0 {
+			r.FailCount++
+			r.ConsumedAt = sql.NullInt64{Int64: time.Now().UTC().Unix(), Valid: true}
+		}
+		r.Consumed = 1
+		m.rows[nameplate] = r
+	}
+	return nil
+}
+
+// Claim 处理认领请求，语义与 ControlDB.Claim 相同
+func (m *MemoryStore) Claim(nameplate, side string, now time.Time, ip string) (PlateStatus, *NameplateRow, error) {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	if err := m.injected("Claim"); err != nil {
+		return "", nil, err
+	}
+	r, err := m.loadLocked(nameplate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return StatusFailed, nil, nil
+		}
+		return "", nil, err
+	}
+	if r.Expired(now) {
+		delete(m.rows, nameplate)
+		return StatusFailed, nil, nil
+	}
+	if r.Consumed != 0 {
+		return StatusFailed, r, nil
+	}
+
+	bit := sideBit(side)
+	if bit == 0 {
+		m.incrFailLocked(nameplate)
+		return StatusFailed, r, nil
+	}
+
+	newMask := r.ClaimedMask | bit
+	if newMask == r.ClaimedMask {
+		if r.canResume(bit, ip, now) {
+			return r.status(), r, nil
+		}
+		m.incrFailLocked(nameplate)
+		return StatusFailed, r, nil
+	}
+	r.ClaimedMask = newMask
+	r.LastIP = sql.NullString{String: ip, Valid: true}
+	at := now.UTC().Unix()
+	if bit == 1 {
+		r.HostClaimedAt = sql.NullInt64{Int64: at, Valid: true}
+		r.HostIP = r.LastIP
+	} else {
+		r.ConnectClaimedAt = sql.NullInt64{Int64: at, Valid: true}
+		r.ConnectIP = r.LastIP
+	}
+	if newMask == 3 {
+		d := m.daily[statsDay(now)]
+		d.pairs++
+		d.pairSeconds += pairSeconds(r, at)
+		m.daily[statsDay(now)] = d
+	}
+	m.rows[nameplate] = *r
+	return r.status(), r, nil
+}
+
+// Consume 将密码牌标记为已消耗
+func (m *MemoryStore) Consume(nameplate string) error {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	if err := m.injected("Consume"); err != nil {
+		return err
+	}
+	if r, ok := m.rows[nameplate]; ok {
+		if r.Consumed == 0 {
+			r.ConsumedAt = sql.NullInt64{Int64: time.Now().UTC().Unix(), Valid: true}
+		}
+		r.Consumed = 1
+		m.rows[nameplate] = r
+	}
+	return nil
+}
+
+// CleanupExpired 清理已过期或已消耗的密码牌记录，语义与 ControlDB.CleanupExpired 相同
+func (m *MemoryStore) CleanupExpired(now time.Time, grace time.Duration) (int64, error) {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	if err := m.injected("CleanupExpired"); err != nil {
+		return 0, err
+	}
+	var n int64
+	g, unix := int64(grace/time.Second), now.UTC().Unix()
+	for k, r := range m.rows {
+		if r.CreatedAt+r.TTLSeconds+g < unix || (r.Consumed == 1 && r.ConsumedAt.Int64+g <= unix) {
+			delete(m.rows, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Stats 汇总匿名的使用统计，语义与 ControlDB.Stats 相同
+func (m *MemoryStore) Stats(now time.Time) (*UsageStats, error) {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	if err := m.injected("Stats"); err != nil {
+		return nil, err
+	}
+	st := &UsageStats{Day: statsDay(now)}
+	d := m.daily[st.Day]
+	st.AllocationsToday, st.PairsToday = d.allocations, d.pairs
+	st.setAvgTimeToPair(d.pairSeconds)
+	for _, r := range m.rows {
+		if r.Consumed != 0 || r.CreatedAt+r.TTLSeconds < now.UTC().Unix() {
+			continue
+		}
+		st.ActiveNameplates++
+		if r.ClaimedMask == 3 {
+			st.PairedNotConsumed++
+		}
+	}
+	for k, t := range m.xfers {
+		if k.day == st.Day {
+			st.Transfers = append(st.Transfers, t)
+		}
+	}
+	sort.Slice(st.Transfers, func(i, j int) bool {
+		a, b := st.Transfers[i], st.Transfers[j]
+		return a.Direction < b.Direction || a.Direction == b.Direction && a.Path < b.Path
+	})
+	return st, nil
+}
+
+// RecordTransfer 把一次传输报告计入当天的汇总，语义与 ControlDB.RecordTransfer 相同
+func (m *MemoryStore) RecordTransfer(r models.TransferReport, now time.Time) error {
+	m.dataMu.Lock()
+	defer m.dataMu.Unlock()
+	if err := m.injected("RecordTransfer"); err != nil {
+		return err
+	}
+	k := memTransferKey{statsDay(now), r.Direction, r.Path}
+	t := m.xfers[k]
+	t.Direction, t.Path = r.Direction, r.Path
+	t.add(r)
+	m.xfers[k] = t
+	return nil
+}
+
+// Lock 获取分配锁
+func (m *MemoryStore) Lock() { m.mu.Lock() }
+
+// Unlock 释放分配锁
+func (m *MemoryStore) Unlock() { m.mu.Unlock() }
@@ -14,3 +14,39 @@ func LogRequests(next http.Handler) http.Handler {
 		log.Printf("%s %s %s %s", ClientIP(r), r.Method, r.URL.Path, time.Since(start))
 	})
 }
+
+// WithCORS 是一个 HTTP 中间件，为允许的来源添加 CORS 响应头，并直接应答 OPTIONS 预检请求
+// origins 为允许的来源列表，"*" 表示允许任意来源；列表为空时不添加任何 CORS 头
+func WithCORS(origins []string, next http.Handler) http.Handler {
+	allowAll := false
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		if o == "*" {
+			allowAll = true
+		}
+		allowed[o] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			switch {
+			case allowAll:
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			case allowed[origin]:
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			if allowAll || allowed[origin] {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+		}
+		// 预检请求不进入业务处理器，也不计入频率限制
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", "GET, POST, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration 是一个表结构变更步骤，按 version 从小到大执行，每个步骤只会成功执行一次
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *sql.Tx) error
+}
+
+// migrations 是控制面数据库的全部迁移步骤。只能在末尾追加新步骤，已发布的步骤不可修改。
+//
+// 引入版本表之前的数据库可能已经包含部分表和列，因此早期步骤都写成可重复执行的形式。
+var migrations = []migration{
+	{1, "create nameplates", execMigration(`
+CREATE TABLE IF NOT EXISTS nameplates(
+  nameplate TEXT PRIMARY KEY,
+  created_at INTEGER NOT NULL,
+  ttl_seconds INTEGER NOT NULL,
+  claimed_mask INTEGER NOT NULL DEFAULT 0,
+  consumed INTEGER NOT NULL DEFAULT 0,
+  fail_count INTEGER NOT NULL DEFAULT 0,
+  last_ip TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_nameplates_created ON nameplates(created_at);
+`)},
+	{2, "per-side claim timestamps", func(tx *sql.Tx) error {
+		return addMissingColumns(tx, "nameplates", []struct{ name, ddl string }{
+			{"host_claimed_at", "INTEGER DEFAULT NULL"},
+			{"connect_claimed_at", "INTEGER DEFAULT NULL"},
+		})
+	}},
+	{3, "daily usage counters", execMigration(`
+CREATE TABLE IF NOT EXISTS usage_daily(
+  day TEXT PRIMARY KEY,
+  allocations INTEGER NOT NULL DEFAULT 0,
+  pairs INTEGER NOT NULL DEFAULT 0,
+  pair_seconds INTEGER NOT NULL DEFAULT 0
+);
+`)},
+	{4, "per-side claim IPs", func(tx *sql.Tx) error {
+		return addMissingColumns(tx, "nameplates", []struct{ name, ddl string }{
+			{"host_ip", "TEXT DEFAULT NULL"},
+			{"connect_ip", "TEXT DEFAULT NULL"},
+		})
+	}},
+	{5, "consumed timestamp", func(tx *sql.Tx) error {
+		return addMissingColumns(tx, "nameplates", []struct{ name, ddl string }{
+			{"consumed_at", "INTEGER DEFAULT NULL"},
+		})
+	}},
+	{6, "daily transfer reports", execMigration(`
+CREATE TABLE IF NOT EXISTS transfer_daily(
+  day TEXT NOT NULL,
+  direction TEXT NOT NULL,
+  path TEXT NOT NULL,
+  reports INTEGER NOT NULL DEFAULT 0,
+  failed_reports INTEGER NOT NULL DEFAULT 0,
+  files INTEGER NOT NULL DEFAULT 0,
+  failed_files INTEGER NOT NULL DEFAULT 0,
+  bytes INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY(day, direction, path)
+);
+`)},
+}
+
+// SchemaVersion 是 migrations 中最新的版本号
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// execMigration 返回执行一段固定 SQL 的迁移步骤
+func execMigration(stmts string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(stmts)
+		return err
+	}
+}
+
+// migrate 创建 schema_version 表，并在各自的事务中依次执行版本号大于当前版本的迁移步骤。
+// 某一步失败时该步骤整体回滚，数据库停留在上一个版本。
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version(
+  version INTEGER PRIMARY KEY,
+  applied_at INTEGER NOT NULL
+)`); err != nil {
+		return err
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > SchemaVersion {
+		return fmt.Errorf("database schema v%d is newer than this server (v%d)", current, SchemaVersion)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.apply(tx); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("v%d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version(version, applied_at) VALUES(?, ?)`, m.version, time.Now().UTC().Unix()); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("v%d (%s): %w", m.version, m.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("v%d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// schemaVersion 返回已应用的最大迁移版本号，全新数据库返回 0
+func schemaVersion(db *sql.DB) (int, error) {
+	var v int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&v)
+	return v, err
+}
+
+// addMissingColumns 为 table 补齐缺少的列，已存在的列保持不变
+func addMissingColumns(tx *sql.Tx, table string, cols []struct{ name, ddl string }) error {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range cols {
+		if have[c.name] {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, c.name, c.ddl)); err != nil {
+			return fmt.Errorf("add column %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
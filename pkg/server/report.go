@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReportTokenTTL 是报告令牌的有效期，一次会话中的传输通常在此之内结束
+const ReportTokenTTL = 24 * time.Hour
+
+// 核验报告令牌的错误
+var (
+	ErrReportTokenInvalid = errors.New("missing, invalid or expired report token")
+	ErrReportTokenUsed    = errors.New("this session has already reported")
+)
+
+// ReportTokens 签发与核验 /v1/report 的令牌。令牌在分配 (host) 或认领成功 (connect) 时随响应下发，
+// 绑定密码牌与侧，以每次启动随机生成的 HMAC 密钥签名，因此无需存储，也无法伪造；
+// 没有拿到过密码牌的人不能报告，每个令牌 (即每次会话的每一侧) 也只计入一次统计。
+// 令牌只在签发它的实例上、在重启之前有效。
+type ReportTokens struct {
+	mu   sync.Mutex
+	key  []byte
+	used map[string]time.Time // 已计入统计的令牌及其过期时间
+}
+
+// NewReportTokens 创建一个使用随机密钥的令牌签发器
+func NewReportTokens() *ReportTokens {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key) // crypto/rand.Read 不会返回错误
+	return &ReportTokens{key: key, used: make(map[string]time.Time)}
+}
+
+func (rt *ReportTokens) mac(nameplate, side string, issued int64) string {
+	m := hmac.New(sha256.New, rt.key)
+	fmt.Fprintf(m, "%s|%s|%d", side, nameplate, issued)
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// Issue 为密码牌的一侧签发报告令牌；rt 为 nil 时返回空串 (不下发令牌)。
+func (rt *ReportTokens) Issue(nameplate, side string, now time.Time) string {
+	if rt == nil {
+		return ""
+	}
+	issued := now.UTC().Unix()
+	return fmt.Sprintf("%s.%s.%d.%s", side, nameplate, issued, rt.mac(nameplate, side, issued))
+}
+
+// Redeem 核验令牌并将其标记为已使用。令牌无效或过期时返回 ErrReportTokenInvalid，
+// 已被使用过时返回 ErrReportTokenUsed；rt 为 nil 时所有令牌都无效。
+func (rt *ReportTokens) Redeem(token string, now time.Time) error {
+	if rt == nil {
+		return ErrReportTokenInvalid
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return ErrReportTokenInvalid
+	}
+	issued, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || !hmac.Equal([]byte(parts[3]), []byte(rt.mac(parts[1], parts[0], issued))) {
+		return ErrReportTokenInvalid
+	}
+	expires := time.Unix(issued, 0).Add(ReportTokenTTL)
+	if !now.Before(expires) {
+		return ErrReportTokenInvalid
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for k, exp := range rt.used {
+		if !now.Before(exp) {
+			delete(rt.used, k)
+		}
+	}
+	if _, ok := rt.used[token]; ok {
+		return ErrReportTokenUsed
+	}
+	rt.used[token] = expires
+	return nil
+}
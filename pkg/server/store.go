@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Metaphorme/wormhole/pkg/models"
+)
+
+// Store 定义了控制面所需的密码牌存储操作
+// 生产环境使用基于 SQLite 的 ControlDB，测试中可以使用 MemoryStore 替代
+type Store interface {
+	InsertNew(nameplate string, ttl time.Duration, now time.Time, ip string) error
+	Load(nameplate string) (*NameplateRow, error)
+	IncrFail(nameplate string) error
+	Delete(nameplate string) error
+	FailAndConsume(nameplate string) error
+	Claim(nameplate, side string, now time.Time, ip string) (PlateStatus, *NameplateRow, error)
+	Consume(nameplate string) error
+	CleanupExpired(now time.Time, grace time.Duration) (int64, error)
+	// Lock/Unlock 用于在分配密码牌时串行化“检查-插入”过程
+	Lock()
+	Unlock()
+	// Ping 检查存储是否可用，用于就绪探针
+	Ping(ctx context.Context) error
+	// RecordTransfer 把客户端报告的一次传输结果计入当天的传输统计
+	RecordTransfer(r models.TransferReport, now time.Time) error
+	// Stats 返回匿名的使用统计，供 /admin/stats 使用
+	Stats(now time.Time) (*UsageStats, error)
+	Close() error
+}
+
+// UsageStats 是不含任何客户端信息（IP、密码牌）的聚合统计
+type UsageStats struct {
+	Day                  string  `json:"day"`                      // 统计所属日期 (UTC, YYYY-MM-DD)
+	AllocationsToday     int64   `json:"allocations_today"`        // 当天分配的密码牌数量
+	PairsToday           int64   `json:"pairs_today"`              // 当天完成配对（两侧都已认领）的次数
+	AvgTimeToPairSeconds float64 `json:"avg_time_to_pair_seconds"` // 当天从分配到配对的平均耗时，单位秒
+	ActiveNameplates     int64   `json:"active_nameplates"`        // 当前未过期且未消耗的密码牌数量
+	PairedNotConsumed    int64   `json:"paired_not_consumed"`      // 已配对但尚未报告消耗的密码牌数量
+
+	Transfers []TransferStats `json:"transfers,omitempty"` // 当天客户端报告的传输结果，按方向与路径分组
+}
+
+// TransferStats 是当天某一方向、某一路径类型的传输报告汇总
+type TransferStats struct {
+	Direction     string `json:"direction"`
+	Path          string `json:"path"`
+	Reports       int64  `json:"reports"`        // 收到的报告数
+	FailedReports int64  `json:"failed_reports"` // 未完整结束或有失败文件的报告数
+	Files         int64  `json:"files"`
+	FailedFiles   int64  `json:"failed_files"`
+	Bytes         int64  `json:"bytes"`
+}
+
+// add 把一份报告计入汇总
+func (t *TransferStats) add(r models.TransferReport) {
+	t.Reports++
+	if !r.OK {
+		t.FailedReports++
+	}
+	t.Files += int64(r.Files)
+	t.FailedFiles += int64(r.FailedFiles)
+	t.Bytes += r.Bytes
+}
+
+// ValidTransferReport 检查报告的取值范围，拒绝明显伪造或损坏的数据
+func ValidTransferReport(r models.TransferReport) error {
+	if r.Direction != models.ReportSend && r.Direction != models.ReportRecv {
+		return fmt.Errorf("direction must be %q or %q", models.ReportSend, models.ReportRecv)
+	}
+	if r.Path != models.ReportPathDirect && r.Path != models.ReportPathRelay {
+		return fmt.Errorf("path must be %q or %q", models.ReportPathDirect, models.ReportPathRelay)
+	}
+	if r.Files < 0 || r.FailedFiles < 0 || r.Bytes < 0 {
+		return fmt.Errorf("counts must not be negative")
+	}
+	return nil
+}
+
+// setAvgTimeToPair 根据当天累计的配对耗时计算平均值
+func (s *UsageStats) setAvgTimeToPair(totalSeconds int64) {
+	if s.PairsToday > 0 {
+		s.AvgTimeToPairSeconds = float64(totalSeconds) / float64(s.PairsToday)
+	}
+}
+
+// pairSeconds 返回从分配到 at 时刻配对完成的耗时，时钟回拨时按 0 计
+func pairSeconds(r *NameplateRow, at int64) int64 {
+	if d := at - r.CreatedAt; d > 0 {
+		return d
+	}
+	return 0
+}
+
+var (
+	_ Store = (*ControlDB)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
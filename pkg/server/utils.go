@@ -11,6 +11,9 @@ import (
 
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"github.com/Metaphorme/wormhole/pkg/models"
 )
 
 // ClientIP 从 HTTP 请求中提取客户端的真实 IP 地址
@@ -43,19 +46,28 @@ func SplitCSV(s string) []string {
 	return out
 }
 
-// AllocateNameplate 生成一个新的、未被占用的密码牌
+// AllocateNameplate 生成一个新的、未被占用的纯数字密码牌
 // 它会尝试最多1000次来避免随机数碰撞
-func AllocateNameplate(db *ControlDB, digits int, ttl time.Duration, now time.Time, ip string) (string, time.Time, error) {
-	max := big.NewInt(1)
-	for i := 0; i < digits; i++ {
-		max.Mul(max, big.NewInt(10))
+func AllocateNameplate(db Store, digits int, ttl time.Duration, now time.Time, ip string) (string, time.Time, error) {
+	return AllocateNameplateFrom(db, models.NameplateAlphabets[models.NameplateCharsetDigits], digits, ttl, now, ip)
+}
+
+// AllocateNameplateFrom 从给定字母表中随机生成长度为 length 的密码牌并写入存储
+func AllocateNameplateFrom(db Store, alphabet string, length int, ttl time.Duration, now time.Time, ip string) (string, time.Time, error) {
+	if alphabet == "" || length <= 0 {
+		return "", time.Time{}, fmt.Errorf("invalid nameplate alphabet/length")
 	}
+	max := big.NewInt(int64(len(alphabet)))
 	db.Lock()
 	defer db.Unlock()
 
+	buf := make([]byte, length)
 	for tries := 0; tries < 1000; tries++ {
-		nBig, _ := rand.Int(rand.Reader, max)
-		code := fmt.Sprintf("%0*d", digits, nBig.Int64())
+		for i := range buf {
+			nBig, _ := rand.Int(rand.Reader, max)
+			buf[i] = alphabet[nBig.Int64()]
+		}
+		code := string(buf)
 		// 检查生成的 code 是否已被占用且未过期
 		row, err := db.Load(code)
 		if err == nil && !row.Expired(now) && row.Consumed == 0 {
@@ -117,3 +129,47 @@ func RelayAddrsWithCircuit(base []string) []string {
 	}
 	return out
 }
+
+// ParseRelayAddrs 解析 -relays 给出的外部中继节点地址，返回带 /p2p-circuit 后缀的地址，
+// 可直接放入响应的 Relay 地址列表。每个地址必须以 /p2p/<PeerID> 标明中继节点
+// (可以已经带有 /p2p-circuit 后缀)，不能是经中继到达其他节点的地址。重复的地址只保留一个。
+func ParseRelayAddrs(csv string) ([]string, error) {
+	var out []string
+	seen := make(map[string]bool)
+	for _, s := range SplitCSV(csv) {
+		base := strings.TrimSuffix(s, "/p2p-circuit")
+		if strings.Contains(base, "/p2p-circuit") {
+			return nil, fmt.Errorf("%q: must name the relay itself, not a peer behind it", s)
+		}
+		m, err := ma.NewMultiaddr(base)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", s, err)
+		}
+		ai, err := peer.AddrInfoFromP2pAddr(m)
+		if err != nil || len(ai.Addrs) == 0 {
+			return nil, fmt.Errorf("%q: want <transport addr>/p2p/<relay peer id>", s)
+		}
+		a := m.String() + "/p2p-circuit"
+		if !seen[a] {
+			seen[a] = true
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+// MergeRelayAddrs 把外部中继地址追加到本服务器自身的中继地址之后，去掉重复项
+func MergeRelayAddrs(own, extra []string) []string {
+	out := append([]string(nil), own...)
+	seen := make(map[string]bool, len(own))
+	for _, a := range own {
+		seen[a] = true
+	}
+	for _, a := range extra {
+		if !seen[a] {
+			seen[a] = true
+			out = append(out, a)
+		}
+	}
+	return out
+}
@@ -3,6 +3,7 @@ package session
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -23,6 +24,7 @@ const (
 )
 
 // WriteFrame 写入一个简单的帧（类型 + 内容）
+// 帧头为 5 字节大端长度，与 pkg/transfer 互通，但与 cmd/wormhole 中 XFER 协议的 9 字节小端帧头不兼容。
 func WriteFrame(s network.Stream, typ byte, payload []byte) error {
 	hdr := make([]byte, 5)
 	hdr[0] = typ
@@ -43,6 +45,13 @@ func WriteFrame(s network.Stream, typ byte, payload []byte) error {
 	return nil
 }
 
+// MaxFrameSize 是 PAKE 帧内容的上限。SPAKE2 消息与确认标签都只有几十字节，
+// 更大的帧头只可能来自异常或恶意的对端，直接拒绝而不为其分配内存
+const MaxFrameSize = 64 * 1024
+
+// FrameReadTimeout 是读取一个帧内容的最长时间，防止对端声明长度后迟迟不发送数据
+var FrameReadTimeout = 30 * time.Second
+
 // ReadFrame 读取一个帧
 func ReadFrame(s network.Stream) (byte, []byte, error) {
 	hdr := make([]byte, 5)
@@ -54,9 +63,13 @@ func ReadFrame(s network.Stream) (byte, []byte, error) {
 	if length == 0 {
 		return typ, nil, nil
 	}
-	if length > 64*1024*1024 {
+	if length > MaxFrameSize {
 		return 0, nil, fmt.Errorf("frame too large")
 	}
+	if FrameReadTimeout > 0 {
+		_ = s.SetReadDeadline(time.Now().Add(FrameReadTimeout))
+		defer s.SetReadDeadline(time.Time{})
+	}
 	payload := make([]byte, length)
 	if _, err := io.ReadFull(s, payload); err != nil {
 		return 0, nil, err
@@ -64,9 +77,20 @@ func ReadFrame(s network.Stream) (byte, []byte, error) {
 	return typ, payload, nil
 }
 
+// ErrKeyConfirm 表示密钥确认失败：双方的口令不一致 (输错代码或遭到中间人攻击)。
+// 本方校验失败或收到对端的 FramePakeAbort 时返回包装了它的错误，
+// 调用方可以用 errors.Is 将其与流中断等传输错误区分开。
+var ErrKeyConfirm = errors.New("pake: key-confirm failed")
+
 // RunPAKEAndConfirm 执行 SPAKE2 密钥协商和密钥确认流程
+// 派生所用的标签由 proto 中的协议版本选择 (见 crypto.LabelsFor)，未知版本在发出任何帧之前
+// 返回包装了 crypto.ErrUnsupportedVersion 的错误；两端版本不一致时确认 MAC 不同，返回 ErrKeyConfirm。
 func RunPAKEAndConfirm(ctx context.Context, s network.Stream, roleA bool, passphrase, nameplate string, proto protocol.ID, local, remote peer.ID) ([]byte, error) {
-	pakeState := crypto.NewPAKEState(roleA, passphrase, nameplate, proto, local, remote)
+	labels, err := crypto.LabelsFor(proto)
+	if err != nil {
+		return nil, fmt.Errorf("pake: %w", err)
+	}
+	pakeState := crypto.NewPAKEStateWithLabels(labels, roleA, passphrase, nameplate, proto, local, remote)
 	my := pakeState.Start()
 
 	if roleA {
@@ -87,12 +111,15 @@ func RunPAKEAndConfirm(ctx context.Context, s network.Stream, roleA bool, passph
 			return nil, err
 		}
 		typ, tagB, err := ReadFrame(s)
+		if err == nil && typ == FramePakeAbort {
+			return nil, fmt.Errorf("%w: peer rejected our confirmation", ErrKeyConfirm)
+		}
 		if err != nil || typ != FramePakeConfirm {
 			return nil, fmt.Errorf("pake: no cB")
 		}
 		if !pakeState.VerifyConfirmTag(K, "B", tagB) {
 			_ = WriteFrame(s, FramePakeAbort, nil)
-			return nil, fmt.Errorf("pake: key-confirm failed (cB)")
+			return nil, fmt.Errorf("%w (cB)", ErrKeyConfirm)
 		}
 		return K, nil
 	} else {
@@ -109,12 +136,15 @@ func RunPAKEAndConfirm(ctx context.Context, s network.Stream, roleA bool, passph
 			return nil, err
 		}
 		typ, tagA, err := ReadFrame(s)
+		if err == nil && typ == FramePakeAbort {
+			return nil, fmt.Errorf("%w: peer aborted", ErrKeyConfirm)
+		}
 		if err != nil || typ != FramePakeConfirm {
 			return nil, fmt.Errorf("pake: no cA")
 		}
 		if !pakeState.VerifyConfirmTag(K, "A", tagA) {
 			_ = WriteFrame(s, FramePakeAbort, nil)
-			return nil, fmt.Errorf("pake: key-confirm failed (cA)")
+			return nil, fmt.Errorf("%w (cA)", ErrKeyConfirm)
 		}
 		tagB := pakeState.ComputeConfirmTag(K, "B")
 		if err := WriteFrame(s, FramePakeConfirm, tagB); err != nil {
@@ -136,9 +166,15 @@ func ReadLineWithDeadline(rw *bufio.ReadWriter, s network.Stream, d time.Duratio
 func HelpText() string {
 	return `Commands:
 /peer                  show peer id & current path
+/whoami                show our peer id, addresses, relay reservation & reachability
 /send -f <file>        send a file
+/send -f <file> -to <path>  send a file, suggesting where the peer saves it
+/send -u <url>         fetch a URL and stream it to the peer as a file
 /send -d <dir>         send a directory recursively
-/bye                   close the chat`
+/send -d <dir> --dry-run  list the files that would be sent, without sending
+/resend                retry only the files that failed in the last /send
+/outdir [<dir>]        show or change where incoming files are saved
+/bye                   close the chat (waits for transfers; again to cancel them)`
 }
 
 // PostConsumeAsync 异步向控制服务器报告会话成功
@@ -0,0 +1,190 @@
+package transfer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PartSuffix 是接收中文件的临时后缀，校验通过后才会重命名为最终文件名。
+const PartSuffix = ".part"
+
+// ArchiveWriter 将接收到的文件依次写入单个 tar 或 zip 归档。
+// 归档先写入 path + PartSuffix，Close 成功后才重命名为 path。
+type ArchiveWriter struct {
+	path string
+	f    *os.File
+	tw   *tar.Writer
+	zw   *zip.Writer
+}
+
+// NewArchiveWriter 创建 format ("tar" 或 "zip") 格式的归档；不会覆盖已存在的文件。
+func NewArchiveWriter(format, path string) (*ArchiveWriter, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("archive %s already exists", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path + PartSuffix)
+	if err != nil {
+		return nil, err
+	}
+	a := &ArchiveWriter{path: path, f: f}
+	switch format {
+	case "tar":
+		a.tw = tar.NewWriter(f)
+	case "zip":
+		a.zw = zip.NewWriter(f)
+	default:
+		_ = f.Close()
+		_ = os.Remove(path + PartSuffix)
+		return nil, fmt.Errorf("unknown archive format %q", format)
+	}
+	return a, nil
+}
+
+// Path 返回归档完成后的最终路径
+func (a *ArchiveWriter) Path() string { return a.path }
+
+// Add 以相对路径 name 写入一个大小为 size 的文件。
+func (a *ArchiveWriter) Add(name string, size int64, r io.Reader) error {
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("unsafe archive entry %q", name)
+	}
+	name = filepath.ToSlash(name)
+	now := time.Now()
+	var w io.Writer
+	if a.tw != nil {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0o644, ModTime: now}
+		if err := a.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		w = a.tw
+	} else {
+		zf, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		w = zf
+	}
+	_, err := io.CopyN(w, r, size)
+	return err
+}
+
+// Close 写入归档结尾并将其重命名为最终文件名。
+func (a *ArchiveWriter) Close() error {
+	var err error
+	if a.tw != nil {
+		err = a.tw.Close()
+	} else {
+		err = a.zw.Close()
+	}
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(a.f.Name())
+		return err
+	}
+	return os.Rename(a.f.Name(), a.path)
+}
+
+// Abort 放弃未完成的归档。
+func (a *ArchiveWriter) Abort() {
+	_ = a.f.Close()
+	_ = os.Remove(a.f.Name())
+}
+
+// WriteTarDir 将 root 下的普通文件按相对路径写成 tar 流；skip 用于应用排除规则。
+func WriteTarDir(w io.Writer, root string, skip func(p string, d fs.DirEntry) (bool, error)) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if s, se := skip(p, d); s {
+			return se
+		}
+		if d.IsDir() {
+			return nil
+		}
+		st, err := os.Stat(p)
+		if err != nil || !st.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: filepath.ToSlash(rel), Size: st.Size(), Mode: int64(st.Mode().Perm()), ModTime: st.ModTime()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, f, st.Size())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// UnpackTar 将已校验的 tar 临时文件 part 解包到 baseDir，或在 arc 非空时转存进归档，
+// 完成后删除 part。tar 中不安全的路径会导致整体失败。
+func UnpackTar(part, baseDir string, arc *ArchiveWriter) error {
+	defer os.Remove(part)
+	f, err := os.Open(part)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("unsafe archive entry %q", hdr.Name)
+		}
+		if arc != nil {
+			if err := arc.Add(name, hdr.Size, tr); err != nil {
+				return err
+			}
+			continue
+		}
+		dst := filepath.Join(baseDir, name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		out, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package transfer
+
+import (
+	"fmt"
+	"strings"
+
+	xxh3 "github.com/zeebo/xxh3"
+)
+
+// BlockHasher 按 size 切分写入的数据，每满一块 (以及 Flush 时的最后一个不完整块)
+// 以该块的 xxh3-128 哈希调用 onBlock；onBlock 返回的错误会从 Write 返回。
+type BlockHasher struct {
+	size    int64
+	h       *xxh3.Hasher
+	filled  int64
+	n       int
+	onBlock func(i int, sum string) error
+}
+
+// NewBlockHasher 创建以 seed 为种子、块大小为 size 的 BlockHasher
+func NewBlockHasher(seed uint64, size int64, onBlock func(i int, sum string) error) *BlockHasher {
+	return &BlockHasher{size: size, h: xxh3.NewSeed(seed), onBlock: onBlock}
+}
+
+func (b *BlockHasher) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := min(int64(len(p)), b.size-b.filled)
+		_, _ = b.h.Write(p[:n])
+		b.filled += n
+		p = p[n:]
+		if b.filled == b.size {
+			if err := b.emit(); err != nil {
+				return total - len(p), err
+			}
+		}
+	}
+	return total, nil
+}
+
+// Blocks 返回已结束 (已调用 onBlock) 的块数
+func (b *BlockHasher) Blocks() int { return b.n }
+
+// Flush 结束最后一个不完整的块。
+func (b *BlockHasher) Flush() error {
+	if b.filled == 0 {
+		return nil
+	}
+	return b.emit()
+}
+
+func (b *BlockHasher) emit() error {
+	sum := b.h.Sum128().Bytes()
+	i := b.n
+	b.n++
+	b.h.Reset()
+	b.filled = 0
+	return b.onBlock(i, fmt.Sprintf("%x", sum[:]))
+}
+
+// ExpectBlocks 返回逐块比对 want 的 BlockHasher，块数超出或哈希不符时返回错误。
+func ExpectBlocks(seed uint64, size int64, want []string) *BlockHasher {
+	return NewBlockHasher(seed, size, func(i int, sum string) error {
+		if i >= len(want) {
+			return fmt.Errorf("block %d beyond the %d announced", i, len(want))
+		}
+		if sum != strings.ToLower(want[i]) {
+			return fmt.Errorf("block %d hash mismatch", i)
+		}
+		return nil
+	})
+}
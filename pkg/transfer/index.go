@@ -0,0 +1,69 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DownloadIndexName 是保存目录下记录已接收文件的索引，JSON Lines 格式，每行一条 DownloadRecord。
+const DownloadIndexName = ".wormhole-downloads.jsonl"
+
+// DownloadRecord 是下载索引中的一条记录。
+type DownloadRecord struct {
+	Time time.Time `json:"time"`
+	Peer string    `json:"peer"` // 发送方 PeerID
+	Path string    `json:"path"` // 相对保存目录的路径 ("/" 分隔)；写入归档时为 "<归档>/<文件>"
+	Size int64     `json:"size"`
+	Algo string    `json:"algo"` // 哈希算法；xxh3-128-seed 的种子由会话密钥派生，只用于本次传输的校验
+	Hash string    `json:"hash"`
+}
+
+// downloadIndexMu 串行化同一进程内并行传输对索引的追加。每条记录以单次 O_APPEND 写入，
+// 多个进程共用同一保存目录时也不会交错。
+var downloadIndexMu sync.Mutex
+
+// AppendDownloadRecord 向 outDir 下的索引追加一条记录，索引文件仅对当前用户可读写。
+func AppendDownloadRecord(outDir string, rec DownloadRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	downloadIndexMu.Lock()
+	defer downloadIndexMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(outDir, DownloadIndexName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadDownloadIndex 读取 outDir 下的索引；索引不存在时返回空列表。
+// 无法解析的行 (如写入中途断电留下的半行) 会被跳过。
+func ReadDownloadIndex(outDir string) ([]DownloadRecord, error) {
+	f, err := os.Open(filepath.Join(outDir, DownloadIndexName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var recs []DownloadRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec DownloadRecord
+		if json.Unmarshal(sc.Bytes(), &rec) == nil {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, sc.Err()
+}
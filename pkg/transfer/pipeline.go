@@ -0,0 +1,59 @@
+package transfer
+
+import "sync/atomic"
+
+// Pipeline 依次写出 feed 产生的条目，最多 window 个条目处于等待回复的状态。
+// 对端严格按收到的顺序逐个回复，因此 reply 总是在后台协程中按写出顺序、每个条目调用一次。
+//
+// write 返回 (false, nil) 表示跳过该条目 (如文件已无法打开)；返回错误时停止写出。
+// reply 返回 stop 为 true 时不再写出新的条目，已写出的条目仍会收到回复；返回错误时
+// 其余条目的回复不再读取。feed 的 send 返回 false 表示应停止产生条目。
+// 回复出错时返回该错误，否则返回写出时的错误。
+func Pipeline[T any](window int, feed func(send func(T) bool), write func(T) (bool, error), reply func(T) (stop bool, err error)) error {
+	inflight := make(chan T, window)     // 按写出顺序排列的待回复条目
+	slots := make(chan struct{}, window) // 待回复条目数的上限
+	var stop atomic.Bool                 // 对端已无法继续接收，或回复流已中断
+	var readErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for it := range inflight {
+			if readErr == nil {
+				s, err := reply(it)
+				if err != nil {
+					readErr = err
+				}
+				if s || err != nil {
+					stop.Store(true)
+				}
+			}
+			<-slots
+		}
+	}()
+
+	var writeErr error
+	feed(func(it T) bool {
+		if stop.Load() {
+			return false
+		}
+		slots <- struct{}{}
+		ok, err := write(it)
+		if err != nil {
+			writeErr = err
+			<-slots
+			return false
+		}
+		if !ok {
+			<-slots
+			return true
+		}
+		inflight <- it
+		return true
+	})
+	close(inflight)
+	<-done
+	if readErr != nil {
+		return readErr
+	}
+	return writeErr
+}
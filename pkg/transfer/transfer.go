@@ -8,6 +8,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/Metaphorme/wormhole/pkg/ui"
@@ -42,6 +44,7 @@ type XferOffer struct {
 }
 
 // WriteFrame 写入一个带类型和长度前缀的帧
+// 帧头为 5 字节大端长度，与 cmd/wormhole 中 XFER 协议的 9 字节小端帧头不兼容 (见 TestFrameCodecs_Matrix)。
 func WriteFrame(w io.Writer, typ byte, payload []byte) error {
 	hdr := [5]byte{typ}
 	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
@@ -70,13 +73,64 @@ func ReadFrame(r io.Reader) (byte, []byte, error) {
 	if length > 512*1024*1024 {
 		return 0, nil, fmt.Errorf("frame too large")
 	}
-	payload := make([]byte, length)
-	if _, err := io.ReadFull(r, payload); err != nil {
+	payload, err := ReadBody(r, int(length), nil)
+	if err != nil {
 		return 0, nil, err
 	}
 	return typ, payload, nil
 }
 
+// FrameIdleTimeout 是读取帧内容时两段数据之间允许的最长间隔，0 表示不设读超时
+var FrameIdleTimeout = 30 * time.Second
+
+// readBodyStep 是 ReadBody 每次读取并扩容的字节数
+const readBodyStep = 64 * 1024
+
+// ReadBody 读取 n 字节的帧内容。buf 容量足够时直接读入 buf，否则内存随实际收到的数据逐段增长，
+// 而不是按帧头声明的长度一次性分配；r 支持 SetReadDeadline (如 network.Stream) 时，
+// 每段数据须在 FrameIdleTimeout 内到达，声明超大帧后缓慢发送的对端无法无限期占用内存与协程。
+func ReadBody(r io.Reader, n int, buf []byte) ([]byte, error) {
+	dl, _ := r.(interface{ SetReadDeadline(time.Time) error })
+	if FrameIdleTimeout <= 0 {
+		dl = nil
+	}
+	if dl != nil {
+		defer dl.SetReadDeadline(time.Time{})
+	}
+	if cap(buf) < n {
+		buf = make([]byte, 0, min(n, readBodyStep))
+	}
+	buf = buf[:0]
+	for len(buf) < n {
+		k := min(readBodyStep, n-len(buf))
+		buf = slices.Grow(buf, k)
+		if dl != nil {
+			_ = dl.SetReadDeadline(time.Now().Add(FrameIdleTimeout))
+		}
+		m, err := io.ReadFull(r, buf[len(buf):len(buf)+k])
+		buf = buf[:len(buf)+m]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// EwmaAge 根据传输总大小返回进度条速度/ETA 的 EWMA 窗口。小文件用较短的窗口使读数
+// 及时反映速度变化，大文件 (通常耗时较长，且经中继时速度抖动明显) 用较长的窗口使读数更稳定。
+func EwmaAge(total int64) float64 {
+	switch {
+	case total <= 64<<20:
+		return 15
+	case total <= 1<<30:
+		return 30
+	case total <= 16<<30:
+		return 60
+	default:
+		return 90
+	}
+}
+
 // NewFileBar 创建文件进度条
 func NewFileBar(p *mpb.Progress, name string, total int64) *mpb.Bar {
 	return p.AddBar(total,
@@ -86,7 +140,7 @@ func NewFileBar(p *mpb.Progress, name string, total int64) *mpb.Bar {
 		mpb.AppendDecorators(
 			decor.CountersKibiByte("% .2f / % .2f"),
 			decor.Percentage(decor.WCSyncSpace),
-			decor.EwmaSpeed(decor.SizeB1024(0), "% .2f", 60, decor.WCSyncSpace),
+			decor.EwmaSpeed(decor.SizeB1024(0), "% .2f", EwmaAge(total), decor.WCSyncSpace),
 		),
 	)
 }
@@ -100,7 +154,7 @@ func NewTotalBar(p *mpb.Progress, total int64) *mpb.Bar {
 		mpb.AppendDecorators(
 			decor.CountersKibiByte("% .2f / % .2f"),
 			decor.Percentage(decor.WCSyncSpace),
-			decor.EwmaSpeed(decor.SizeB1024(0), "% .2f", 60, decor.WCSyncSpace),
+			decor.EwmaSpeed(decor.SizeB1024(0), "% .2f", EwmaAge(total), decor.WCSyncSpace),
 		),
 	)
 }
@@ -119,7 +173,9 @@ func SendXfer(ctx context.Context, h host.Host, remote peer.ID, kind, arg string
 	return fmt.Errorf("not implemented yet")
 }
 
-// HandleIncomingXfer 处理接收文件或目录的逻辑
+// HandleIncomingXfer 处理接收文件或目录的逻辑。
+// 每次调用的状态 (包括 failedFiles) 都是局部的，可以并发调用；console 与 askYesNo
+// 由调用方共享，多个传输同时进行时调用方应自行串行化，以免进度条与提示交错。
 func HandleIncomingXfer(ctx context.Context, h host.Host, xs network.Stream, outDir string, askYesNo func(q string, timeout time.Duration) bool, console *ui.Console, seed uint64) {
 	defer xs.Close()
 	// 1. 读取传输提议
@@ -186,6 +242,7 @@ func HandleIncomingXfer(ctx context.Context, h host.Host, xs network.Stream, out
 			size, _ := hdr["size"].(float64)
 			_, _ = hdr["algo"].(string) // algo 暂时不使用
 			expectHash, _ = hdr["hash"].(string)
+			expectHash = strings.ToLower(strings.TrimSpace(expectHash))
 
 			dstPath = filepath.Join(outDir, name)
 			if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
@@ -229,11 +286,13 @@ func HandleIncomingXfer(ctx context.Context, h host.Host, xs network.Stream, out
 			lastTick = time.Now()
 
 		case FrameFileDone:
-			// 文件接收完成，进行校验
-			if fw != nil {
-				_ = fw.Close()
-				fw = nil
+			// 文件接收完成，进行校验。零字节文件没有 FrameChunk，此时校验的是空输入的哈希；
+			// 但没有文件头的 FrameFileDone 不对应任何文件，不能回复 ACK
+			if fw == nil {
+				return
 			}
+			_ = fw.Close()
+			fw = nil
 			if fileBar != nil {
 				fileBar.SetTotal(-1, true)
 			}
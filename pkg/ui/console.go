@@ -1,16 +1,20 @@
 package ui
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/chzyer/readline"
 	"github.com/libp2p/go-libp2p/core/peer"
 	ma "github.com/multiformats/go-multiaddr"
 
+	"github.com/Metaphorme/wormhole/pkg/crypto"
 	"github.com/Metaphorme/wormhole/pkg/p2p"
 )
 
@@ -32,15 +36,36 @@ const (
 	CYel  = "\x1b[33m"
 )
 
-// Console 是一个对 readline 库的封装，提供了线程安全的控制台 I/O 操作
+// Sanitize 将字符串中的控制字符（制表符除外）转义为可见的 \xNN 形式，
+// 防止对端通过 ANSI 转义序列移动光标、清屏或向终端注入内容
+func Sanitize(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\t' || !unicode.IsControl(r) {
+			b.WriteRune(r)
+			continue
+		}
+		fmt.Fprintf(&b, "\\x%02x", r)
+	}
+	return b.String()
+}
+
+// Console 是一个对 readline 库的封装，提供了线程安全的控制台 I/O 操作。
+// 标准输入不是终端时 rl 为 nil，改由 plain 逐行读写 (见 NewPlainConsole)。
 type Console struct {
 	rl            *readline.Instance
+	plain         *plainIO
 	mu            sync.Mutex
 	defaultPrompt string
+	quiet         bool // 为 true 时只输出必要的结果与错误，日志和提示性信息被丢弃
 }
 
-// NewConsole 创建一个新的控制台实例
+// NewConsole 创建一个新的控制台实例。标准输入不是终端时 (管道、脚本驱动、无 pty 的 ssh 执行)
+// readline 无法工作，此时返回逐行读取标准输入的非交互控制台。
 func NewConsole(prompt string) (*Console, error) {
+	if !readline.IsTerminal(int(os.Stdin.Fd())) {
+		return NewPlainConsole(os.Stdin, os.Stdout, os.Stderr, prompt), nil
+	}
 	rl, err := readline.New(prompt)
 	if err != nil {
 		return nil, err
@@ -53,13 +78,45 @@ func NewConsoleWithReadline(rl *readline.Instance, prompt string) *Console {
 	return &Console{rl: rl, defaultPrompt: prompt}
 }
 
+// NewPlainConsole 创建不依赖终端的控制台：从 in 逐行读取输入，消息直接写入 out/errOut。
+// 没有行编辑和常驻提示符；问题提示 (与默认提示符不同的提示符) 单独输出一行，便于脚本匹配。
+func NewPlainConsole(in io.Reader, out, errOut io.Writer, prompt string) *Console {
+	return &Console{plain: newPlainIO(in, out, errOut), defaultPrompt: prompt}
+}
+
 // Close 关闭控制台
-func (c *Console) Close() { _ = c.rl.Close() }
+func (c *Console) Close() {
+	if c.plain != nil {
+		c.plain.close()
+		return
+	}
+	_ = c.rl.Close()
+}
+
+// SetQuiet 开启或关闭安静模式：Logln/Logf/Infoln 不再输出，Println 与 Errorln 不受影响
+func (c *Console) SetQuiet(q bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quiet = q
+}
+
+// Quiet 报告是否处于安静模式
+func (c *Console) Quiet() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.quiet
+}
 
 // SetPrompt 设置命令提示符
 func (c *Console) SetPrompt(p string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.plain != nil {
+		if p != c.defaultPrompt {
+			_, _ = io.WriteString(c.plain.out, p+"\n")
+		}
+		return
+	}
 	c.rl.SetPrompt(p)
 	c.rl.Refresh()
 }
@@ -71,16 +128,40 @@ func (c *Console) ResetPrompt() { c.SetPrompt(c.defaultPrompt) }
 func (c *Console) Println(msg string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.plain != nil {
+		_, _ = io.WriteString(c.plain.out, msg+"\n")
+		return
+	}
 	_, _ = c.rl.Stdout().Write([]byte("\r" + msg + "\n"))
 	c.rl.Refresh()
 }
 
-// Logln 打印带时间戳的日志消息
-func (c *Console) Logln(msg string) { c.Println(C(ts(), CDim) + " " + msg) }
+// Infoln 打印提示性信息，安静模式下不输出
+func (c *Console) Infoln(msg string) {
+	if c.Quiet() {
+		return
+	}
+	c.Println(msg)
+}
+
+// Errorln 打印错误信息到标准错误，安静模式下也会输出
+func (c *Console) Errorln(msg string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.plain != nil {
+		_, _ = io.WriteString(c.plain.errOut, msg+"\n")
+		return
+	}
+	_, _ = c.rl.Stderr().Write([]byte("\r" + msg + "\n"))
+	c.rl.Refresh()
+}
+
+// Logln 打印带时间戳的日志消息，安静模式下不输出
+func (c *Console) Logln(msg string) { c.Infoln(C(ts(), CDim) + " " + msg) }
 
-// Logf 打印格式化的带时间戳的日志消息
+// Logf 打印格式化的带时间戳的日志消息，安静模式下不输出
 func (c *Console) Logf(format string, a ...any) {
-	c.Println(C(ts(), CDim) + " " + fmt.Sprintf(format, a...))
+	c.Infoln(C(ts(), CDim) + " " + fmt.Sprintf(format, a...))
 }
 
 // PromptQuestion 设置一个问题提示符
@@ -94,24 +175,84 @@ func (c *Console) PromptQuestionAndRestore(q string) func() {
 
 // Readline 读取一行用户输入
 func (c *Console) Readline() (string, error) {
+	if c.plain != nil {
+		return c.plain.readline()
+	}
 	return c.rl.Readline()
 }
 
 // Refresh 刷新提示符显示
 func (c *Console) Refresh() {
+	if c.plain != nil {
+		return
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.rl.Refresh()
 }
 
+// plainIO 是非交互控制台的输入输出。输入由后台协程逐行读取并经 lines 交付，
+// 这样 Close 可以让阻塞中的 Readline 立即返回，而不必等待标准输入上的下一行。
+type plainIO struct {
+	out, errOut io.Writer
+	lines       chan string
+	readErr     error // 输入结束的原因，在关闭 lines 之前写入
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newPlainIO(in io.Reader, out, errOut io.Writer) *plainIO {
+	p := &plainIO{out: out, errOut: errOut, lines: make(chan string), closed: make(chan struct{})}
+	go func() {
+		sc := bufio.NewScanner(in)
+		sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for sc.Scan() {
+			select {
+			case p.lines <- sc.Text():
+			case <-p.closed:
+				return
+			}
+		}
+		p.readErr = sc.Err()
+		close(p.lines)
+	}()
+	return p
+}
+
+// readline 返回下一行输入 (不含换行符)；输入结束或控制台关闭后返回 io.EOF
+func (p *plainIO) readline() (string, error) {
+	select {
+	case line, ok := <-p.lines:
+		if !ok {
+			if p.readErr != nil {
+				return "", p.readErr
+			}
+			return "", io.EOF
+		}
+		return line, nil
+	case <-p.closed:
+		return "", io.EOF
+	}
+}
+
+func (p *plainIO) close() { p.closeOnce.Do(func() { close(p.closed) }) }
+
 // ts 返回当前时间的格式化字符串
 func ts() string { return time.Now().Format("2006-01-02 15:04:05") }
 
-// PrintPeerVerifyCard 打印对等节点验证信息卡片，包含其ID和短认证字符串(SAS)
+// PrintPeerVerifyCard 打印对等节点验证信息卡片，包含其ID和短认证字符串(SAS)。
+// sas 为空时不显示本端的 SAS (-strict-sas 下用户须键入对端屏幕上的 SAS)。
 func PrintPeerVerifyCard(c *Console, remote peer.ID, sas string) {
 	c.Println(C("┌─ Peer Verification ───────────────────────────────────────┐", CBold))
 	c.Println("  ID  : " + C(remote.String(), CCyan))
-	c.Println("  SAS : " + C(sas, CYel+CBold))
+	if sas == "" {
+		c.Println("  SAS : " + C("(hidden, read it from the peer's screen)", CDim))
+	} else {
+		c.Println("  SAS : " + C(sas, CYel+CBold))
+		if digits := crypto.SASDigits(sas); digits != "" {
+			c.Println("  No. : " + digits)
+		}
+	}
 	c.Println(C("└───────────────────────────────────────────────────────────┘", CBold))
 }
 
@@ -123,14 +264,20 @@ func PrintConnCard(c *Console, pi p2p.PathInfo, local, remote ma.Multiaddr, verb
 	} else {
 		pathLine = fmt.Sprintf("DIRECT (%s)", pi.Transport)
 	}
-	c.Println(C("┌─ Connection Summary ──────────────────────────────┐", CBold))
-	c.Println("  path   : " + C(pathLine, CCyan))
-	c.Println("  local  : " + local.String())
-	c.Println("  remote : " + remote.String())
+	c.Infoln(C("┌─ Connection Summary ──────────────────────────────┐", CBold))
+	c.Infoln("  path   : " + C(pathLine, CCyan))
+	sec := pi.Security
+	if pi.SecureOK { // 已通过 p2p.CheckSecurity 的检查
+		sec += C(" (checked)", CDim)
+	}
+	c.Infoln("  crypto : " + sec)
+	c.Infoln("  muxer  : " + pi.Muxer)
+	c.Infoln("  local  : " + local.String())
+	c.Infoln("  remote : " + remote.String())
 	if pi.Kind == "RELAY" && verbose {
-		c.Println("  via    : " + pi.RelayVia)
+		c.Infoln("  via    : " + pi.RelayVia)
 	}
-	c.Println(C("└───────────────────────────────────────────────────┘", CBold))
+	c.Infoln(C("└───────────────────────────────────────────────────┘", CBold))
 }
 
 // AskYesNo 向用户提问并等待 y/N 回答，有超时
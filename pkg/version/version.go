@@ -0,0 +1,60 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/Metaphorme/wormhole/pkg/models"
+)
+
+// Version 是构建版本，可以在编译时通过 ldflags 注入：
+//
+//	go build -ldflags "-X github.com/Metaphorme/wormhole/pkg/version.Version=v1.2.3" ./cmd/wormhole
+//
+// 未注入时从模块构建信息中推断
+var Version = ""
+
+// BuildVersion 返回当前二进制的版本号
+// 优先使用 ldflags 注入的值，其次是模块版本，最后回退到 "devel"（附带 VCS 修订号，如果有）
+func BuildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if v := bi.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	rev, dirty := "", false
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if rev == "" {
+		return "devel"
+	}
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	if dirty {
+		rev += "-dirty"
+	}
+	return "devel+" + rev
+}
+
+// Lines 返回用于展示的版本信息：构建版本、Go 版本以及支持的协议
+func Lines() []string {
+	return []string{
+		fmt.Sprintf("wormhole %s", BuildVersion()),
+		fmt.Sprintf("go       %s (%s/%s)", runtime.Version(), runtime.GOOS, runtime.GOARCH),
+		fmt.Sprintf("chat     %s", models.ProtoChat),
+		fmt.Sprintf("xfer     %s (wire v%d)", models.ProtoXfer, models.XferWireVersion),
+	}
+}